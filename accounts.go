@@ -29,6 +29,7 @@ type account struct {
 	searchWords     string
 	orderNo         int
 	isExtraordinary bool
+	currency        string // 外貨建ての場合の通貨コード。円の場合は空文字
 	parent          struct {
 		id   int
 		name string
@@ -55,6 +56,10 @@ func runListAccounts(db *sql.DB) error {
 		return err
 	}
 
+	if isRecordOutput() {
+		return printRecords(accounts2records(accounts))
+	}
+
 	src := getAccountsReader(accounts)
 
 	print(src)
@@ -62,6 +67,18 @@ func runListAccounts(db *sql.DB) error {
 	return nil
 }
 
+func accounts2records(accounts []account) *recordTable {
+	t := newRecordTable("account_id", "account_type", "name", "search_words", "parent_id", "parent",
+		"order_no", "is_extraordinary", "currency")
+
+	for _, ac := range accounts {
+		t.add(ac.id, ac.accountType, ac.name, ac.searchWords, ac.parent.id, ac.parent.name,
+			ac.orderNo, ac.isExtraordinary, ac.currency)
+	}
+
+	return t
+}
+
 func cmdAddAccount(context *cli.Context) error {
 	db, err := connectDB()
 	if err != nil {
@@ -95,7 +112,7 @@ func runAddAccount(db *sql.DB, args []string) error {
 		if ok == false {
 			return nil
 		}
-	case 2, 3, 4:
+	case 2, 3, 4, 5:
 		name2id := make(map[string]int)
 
 		for _, d := range accounts {
@@ -107,7 +124,7 @@ func runAddAccount(db *sql.DB, args []string) error {
 			return err
 		}
 	default:
-		return errors.New("Usage: mita account add accountType name [searchWords] [parent]")
+		return errors.New("Usage: mita account add accountType name [searchWords] [parent] [currency]")
 	}
 
 	if _, err = dbAddAccount(db, d); err != nil {
@@ -189,12 +206,14 @@ func cmdReorderAccount(context *cli.Context) error {
 	}
 	defer db.Close()
 
-	parents, err := dbGetAccountsThatHasChildren(db)
+	all, err := dbGetAccounts(db)
 	if err != nil {
 		return err
 	}
 
-	i, err := selectOrderTarget(parents)
+	parents := accountsThatHaveChildren(all)
+
+	i, err := selectOrderTarget(all, parents)
 	if err != nil {
 		return err
 	}
@@ -204,7 +223,6 @@ func cmdReorderAccount(context *cli.Context) error {
 	}
 
 	var accounts []account
-	var startNo int
 
 	switch i {
 	case 1: // 資産
@@ -216,9 +234,7 @@ func cmdReorderAccount(context *cli.Context) error {
 	case 4: // 費用
 		accounts, err = dbGetAccountsByType(db, acTypeExpense)
 	default:
-		d := parents[i-5]
-		accounts, err = dbGetAccountChildren(db, d.id)
-		startNo = d.orderNo + 1
+		accounts, err = dbGetAccountChildren(db, parents[i-5].id)
 	}
 
 	if err != nil {
@@ -249,14 +265,20 @@ func cmdReorderAccount(context *cli.Context) error {
 		return err
 	}
 
+	return dbReorderAccounts(db, accounts, nwo)
+}
+
+/*
+兄弟の勘定科目の順番を nwo にする
+子孫は表示するときに親の後に並べるので、どの階層も兄弟の中での順番だけを 0 から振る
+*/
+func dbReorderAccounts(db *sql.DB, accounts []account, nwo []int) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
 
 	for i := 0; i < len(accounts); i++ {
-		nwo[i] += startNo
-
 		if accounts[i].orderNo != nwo[i] {
 			accounts[i].orderNo = nwo[i]
 
@@ -332,8 +354,8 @@ func readAccounts(db *sql.DB, f io.Reader) error {
 
 func arr2account(name2id map[string]int, arr []string) (*account, error) {
 	arrLen := len(arr)
-	if arrLen < 2 || arrLen > 4 {
-		return nil, fmt.Errorf("項目数が2から4でない")
+	if arrLen < 2 || arrLen > 5 {
+		return nil, fmt.Errorf("項目数が2から5でない")
 	}
 
 	var d account
@@ -360,6 +382,11 @@ func arr2account(name2id map[string]int, arr []string) (*account, error) {
 	}
 
 	if len(arr) >= 4 && arr[3] != "" {
+		// 追加する勘定科目は子を持たないので、循環するのは自分自身を親にした場合だけ
+		if arr[3] == d.name {
+			return nil, fmt.Errorf("自分自身を親にできない'%s'", arr[3])
+		}
+
 		parentID := name2id[arr[3]]
 		if parentID == 0 {
 			return nil, fmt.Errorf("存在しない親'%s'", arr[3])
@@ -368,6 +395,19 @@ func arr2account(name2id map[string]int, arr []string) (*account, error) {
 		d.parent.id = parentID
 	}
 
+	if len(arr) >= 5 && arr[4] != "" {
+		currency, err := str2currencyCode(arr[4])
+		if err != nil {
+			return nil, err
+		}
+
+		if d.accountType != acTypeAsset && d.accountType != acTypeLiability {
+			return nil, errors.New("外貨建てにできるのは資産と負債だけ")
+		}
+
+		d.currency = currency
+	}
+
 	return &d, nil
 }
 
@@ -389,8 +429,13 @@ func writeAccounts(db *sql.DB, f io.Writer) error {
 			parent = ""
 		}
 
-		_, err := b.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\n",
-			acType2str(d.accountType), d.name, d.searchWords, parent))
+		currency := ""
+		if d.currency != "" {
+			currency = "\t" + d.currency
+		}
+
+		_, err := b.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s%s\n",
+			acType2str(d.accountType), d.name, d.searchWords, parent, currency))
 		if err != nil {
 			return err
 		}
@@ -401,7 +446,7 @@ func writeAccounts(db *sql.DB, f io.Writer) error {
 	return nil
 }
 
-func selectOrderTarget(parents []account) (int, error) {
+func selectOrderTarget(accounts []account, parents []account) (int, error) {
 	src := new(bytes.Buffer)
 
 	src.WriteString("1 資産 sisan\n")
@@ -410,7 +455,7 @@ func selectOrderTarget(parents []account) (int, error) {
 	src.WriteString("4 費用 hiyou\n")
 
 	for i, d := range parents {
-		src.WriteString(fmt.Sprintf("%d %s %s\n", 5+i, d.name, d.searchWords))
+		src.WriteString(fmt.Sprintf("%d %s > %s %s\n", 5+i, acType2str(d.accountType), accountPath(accounts, d.id), d.searchWords))
 	}
 
 	dst := new(bytes.Buffer)
@@ -448,7 +493,7 @@ func selectOrderTarget(parents []account) (int, error) {
 	default:
 		idx := i - 5
 		if idx >= 0 && idx < len(parents) {
-			name = parents[idx].name
+			name = acType2str(parents[idx].accountType) + " > " + accountPath(accounts, parents[idx].id)
 		} else {
 			return 0, errors.New("out of index")
 		}
@@ -462,10 +507,14 @@ func selectOrderTarget(parents []account) (int, error) {
 
 func confirmAccount(accounts []account, d *account, enableType bool) (bool, error) {
 	for {
-		printf("\n%s %s %s (%s) 特別損益: %t\n", acType2str(d.accountType), d.name, d.searchWords, d.parent.name, d.isExtraordinary)
+		printf("\n%s %s %s (%s) 特別損益: %t", acType2str(d.accountType), d.name, d.searchWords, d.parent.name, d.isExtraordinary)
+		if d.currency != "" {
+			printf(" 通貨: %s", d.currency)
+		}
+		println()
 
 		if enableType {
-			print("y(es), t(ype), n(ame), s(earch words), p(arent), e(xtraordinary), q(uit): ")
+			print("y(es), t(ype), n(ame), s(earch words), p(arent), e(xtraordinary), c(urrency), q(uit): ")
 		} else {
 			print("y(es), n(ame), s(earch words), p(arent), e(xtraordinary), q(uit): ")
 		}
@@ -493,6 +542,11 @@ func confirmAccount(accounts []account, d *account, enableType bool) (bool, erro
 					return false, err
 				}
 				if parent != nil {
+					if isAccountCycle(accounts, d.id, parent.id) {
+						eprintln("子孫の勘定科目は親にできない")
+						break
+					}
+
 					d.parent.id = parent.id
 					d.parent.name = parent.name
 				} else {
@@ -504,15 +558,149 @@ func confirmAccount(accounts []account, d *account, enableType bool) (bool, erro
 			d.searchWords = scanSearchWords()
 		case "e", "extraordinary":
 			d.isExtraordinary = confirmYesNo("特別損益？")
+		case "c", "currency":
+			// 取引の外貨金額と整合しなくなるので、通貨は追加時のみ設定できる
+			if enableType {
+				if d.accountType != acTypeAsset && d.accountType != acTypeLiability {
+					eprintln("外貨建てにできるのは資産と負債だけ")
+					break
+				}
+
+				d.currency = scanCurrencyCode()
+			}
 		}
 	}
 }
 
+// 勘定科目IDごとの親のID。親がない勘定科目は含まない
+func accountParents(accounts []account) map[int]int {
+	id2parent := make(map[int]int)
+
+	for _, d := range accounts {
+		if d.parent.id != 0 && d.parent.id != d.id {
+			id2parent[d.id] = d.parent.id
+		}
+	}
+
+	return id2parent
+}
+
+// 勘定科目の祖先のIDを親から順に返す。自分自身は含まない
+func accountAncestors(id2parent map[int]int, id int) []int {
+	var ids []int
+
+	for p, ok := id2parent[id]; ok; p, ok = id2parent[p] {
+		// 循環してる場合
+		if p == id || len(ids) > len(id2parent) {
+			break
+		}
+
+		ids = append(ids, p)
+	}
+
+	return ids
+}
+
+// 勘定科目 id の親を parentID にすると循環するか
+func isAccountCycle(accounts []account, id int, parentID int) bool {
+	if id == 0 || parentID == id {
+		return false
+	}
+
+	for _, p := range append([]int{parentID}, accountAncestors(accountParents(accounts), parentID)...) {
+		if p == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 最上位の祖先から勘定科目までの名前を " > " でつないだもの。例: 費用 > 住居 > 光熱費
+func accountPath(accounts []account, id int) string {
+	id2name := make(map[int]string)
+	for _, d := range accounts {
+		id2name[d.id] = d.name
+	}
+
+	ancestors := accountAncestors(accountParents(accounts), id)
+
+	names := make([]string, 0, len(ancestors)+1)
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		names = append(names, id2name[ancestors[i]])
+	}
+
+	return strings.Join(append(names, id2name[id]), " > ")
+}
+
+// 子を持つ勘定科目。accounts の順番のまま返すので、dbGetAccounts の結果なら階層順になる
+func accountsThatHaveChildren(accounts []account) []account {
+	id2parent := accountParents(accounts)
+
+	hasChildren := make(map[int]bool)
+	for _, p := range id2parent {
+		hasChildren[p] = true
+	}
+
+	var parents []account
+
+	for _, d := range accounts {
+		if hasChildren[d.id] {
+			parents = append(parents, d)
+		}
+	}
+
+	return parents
+}
+
+// 親の後に子孫が並ぶように並べ替える。兄弟の順番は accounts の順番のまま
+func sortAccountTree(accounts []account) []account {
+	id2parent := accountParents(accounts)
+
+	exists := make(map[int]bool)
+	for _, d := range accounts {
+		exists[d.id] = true
+	}
+
+	var roots []account
+	children := make(map[int][]account)
+
+	for _, d := range accounts {
+		if p, ok := id2parent[d.id]; ok && exists[p] {
+			children[p] = append(children[p], d)
+		} else {
+			roots = append(roots, d)
+		}
+	}
+
+	sorted := make([]account, 0, len(accounts))
+
+	var add func(d account)
+	add = func(d account) {
+		sorted = append(sorted, d)
+
+		for _, c := range children[d.id] {
+			add(c)
+		}
+	}
+
+	for _, d := range roots {
+		add(d)
+	}
+
+	// 循環してる勘定科目があれば並べ替えない
+	if len(sorted) != len(accounts) {
+		return accounts
+	}
+
+	return sorted
+}
+
 const sqlGetAccounts = `
-SELECT ac.account_id, ac.account_type, ac.name, ac.search_words, p.account_id, p.name, ac.is_extraordinary
+SELECT ac.account_id, ac.account_type, ac.name, ac.search_words, p.account_id, p.name, ac.is_extraordinary, ac.currency
 FROM accounts ac
 LEFT JOIN accounts AS p ON ac.parent = p.account_id
-ORDER BY ac.account_type, p.order_no, ac.order_no, ac.account_id
+ORDER BY ac.account_type, ac.order_no, ac.account_id
 `
 
 func dbGetAccounts(db *sql.DB) ([]account, error) {
@@ -526,7 +714,7 @@ func dbGetAccounts(db *sql.DB) ([]account, error) {
 	for rows.Next() {
 		var ac account
 
-		if err := rows.Scan(&ac.id, &ac.accountType, &ac.name, &ac.searchWords, &ac.parent.id, &ac.parent.name, &ac.isExtraordinary); err != nil {
+		if err := rows.Scan(&ac.id, &ac.accountType, &ac.name, &ac.searchWords, &ac.parent.id, &ac.parent.name, &ac.isExtraordinary, &ac.currency); err != nil {
 			return nil, err
 		}
 
@@ -534,7 +722,7 @@ func dbGetAccounts(db *sql.DB) ([]account, error) {
 	}
 	rows.Close()
 
-	return accounts, nil
+	return sortAccountTree(accounts), nil
 }
 
 const sqlGetAccountsByType = `
@@ -567,38 +755,6 @@ func dbGetAccountsByType(db *sql.DB, t int) ([]account, error) {
 	return accounts, nil
 }
 
-const sqlGetAccountsThatHasChildren = `
-SELECT p.account_id, p.account_type, p.name, p.search_words, p.order_no
-FROM accounts ac
-LEFT JOIN accounts AS p ON ac.parent = p.account_id
-GROUP BY p.account_id, p.account_type, p.name, p.search_words, p.order_no
-HAVING COUNT(*) >= 2
-ORDER BY p.account_type, p.order_no, p.account_id
-`
-
-// 2人以上の子を持つ勘定科目を取得
-func dbGetAccountsThatHasChildren(db *sql.DB) ([]account, error) {
-	rows, err := db.Query(sqlGetAccountsThatHasChildren)
-	if err != nil {
-		return nil, err
-	}
-
-	var accounts []account
-
-	for rows.Next() {
-		var ac account
-
-		if err := rows.Scan(&ac.id, &ac.accountType, &ac.name, &ac.searchWords, &ac.orderNo); err != nil {
-			return nil, err
-		}
-
-		accounts = append(accounts, ac)
-	}
-	rows.Close()
-
-	return accounts, nil
-}
-
 const sqlGetAccountChildren = `
 SELECT account_id, account_type, name, order_no
 FROM accounts ac
@@ -629,14 +785,14 @@ func dbGetAccountChildren(db *sql.DB, parentID int) ([]account, error) {
 }
 
 const sqlAddAccount = `
-INSERT INTO accounts(account_type, name, search_words, parent, is_extraordinary)
-VALUES($1, $2, $3, $4, $5)
+INSERT INTO accounts(account_type, name, search_words, parent, is_extraordinary, currency)
+VALUES($1, $2, $3, $4, $5, $6)
 RETURNING account_id
 `
 
 func dbAddAccount(db dbtx, d *account) (int, error) {
 	var idStr string
-	err := db.QueryRow(sqlAddAccount, d.accountType, d.name, d.searchWords, d.parent.id, d.isExtraordinary).Scan(&idStr)
+	err := db.QueryRow(sqlAddAccount, d.accountType, d.name, d.searchWords, d.parent.id, d.isExtraordinary, d.currency).Scan(&idStr)
 	if err != nil {
 		return 0, err
 	}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -227,3 +228,137 @@ func TestWriteAccounts(t *testing.T) {
 		t.Fatal("wf.String() != string(bytes)")
 	}
 }
+
+func TestAccountTree(t *testing.T) {
+	newAccount := func(id int, name string, parentID int) account {
+		var d account
+		d.id = id
+		d.name = name
+		d.parent.id = parentID
+		return d
+	}
+
+	// 1 > 3 > 4, 2 > 5
+	accounts := []account{
+		newAccount(4, "孫", 3),
+		newAccount(1, "親1", 1),
+		newAccount(5, "子2", 2),
+		newAccount(2, "親2", 0),
+		newAccount(3, "子1", 1),
+	}
+
+	var names []string
+	for _, d := range sortAccountTree(accounts) {
+		names = append(names, d.name)
+	}
+
+	if strings.Join(names, ",") != "親1,子1,孫,親2,子2" {
+		t.Error("sortAccountTree, got =", names)
+	}
+
+	ancestors := accountAncestors(accountParents(accounts), 4)
+	if len(ancestors) != 2 || ancestors[0] != 3 || ancestors[1] != 1 {
+		t.Error("accountAncestors, got =", ancestors)
+	}
+
+	tests := []struct {
+		id       int
+		parentID int
+		res      bool
+	}{
+		{1, 4, true},
+		{1, 3, true},
+		{3, 4, true},
+		{1, 1, false},
+		{4, 2, false},
+		{0, 1, false},
+	}
+
+	for _, tt := range tests {
+		if res := isAccountCycle(accounts, tt.id, tt.parentID); res != tt.res {
+			t.Errorf("isAccountCycle(%d, %d), got = %v", tt.id, tt.parentID, res)
+		}
+	}
+
+	// 循環してたら並べ替えない
+	cycle := []account{newAccount(1, "A", 2), newAccount(2, "B", 1), newAccount(3, "C", 0)}
+	if sorted := sortAccountTree(cycle); sorted[0].name != "A" || len(sorted) != 3 {
+		t.Error("循環, got =", sorted)
+	}
+
+	if _, err := arr2account(map[string]int{"食費": 1}, []string{"費用", "食費", "", "食費"}); err == nil {
+		t.Error("自分自身を親にできないはず")
+	}
+}
+
+func TestReorderNestedAccounts(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	db, err := setup()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"費用", "食費", "syokuhi"},
+		{"費用", "住居", "jyuukyo"},
+		{"費用", "光熱費", "kounetuhi", "住居"},
+		{"費用", "電気代", "denkidai", "光熱費"},
+		{"費用", "ガス代", "gasudai", "光熱費"},
+		{"費用", "水道代", "suidoudai", "光熱費"},
+	} {
+		if err := runAddAccount(db, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 子が1つでも、孫がいる階層を並べ替えられるように並べ替え対象にする
+	parents := accountsThatHaveChildren(accounts)
+
+	var paths []string
+	for _, d := range parents {
+		paths = append(paths, accountPath(accounts, d.id))
+	}
+
+	if strings.Join(paths, ",") != "住居,住居 > 光熱費" {
+		t.Fatal("並べ替え対象が違う:", paths)
+	}
+
+	// 孫の階層を並べ替える
+	children, err := dbGetAccountChildren(db, parents[1].id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nwo, err := readOrder("2 水道代\n0 電気代\n1 ガス代\n", len(children))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dbReorderAccounts(db, children, nwo); err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err = dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, d := range accounts {
+		names = append(names, d.name)
+	}
+
+	if strings.Join(names, ",") != "食費,住居,光熱費,水道代,電気代,ガス代" {
+		t.Error("got =", names)
+	}
+}
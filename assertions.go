@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/urfave/cli/v2"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+残高の確認
+
+ある日の勘定科目の実際の残高(通帳や明細の残高)を記録しておき、
+帳簿上の残高と一致するかを mita check で確認する。
+外貨建ての勘定科目は外貨の金額で確認する。
+*/
+type assertion struct {
+	account account
+	date    time.Time
+	amount  int
+}
+
+func (d *assertion) String() string {
+	return fmt.Sprintf("%s %s %s", d.date.Format("2006-01-02"), d.account.name,
+		balance2str(d.amount, d.account.currency))
+}
+
+func balance2str(n int, currency string) string {
+	if currency == "" {
+		return int2str(n)
+	}
+
+	return currency2str(n, currency) + " " + currency
+}
+
+// 残高の確認の結果
+type assertionResult struct {
+	assertion
+	balance int // 帳簿上の残高
+}
+
+// 実際の残高 - 帳簿上の残高
+func (d *assertionResult) diff() int {
+	return d.amount - d.balance
+}
+
+func (d *assertionResult) String() string {
+	status := "OK"
+	if d.diff() != 0 {
+		status = "差異 " + balance2str(d.diff(), d.account.currency)
+	}
+
+	nw := 16 - getTextWidth(d.account.name)
+	if nw < 0 {
+		nw = 0
+	}
+
+	return fmt.Sprintf("%s %s%*s %15s %15s %s", d.date.Format("2006-01-02"), d.account.name, nw, "",
+		balance2str(d.amount, d.account.currency), balance2str(d.balance, d.account.currency), status)
+}
+
+func cmdListAssertions(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runListAssertions(db)
+}
+
+func runListAssertions(db *sql.DB) error {
+	assertions, err := dbGetAssertions(db)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range assertions {
+		println(&d)
+	}
+
+	return nil
+}
+
+func cmdAddAssertion(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runAddAssertion(db, context.Args().Slice())
+}
+
+func runAddAssertion(db *sql.DB, args []string) error {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	var d *assertion
+
+	switch len(args) {
+	case 0:
+		d = &assertion{}
+		d.date = scanDate()
+
+		ac, err := selectAccount(filterBalanceAccounts(accounts), "勘定科目")
+		if ac == nil || err != nil {
+			return err
+		}
+		d.account = *ac
+
+		if d.account.currency == "" {
+			d.amount = scanAmount()
+		} else {
+			d.amount = scanBalanceCurrency(d.account.currency)
+		}
+	case 3:
+		d, err = arr2assertion(accounts, args)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("Usage: mita assert add date account amount")
+	}
+
+	return dbSetAssertion(db, d)
+}
+
+// 残高を確認できる資産と負債の勘定科目
+func filterBalanceAccounts(accounts []account) []account {
+	var res []account
+
+	for _, ac := range accounts {
+		if ac.accountType == acTypeAsset || ac.accountType == acTypeLiability {
+			res = append(res, ac)
+		}
+	}
+
+	return res
+}
+
+func arr2assertion(accounts []account, arr []string) (*assertion, error) {
+	if len(arr) != 3 {
+		return nil, errors.New("項目数が3でない")
+	}
+
+	var d assertion
+
+	date, err := str2date(arr[0])
+	if err != nil {
+		return nil, fmt.Errorf("日付:%s", err)
+	}
+	d.date = date
+
+	for _, ac := range accounts {
+		if ac.name == arr[1] {
+			d.account = ac
+		}
+	}
+
+	if d.account.id == 0 {
+		return nil, fmt.Errorf("存在しない勘定科目'%s'", arr[1])
+	}
+
+	if d.account.accountType != acTypeAsset && d.account.accountType != acTypeLiability {
+		return nil, fmt.Errorf("残高を確認できるのは資産と負債だけ'%s'", arr[1])
+	}
+
+	if d.account.currency == "" {
+		d.amount, err = strconv.Atoi(strings.ReplaceAll(arr[2], ",", ""))
+	} else {
+		d.amount, err = str2currency(arr[2], d.account.currency)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("金額:%s", err)
+	}
+
+	return &d, nil
+}
+
+func cmdRemoveAssertion(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runRemoveAssertion(db)
+}
+
+func runRemoveAssertion(db *sql.DB) error {
+	d, err := selectAssertion(db)
+	if d == nil || err != nil {
+		return err
+	}
+
+	if confirmYesNo("本当に削除する?") {
+		return dbRemoveAssertion(db, d)
+	}
+
+	return nil
+}
+
+func cmdImportAssertions(context *cli.Context) error {
+	return importItems(context.Args().First(), readAssertions)
+}
+
+func readAssertions(db *sql.DB, f io.Reader) error {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(f)
+
+	lineNo := 0
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for scanner.Scan() {
+		lineNo++
+
+		line := skipSpace(scanner.Text())
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		d, err := arr2assertion(accounts, strings.Split(line, "\t"))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%d:%s", lineNo, err)
+		}
+
+		if err := dbSetAssertion(tx, d); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func cmdExportAssertions(context *cli.Context) error {
+	return exportItems(context.Args().First(), writeAssertions)
+}
+
+func writeAssertions(db *sql.DB, f io.Writer) error {
+	b := bufio.NewWriter(f)
+
+	assertions, err := dbGetAssertions(db)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range assertions {
+		amount := strconv.Itoa(d.amount)
+		if d.account.currency != "" {
+			amount = strings.ReplaceAll(currency2str(d.amount, d.account.currency), ",", "")
+		}
+
+		_, err := b.WriteString(fmt.Sprintf("%s\t%s\t%s\n", d.date.Format("2006-01-02"), d.account.name, amount))
+		if err != nil {
+			return err
+		}
+	}
+
+	b.Flush()
+
+	return nil
+}
+
+func cmdCheck(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runCheck(db, !context.Bool("no-fix"))
+}
+
+/*
+すべての残高の確認を帳簿と比較して表示する
+isFix なら差異があるたびに、調整の取引を追加するか確認する
+*/
+func runCheck(db *sql.DB, isFix bool) error {
+	assertions, err := dbGetAssertions(db)
+	if err != nil {
+		return err
+	}
+
+	var accounts []account
+
+	numDiffs := 0
+
+	for _, d := range assertions {
+		// 調整の取引を追加すると後の確認の結果も変わるので、1件ずつ残高を求める
+		res, err := checkAssertion(db, &d)
+		if err != nil {
+			return err
+		}
+
+		println(res)
+
+		if res.diff() == 0 {
+			continue
+		}
+
+		numDiffs++
+
+		if !isFix || !confirmYesNo("調整の取引を追加する?") {
+			continue
+		}
+
+		if accounts == nil {
+			accounts, err = dbGetAccounts(db)
+			if err != nil {
+				return err
+			}
+		}
+
+		other, err := selectAccount(accounts, "調整の相手勘定科目")
+		if err != nil {
+			return err
+		}
+
+		if other == nil {
+			continue
+		}
+
+		tr, err := makeAdjustment(db, res, other)
+		if err != nil {
+			return err
+		}
+
+		if err := addAdjustment(db, accounts, tr); err != nil {
+			return err
+		}
+
+		println(tr)
+		numDiffs--
+	}
+
+	if numDiffs != 0 {
+		return fmt.Errorf("残高が一致しない: %d件", numDiffs)
+	}
+
+	return nil
+}
+
+func checkAssertion(db *sql.DB, d *assertion) (*assertionResult, error) {
+	balance, err := dbGetBalance(db, &d.account, d.date)
+	if err != nil {
+		return nil, err
+	}
+
+	return &assertionResult{*d, balance}, nil
+}
+
+// 差異をなくすための、確認した日付の取引をつくる
+func makeAdjustment(db *sql.DB, res *assertionResult, other *account) (*transaction, error) {
+	var tr transaction
+	tr.date = res.date
+	tr.note = "残高調整"
+
+	diff := res.diff()
+	yen := diff
+
+	if res.account.currency != "" {
+		rate, err := dbGetRate(db, res.account.currency, res.date)
+		if err != nil {
+			return nil, err
+		}
+
+		if rate == 0 {
+			return nil, fmt.Errorf("%sの%s以前の為替レートが見つからない", res.account.currency,
+				res.date.Format("2006-01-02"))
+		}
+
+		yen = currency2yen(diff, res.account.currency, rate)
+	}
+
+	// 負債は貸方で増える
+	isDebit := diff > 0
+	if res.account.accountType == acTypeLiability {
+		isDebit = !isDebit
+	}
+
+	if yen < 0 {
+		yen = -yen
+	}
+
+	if yen == 0 {
+		return nil, errors.New("調整する金額が0円になる")
+	}
+
+	if isDebit {
+		tr.setSimple(res.account, *other, yen)
+		tr.items[0].currencyAmount = abs(diff)
+	} else {
+		tr.setSimple(*other, res.account, yen)
+		tr.items[1].currencyAmount = abs(diff)
+	}
+
+	return &tr, nil
+}
+
+func addAdjustment(db *sql.DB, accounts []account, tr *transaction) error {
+	if err := fillCurrencyAmounts(db, accounts, tr); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := dbAddTransaction(tx, tr); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
+
+func selectAssertion(db *sql.DB) (*assertion, error) {
+	assertions, err := dbGetAssertions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(assertions) == 0 {
+		return nil, nil
+	}
+
+	src := new(bytes.Buffer)
+
+	for i, d := range assertions {
+		src.Write([]byte(fmt.Sprintf("%d %v\n", i, &d)))
+	}
+
+	dst := new(bytes.Buffer)
+	args := []string{}
+
+	cancel, err := fzf(src, dst, os.Stderr, args)
+	if cancel {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	arr := strings.Split(dst.String(), " ")
+
+	i, err := strconv.Atoi(arr[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &assertions[i], nil
+}
+
+func scanBalanceCurrency(currency string) int {
+	for {
+		printf("残高(%s): ", currency)
+		s, _ := input()
+
+		v, err := str2currency(s, currency)
+		if err == nil {
+			return v
+		}
+
+		eprintln(err)
+	}
+}
+
+const sqlGetAssertions = `
+SELECT a.account_id, ac.account_type, ac.name, ac.currency, a.date, a.amount
+FROM assertions AS a
+JOIN accounts AS ac ON a.account_id = ac.account_id
+ORDER BY ac.account_type, ac.order_no, a.account_id, a.date
+`
+
+func dbGetAssertions(db *sql.DB) ([]assertion, error) {
+	rows, err := db.Query(sqlGetAssertions)
+	if err != nil {
+		return nil, err
+	}
+
+	var assertions []assertion
+
+	for rows.Next() {
+		var d assertion
+
+		if err := rows.Scan(&d.account.id, &d.account.accountType, &d.account.name, &d.account.currency,
+			&d.date, &d.amount); err != nil {
+			return nil, err
+		}
+
+		assertions = append(assertions, d)
+	}
+	rows.Close()
+
+	return assertions, nil
+}
+
+const sqlSetAssertion = `
+INSERT INTO assertions(account_id, date, amount)
+VALUES($1, $2, $3)
+ON CONFLICT (account_id, date) DO UPDATE SET amount = EXCLUDED.amount
+`
+
+func dbSetAssertion(db dbtx, d *assertion) error {
+	_, err := db.Exec(sqlSetAssertion, d.account.id, d.date, d.amount)
+
+	return err
+}
+
+const sqlRemoveAssertion = `
+DELETE FROM assertions
+WHERE account_id = $1 AND date = $2
+`
+
+func dbRemoveAssertion(db dbtx, d *assertion) error {
+	_, err := db.Exec(sqlRemoveAssertion, d.account.id, d.date)
+
+	return err
+}
+
+const sqlGetBalance = `
+SELECT COALESCE(SUM(CASE WHEN $3 THEN
+                             CASE WHEN debit_amount <> 0 THEN currency_amount ELSE -currency_amount END
+                         ELSE debit_amount - credit_amount END), 0)
+FROM transactions_view
+WHERE account_id = $1 AND date <= $2
+`
+
+/*
+date の終わりの帳簿上の残高
+資産は借方 - 貸方、負債は貸方 - 借方。外貨建てなら外貨の金額
+*/
+func dbGetBalance(db *sql.DB, ac *account, date time.Time) (int, error) {
+	var balance int
+
+	err := db.QueryRow(sqlGetBalance, ac.id, date.Format("2006-01-02"), ac.currency != "").Scan(&balance)
+	if err != nil {
+		return 0, err
+	}
+
+	if ac.accountType == acTypeLiability {
+		balance = -balance
+	}
+
+	return balance, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	_ "github.com/lib/pq"
+	"testing"
+)
+
+func TestMakeAdjustment(t *testing.T) {
+	cash := account{id: 1, accountType: acTypeAsset, name: "現金"}
+	card := account{id: 2, accountType: acTypeLiability, name: "Aカード"}
+	misc := account{id: 3, accountType: acTypeExpense, name: "雑費"}
+
+	// 資産が帳簿より少ない
+	res := &assertionResult{assertion{cash, ymd(2019, 11, 30), 30000}, 31000}
+
+	tr, err := makeAdjustment(nil, res, &misc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.debit().name != "雑費" || tr.credit().name != "現金" || tr.amount() != 1000 {
+		t.Errorf("現金, got = %v", tr)
+	}
+
+	// 負債が帳簿より多い
+	res = &assertionResult{assertion{card, ymd(2019, 11, 30), 9000}, 8000}
+
+	tr, err = makeAdjustment(nil, res, &misc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.debit().name != "雑費" || tr.credit().name != "Aカード" || tr.amount() != 1000 {
+		t.Errorf("Aカード, got = %v", tr)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAddAssertion(db, []string{"2019-11-30", "現金", "30,000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAddAssertion(db, []string{"2019-11-30", "Aカード", "8000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAddAssertion(db, []string{"2019-11-30", "食費", "8000"}); err == nil {
+		t.Fatal("費用の残高は確認できないのでエラーになるはず")
+	}
+
+	assertions, err := dbGetAssertions(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(assertions) != 2 {
+		t.Fatal("len(assertions) != 2:", len(assertions))
+	}
+
+	var cash *assertionResult
+
+	for _, d := range assertions {
+		res, err := checkAssertion(db, &d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch d.account.name {
+		case "現金":
+			if res.balance != 31000 || res.diff() != -1000 {
+				t.Errorf("現金, got = %v", res)
+			}
+			cash = res
+		case "Aカード":
+			if res.balance != 8000 || res.diff() != 0 {
+				t.Errorf("Aカード, got = %v", res)
+			}
+		}
+	}
+
+	if err := runCheck(db, false); err == nil {
+		t.Fatal("差異があるのでエラーになるはず")
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var misc account
+	for _, ac := range accounts {
+		if ac.name == "雑費" {
+			misc = ac
+		}
+	}
+
+	tr, err := makeAdjustment(db, cash, &misc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := addAdjustment(db, accounts, tr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runCheck(db, false); err != nil {
+		t.Fatal(err)
+	}
+}
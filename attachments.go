@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+添付ファイル
+
+領収書や保証書などのファイルを取引に添付する。
+ファイルは中身の SHA-256 を名前にして添付ファイルのディレクトリにコピーし、
+同じ中身のファイルは1つだけ保存する。データベースには元のファイル名等を記録する。
+取引を削除すると添付の記録は削除の履歴に移り、UNDO で取引を戻すと添付も戻る。ファイルは残る。
+*/
+const maxAttachmentNameLen = 256
+
+type attachment struct {
+	id            int
+	transactionID int
+	name          string
+	sha256        string
+	size          int64
+	attachTime    time.Time
+}
+
+func (d *attachment) String() string {
+	attachTime := d.attachTime.Local().Format("2006-01-02 15:04:05")
+
+	return fmt.Sprintf("#%d 取引#%d %s %s %dバイト", d.id, d.transactionID, attachTime, d.name, d.size)
+}
+
+func getAttachmentDir() string {
+	if configData.Attachment.Dir != "" {
+		return configData.Attachment.Dir
+	}
+
+	return filepath.Join(getConfigDir(), "attachments")
+}
+
+// 中身の SHA-256 から添付ファイルのパスを返す。1つのディレクトリにファイルが増えすぎないように先頭2文字で分ける
+func attachmentPath(sum string) string {
+	return filepath.Join(getAttachmentDir(), sum[:2], sum)
+}
+
+// r の内容を添付ファイルのディレクトリに保存して、SHA-256 とサイズを返す
+func storeAttachment(r io.Reader) (string, int64, error) {
+	dir := getAttachmentDir()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", 0, err
+	}
+
+	f, err := ioutil.TempFile(dir, "tmp-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		f.Close()
+		return "", 0, err
+	}
+
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	path := attachmentPath(sum)
+
+	if _, err := os.Stat(path); err == nil {
+		return sum, size, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", 0, err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", 0, err
+	}
+
+	return sum, size, nil
+}
+
+// 保存した添付ファイルを読んで、中身が壊れてないか確認する
+func readAttachment(sum string) ([]byte, error) {
+	b, err := ioutil.ReadFile(attachmentPath(sum))
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.Sum256(b)
+	if hex.EncodeToString(h[:]) != sum {
+		return nil, errors.New("添付ファイルの中身が SHA-256 と一致しない: " + sum)
+	}
+
+	return b, nil
+}
+
+func cmdAttach(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if context.NArg() == 0 {
+		return errors.New("Usage: mita tr attach [--id transaction_id] file...")
+	}
+
+	id := context.Int("id")
+
+	if id == 0 {
+		tr, err := selectTransaction(db)
+		if tr == nil || err != nil {
+			return err
+		}
+
+		id = tr.id
+	}
+
+	return runAttach(db, id, context.Args().Slice())
+}
+
+func runAttach(db *sql.DB, id int, files []string) error {
+	tr, err := dbFindTransaction(db, id)
+	if err != nil {
+		return err
+	}
+
+	if tr == nil {
+		return fmt.Errorf("取引#%dがない", id)
+	}
+
+	var items []attachment
+
+	for _, filename := range files {
+		d, err := storeAttachmentFile(filename)
+		if err != nil {
+			return err
+		}
+
+		d.transactionID = id
+		items = append(items, *d)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for i := range items {
+		if err := dbAddAttachment(tx, &items[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	println(tr)
+
+	for _, d := range items {
+		println("添付:", d.name)
+	}
+
+	return nil
+}
+
+// ファイルを添付ファイルのディレクトリにコピーする
+func storeAttachmentFile(filename string) (*attachment, error) {
+	name := filepath.Base(filename)
+
+	if utf8.RuneCountInString(name) > maxAttachmentNameLen {
+		return nil, fmt.Errorf("ファイル名が%d文字より長い: %s", maxAttachmentNameLen, name)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, errors.New("通常のファイルではない: " + filename)
+	}
+
+	sum, size, err := storeAttachment(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachment{name: name, sha256: sum, size: size, attachTime: time.Now()}, nil
+}
+
+const sqlAddAttachment = `
+INSERT INTO attachments (transaction_id, name, sha256, size, attach_time)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING attachment_id
+`
+
+func dbAddAttachment(tx *sql.Tx, d *attachment) error {
+	return tx.QueryRow(sqlAddAttachment, d.transactionID, d.name, d.sha256, d.size, d.attachTime).Scan(&d.id)
+}
+
+// 最後に削除したときの添付を戻す。添付ファイルIDは振り直す
+const sqlRestoreAttachments = `
+INSERT INTO attachments (transaction_id, name, sha256, size, attach_time)
+SELECT transaction_id, name, sha256, size, attach_time
+FROM attachments_history
+WHERE transaction_id = $1 AND version =
+    (SELECT MAX(version) FROM transactions_history WHERE transaction_id = $1 AND operation = 'D')
+ORDER BY attachment_id
+`
+
+// 削除された取引を追加し直したあとに、削除したときの添付を戻す
+func dbRestoreAttachments(tx *sql.Tx, id int) error {
+	_, err := tx.Exec(sqlRestoreAttachments, id)
+
+	return err
+}
+
+func cmdListAttachments(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runListAttachments(db, context.Int("id"))
+}
+
+// 取引の添付ファイルを一覧。id が 0 なら全ての取引
+func runListAttachments(db *sql.DB, id int) error {
+	items, err := dbGetAttachments(db, id)
+	if err != nil {
+		return err
+	}
+
+	if isRecordOutput() {
+		t := newRecordTable("attachment_id", "transaction_id", "name", "sha256", "size", "attach_time", "path")
+
+		for _, d := range items {
+			t.add(d.id, d.transactionID, d.name, d.sha256, int(d.size), d.attachTime.Local().Format("2006-01-02 15:04:05"),
+				attachmentPath(d.sha256))
+		}
+
+		return printRecords(t)
+	}
+
+	for _, d := range items {
+		println(&d)
+		println("  " + attachmentPath(d.sha256))
+	}
+
+	return nil
+}
+
+const sqlGetAttachmentsSelect = `
+SELECT attachment_id, transaction_id, name, sha256, size, attach_time
+FROM attachments
+`
+
+const sqlGetAllAttachments = sqlGetAttachmentsSelect + `
+ORDER BY transaction_id, attachment_id
+`
+
+const sqlGetAttachments = sqlGetAttachmentsSelect + `
+WHERE transaction_id = $1
+ORDER BY attachment_id
+`
+
+const sqlGetAttachment = sqlGetAttachmentsSelect + `
+WHERE transaction_id = $1 AND attachment_id = $2
+`
+
+// 取引の添付ファイル。id が 0 なら全ての取引
+func dbGetAttachments(db *sql.DB, id int) ([]attachment, error) {
+	var rows *sql.Rows
+	var err error
+
+	if id == 0 {
+		rows, err = db.Query(sqlGetAllAttachments)
+	} else {
+		rows, err = db.Query(sqlGetAttachments, id)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rows2attachments(rows)
+}
+
+// 取引の添付ファイル。なければ nil
+func dbGetAttachment(db *sql.DB, transactionID int, id int) (*attachment, error) {
+	rows, err := db.Query(sqlGetAttachment, transactionID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := rows2attachments(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	return &items[0], nil
+}
+
+func rows2attachments(rows *sql.Rows) ([]attachment, error) {
+	defer rows.Close()
+
+	var items []attachment
+
+	for rows.Next() {
+		var d attachment
+
+		if err := rows.Scan(&d.id, &d.transactionID, &d.name, &d.sha256, &d.size, &d.attachTime); err != nil {
+			return nil, err
+		}
+
+		d.sha256 = strings.TrimSpace(d.sha256)
+
+		items = append(items, d)
+	}
+
+	return items, rows.Err()
+}
+
+const attachmentsIndexName = "attachments.tsv"
+
+/*
+検索条件に一致する取引の添付ファイルを dir に書き出す
+
+ファイル名は "<添付ファイルID>_<元のファイル名>"。
+attachments.tsv には1列目にファイル名、2列目以降に取引をエクスポートと同じ形式で書く。
+*/
+func exportAttachments(db *sql.DB, dir string, terms []string) error {
+	transactions, err := findTransactions(db, terms)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	index, err := os.OpenFile(filepath.Join(dir, attachmentsIndexName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	for _, tr := range transactions {
+		items, err := dbGetAttachments(db, tr.id)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range items {
+			b, err := readAttachment(d.sha256)
+			if err != nil {
+				return err
+			}
+
+			name := fmt.Sprintf("%d_%s", d.id, d.name)
+
+			if err := writeNewFile(filepath.Join(dir, name), b); err != nil {
+				return err
+			}
+
+			line := append([]string{name}, transaction2tsv(&tr)...)
+
+			if _, err := index.WriteString(strings.Join(line, "\t") + "\n"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return index.Close()
+}
+
+// 既にあるファイルは上書きしない
+func writeNewFile(filename string, b []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAttachments(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "mita_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	receipt := filepath.Join(dir, "receipt.txt")
+	if err := ioutil.WriteFile(receipt, []byte("領収書"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じ中身のファイルは1つだけ保存する
+	if err := runAttach(db, 1, []string{receipt}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAttach(db, 2, []string{receipt}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAttach(db, 999, []string{receipt}); err == nil {
+		t.Fatal("取引がないのでエラーになるはず")
+	}
+
+	if err := runAttach(db, 1, []string{dir}); err == nil {
+		t.Fatal("ディレクトリは添付できないのでエラーになるはず")
+	}
+
+	items, err := dbGetAttachments(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 || items[0].sha256 != items[1].sha256 || items[0].size != int64(len("領収書")) {
+		t.Fatal("添付ファイルが違う:", items)
+	}
+
+	b, err := readAttachment(items[0].sha256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "領収書" {
+		t.Fatal("保存した中身が違う:", string(b))
+	}
+
+	if err := runListAttachments(db, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// 取引を削除すると添付の記録も消える
+	if err := dbRemoveTransaction(db, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err = dbGetAttachments(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 1 || items[0].transactionID != 1 {
+		t.Fatal("削除した取引の添付が残っている:", items)
+	}
+
+	// エクスポート
+	exported := filepath.Join(dir, "export")
+
+	if err := exportAttachments(db, exported, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := ioutil.ReadFile(filepath.Join(exported, attachmentsIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arr := strings.Split(strings.TrimSpace(string(index)), "\t")
+	if len(arr) < 8 || arr[0] != "1_receipt.txt" {
+		t.Fatal("attachments.tsv が違う:", string(index))
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(exported, arr[0])); err != nil || string(b) != "領収書" {
+		t.Fatal("書き出した添付ファイルが違う:", string(b), err)
+	}
+
+	// API
+	w := httptest.NewRecorder()
+	apiTransactionsHandler(w, httptest.NewRequest("GET", "/api/transactions/1/attachments", nil))
+
+	var data []apiAttachment
+
+	if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) != 1 || data[0].Name != "receipt.txt" {
+		t.Fatal("一覧が違う:", data)
+	}
+
+	w = httptest.NewRecorder()
+	apiTransactionsHandler(w, httptest.NewRequest("GET", data[0].URL, nil))
+
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), []byte("領収書")) {
+		t.Fatal("添付ファイルが返らない:", w.Code, w.Body.String())
+	}
+
+	for _, path := range []string{"/api/transactions/2/attachments/1", "/api/transactions/1/attachments/999", "/api/transactions/x/attachments"} {
+		w = httptest.NewRecorder()
+		apiTransactionsHandler(w, httptest.NewRequest("GET", path, nil))
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: %d", path, w.Code)
+		}
+	}
+
+	// 削除を UNDO すると添付も戻る
+	histories, err := dbGetHistory(db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := &histories[len(histories)-1]
+	if last.operation != "DELETE" {
+		t.Fatal("最後の履歴が削除でない:", last)
+	}
+
+	if _, err := undoHistory(db, last); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	stdout = buf
+
+	if err := runListAttachments(db, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "取引#2") || !strings.Contains(buf.String(), "receipt.txt") {
+		t.Fatal("UNDO で添付が戻らない:", buf.String())
+	}
+
+	// 操作の UNDO と REDO でも添付が戻る
+	if _, err := dbRecordOperation(db, "tr rm", operationNormal, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dbRemoveTransaction(db, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbRecordOperation(db, "tr rm", operationNormal, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	op, err := dbGetOperation1(db, sqlGetUndoTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countAttachments := func() int {
+		items, err := dbGetAttachments(db, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(items)
+	}
+
+	for i, isUndo := range []bool{true, false, true} {
+		if _, err := undoOperation(db, op, isUndo); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := countAttachments(); (isUndo && n != 1) || (!isUndo && n != 0) {
+			t.Fatalf("%d: 添付の数が違う: %d", i, n)
+		}
+	}
+}
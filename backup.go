@@ -0,0 +1,766 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+バックアップ
+
+データベースの種類によらない形式で、テーブルの内容を1つのファイルに保存する。
+ファイルは tar.gz で、最初に manifest.json、続いてテーブルごとの TSV(1行目は列名)が入っている。
+manifest.json には各 TSV の行数と SHA-256、取引の件数と金額の合計を記録する。
+添付ファイルは attachments/<SHA-256> に入れ、復元時に添付ファイルのディレクトリに戻す。
+
+transactions_month と transactions_summary は保存せず、復元時にトリガー等で計算し直す。
+*/
+const backupFormat = 1
+
+const backupManifestName = "manifest.json"
+
+const backupAttachmentsDir = "attachments/"
+
+// NULL を表す TSV の値
+const backupNull = `\N`
+
+type backupTable struct {
+	name    string
+	columns []string
+	order   string
+	serial  string          // 自動で ID を振る列
+	bools   map[string]bool // boolean の列
+}
+
+// 復元する順番に並べている
+var backupTables = []backupTable{
+	{name: "accounts",
+		columns: []string{"account_id", "account_type", "name", "search_words", "parent", "order_no", "is_extraordinary", "currency"},
+		order:   "account_id", serial: "account_id", bools: map[string]bool{"is_extraordinary": true}},
+	{name: "exchange_rates",
+		columns: []string{"currency", "date", "rate"},
+		order:   "currency, date"},
+	{name: "transactions",
+		columns: []string{"transaction_id", "version", "date", "description", "start_month", "end_month"},
+		order:   "transaction_id", serial: "transaction_id"},
+	{name: "transactions_detail",
+		columns: []string{"transaction_id", "no", "account_id", "debit_amount", "credit_amount", "currency_amount", "rate"},
+		order:   "transaction_id, no"},
+	{name: "transactions_import",
+		columns: []string{"external_id", "transaction_id"},
+		order:   "external_id"},
+	{name: "tags",
+		columns: []string{"tag_id", "name"},
+		order:   "tag_id", serial: "tag_id"},
+	{name: "transactions_tags",
+		columns: []string{"transaction_id", "tag_id"},
+		order:   "transaction_id, tag_id"},
+	{name: "attachments",
+		columns: []string{"attachment_id", "transaction_id", "name", "sha256", "size", "attach_time"},
+		order:   "attachment_id", serial: "attachment_id"},
+	{name: "templates",
+		columns: []string{"template_id", "name"},
+		order:   "template_id", serial: "template_id"},
+	{name: "templates_detail",
+		columns: []string{"template_id", "no", "order_no", "debit_id", "credit_id", "amount", "description"},
+		order:   "template_id, no"},
+	{name: "schedules",
+		columns: []string{"schedule_id", "name", "template_id", "debit_id", "credit_id", "amount", "description",
+			"rule", "rule_value", "start_date", "last_date"},
+		order: "schedule_id", serial: "schedule_id"},
+	{name: "schedules_log",
+		columns: []string{"schedule_id", "date", "no", "transaction_id", "operate_time"},
+		order:   "schedule_id, date, no"},
+	{name: "assertions",
+		columns: []string{"account_id", "date", "amount"},
+		order:   "account_id, date"},
+	{name: "budgets",
+		columns: []string{"account_id", "month", "amount"},
+		order:   "account_id, month"},
+	{name: "import_rules",
+		columns: []string{"rule_id", "pattern", "account_id"},
+		order:   "rule_id", serial: "rule_id"},
+	{name: "groups",
+		columns: []string{"group_id", "name", "check_account_id"},
+		order:   "group_id", serial: "group_id"},
+	{name: "groups_detail",
+		columns: []string{"group_id", "transaction_id"},
+		order:   "group_id, transaction_id"},
+
+	// 取引を追加するとトリガーで履歴が追加されるので、履歴は最後に置き換える
+	{name: "operations",
+		columns: []string{"operation_id", "operate_time", "command", "kind", "target_id", "is_undone"},
+		order:   "operation_id", serial: "operation_id", bools: map[string]bool{"is_undone": true}},
+	{name: "transactions_history",
+		columns: []string{"operation", "operate_time", "transaction_id", "version", "date", "description", "start_month", "end_month",
+			"operation_id", "tags"},
+		order: "transaction_id, version"},
+	{name: "transactions_detail_history",
+		columns: []string{"transaction_id", "version", "no", "account_id", "debit_amount", "credit_amount", "currency_amount", "rate"},
+		order:   "transaction_id, version, no"},
+	{name: "attachments_history",
+		columns: []string{"transaction_id", "version", "attachment_id", "name", "sha256", "size", "attach_time"},
+		order:   "transaction_id, version, attachment_id"},
+	{name: "transactions_import_history",
+		columns: []string{"transaction_id", "version", "external_id"},
+		order:   "transaction_id, version, external_id"},
+}
+
+type backupManifest struct {
+	Format        int               `json:"format"`
+	SchemaVersion int               `json:"schema_version"`
+	Driver        string            `json:"driver"`
+	Created       string            `json:"created"`
+	Files         []backupFile      `json:"files"`
+	Attachments   []string          `json:"attachments"` // 添付ファイルの SHA-256
+	Totals        backupTotals      `json:"totals"`
+	files         map[string][]byte // 復元時に読んだファイルの内容
+}
+
+type backupFile struct {
+	Name   string `json:"name"`
+	Rows   int    `json:"rows"`
+	SHA256 string `json:"sha256"`
+}
+
+// 復元後に確認するための合計
+type backupTotals struct {
+	Transactions int `json:"transactions"`
+	Debit        int `json:"debit"`
+	Credit       int `json:"credit"`
+}
+
+const sqlGetBackupTotals = `
+SELECT (SELECT COUNT(*) FROM transactions),
+       COALESCE(SUM(debit_amount), 0), COALESCE(SUM(credit_amount), 0)
+FROM transactions_detail
+`
+
+func dbGetBackupTotals(db dbtx) (backupTotals, error) {
+	var d backupTotals
+
+	err := db.QueryRow(sqlGetBackupTotals).Scan(&d.Transactions, &d.Debit, &d.Credit)
+
+	return d, err
+}
+
+func cmdBackup(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	filename := context.Args().First()
+	if filename == "" {
+		filename = "mita-" + time.Now().Format("20060102") + ".tar.gz"
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := runBackup(db, f); err != nil {
+		f.Close()
+		os.Remove(filename)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	println("バックアップ:", filename)
+
+	return nil
+}
+
+func runBackup(db *sql.DB, w io.Writer) error {
+	/* 読んでいる途中で変更されても表どうしが食い違わないように、
+	   1つのスナップショットを読む読み取り専用のトランザクションで読む。
+	   PostgreSQL の既定の READ COMMITTED では SELECT ごとにスナップショットが変わる */
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	manifest := backupManifest{
+		Format:        backupFormat,
+		SchemaVersion: schemaVersion,
+		Driver:        storageName(),
+		Created:       time.Now().Format(time.RFC3339),
+	}
+
+	var contents [][]byte
+
+	for _, t := range backupTables {
+		b, rows, err := dbDumpTable(tx, t)
+		if err != nil {
+			return fmt.Errorf("%s: %s", t.name, err)
+		}
+
+		sum := sha256.Sum256(b)
+
+		manifest.Files = append(manifest.Files, backupFile{
+			Name:   t.name + ".tsv",
+			Rows:   rows,
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+
+		contents = append(contents, b)
+	}
+
+	manifest.Totals, err = dbGetBackupTotals(tx)
+	if err != nil {
+		return err
+	}
+
+	manifest.Attachments, err = dbGetAttachmentSums(tx)
+	if err != nil {
+		return err
+	}
+
+	mb, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	if err := writeTarFile(tw, backupManifestName, append(mb, '\n')); err != nil {
+		return err
+	}
+
+	for i, f := range manifest.Files {
+		if err := writeTarFile(tw, f.Name, contents[i]); err != nil {
+			return err
+		}
+	}
+
+	for _, sum := range manifest.Attachments {
+		b, err := readAttachment(sum)
+		if err != nil {
+			return err
+		}
+
+		if err := writeTarFile(tw, backupAttachmentsDir+sum, b); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+// 削除した取引の添付も UNDO で戻せるように、履歴の添付ファイルも含める
+const sqlGetAttachmentSums = `
+SELECT sha256 FROM attachments
+UNION
+SELECT sha256 FROM attachments_history
+ORDER BY sha256
+`
+
+func dbGetAttachmentSums(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query(sqlGetAttachmentSums)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sums []string
+
+	for rows.Next() {
+		var sum string
+
+		if err := rows.Scan(&sum); err != nil {
+			return nil, err
+		}
+
+		sums = append(sums, strings.TrimSpace(sum))
+	}
+
+	return sums, rows.Err()
+}
+
+func writeTarFile(tw *tar.Writer, name string, contents []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(contents)),
+		ModTime: time.Now(),
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(contents)
+
+	return err
+}
+
+// テーブルの内容を TSV にする
+func dbDumpTable(tx *sql.Tx, t backupTable) ([]byte, int, error) {
+	rows, err := tx.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY %s",
+		strings.Join(t.columns, ", "), t.name, t.order))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	d := newRecordTable(t.columns...)
+
+	for rows.Next() {
+		values := make([]interface{}, len(t.columns))
+		ptrs := make([]interface{}, len(t.columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, 0, err
+		}
+
+		row := make([]interface{}, len(values))
+		for i, v := range values {
+			row[i] = backupValue2str(v)
+		}
+
+		d.add(row...)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	b := new(bytes.Buffer)
+
+	if err := writeRecordsCSV(b, '\t', d); err != nil {
+		return nil, 0, err
+	}
+
+	return b.Bytes(), len(d.rows), nil
+}
+
+// データベースの種類によらない文字列にする
+func backupValue2str(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return backupNull
+	case []byte:
+		return string(t)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case time.Time:
+		if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+			return t.Format("2006-01-02")
+		}
+
+		return t.Format("2006-01-02 15:04:05.999999")
+	}
+
+	return recordValue2str(v)
+}
+
+func cmdRestore(context *cli.Context) error {
+	filename := context.Args().First()
+	if filename == "" {
+		return errors.New("バックアップファイルを指定してください")
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := runRestore(db, f); err != nil {
+		return err
+	}
+
+	println("復元:", filename)
+
+	return nil
+}
+
+func runRestore(db *sql.DB, r io.Reader) error {
+	manifest, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+
+	var n int
+
+	if err := db.QueryRow("SELECT (SELECT COUNT(*) FROM accounts) + (SELECT COUNT(*) FROM transactions_history)").Scan(&n); err != nil {
+		return err
+	}
+
+	if n != 0 {
+		return errors.New("データベースが空ではない。mita db init で作った新しいデータベースに復元してください")
+	}
+
+	st, err := getStorage()
+	if err != nil {
+		return err
+	}
+
+	// 添付ファイルは同じ中身なら同じ名前になるので、先に戻しても問題ない
+	for _, sum := range manifest.Attachments {
+		if _, _, err := storeAttachment(bytes.NewReader(manifest.files[backupAttachmentsDir+sum])); err != nil {
+			return err
+		}
+	}
+
+	numHistories := 5 // 最後の履歴のテーブルの数
+
+	// 取引等を追加する。コミット時に集計テーブルが計算される
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, t := range backupTables[:len(backupTables)-numHistories] {
+		if err := dbRestoreTable(tx, t, manifest.files[t.name+".tsv"]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %s", t.name, err)
+		}
+
+		if t.serial != "" {
+			if err := st.resetSerial(tx, t.name, t.serial); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// トリガーで追加された履歴と操作を、バックアップの履歴に置き換える
+	tx, err = db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"transactions_history", "operations"} {
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	for _, t := range backupTables[len(backupTables)-numHistories:] {
+		if err := dbRestoreTable(tx, t, manifest.files[t.name+".tsv"]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %s", t.name, err)
+		}
+
+		if t.serial != "" {
+			if err := st.resetSerial(tx, t.name, t.serial); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := updateTransactionsSummary(db); err != nil {
+		return err
+	}
+
+	return verifyRestore(db, manifest)
+}
+
+// バックアップファイルを読んで、形式とチェックサムを確認する
+func readBackup(r io.Reader) (*backupManifest, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	files := make(map[string][]byte)
+
+	tr := tar.NewReader(gr)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		files[hdr.Name] = b
+	}
+
+	mb, ok := files[backupManifestName]
+	if !ok {
+		return nil, errors.New("バックアップファイルに " + backupManifestName + " がない")
+	}
+
+	var manifest backupManifest
+
+	if err := json.Unmarshal(mb, &manifest); err != nil {
+		return nil, err
+	}
+
+	if manifest.Format != backupFormat {
+		return nil, fmt.Errorf("未対応のバックアップ形式(%d)", manifest.Format)
+	}
+
+	if manifest.SchemaVersion != schemaVersion {
+		return nil, fmt.Errorf("バックアップのスキーマのバージョン(%d)が mita のバージョン(%d)と違う",
+			manifest.SchemaVersion, schemaVersion)
+	}
+
+	manifest.files = files
+
+	if err := verifyBackupFiles(&manifest); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// 全てのテーブルと添付ファイルがあり、チェックサムが一致するか確認する
+func verifyBackupFiles(manifest *backupManifest) error {
+	name2file := make(map[string]backupFile)
+	for _, f := range manifest.Files {
+		name2file[f.Name] = f
+	}
+
+	for _, t := range backupTables {
+		name := t.name + ".tsv"
+
+		f, ok := name2file[name]
+		if !ok {
+			return errors.New("manifest に " + name + " がない")
+		}
+
+		b, ok := manifest.files[name]
+		if !ok {
+			return errors.New("バックアップファイルに " + name + " がない")
+		}
+
+		sum := sha256.Sum256(b)
+		if hex.EncodeToString(sum[:]) != f.SHA256 {
+			return errors.New(name + " のチェックサムが一致しない")
+		}
+	}
+
+	for _, s := range manifest.Attachments {
+		name := backupAttachmentsDir + s
+
+		b, ok := manifest.files[name]
+		if !ok {
+			return errors.New("バックアップファイルに " + name + " がない")
+		}
+
+		sum := sha256.Sum256(b)
+		if hex.EncodeToString(sum[:]) != s {
+			return errors.New(name + " のチェックサムが一致しない")
+		}
+	}
+
+	return nil
+}
+
+// TSV の内容をテーブルに追加する
+func dbRestoreTable(tx *sql.Tx, t backupTable, b []byte) error {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.Comma = '\t'
+	r.FieldsPerRecord = len(t.columns)
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	if len(records) == 0 || strings.Join(records[0], "\t") != strings.Join(t.columns, "\t") {
+		return errors.New("列名が一致しない")
+	}
+
+	columns := t.columns
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	isAccounts := t.name == "accounts"
+	parentIndex := -1
+
+	if isAccounts {
+		for i, c := range columns {
+			if c == "parent" {
+				parentIndex = i
+			}
+		}
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		t.name, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+
+	for i, rec := range records[1:] {
+		values := make([]interface{}, len(rec))
+
+		for j, s := range rec {
+			switch {
+			case s == backupNull:
+				values[j] = nil
+			case t.bools[columns[j]]:
+				v, err := strconv.ParseBool(s)
+				if err != nil {
+					return fmt.Errorf("%d:%s", i+2, err)
+				}
+				values[j] = v
+			default:
+				values[j] = s
+			}
+		}
+
+		if isAccounts {
+			// 親がまだ追加されてないかもしれないので、いったん自分を親にする
+			values[parentIndex] = values[0]
+		}
+
+		if _, err := tx.Exec(query, values...); err != nil {
+			return fmt.Errorf("%d:%s", i+2, err)
+		}
+	}
+
+	if isAccounts {
+		for i, rec := range records[1:] {
+			if rec[parentIndex] == rec[0] {
+				continue
+			}
+
+			if _, err := tx.Exec("UPDATE accounts SET parent = $1 WHERE account_id = $2", rec[parentIndex], rec[0]); err != nil {
+				return fmt.Errorf("%d:%s", i+2, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SQLite の古いバージョンは FULL OUTER JOIN が使えないので、両方向から LEFT JOIN する
+const sqlVerifyMonth = `
+WITH td AS (
+    SELECT account_id, SUM(debit_amount) AS debit, SUM(credit_amount) AS credit
+    FROM transactions_detail
+    GROUP BY account_id
+), tm AS (
+    SELECT account_id,
+           SUM(accrual_debit_amount) AS accrual_debit, SUM(accrual_credit_amount) AS accrual_credit,
+           SUM(cash_debit_amount) AS cash_debit, SUM(cash_credit_amount) AS cash_credit
+    FROM transactions_month
+    GROUP BY account_id
+)
+SELECT (SELECT COUNT(*)
+        FROM td
+        LEFT JOIN tm ON td.account_id = tm.account_id
+        WHERE tm.account_id IS NULL
+              OR td.debit <> tm.accrual_debit OR td.credit <> tm.accrual_credit
+              OR td.debit <> tm.cash_debit OR td.credit <> tm.cash_credit)
+       +
+       (SELECT COUNT(*)
+        FROM tm
+        LEFT JOIN td ON tm.account_id = td.account_id
+        WHERE td.account_id IS NULL)
+`
+
+const sqlVerifySummary = `
+SELECT COUNT(*)
+FROM (SELECT account_id,
+             SUM(accrual_debit_amount) AS accrual_debit, SUM(accrual_credit_amount) AS accrual_credit,
+             SUM(cash_debit_amount) AS cash_debit, SUM(cash_credit_amount) AS cash_credit
+      FROM transactions_month
+      GROUP BY account_id) AS tm
+LEFT JOIN (SELECT account_id,
+                  SUM(accrual_debit_amount) AS accrual_debit, SUM(accrual_credit_amount) AS accrual_credit,
+                  SUM(cash_debit_amount) AS cash_debit, SUM(cash_credit_amount) AS cash_credit
+           FROM transactions_summary
+           GROUP BY account_id) AS ts ON tm.account_id = ts.account_id
+WHERE ts.account_id IS NULL
+      OR tm.accrual_debit <> ts.accrual_debit OR tm.accrual_credit <> ts.accrual_credit
+      OR tm.cash_debit <> ts.cash_debit OR tm.cash_credit <> ts.cash_credit
+`
+
+// 復元した行数と合計がバックアップと一致するか確認する
+func verifyRestore(db *sql.DB, manifest *backupManifest) error {
+	for _, f := range manifest.Files {
+		var n int
+
+		table := strings.TrimSuffix(f.Name, ".tsv")
+
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			return err
+		}
+
+		if n != f.Rows {
+			return fmt.Errorf("%s の行数が一致しない(バックアップ %d, 復元 %d)", table, f.Rows, n)
+		}
+	}
+
+	totals, err := dbGetBackupTotals(db)
+	if err != nil {
+		return err
+	}
+
+	if totals != manifest.Totals {
+		return fmt.Errorf("取引の合計が一致しない(バックアップ %+v, 復元 %+v)", manifest.Totals, totals)
+	}
+
+	for _, q := range []string{sqlVerifyMonth, sqlVerifySummary} {
+		var n int
+
+		if err := db.QueryRow(q).Scan(&n); err != nil {
+			return err
+		}
+
+		if n != 0 {
+			return fmt.Errorf("集計テーブルの金額が取引と一致しない勘定科目が %d 件ある", n)
+		}
+	}
+
+	return nil
+}
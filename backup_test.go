@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 履歴に複数のバージョンがあるようにする
+	tr, err := dbGetTransaction(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr.note = "編集した"
+
+	if err := dbEditTransactionTx(db, tr); err != nil {
+		t.Fatal(err)
+	}
+
+	// 添付ファイルもバックアップする
+	receipt := filepath.Join(os.TempDir(), "mita_test_receipt.txt")
+	if err := ioutil.WriteFile(receipt, []byte("領収書"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(receipt)
+
+	if err := runAttach(db, 1, []string{receipt}); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := dumpTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup := new(bytes.Buffer)
+
+	if err := runBackup(db, backup); err != nil {
+		t.Fatal(err)
+	}
+
+	data := backup.Bytes()
+
+	if err := runRestore(db, bytes.NewReader(data)); err == nil {
+		t.Error("空のデータベースではないのでエラーになるはず")
+	}
+
+	if err := dbClean(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(getAttachmentDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runRestore(db, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := dumpTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, table := range backupTables {
+		if before[i] != after[i] {
+			t.Errorf("%s\nbefore:\n%s\nafter:\n%s", table.name, before[i], after[i])
+		}
+	}
+
+	items, err := dbGetAttachments(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 1 {
+		t.Fatal("添付ファイルが復元されてない")
+	}
+
+	if b, err := readAttachment(items[0].sha256); err != nil || string(b) != "領収書" {
+		t.Fatal("添付ファイルの中身が復元されてない:", string(b), err)
+	}
+
+	// 復元後も ID が重ならずに追加できる
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbAddTransaction(tx, tr); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreChecksum(t *testing.T) {
+	db, err := setupAccounts()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup := new(bytes.Buffer)
+
+	if err := runBackup(db, backup); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readBackup(bytes.NewReader(backup.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if manifest.Files[0].Rows == 0 {
+		t.Fatal("accounts.tsv の行数が 0")
+	}
+
+	// 中身を書き換えたバックアップはチェックサムが一致しない
+	manifest.files["accounts.tsv"] = append(manifest.files["accounts.tsv"], []byte("x")...)
+
+	if err := verifyBackupFiles(manifest); err == nil {
+		t.Error("チェックサムが一致しないのでエラーになるはず")
+	}
+}
+
+func dumpTables(db *sql.DB) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var tables []string
+
+	for _, table := range backupTables {
+		b, _, err := dbDumpTable(tx, table)
+		if err != nil {
+			return nil, err
+		}
+
+		tables = append(tables, string(b))
+	}
+
+	return tables, nil
+}
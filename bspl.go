@@ -59,37 +59,137 @@ func runBS(db *sql.DB, monthStr string) error {
 		return err
 	}
 
+	if isRecordOutput() {
+		return printBSRecords(db, month)
+	}
+
+	_, err = printBS(db, month)
+
+	return err
+}
+
+// 残高が0でない資産と負債の勘定科目ごとに1レコード
+func printBSRecords(db *sql.DB, month int) error {
 	items, err := dbGetBalances(db, month)
 	if err != nil {
 		return err
 	}
 
-	var assetSum, liabilitySum int
+	fxItems, err := getFXValuations(db, month)
+	if err != nil {
+		return err
+	}
+
+	id2fx := make(map[int]*fxValuation)
+	for i := range fxItems {
+		id2fx[fxItems[i].account.id] = &fxItems[i]
+	}
+
+	t := newRecordTable("month", "account_id", "account_type", "name", "balance", "book_balance",
+		"currency", "currency_balance")
 
-	println("資産:")
 	for _, d := range items {
-		if d.accountType != acTypeAsset {
+		balance, book := d.balance, d.balance
+		currency, currencyBalance := "", 0
+
+		if fx := id2fx[d.id]; fx != nil {
+			balance, book = fx.value, fx.book
+			currency, currencyBalance = fx.account.currency, fx.balance
+		}
+
+		if balance == 0 && book == 0 {
 			continue
 		}
 
-		if d.balance != 0 {
-			println(&d)
+		t.add(month, d.id, d.accountType, d.name, balance, book, currency, currencyBalance)
+	}
 
-			assetSum += d.balance
+	return printRecords(t)
+}
+
+// 月末の資産と負債を表示して、純資産を返す
+func printBS(db *sql.DB, month int) (int, error) {
+	items, err := dbGetBalances(db, month)
+	if err != nil {
+		return 0, err
+	}
+
+	fxItems, err := getFXValuations(db, month)
+	if err != nil {
+		return 0, err
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return 0, err
+	}
+
+	id2fx := make(map[int]*fxValuation)
+	for i := range fxItems {
+		id2fx[fxItems[i].account.id] = &fxItems[i]
+	}
+
+	var fxGain int
+
+	// 外貨建ての勘定科目は月末のレートで評価する
+	for i := range items {
+		if fx := id2fx[items[i].id]; fx != nil {
+			items[i].balance = fx.value
+			fxGain += fx.gain()
 		}
 	}
 
-	println()
-	println("負債:")
-	for _, d := range items {
-		if d.accountType != acTypeLiability {
-			continue
+	roots, p2d := rollUpSummaries(accounts, items)
+
+	var printItems func(id int, depth int)
+	printItems = func(id int, depth int) {
+		for _, d := range p2d[id] {
+			if d.balance == 0 {
+				continue
+			}
+
+			if fx := id2fx[d.id]; fx != nil && (d.id == id || !hasSubItems(p2d, d.id)) {
+				printf("%*s%v %s\n", 8*depth, "", &d, fxValuation2str(fx))
+			} else {
+				printf("%*s%v\n", 8*depth, "", &d)
+			}
+
+			if d.id != id && hasSubItems(p2d, d.id) {
+				printItems(d.id, depth+1)
+			}
 		}
+	}
+
+	var assetSum, liabilitySum int
 
-		if d.balance != 0 {
-			println(&d)
+	for _, accountType := range []int{acTypeAsset, acTypeLiability} {
+		if accountType == acTypeAsset {
+			println("資産:")
+		} else {
+			println()
+			println("負債:")
+		}
 
-			liabilitySum += d.balance
+		for _, d := range roots {
+			if d.accountType != accountType || d.balance == 0 {
+				continue
+			}
+
+			if fx := id2fx[d.id]; fx != nil && !hasSubItems(p2d, d.id) {
+				println(&d, fxValuation2str(fx))
+			} else {
+				println(&d)
+			}
+
+			if hasSubItems(p2d, d.id) {
+				printItems(d.id, 1)
+			}
+
+			if accountType == acTypeAsset {
+				assetSum += d.balance
+			} else {
+				liabilitySum += d.balance
+			}
 		}
 	}
 
@@ -98,7 +198,11 @@ func runBS(db *sql.DB, monthStr string) error {
 	printf("総負債: %20s\n", int2str(liabilitySum))
 	printf("純資産: %20s\n", int2str(assetSum+liabilitySum))
 
-	return nil
+	if len(fxItems) != 0 {
+		printf("評価損益: %18s\n", int2str(fxGain))
+	}
+
+	return assetSum + liabilitySum, nil
 }
 
 func cmdPL(context *cli.Context) error {
@@ -108,7 +212,60 @@ func cmdPL(context *cli.Context) error {
 	}
 	defer db.Close()
 
-	return runPL(db, context.Bool("cash"), context.Args().First())
+	if context.Bool("budget") {
+		return runPLBudget(db, context.Bool("cash"), context.Args().First())
+	}
+
+	from, to, err := getPLRange(context.Args().First(), context.String("from"), context.String("to"),
+		context.Int("last"))
+	if err != nil {
+		return err
+	}
+
+	if context.Bool("monthly") {
+		return runPLMonthly(db, context.Bool("cash"), from, to)
+	}
+
+	return runPLRange(db, context.Bool("cash"), from, to)
+}
+
+/*
+P/Lの期間を求める
+
+期間の指定がなければ monthStr の1月(省略すると今月)。
+to を省略すると monthStr(省略すると今月)まで、from を省略すると to の1月。
+last が0より大きければ to までの last 月。
+*/
+func getPLRange(monthStr string, fromStr string, toStr string, last int) (int, int, error) {
+	if toStr == "" {
+		toStr = monthStr
+	}
+
+	if toStr == "" {
+		toStr = "-0" // 今月
+	}
+
+	to, err := str2month(toStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("終了月:%s", err)
+	}
+
+	from := to
+
+	if last > 0 {
+		from = subtractMonth(to, last-1)
+	} else if fromStr != "" {
+		from, err = str2month(fromStr)
+		if err != nil {
+			return 0, 0, fmt.Errorf("開始月:%s", err)
+		}
+	}
+
+	if from > to {
+		return 0, 0, fmt.Errorf("開始月が終了月より後ろ。開始月 = %s, 終了月 = %s", month2str(from), month2str(to))
+	}
+
+	return from, to, nil
 }
 
 func runPL(db *sql.DB, isCash bool, monthStr string) error {
@@ -121,19 +278,89 @@ func runPL(db *sql.DB, isCash bool, monthStr string) error {
 		return err
 	}
 
-	println(month2str(month))
+	return runPLRange(db, isCash, month, month)
+}
+
+// from から to までの月を合計したP/Lを表示する
+func runPLRange(db *sql.DB, isCash bool, from int, to int) error {
+	if isRecordOutput() {
+		t := newPLRecordTable()
+
+		if err := addPLRecords(db, t, isCash, from, to); err != nil {
+			return err
+		}
+
+		return printRecords(t)
+	}
+
+	println(range2str(from, to))
 	println()
 
-	items, err := dbGetGroupedPL(db, isCash, month)
+	_, err := printPL(db, isCash, from, to)
+
+	return err
+}
+
+func newPLRecordTable() *recordTable {
+	return newRecordTable("from_month", "to_month", "account_id", "account_type", "name", "parent_id", "parent",
+		"is_extraordinary", "balance")
+}
+
+// from から to までの月を合計したP/Lを、子の勘定科目ごとに1レコード追加する
+func addPLRecords(db *sql.DB, t *recordTable, isCash bool, from int, to int) error {
+	items, err := dbGetGroupedPL(db, isCash, from, to)
 	if err != nil {
 		return err
 	}
 
-	p2d, err := dbGetPL(db, isCash, month)
+	p2d, err := dbGetPL(db, isCash, from, to)
 	if err != nil {
 		return err
 	}
 
+	addPLItemRecords(t, from, to, items, p2d)
+
+	return nil
+}
+
+// 親の勘定科目ごとのP/Lと、その子の勘定科目のP/Lを、金額のある勘定科目ごとに1レコード追加する
+func addPLItemRecords(t *recordTable, from int, to int, items []summary, p2d map[int][]summary) {
+	for _, p := range items {
+		addPLSubItemRecords(t, from, to, p, p, p2d)
+	}
+}
+
+// 勘定科目 p の子孫のレコードを追加する。parent は p の親
+func addPLSubItemRecords(t *recordTable, from int, to int, p summary, parent summary, p2d map[int][]summary) {
+	for _, d := range p2d[p.id] {
+		switch {
+		case d.id == p.id:
+			t.add(from, to, d.id, d.accountType, d.name, parent.id, parent.name, d.isExtraordinary, d.balance)
+		case hasSubItems(p2d, d.id):
+			addPLSubItemRecords(t, from, to, d, p, p2d)
+		default:
+			t.add(from, to, d.id, d.accountType, d.name, p.id, p.name, d.isExtraordinary, d.balance)
+		}
+	}
+}
+
+// from から to までの月を合計した収入と費用を表示して、損益を返す
+func printPL(db *sql.DB, isCash bool, from int, to int) (int, error) {
+	items, err := dbGetGroupedPL(db, isCash, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	p2d, err := dbGetPL(db, isCash, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	return printPLItems(items, p2d), nil
+}
+
+// 親の勘定科目ごとのP/Lと、その子の勘定科目のP/Lから収入と費用を表示して、損益を返す
+func printPLItems(items []summary, p2d map[int][]summary) int {
 	var incomeSum, expenseSum int
 
 	println("収入:")
@@ -146,8 +373,8 @@ func runPL(db *sql.DB, isCash bool, monthStr string) error {
 
 		incomeSum += d.balance
 
-		if len(p2d[d.id]) > 1 || (len(p2d[d.id]) == 1 && p2d[d.id][0].id != d.id) {
-			printSubItems(p2d[d.id])
+		if hasSubItems(p2d, d.id) {
+			printSubItems(p2d, d.id, 1)
 		}
 	}
 
@@ -162,8 +389,8 @@ func runPL(db *sql.DB, isCash bool, monthStr string) error {
 
 		expenseSum += d.balance
 
-		if len(p2d[d.id]) > 1 || (len(p2d[d.id]) == 1 && p2d[d.id][0].id != d.id) {
-			printSubItems(p2d[d.id])
+		if hasSubItems(p2d, d.id) {
+			printSubItems(p2d, d.id, 1)
 		}
 	}
 
@@ -172,19 +399,190 @@ func runPL(db *sql.DB, isCash bool, monthStr string) error {
 	printf("総費用: %20s\n", int2str(expenseSum))
 	printf("損益  : %20s\n", int2str(incomeSum+expenseSum))
 
+	return incomeSum + expenseSum
+}
+
+func range2str(from int, to int) string {
+	if from == to {
+		return month2str(from)
+	}
+
+	return month2str(from) + " - " + month2str(to)
+}
+
+// 親の勘定科目に、自分以外の子があるか
+func hasSubItems(p2d map[int][]summary, id int) bool {
+	return len(p2d[id]) > 1 || (len(p2d[id]) == 1 && p2d[id][0].id != id)
+}
+
+/*
+from から to までのP/Lを、月ごとに列を並べて表示する
+最後の列は期間の合計
+*/
+func runPLMonthly(db *sql.DB, isCash bool, from int, to int) error {
+	if isRecordOutput() {
+		t := newPLRecordTable()
+
+		for m := from; m <= to; m = nextMonth(m) {
+			if err := addPLRecords(db, t, isCash, m, m); err != nil {
+				return err
+			}
+		}
+
+		return printRecords(t)
+	}
+
+	items, err := dbGetGroupedPL(db, isCash, from, to)
+	if err != nil {
+		return err
+	}
+
+	p2d, err := dbGetPL(db, isCash, from, to)
+	if err != nil {
+		return err
+	}
+
+	var months []int
+	var groupedByMonth []map[int]int
+	var subByMonth []map[int][]summary
+
+	for m := from; m <= to; m = nextMonth(m) {
+		months = append(months, m)
+
+		grouped, err := dbGetGroupedPL(db, isCash, m, m)
+		if err != nil {
+			return err
+		}
+
+		g := make(map[int]int)
+		for _, d := range grouped {
+			g[d.id] = d.balance
+		}
+		groupedByMonth = append(groupedByMonth, g)
+
+		sub, err := dbGetPL(db, isCash, m, m)
+		if err != nil {
+			return err
+		}
+		subByMonth = append(subByMonth, sub)
+	}
+
+	// 親 p の子 id の月ごとの金額と期間の合計
+	subValues := func(p int, sub summary) []int {
+		values := make([]int, len(months)+1)
+
+		for i := range months {
+			for _, d := range subByMonth[i][p] {
+				if d.id == sub.id {
+					values[i] = d.balance
+				}
+			}
+		}
+		values[len(months)] = sub.balance
+
+		return values
+	}
+
+	var printSubRows func(p int, depth int)
+	printSubRows = func(p int, depth int) {
+		for _, sub := range p2d[p] {
+			println(plRow(sub.name, 2*depth, subValues(p, sub)))
+
+			if sub.id != p && hasSubItems(p2d, sub.id) {
+				printSubRows(sub.id, depth+1)
+			}
+		}
+	}
+
+	header := fmt.Sprintf("%18s", "")
+	for _, m := range months {
+		header += fmt.Sprintf(" %11s", month2str(m))
+	}
+	println(header + fmt.Sprintf(" %11s", "合計"))
+
+	incomeSums := make([]int, len(months)+1)
+	expenseSums := make([]int, len(months)+1)
+
+	for _, accountType := range []int{acTypeIncome, acTypeExpense} {
+		sums := incomeSums
+		if accountType == acTypeIncome {
+			println()
+			println("収入:")
+		} else {
+			sums = expenseSums
+			println()
+			println("費用:")
+		}
+
+		for _, d := range items {
+			if d.accountType != accountType {
+				continue
+			}
+
+			values := make([]int, len(months)+1)
+			for i := range months {
+				values[i] = groupedByMonth[i][d.id]
+				sums[i] += values[i]
+			}
+			values[len(months)] = d.balance
+			sums[len(months)] += d.balance
+
+			println(plRow(d.name, 0, values))
+
+			if hasSubItems(p2d, d.id) {
+				printSubRows(d.id, 1)
+			}
+		}
+	}
+
+	profits := make([]int, len(months)+1)
+	for i := range profits {
+		profits[i] = incomeSums[i] + expenseSums[i]
+	}
+
+	println()
+	println(plRow("総収入:", 0, incomeSums))
+	println(plRow("総費用:", 0, expenseSums))
+	println(plRow("損益  :", 0, profits))
+
 	return nil
 }
 
-func printSubItems(items []summary) {
-	for _, d := range items {
-		printf("        %v\n", &d)
+// 月ごとのP/Lの1行。名前の幅は indent を含めて18
+func plRow(name string, indent int, values []int) string {
+	src := new(bytes.Buffer)
+
+	nw := 18 - indent - getTextWidth(name)
+	if nw < 0 {
+		nw = 0
+	}
+	src.WriteString(fmt.Sprintf("%*s%s%*s", indent, "", name, nw, ""))
+
+	for _, v := range values {
+		src.WriteString(fmt.Sprintf(" %11s", int2str(v)))
+	}
+
+	return src.String()
+}
+
+// 親の勘定科目 id の子を、深さ depth に合わせて字下げして表示する
+func printSubItems(p2d map[int][]summary, id int, depth int) {
+	for _, d := range p2d[id] {
+		printf("%*s%v\n", 8*depth, "", &d)
+
+		if d.id != id && hasSubItems(p2d, d.id) {
+			printSubItems(p2d, d.id, depth+1)
+		}
 	}
 }
 
 func updateTransactionsSummary(db *sql.DB) error {
-	_, err := db.Exec("SELECT add_current_transactions_summary()")
+	st, err := getStorage()
+	if err != nil {
+		return err
+	}
 
-	return err
+	return st.addCurrentSummary(db)
 }
 
 const sqlGetBalances = `
@@ -215,19 +613,24 @@ func dbGetBalances(db *sql.DB, month int) ([]summary, error) {
 	return balances, nil
 }
 
-const sqlGetGroupedPLAccrual = `
-SELECT account_id, account_type, name, is_extraordinary, accrual_balance
-FROM grouped_pl_view
-WHERE month = $1
-`
+const sqlGetGroupedPLSelect = `
+SELECT pl.account_id, pl.account_type, pl.name, pl.is_extraordinary, `
 
-const sqlGetGroupedPLCash = `
-SELECT account_id, account_type, name, is_extraordinary, cash_balance
-FROM grouped_pl_view
-WHERE month = $1
+const sqlGetGroupedPLFrom = `
+FROM grouped_pl_view AS pl
+JOIN accounts AS ac ON pl.account_id = ac.account_id
+WHERE pl.month BETWEEN $1 AND $2
+GROUP BY pl.account_id, pl.account_type, pl.name, pl.is_extraordinary, ac.order_no
+HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0
+ORDER BY pl.account_type, ac.order_no, pl.account_id
 `
 
-func dbGetGroupedPL(db *sql.DB, isCash bool, month int) ([]summary, error) {
+const sqlGetGroupedPLAccrual = sqlGetGroupedPLSelect + "SUM(pl.accrual_balance)" + sqlGetGroupedPLFrom
+
+const sqlGetGroupedPLCash = sqlGetGroupedPLSelect + "SUM(pl.cash_balance)" + sqlGetGroupedPLFrom
+
+// from から to までの月を合計した、親の勘定科目ごとのP/L
+func dbGetGroupedPL(db *sql.DB, isCash bool, from int, to int) ([]summary, error) {
 	var sqlStr string
 	if isCash {
 		sqlStr = sqlGetGroupedPLCash
@@ -235,11 +638,15 @@ func dbGetGroupedPL(db *sql.DB, isCash bool, month int) ([]summary, error) {
 		sqlStr = sqlGetGroupedPLAccrual
 	}
 
-	rows, err := db.Query(sqlStr, month)
+	rows, err := db.Query(sqlStr, from, to)
 	if err != nil {
 		return nil, err
 	}
 
+	return rows2groupedPL(rows)
+}
+
+func rows2groupedPL(rows *sql.Rows) ([]summary, error) {
 	var balances []summary
 
 	for rows.Next() {
@@ -256,19 +663,28 @@ func dbGetGroupedPL(db *sql.DB, isCash bool, month int) ([]summary, error) {
 	return balances, nil
 }
 
-const sqlGetPLAccrual = `
-SELECT account_id, account_type, name, parent, is_extraordinary, accrual_balance
-FROM pl_view
-WHERE month = $1
-`
+const sqlGetPLSelect = `
+SELECT pl.account_id, pl.account_type, pl.name, pl.parent, pl.is_extraordinary, `
 
-const sqlGetPLCash = `
-SELECT account_id, account_type, name, parent, is_extraordinary, cash_balance
-FROM pl_view
-WHERE month = $1
+const sqlGetPLFrom = `
+FROM pl_view AS pl
+JOIN accounts AS ac ON pl.account_id = ac.account_id
+WHERE pl.month BETWEEN $1 AND $2
+GROUP BY pl.account_id, pl.account_type, pl.name, pl.parent, pl.is_extraordinary, ac.order_no
+HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0
+ORDER BY pl.account_type, ac.order_no, pl.account_id, pl.is_extraordinary
 `
 
-func dbGetPL(db *sql.DB, isCash bool, month int) (map[int][]summary, error) {
+const sqlGetPLAccrual = sqlGetPLSelect + "SUM(pl.accrual_balance)" + sqlGetPLFrom
+
+const sqlGetPLCash = sqlGetPLSelect + "SUM(pl.cash_balance)" + sqlGetPLFrom
+
+/*
+from から to までの月を合計した、親の勘定科目IDごとの子の勘定科目のP/L
+
+子の金額は子孫を含めた合計。親自身の金額も親のIDで入る。
+*/
+func dbGetPL(db *sql.DB, isCash bool, from int, to int) (map[int][]summary, error) {
 	var sqlStr string
 	if isCash {
 		sqlStr = sqlGetPLCash
@@ -276,24 +692,85 @@ func dbGetPL(db *sql.DB, isCash bool, month int) (map[int][]summary, error) {
 		sqlStr = sqlGetPLAccrual
 	}
 
-	rows, err := db.Query(sqlStr, month)
+	rows, err := db.Query(sqlStr, from, to)
 	if err != nil {
 		return nil, err
 	}
 
-	p2d := map[int][]summary{}
+	return rows2pl(db, rows)
+}
+
+func rows2pl(db *sql.DB, rows *sql.Rows) (map[int][]summary, error) {
+	var items []summary
 
 	for rows.Next() {
 		var d summary
 		var p int
 
 		if err := rows.Scan(&d.id, &d.accountType, &d.name, &p, &d.isExtraordinary, &d.balance); err != nil {
+			rows.Close()
 			return nil, err
 		}
 
-		p2d[p] = append(p2d[p], d)
+		items = append(items, d)
 	}
 	rows.Close()
 
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	_, p2d := rollUpSummaries(accounts, items)
+
 	return p2d, nil
 }
+
+/*
+勘定科目ごとの金額を、勘定科目の階層で集計する
+
+最上位の勘定科目ごとの合計と、親の勘定科目IDから子の合計へのマップを返す。
+マップには親自身の金額も親のIDで、子より先に入る。
+*/
+func rollUpSummaries(accounts []account, items []summary) ([]summary, map[int][]summary) {
+	id2parent := accountParents(accounts)
+
+	own := make(map[int]summary)
+	totals := make(map[int]int)
+	exists := make(map[int]bool)
+
+	for _, d := range items {
+		own[d.id] = d
+		totals[d.id] += d.balance
+		exists[d.id] = true
+
+		for _, p := range accountAncestors(id2parent, d.id) {
+			totals[p] += d.balance
+			exists[p] = true
+		}
+	}
+
+	var roots []summary
+	p2d := make(map[int][]summary)
+
+	for _, ac := range accounts {
+		if !exists[ac.id] {
+			continue
+		}
+
+		d := summary{id: ac.id, accountType: ac.accountType, name: ac.name, isExtraordinary: ac.isExtraordinary,
+			balance: totals[ac.id]}
+
+		if p, ok := id2parent[ac.id]; ok {
+			p2d[p] = append(p2d[p], d)
+		} else {
+			roots = append(roots, d)
+		}
+
+		if o, ok := own[ac.id]; ok {
+			p2d[ac.id] = append(p2d[ac.id], o)
+		}
+	}
+
+	return roots, p2d
+}
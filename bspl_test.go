@@ -7,14 +7,11 @@ import (
 	_ "github.com/lib/pq"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestRunBS(t *testing.T) {
-	buf := new(bytes.Buffer)
-	stdout = buf
-	stderr = new(bytes.Buffer)
-
 	db, err := setupAcAndTr()
 	if db != nil {
 		defer db.Close()
@@ -23,6 +20,10 @@ func TestRunBS(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	buf := new(bytes.Buffer)
+	stdout = buf
+	stderr = new(bytes.Buffer)
+
 	err = runBS(db, "2020-01")
 	if err != nil {
 		t.Fatal(err)
@@ -78,3 +79,209 @@ func subTestRunPL(db *sql.DB, t *testing.T, isCash bool, month string) {
 		t.Fatalf("string(bytes) != buf.String()\n%s\n%s", string(b), buf.String())
 	}
 }
+
+func TestGetPLRange(t *testing.T) {
+	from, to, err := getPLRange("", "2019-04", "2020-03", 0)
+	if err != nil || from != 201904 || to != 202003 {
+		t.Errorf("from, to, got = %d, %d, %v", from, to, err)
+	}
+
+	from, to, err = getPLRange("2019-12", "", "", 0)
+	if err != nil || from != 201912 || to != 201912 {
+		t.Errorf("month, got = %d, %d, %v", from, to, err)
+	}
+
+	from, to, err = getPLRange("", "", "2020-02", 3)
+	if err != nil || from != 201912 || to != 202002 {
+		t.Errorf("last, got = %d, %d, %v", from, to, err)
+	}
+
+	if _, _, err := getPLRange("", "2020-04", "2020-03", 0); err == nil {
+		t.Error("開始月が終了月より後ろなのでエラーになるはず")
+	}
+}
+
+func TestPlRow(t *testing.T) {
+	if s := plRow("食費", 2, []int{-6000, -26000}); s != "  食費                  -6,000     -26,000" {
+		t.Errorf("got = '%s'", s)
+	}
+}
+
+func TestRunPLRange(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	stdout = buf
+	stderr = new(bytes.Buffer)
+
+	if err := runPLRange(db, false, 201911, 201912); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"2019-11 - 2019-12\n", "家賃                 -80,000\n", "自動車               -20,167\n",
+		"総費用:             -169,467\n", "損益  :              -49,467\n"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("'%s' がない\n%s", s, buf.String())
+		}
+	}
+
+	buf.Reset()
+
+	if err := runPLMonthly(db, false, 201911, 201912); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"家賃                   -40,000     -40,000     -80,000\n",
+		"  ガソリン代            -3,000      -3,000      -6,000\n",
+		"損益  :                  8,700     -58,167     -49,467\n"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("'%s' がない\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestNestedPL(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 車両費 > 自動車 > ガソリン代 の3階層にする
+	if err := runAddAccount(db, []string{"費用", "車両費"}); err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	car := findAccount(accounts, "自動車")
+	vehicle := findAccount(accounts, "車両費")
+	car.parent.id = vehicle.id
+
+	if err := dbEditAccount(db, car); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	stdout = buf
+	stderr = new(bytes.Buffer)
+
+	if err := runPL(db, false, "2019-12"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "車両費               -12,167\n" +
+		"        自動車               -12,167\n" +
+		"                自動車                -4,167\n" +
+		"                ガソリン代            -3,000\n" +
+		"                駐車料                -5,000\n"
+
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("階層が違う\n%s", buf.String())
+	}
+
+	if !strings.Contains(buf.String(), "総費用:              -58,167\n") {
+		t.Errorf("合計が違う\n%s", buf.String())
+	}
+
+	// レコードは金額のある勘定科目ごとで、親は直接の親
+	table := newPLRecordTable()
+	if err := addPLRecords(db, table, false, 201912, 201912); err != nil {
+		t.Fatal(err)
+	}
+
+	name2parent := make(map[string]string)
+	for _, row := range table.rows {
+		name2parent[row[4].(string)] = row[6].(string)
+	}
+
+	if name2parent["自動車"] != "車両費" || name2parent["ガソリン代"] != "自動車" || name2parent["家賃"] != "家賃" {
+		t.Errorf("親が違う: %v", name2parent)
+	}
+
+	buf.Reset()
+
+	if err := runPLMonthly(db, false, 201911, 201912); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"車両費                  -8,000     -12,167     -20,167\n",
+		"  自動車                -8,000     -12,167     -20,167\n",
+		"    自動車                   0      -4,167      -4,167\n",
+		"    ガソリン代          -3,000      -3,000      -6,000\n"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("'%s' がない\n%s", s, buf.String())
+		}
+	}
+
+	// 最上位の勘定科目ごとの集計にも孫が含まれる
+	items, err := dbGetGroupedPL(db, false, 201912, 201912)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range items {
+		if d.name == "自動車" {
+			t.Error("自動車は最上位ではない")
+		}
+
+		if d.name == "車両費" && d.balance != -12167 {
+			t.Error("車両費の合計が違う:", d.balance)
+		}
+	}
+}
+
+func TestNestedBS(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{{"資産", "預金"}, {"資産", "普通預金", "", "預金"}} {
+		if err := runAddAccount(db, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bank := findAccount(accounts, "A銀行")
+	bank.parent.id = findAccount(accounts, "普通預金").id
+
+	if err := dbEditAccount(db, bank); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	stdout = buf
+	stderr = new(bytes.Buffer)
+
+	if err := runBS(db, "2020-01"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "預金                 157,700\n" +
+		"        普通預金             157,700\n" +
+		"                A銀行                157,700\n"
+
+	if !strings.Contains(buf.String(), want) || !strings.Contains(buf.String(), "総資産:              179,700\n") {
+		t.Errorf("階層が違う\n%s", buf.String())
+	}
+}
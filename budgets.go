@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/urfave/cli/v2"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+勘定科目の月ごとの予算
+
+金額は収入・費用ともに正の値
+account.parent には親の勘定科目が入る。親がない場合は自分自身
+*/
+type budget struct {
+	account account
+	month   int
+	amount  int
+}
+
+func (d *budget) String() string {
+	return fmt.Sprintf("%s %s %s", month2str(d.month), d.account.name, int2str(d.amount))
+}
+
+/*
+予算と実績を比較する P/L の1行
+
+actual は収入・費用ともに正の値
+*/
+type budgetLine struct {
+	id          int
+	accountType int
+	name        string
+	hasBudget   bool
+	budget      int
+	actual      int
+	subItems    []budgetLine
+}
+
+// 差異。予算より良ければ正の値
+func (d *budgetLine) variance() int {
+	if d.accountType == acTypeIncome {
+		return d.actual - d.budget
+	}
+
+	return d.budget - d.actual
+}
+
+func (d *budgetLine) String() string {
+	src := new(bytes.Buffer)
+
+	nameWidth := getTextWidth(d.name)
+	nw := 16 - nameWidth
+	if nw < 0 {
+		nw = 0
+	}
+	src.WriteString(fmt.Sprintf("%s%*s", d.name, nw, ""))
+
+	if d.hasBudget {
+		src.WriteString(fmt.Sprintf(" %11s %11s %11s", int2str(d.budget), int2str(d.actual), int2str(d.variance())))
+	} else {
+		src.WriteString(fmt.Sprintf(" %11s %11s %11s", "-", int2str(d.actual), "-"))
+	}
+
+	return src.String()
+}
+
+func cmdListBudgets(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runListBudgets(db, context.Args().First())
+}
+
+func runListBudgets(db *sql.DB, monthStr string) error {
+	if monthStr == "" {
+		monthStr = "-0" // 今月
+	}
+
+	month, err := str2month(monthStr)
+	if err != nil {
+		return err
+	}
+
+	budgets, err := dbGetBudgets(db, month)
+	if err != nil {
+		return err
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	id2parent := accountParents(accounts)
+
+	println(month2str(month))
+	println()
+
+	for _, d := range budgets {
+		depth := len(accountAncestors(id2parent, d.account.id))
+		name := strings.Repeat("    ", depth) + d.account.name
+
+		nameWidth := getTextWidth(name)
+		nw := 16 - nameWidth
+		if nw < 0 {
+			nw = 0
+		}
+
+		printf("%s%*s %11s\n", name, nw, "", int2str(d.amount))
+	}
+
+	return nil
+}
+
+func cmdSetBudget(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runSetBudget(db, context.Args().Slice())
+}
+
+/*
+予算を設定する
+
+引数: 勘定科目 金額 [開始月 [終了月]]
+月を省略すると今月、終了月を省略すると開始月だけに設定する。
+金額が0なら予算を削除する。
+*/
+func runSetBudget(db *sql.DB, args []string) error {
+	if len(args) < 2 || len(args) > 4 {
+		return errors.New("Usage: mita budget set account amount [startMonth [endMonth]]")
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	ac, err := findBudgetAccount(accounts, args[0])
+	if err != nil {
+		return err
+	}
+
+	amount, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("金額:%s", err)
+	}
+
+	if amount < 0 {
+		return errors.New("予算は正の値で入力する")
+	}
+
+	startStr := "-0"
+	if len(args) >= 3 {
+		startStr = args[2]
+	}
+
+	start, err := str2month(startStr)
+	if err != nil {
+		return fmt.Errorf("開始月:%s", err)
+	}
+
+	end := start
+	if len(args) == 4 {
+		end, err = str2month(args[3])
+		if err != nil {
+			return fmt.Errorf("終了月:%s", err)
+		}
+	}
+
+	if start > end {
+		return errors.New("開始月が終了月より後")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for month := start; month <= end; month = nextMonth(month) {
+		d := budget{account: *ac, month: month, amount: amount}
+
+		if err := dbSetBudget(tx, &d); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// 予算を設定できる(収入か費用の)勘定科目を名前で探す
+func findBudgetAccount(accounts []account, name string) (*account, error) {
+	for _, ac := range accounts {
+		if ac.name != name {
+			continue
+		}
+
+		if ac.accountType != acTypeIncome && ac.accountType != acTypeExpense {
+			return nil, fmt.Errorf("予算を設定できるのは収入と費用だけ'%s'", name)
+		}
+
+		return &ac, nil
+	}
+
+	return nil, fmt.Errorf("存在しない勘定科目'%s'", name)
+}
+
+func nextMonth(ym int) int {
+	if ym%100 == 12 {
+		return (ym/100+1)*100 + 1
+	}
+
+	return ym + 1
+}
+
+func cmdImportBudgets(context *cli.Context) error {
+	return importItems(context.Args().First(), readBudgets)
+}
+
+func readBudgets(db *sql.DB, f io.Reader) error {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(f)
+
+	lineNo := 0
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for scanner.Scan() {
+		lineNo++
+
+		line := skipSpace(scanner.Text())
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		arr := strings.Split(line, "\t")
+
+		d, err := arr2budget(accounts, arr)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%d:%s", lineNo, err)
+		}
+
+		if err := dbSetBudget(tx, d); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// 月 勘定科目 金額
+func arr2budget(accounts []account, arr []string) (*budget, error) {
+	if len(arr) != 3 {
+		return nil, errors.New("項目数が3でない")
+	}
+
+	var d budget
+
+	month, err := str2month(arr[0])
+	if err != nil || month == 0 {
+		return nil, fmt.Errorf("月:不正な月'%s'", arr[0])
+	}
+	d.month = month
+
+	ac, err := findBudgetAccount(accounts, arr[1])
+	if err != nil {
+		return nil, err
+	}
+	d.account = *ac
+
+	d.amount, err = strconv.Atoi(arr[2])
+	if err != nil {
+		return nil, fmt.Errorf("金額:%s", err)
+	}
+
+	if d.amount < 0 {
+		return nil, errors.New("予算は正の値で入力する")
+	}
+
+	return &d, nil
+}
+
+func cmdExportBudgets(context *cli.Context) error {
+	return exportItems(context.Args().First(), writeBudgets)
+}
+
+func writeBudgets(db *sql.DB, f io.Writer) error {
+	b := bufio.NewWriter(f)
+
+	budgets, err := dbGetAllBudgets(db)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range budgets {
+		_, err := b.WriteString(fmt.Sprintf("%s\t%s\t%d\n",
+			month2str(d.month), d.account.name, d.amount))
+		if err != nil {
+			return err
+		}
+	}
+
+	b.Flush()
+
+	return nil
+}
+
+func runPLBudget(db *sql.DB, isCash bool, monthStr string) error {
+	if monthStr == "" {
+		monthStr = "-0" // 今月
+	}
+
+	month, err := str2month(monthStr)
+	if err != nil {
+		return err
+	}
+
+	lines, err := getBudgetLines(db, isCash, month)
+	if err != nil {
+		return err
+	}
+
+	println(month2str(month))
+	println()
+
+	// 全角文字は幅が2なので、書式指定ではなく空白で揃える
+	header := strings.Repeat(" ", 16) + "        予算        実績        差異"
+
+	var sums [2]budgetLine
+	sums[0] = budgetLine{accountType: acTypeIncome, name: "総収入:", hasBudget: true}
+	sums[1] = budgetLine{accountType: acTypeExpense, name: "総費用:", hasBudget: true}
+
+	for i, accountType := range []int{acTypeIncome, acTypeExpense} {
+		if i == 0 {
+			println("収入:")
+		} else {
+			println()
+			println("費用:")
+		}
+
+		println(header)
+
+		for _, d := range lines {
+			if d.accountType != accountType {
+				continue
+			}
+
+			println(&d)
+
+			if len(d.subItems) > 1 || (len(d.subItems) == 1 && d.subItems[0].id != d.id) {
+				for _, sub := range d.subItems {
+					printf("        %v\n", &sub)
+				}
+			}
+
+			sums[i].budget += d.budget
+			sums[i].actual += d.actual
+		}
+	}
+
+	println()
+	println(&sums[0])
+	println(&sums[1])
+	printf("損益  : %20s %11s %11s\n", int2str(sums[0].budget-sums[1].budget),
+		int2str(sums[0].actual-sums[1].actual), int2str(sums[0].variance()+sums[1].variance()))
+
+	return nil
+}
+
+// 月の予算と実績を比較する行の一覧を取得
+func getBudgetLines(db *sql.DB, isCash bool, month int) ([]budgetLine, error) {
+	err := updateTransactionsSummary(db)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := dbGetGroupedPL(db, isCash, month, month)
+	if err != nil {
+		return nil, err
+	}
+
+	p2d, err := dbGetPL(db, isCash, month, month)
+	if err != nil {
+		return nil, err
+	}
+
+	budgets, err := dbGetBudgets(db, month)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return makeBudgetLines(accounts, items, p2d, budgets), nil
+}
+
+/*
+P/L と予算から予算と実績を比較する行を作成する
+
+items は親ごとにまとめた P/L、p2d は親の id から子の P/L へのマップ
+行は最上位の勘定科目とその子の2階層で、孫より深い勘定科目の予算は子の行にまとめる。
+親に予算がなければ、子孫の予算の合計を親の予算とする。
+実績がなくても予算があれば行を作る。
+*/
+func makeBudgetLines(accounts []account, items []summary, p2d map[int][]summary, budgets []budget) []budgetLine {
+	var lines []budgetLine
+	id2idx := make(map[int]int)
+
+	id2parent := accountParents(accounts)
+
+	id2ac := make(map[int]account)
+	for _, ac := range accounts {
+		id2ac[ac.id] = ac
+	}
+
+	hasBudget := make(map[int]bool)
+	for _, b := range budgets {
+		hasBudget[b.account.id] = true
+	}
+
+	for _, d := range items {
+		line := budgetLine{id: d.id, accountType: d.accountType, name: d.name,
+			actual: plActual(d.accountType, d.balance)}
+
+		for _, sub := range p2d[d.id] {
+			line.subItems = append(line.subItems, budgetLine{id: sub.id, accountType: sub.accountType,
+				name: sub.name, actual: plActual(sub.accountType, sub.balance)})
+		}
+
+		id2idx[d.id] = len(lines)
+		lines = append(lines, line)
+	}
+
+	for _, b := range budgets {
+		// 自分から最上位までの勘定科目
+		path := append([]int{b.account.id}, accountAncestors(id2parent, b.account.id)...)
+
+		parentID := path[len(path)-1]
+		subID := parentID
+		if len(path) >= 2 {
+			subID = path[len(path)-2]
+		}
+
+		// 子の行までの間の祖先に予算があれば、その予算に含まれる
+		if len(path) >= 3 && hasAnyBudget(hasBudget, path[1:len(path)-1]) {
+			continue
+		}
+
+		idx, ok := id2idx[parentID]
+		if !ok {
+			idx = len(lines)
+			id2idx[parentID] = idx
+			lines = append(lines, budgetLine{id: parentID, accountType: b.account.accountType,
+				name: id2ac[parentID].name})
+		}
+
+		line := &lines[idx]
+
+		subIdx := -1
+		for i, sub := range line.subItems {
+			if sub.id == subID {
+				subIdx = i
+			}
+		}
+
+		if subIdx == -1 {
+			subIdx = len(line.subItems)
+			line.subItems = append(line.subItems, budgetLine{id: subID,
+				accountType: b.account.accountType, name: id2ac[subID].name})
+		}
+
+		line.subItems[subIdx].hasBudget = true
+		line.subItems[subIdx].budget += b.amount
+
+		if b.account.id == parentID {
+			line.hasBudget = true
+			line.budget = b.amount
+		}
+	}
+
+	for i := range lines {
+		line := &lines[i]
+
+		if line.hasBudget {
+			continue
+		}
+
+		for _, sub := range line.subItems {
+			if sub.hasBudget {
+				line.hasBudget = true
+				line.budget += sub.budget
+			}
+		}
+	}
+
+	return lines
+}
+
+func hasAnyBudget(hasBudget map[int]bool, ids []int) bool {
+	for _, id := range ids {
+		if hasBudget[id] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// P/L の残高を実績(正の値)に変換
+func plActual(accountType int, balance int) int {
+	if accountType == acTypeExpense {
+		return -balance
+	}
+
+	return balance
+}
+
+const sqlGetBudgets = `
+SELECT month, account_id, account_type, name, parent_id, parent_name, amount
+FROM budgets_view
+WHERE month = $1
+`
+
+func dbGetBudgets(db *sql.DB, month int) ([]budget, error) {
+	rows, err := db.Query(sqlGetBudgets, month)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows2budgets(rows)
+}
+
+const sqlGetAllBudgets = `
+SELECT month, account_id, account_type, name, parent_id, parent_name, amount
+FROM budgets_view
+`
+
+func dbGetAllBudgets(db *sql.DB) ([]budget, error) {
+	rows, err := db.Query(sqlGetAllBudgets)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows2budgets(rows)
+}
+
+func rows2budgets(rows *sql.Rows) ([]budget, error) {
+	var budgets []budget
+
+	for rows.Next() {
+		var d budget
+
+		if err := rows.Scan(&d.month, &d.account.id, &d.account.accountType, &d.account.name,
+			&d.account.parent.id, &d.account.parent.name, &d.amount); err != nil {
+			return nil, err
+		}
+
+		budgets = append(budgets, d)
+	}
+	rows.Close()
+
+	return budgets, nil
+}
+
+const sqlSetBudget = `
+INSERT INTO budgets(account_id, month, amount)
+VALUES($1, $2, $3)
+ON CONFLICT (account_id, month) DO UPDATE SET amount = EXCLUDED.amount
+`
+
+const sqlRemoveBudget = `
+DELETE FROM budgets
+WHERE account_id = $1 AND month = $2
+`
+
+// 予算を設定する。金額が0なら削除する
+func dbSetBudget(db dbtx, d *budget) error {
+	var err error
+
+	if d.amount == 0 {
+		_, err = db.Exec(sqlRemoveBudget, d.account.id, d.month)
+	} else {
+		_, err = db.Exec(sqlSetBudget, d.account.id, d.month, d.amount)
+	}
+
+	return err
+}
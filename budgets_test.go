@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	_ "github.com/lib/pq"
+	"testing"
+)
+
+func TestNextMonth(t *testing.T) {
+	if m := nextMonth(201911); m != 201912 {
+		t.Errorf("nextMonth(201911), got = %d", m)
+	}
+
+	if m := nextMonth(201912); m != 202001 {
+		t.Errorf("nextMonth(201912), got = %d", m)
+	}
+}
+
+func TestMakeBudgetLines(t *testing.T) {
+	items := []summary{
+		{id: 1, accountType: acTypeExpense, name: "食費", balance: -6000},
+		{id: 2, accountType: acTypeExpense, name: "自動車", balance: -8000},
+	}
+
+	p2d := map[int][]summary{
+		1: {{id: 1, accountType: acTypeExpense, name: "食費", balance: -6000}},
+		2: {{id: 3, accountType: acTypeExpense, name: "ガソリン代", balance: -3000},
+			{id: 4, accountType: acTypeExpense, name: "駐車料", balance: -5000}},
+	}
+
+	var food, gas, parking, salary budget
+	food.account = account{id: 1, accountType: acTypeExpense, name: "食費"}
+	food.account.parent.id, food.account.parent.name = 1, "食費"
+	food.amount = 40000
+	gas.account = account{id: 3, accountType: acTypeExpense, name: "ガソリン代"}
+	gas.account.parent.id, gas.account.parent.name = 2, "自動車"
+	gas.amount = 4000
+	parking.account = account{id: 4, accountType: acTypeExpense, name: "駐車料"}
+	parking.account.parent.id, parking.account.parent.name = 2, "自動車"
+	parking.amount = 5000
+	salary.account = account{id: 5, accountType: acTypeIncome, name: "給与"}
+	salary.account.parent.id, salary.account.parent.name = 5, "給与"
+	salary.amount = 200000
+
+	car := account{id: 2, accountType: acTypeExpense, name: "自動車"}
+	car.parent.id, car.parent.name = 2, "自動車"
+
+	// 駐車料の下の孫の予算は、駐車料に予算があるので数えない
+	var garage budget
+	garage.account = account{id: 6, accountType: acTypeExpense, name: "車庫"}
+	garage.account.parent.id, garage.account.parent.name = 4, "駐車料"
+	garage.amount = 1000
+
+	accounts := []account{food.account, car, gas.account, parking.account, garage.account, salary.account}
+
+	lines := makeBudgetLines(accounts, items, p2d, []budget{food, gas, parking, garage, salary})
+
+	if len(lines) != 3 {
+		t.Fatal("len(lines) != 3:", len(lines))
+	}
+
+	if d := lines[0]; !d.hasBudget || d.budget != 40000 || d.actual != 6000 || d.variance() != 34000 {
+		t.Errorf("食費, got = %v", &d)
+	}
+
+	// 親に予算がなければ子の予算の合計
+	if d := lines[1]; !d.hasBudget || d.budget != 9000 || d.actual != 8000 || d.variance() != 1000 {
+		t.Errorf("自動車, got = %v", &d)
+	}
+
+	if d := lines[1].subItems[0]; d.budget != 4000 || d.actual != 3000 {
+		t.Errorf("ガソリン代, got = %v", &d)
+	}
+
+	// 実績がなくても予算があれば行を作る
+	if d := lines[2]; d.name != "給与" || d.budget != 200000 || d.actual != 0 || d.variance() != -200000 {
+		t.Errorf("給与, got = %v", &d)
+	}
+}
+
+func TestBudgetCommands(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runSetBudget(db, []string{"食費", "40000", "2019-11", "2020-01"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runSetBudget(db, []string{"家賃", "40000", "2019-12"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runSetBudget(db, []string{"現金", "40000", "2019-12"}); err == nil {
+		t.Fatal("資産には予算を設定できないのでエラーになるはず")
+	}
+
+	budgets, err := dbGetAllBudgets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(budgets) != 4 {
+		t.Fatal("len(budgets) != 4:", len(budgets))
+	}
+
+	lines, err := getBudgetLines(db, false, 201912)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range lines {
+		switch d.name {
+		case "家賃":
+			if d.budget != 40000 || d.actual != 40000 {
+				t.Errorf("家賃, got = %v", &d)
+			}
+		case "食費":
+			if d.budget != 40000 || d.actual != 6000 {
+				t.Errorf("食費, got = %v", &d)
+			}
+		case "自動車":
+			if d.hasBudget {
+				t.Errorf("自動車, got = %v", &d)
+			}
+		}
+	}
+
+	// 金額が0なら削除
+	if err := runSetBudget(db, []string{"食費", "0", "2019-11", "2020-01"}); err != nil {
+		t.Fatal(err)
+	}
+
+	budgets, err = dbGetAllBudgets(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(budgets) != 1 {
+		t.Fatal("len(budgets) != 1:", len(budgets))
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"strings"
+)
+
+/*
+取引の一括変更
+
+選んだ取引に同じ変更を加え、1つのトランザクションで保存する。
+1回の変更は1つの操作になるので、undo でまとめて元に戻せる。
+*/
+type bulkEdit struct {
+	replaces  []accountReplace
+	shiftDays int
+	note      *string
+}
+
+// 勘定科目の置き換え。isDebit と isCredit の両方が true なら借方・貸方の両方
+type accountReplace struct {
+	from     account
+	to       account
+	isDebit  bool
+	isCredit bool
+}
+
+// "置き換え元=置き換え先" を解析する
+func str2accountReplace(accounts []account, s string, isDebit bool, isCredit bool) (accountReplace, error) {
+	r := accountReplace{isDebit: isDebit, isCredit: isCredit}
+
+	arr := strings.Split(s, "=")
+	if len(arr) != 2 {
+		return r, fmt.Errorf("'置き換え元=置き換え先' の形式でない '%s'", s)
+	}
+
+	from := findAccount(accounts, arr[0])
+	if from == nil {
+		return r, fmt.Errorf("存在しない勘定科目 '%s'", arr[0])
+	}
+
+	to := findAccount(accounts, arr[1])
+	if to == nil {
+		return r, fmt.Errorf("存在しない勘定科目 '%s'", arr[1])
+	}
+
+	if from.id == to.id {
+		return r, fmt.Errorf("置き換え元と置き換え先が同じ '%s'", s)
+	}
+
+	if from.currency != to.currency {
+		return r, fmt.Errorf("通貨が違う勘定科目には置き換えられない '%s'", s)
+	}
+
+	r.from, r.to = *from, *to
+
+	return r, nil
+}
+
+// 変更を加えた取引を返す。変更がなければ false
+func (e *bulkEdit) apply(d *transaction) (transaction, bool) {
+	tr := *d
+	tr.items = append([]transactionItem(nil), d.items...)
+
+	// 明細ごとに最初に一致した置き換えだけを行う。A=B と B=C で A が C になったり、入れ替えができなかったりしないように
+	for i := range tr.items {
+		item := &tr.items[i]
+
+		for _, r := range e.replaces {
+			if item.account.id != r.from.id {
+				continue
+			}
+
+			if (item.debit != 0 && r.isDebit) || (item.credit != 0 && r.isCredit) {
+				item.account = r.to
+				break
+			}
+		}
+	}
+
+	tr.date = tr.date.AddDate(0, 0, e.shiftDays)
+
+	if e.note != nil {
+		tr.note = *e.note
+	}
+
+	changed := e.shiftDays != 0 || tr.note != d.note
+
+	for i := range tr.items {
+		if tr.items[i].account.id != d.items[i].account.id {
+			changed = true
+		}
+	}
+
+	return tr, changed
+}
+
+func cmdBulkEditTransactions(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	e := &bulkEdit{shiftDays: context.Int("shift-days")}
+
+	for _, f := range []struct {
+		name     string
+		isDebit  bool
+		isCredit bool
+	}{
+		{"debit", true, false},
+		{"credit", false, true},
+		{"account", true, true},
+	} {
+		for _, s := range context.StringSlice(f.name) {
+			r, err := str2accountReplace(accounts, s, f.isDebit, f.isCredit)
+			if err != nil {
+				return err
+			}
+
+			e.replaces = append(e.replaces, r)
+		}
+	}
+
+	if context.IsSet("note") {
+		note := context.String("note")
+		e.note = &note
+	}
+
+	if len(e.replaces) == 0 && e.shiftDays == 0 && e.note == nil {
+		return errors.New("変更の指定がない。--debit, --credit, --account, --shift-days, --note のどれかを指定する")
+	}
+
+	transactions, err := selectBulkTransactions(db, context.String("query"), "一括変更する取引")
+	if err != nil || len(transactions) == 0 {
+		return err
+	}
+
+	return runBulkEdit(db, transactions, e, context.Bool("dry-run"))
+}
+
+/*
+取引を選ぶ
+
+検索条件があれば一致する取引全て、なければ fzf で選んだ取引
+*/
+func selectBulkTransactions(db *sql.DB, query string, header string) ([]transaction, error) {
+	if query != "" {
+		terms, err := splitQuery(query)
+		if err != nil {
+			return nil, err
+		}
+
+		return findTransactions(db, terms)
+	}
+
+	transactions, err := getTransactions(db, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(transactions) == 0 {
+		return nil, errors.New("取引が1件も登録されてない")
+	}
+
+	return selectTransactionsMulti(transactions, header)
+}
+
+// 変更前と変更後を表示して、確認してから全ての変更を1つのトランザクションで保存する
+func runBulkEdit(db *sql.DB, transactions []transaction, e *bulkEdit, isDryRun bool) error {
+	var edited []transaction
+
+	for i := range transactions {
+		tr, changed := e.apply(&transactions[i])
+		if !changed {
+			continue
+		}
+
+		if err := tr.validate(); err != nil {
+			return fmt.Errorf("%v: %s", &transactions[i], err)
+		}
+
+		printf("- %s\n", tr2alignedString(&transactions[i]))
+		printf("+ %s\n", tr2alignedString(&tr))
+
+		edited = append(edited, tr)
+	}
+
+	if len(edited) == 0 {
+		println("変更する取引がない")
+		return nil
+	}
+
+	if isDryRun || !confirmYesNo(fmt.Sprintf("%d件の取引を変更する?", len(edited))) {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for i := range edited {
+		if err := dbEditTransaction(tx, &edited[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	printf("%d件の取引を変更した\n", len(edited))
+
+	return nil
+}
+
+func cmdBulkRemoveTransactions(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	transactions, err := selectBulkTransactions(db, context.String("query"), "一括削除する取引")
+	if err != nil || len(transactions) == 0 {
+		return err
+	}
+
+	return runBulkRemove(db, transactions, context.Bool("dry-run"))
+}
+
+// 削除する取引を表示して、確認してから1つのトランザクションで削除する
+func runBulkRemove(db *sql.DB, transactions []transaction, isDryRun bool) error {
+	for _, d := range transactions {
+		printf("- %s\n", tr2alignedString(&d))
+	}
+
+	if isDryRun || !confirmYesNo(fmt.Sprintf("%d件の取引を削除する?", len(transactions))) {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range transactions {
+		if err := dbRemoveTransaction(tx, d.id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	printf("%d件の取引を削除した\n", len(transactions))
+
+	return nil
+}
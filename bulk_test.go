@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestBulkEdit(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := str2accountReplace(accounts, "食費=娯楽", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"食費", "食費=存在しない", "食費=食費"} {
+		if _, err := str2accountReplace(accounts, s, true, false); err == nil {
+			t.Errorf("%s: エラーになるはず", s)
+		}
+	}
+
+	transactions, err := findTransactions(db, []string{"account:食費", "date:2019-11"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != 4 {
+		t.Fatal("len(transactions) != 4:", len(transactions))
+	}
+
+	e := &bulkEdit{replaces: []accountReplace{r}, shiftDays: 1}
+
+	// dry-run では変更しない
+	if err := runBulkEdit(db, transactions, e, true); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := findTransactions(db, []string{"debit:娯楽"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 0 {
+		t.Fatal("dry-run なのに変更された")
+	}
+
+	stdin = bytes.NewBufferString("y\n")
+	scanner = bufio.NewScanner(stdin)
+
+	if err := runBulkEdit(db, transactions, e, false); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err = findTransactions(db, []string{"debit:娯楽", "date:2019-11-08"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 1 || found[0].credit().name != "現金" || found[0].amount() != 6000 {
+		t.Fatal("変更されてない:", found)
+	}
+
+	// 履歴を1件選んで、その取引の変更だけをUNDOできる
+	stdin = bytes.NewBufferString("0 UNDO\ny\n")
+	scanner = bufio.NewScanner(stdin)
+
+	if err := runUndoTransaction(db); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err = findTransactions(db, []string{"debit:娯楽"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 3 {
+		t.Fatal("len(found) != 3:", len(found))
+	}
+}
+
+func TestBulkEditReplaceOnce(t *testing.T) {
+	db, err := setupAccounts()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d transaction
+	d.date = ymd(2019, 12, 10)
+	d.setSimple(*findAccount(accounts, "食費"), *findAccount(accounts, "現金"), 1000)
+
+	tests := []struct {
+		replaces []string
+		debit    string
+		credit   string
+	}{
+		// 置き換えた勘定科目をさらに置き換えない
+		{[]string{"食費=娯楽", "娯楽=家賃"}, "娯楽", "現金"},
+		// 入れ替え
+		{[]string{"食費=現金", "現金=食費"}, "現金", "食費"},
+		// 最初に一致したものだけ
+		{[]string{"食費=娯楽", "食費=家賃"}, "娯楽", "現金"},
+	}
+
+	for _, tt := range tests {
+		e := &bulkEdit{}
+
+		for _, s := range tt.replaces {
+			r, err := str2accountReplace(accounts, s, true, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e.replaces = append(e.replaces, r)
+		}
+
+		tr, changed := e.apply(&d)
+
+		if !changed || tr.debit().name != tt.debit || tr.credit().name != tt.credit {
+			t.Errorf("%v, got = %v", tt.replaces, &tr)
+		}
+	}
+}
+
+func TestBulkRemove(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err := findTransactions(db, []string{"date:2019-12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 確認で n なら削除しない
+	stdin = bytes.NewBufferString("n\ny\n")
+	scanner = bufio.NewScanner(stdin)
+
+	if err := runBulkRemove(db, transactions, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runBulkRemove(db, transactions, false); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := findTransactions(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) != 19 {
+		t.Fatal("len(all) != 19:", len(all))
+	}
+}
@@ -11,9 +11,21 @@ import (
 func cmdData(context *cli.Context) error {
 	files := []string{
 		"schema.sql",
+		"schema_sqlite.sql",
 		"accounts.example.tsv",
 	}
 
+	for _, driver := range []string{"postgres", "sqlite"} {
+		migrations, err := getMigrations(driver)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			files = append(files, m.filename)
+		}
+	}
+
 	filename := context.Args().First()
 
 	if filename == "" {
@@ -32,23 +44,33 @@ func cmdData(context *cli.Context) error {
 		return errors.New("file does not exist:" + filename)
 	}
 
-	statikFS, err := fs.New()
+	contents, err := readDataFile(filename)
 	if err != nil {
 		return err
 	}
 
+	print(contents)
+
+	return nil
+}
+
+// 埋め込んだデータファイルを読む
+func readDataFile(filename string) (string, error) {
+	statikFS, err := fs.New()
+	if err != nil {
+		return "", err
+	}
+
 	r, err := statikFS.Open("/data/" + filename)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer r.Close()
 
 	contents, err := ioutil.ReadAll(r)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	print(string(contents))
-
-	return nil
+	return string(contents), nil
 }
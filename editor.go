@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+エディタで月の取引をまとめて編集する
+
+取引を1行ずつ ID, バージョン, import と同じTSVの列で書き出してエディタで開く。
+行を書き換えると更新、ID とバージョンを空にした行を足すと追加、行を消すと削除になる。
+バージョンは書き出したときのものを使うので、書き換えるとエラーにする。
+保存するときに、書き出した後で他から変更された取引(バージョンが違う)があれば何も保存しない。
+*/
+const editorHeader = `# ID	バージョン	日付	借方	貸方	金額	摘要	開始月	終了月	(空)	タグ
+# 行を書き換えると更新、ID とバージョンを空にした行を足すと追加、行を消すと削除。バージョンは書き換えない
+`
+
+type editorChanges struct {
+	inserts []transaction
+	updates []transaction // version は書き出したときのバージョン
+	deletes []transaction
+}
+
+func (c *editorChanges) isEmpty() bool {
+	return len(c.inserts) == 0 && len(c.updates) == 0 && len(c.deletes) == 0
+}
+
+func transactions2editorText(transactions []transaction) string {
+	src := new(bytes.Buffer)
+
+	src.WriteString(editorHeader)
+
+	for _, d := range transactions {
+		arr := transaction2tsv(&d)
+		if d.start == 0 && len(d.tags) == 0 {
+			arr = arr[:5]
+		}
+
+		src.WriteString(fmt.Sprintf("%d\t%d\t%s\n", d.id, d.version, strings.Join(arr, "\t")))
+	}
+
+	return src.String()
+}
+
+// エディタで編集した文字列と、書き出した取引を比べて変更を求める
+func parseEditorText(accounts []account, text string, original []transaction) (*editorChanges, error) {
+	name2id := make(map[string]int)
+	id2currency := make(map[int]string)
+
+	for _, d := range accounts {
+		name2id[d.name] = d.id
+		id2currency[d.id] = d.currency
+	}
+
+	id2original := make(map[int]*transaction)
+	for i := range original {
+		id2original[original[i].id] = &original[i]
+	}
+
+	var c editorChanges
+	seen := make(map[int]bool)
+
+	for i, line := range strings.Split(text, "\n") {
+		lineNo := i + 1
+
+		if strings.TrimSpace(line) == "" || line[0] == '#' {
+			continue
+		}
+
+		arr := strings.Split(line, "\t")
+
+		if n := len(arr) - 2; n != 4 && n != 5 && n != 7 && n != 9 {
+			return nil, fmt.Errorf("%d:項目数が6, 7, 9, 11でない", lineNo)
+		}
+
+		d, err := arr2transaction(name2id, id2currency, arr[2:])
+		if err != nil {
+			return nil, fmt.Errorf("%d:%s", lineNo, err)
+		}
+
+		idStr, versionStr := strings.TrimSpace(arr[0]), strings.TrimSpace(arr[1])
+
+		if idStr == "" {
+			if versionStr != "" {
+				return nil, fmt.Errorf("%d:ID がないのにバージョンがある", lineNo)
+			}
+
+			c.inserts = append(c.inserts, *d)
+			continue
+		}
+
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("%d:ID:%s", lineNo, err)
+		}
+
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("%d:バージョン:%s", lineNo, err)
+		}
+
+		orig := id2original[id]
+		if orig == nil {
+			return nil, fmt.Errorf("%d:書き出してない取引のID %d", lineNo, id)
+		}
+
+		if seen[id] {
+			return nil, fmt.Errorf("%d:ID %d が重複している", lineNo, id)
+		}
+		seen[id] = true
+
+		if version != orig.version {
+			return nil, fmt.Errorf("%d:取引 %d のバージョンは変更できない", lineNo, id)
+		}
+
+		d.id = id
+		d.version = orig.version
+
+		if strings.Join(transaction2tsv(d), "\t") != strings.Join(transaction2tsv(orig), "\t") {
+			c.updates = append(c.updates, *d)
+		}
+	}
+
+	for _, d := range original {
+		if !seen[d.id] {
+			c.deletes = append(c.deletes, d)
+		}
+	}
+
+	return &c, nil
+}
+
+func runEditTransactionsWithEditor(db *sql.DB, monthStr string) error {
+	if monthStr == "" {
+		monthStr = "-0" // 今月
+	}
+
+	month, err := str2month(monthStr)
+	if err != nil {
+		return err
+	}
+
+	transactions, err := getTransactionsByMonth(db, month/100, month%100)
+	if err != nil {
+		return err
+	}
+
+	text, cancel, err := scanWithEditor(transactions2editorText(transactions))
+	if err != nil {
+		return err
+	}
+
+	if cancel {
+		return nil
+	}
+
+	return applyEditorText(db, text, transactions)
+}
+
+// 変更を表示して、確認してから1つのトランザクションで保存する
+func applyEditorText(db *sql.DB, text string, original []transaction) error {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	c, err := parseEditorText(accounts, text, original)
+	if err != nil {
+		return err
+	}
+
+	if c.isEmpty() {
+		println("変更なし")
+		return nil
+	}
+
+	for _, list := range [][]transaction{c.inserts, c.updates} {
+		for i := range list {
+			if err := fillCurrencyAmounts(db, accounts, &list[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, d := range c.inserts {
+		printf("追加: %v\n", &d)
+	}
+
+	for _, d := range c.updates {
+		printf("更新: %v\n", &d)
+	}
+
+	for _, d := range c.deletes {
+		printf("削除: %v\n", &d)
+	}
+
+	if !confirmYesNo("保存する?") {
+		return nil
+	}
+
+	return dbApplyEditorChanges(db, c)
+}
+
+const sqlLockTransaction = `
+SELECT version
+FROM transactions
+WHERE transaction_id = $1
+FOR UPDATE
+`
+
+// 取引の行をロックして、バージョンが version のままか確認する
+func dbCheckTransactionVersion(tx dbtx, id int, version int) error {
+	var current int
+
+	err := tx.QueryRow(sqlLockTransaction, id).Scan(&current)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("取引 %d は他で削除された", id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if current != version {
+		return fmt.Errorf("取引 %d は他で変更された(バージョン %d -> %d)", id, version, current)
+	}
+
+	return nil
+}
+
+func dbApplyEditorChanges(db *sql.DB, c *editorChanges) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var conflicts []string
+
+	for _, list := range [][]transaction{c.updates, c.deletes} {
+		for _, d := range list {
+			if err := dbCheckTransactionVersion(tx, d.id, d.version); err != nil {
+				conflicts = append(conflicts, err.Error())
+			}
+		}
+	}
+
+	if len(conflicts) != 0 {
+		tx.Rollback()
+		return errors.New("保存しなかった。もう一度編集してください\n" + strings.Join(conflicts, "\n"))
+	}
+
+	for i := range c.updates {
+		if err := dbEditTransaction(tx, &c.updates[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	for _, d := range c.deletes {
+		if err := dbRemoveTransaction(tx, d.id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	for i := range c.inserts {
+		if _, err := dbAddTransaction(tx, &c.inserts[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
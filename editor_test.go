@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEditTransactionsWithEditor(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err := getTransactionsByMonth(db, 2019, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := transactions2editorText(transactions)
+
+	c, err := parseEditorText(accounts, text, transactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.isEmpty() {
+		t.Fatal("変更してないのに変更がある:", c)
+	}
+
+	// 食費の金額を変え、ガソリン代の行を消して、1行追加する
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		switch {
+		case strings.Contains(line, "ガソリン代"):
+			continue
+		case strings.Contains(line, "食費"):
+			line = strings.Replace(line, "6000", "6500", 1)
+		}
+
+		lines = append(lines, line)
+	}
+	lines = append(lines, "\t\t2019-12-31\t娯楽\t現金\t1000\t年末")
+
+	edited := strings.Join(lines, "\n")
+
+	c, err = parseEditorText(accounts, edited, transactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.inserts) != 1 || len(c.updates) != 1 || len(c.deletes) != 1 {
+		t.Fatalf("inserts = %d, updates = %d, deletes = %d", len(c.inserts), len(c.updates), len(c.deletes))
+	}
+
+	stdin = bytes.NewBufferString("y\n")
+	scanner = bufio.NewScanner(stdin)
+
+	if err := applyEditorText(db, edited, transactions); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := findTransactions(db, []string{"date:2019-12", "account:食費"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 1 || found[0].amount() != 6500 {
+		t.Fatal("更新されてない:", found)
+	}
+
+	after, err := getTransactionsByMonth(db, 2019, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(after) != len(transactions) {
+		t.Fatal("len(after) != len(transactions):", len(after))
+	}
+
+	// 書き出した後で他から変更された取引があれば、何も保存しない
+	text = transactions2editorText(after)
+
+	d := after[0]
+	if d.debit().name != "家賃" {
+		t.Fatal("最初の取引が家賃でない:", &d)
+	}
+
+	d.note = "他で変更"
+	if err := dbEditTransactionTx(db, &d); err != nil {
+		t.Fatal(err)
+	}
+
+	edited = strings.Replace(text, "年末", "大晦日", 1)
+	edited = strings.Replace(edited, "\t40000\t", "\t41000\t", 1)
+
+	stdin = bytes.NewBufferString("y\n")
+	scanner = bufio.NewScanner(stdin)
+
+	if err := applyEditorText(db, edited, after); err == nil {
+		t.Fatal("他で変更されたのでエラーになるはず")
+	}
+
+	found, err = findTransactions(db, []string{"note~大晦日"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 0 {
+		t.Fatal("エラーなのに保存された")
+	}
+
+	for _, s := range []string{"1\t1\t2019-12-01\t食費", "999\t1\t2019-12-01\t食費\t現金\t100", "\t1\t2019-12-01\t食費\t現金\t100"} {
+		if _, err := parseEditorText(accounts, s, after); err == nil {
+			t.Errorf("%q: エラーになるはず", s)
+		}
+	}
+
+	// バージョンの列は書き換えられない
+	line := strings.Split(transactions2editorText(after[:1]), "\n")[2]
+	arr := strings.Split(line, "\t")
+
+	for _, version := range []int{after[0].version - 1, after[0].version + 1} {
+		arr[1] = strconv.Itoa(version)
+
+		if _, err := parseEditorText(accounts, strings.Join(arr, "\t"), after); err == nil {
+			t.Errorf("バージョン %d: エラーになるはず", version)
+		}
+	}
+}
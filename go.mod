@@ -6,7 +6,9 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
 	github.com/lib/pq v1.3.0
+	github.com/mattn/go-sqlite3 v1.14.14
 	github.com/rakyll/statik v0.1.6
 	github.com/urfave/cli/v2 v2.1.1
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 	golang.org/x/text v0.3.2
 )
@@ -49,6 +49,10 @@ func runListGroups(db *sql.DB) error {
 		return err
 	}
 
+	if isRecordOutput() {
+		return printRecords(groups2records(g))
+	}
+
 	src := getGroupsReader(g)
 
 	print(src)
@@ -56,6 +60,17 @@ func runListGroups(db *sql.DB) error {
 	return nil
 }
 
+func groups2records(groups []group) *recordTable {
+	t := newRecordTable("group_id", "name", "check_account_id", "check_account", "debit", "credit",
+		"num_transactions")
+
+	for _, d := range groups {
+		t.add(d.id, d.name, d.checkAccount.id, d.checkAccount.name, d.debit, d.credit, len(d.items))
+	}
+
+	return t
+}
+
 func cmdAddGroup(context *cli.Context) error {
 	db, err := connectDB()
 	if err != nil {
@@ -122,13 +137,10 @@ func calcGroupBalance(gr *group) {
 	gr.credit = 0
 
 	for _, tr := range gr.items {
-		if tr.debit.id == gr.checkAccount.id {
-			gr.debit += tr.amount
-		}
+		debit, credit := tr.amountOf(gr.checkAccount.id)
 
-		if tr.credit.id == gr.checkAccount.id {
-			gr.credit += tr.amount
-		}
+		gr.debit += debit
+		gr.credit += credit
 	}
 }
 
@@ -140,16 +152,16 @@ WHERE transaction_id NOT IN (SELECT transaction_id FROM groups_detail)
 `
 
 const sqlGetMultiTransactions2 = `
-ORDER BY date DESC, transaction_id DESC
+ORDER BY date DESC, transaction_id DESC, no
 `
 
 func getMultiTransactions(db *sql.DB, checkAccountId int) ([]transaction, error) {
 	sql := sqlGetMultiTransactions1
 
 	if checkAccountId != 0 {
-		sql += `AND (debit_id = $1 OR credit_id = $1) `
+		sql += `AND transaction_id IN (SELECT transaction_id FROM transactions_detail WHERE account_id = $1) `
 	} else {
-		sql += `AND debit_id <> $1 `
+		sql += `AND $1 = 0 `
 	}
 
 	sql += sqlGetMultiTransactions2
@@ -172,10 +184,19 @@ func selectMultiTransactions(db *sql.DB, checkAccountId int) ([]transaction, err
 		return nil, errors.New("取引が1件も登録されてない")
 	}
 
+	return selectTransactionsMulti(transactions, "")
+}
+
+// fzf の --multi で取引を複数選ぶ
+func selectTransactionsMulti(transactions []transaction, header string) ([]transaction, error) {
 	src := getTransactionsReader(transactions, true)
 	dst := new(bytes.Buffer)
 	args := []string{"--multi"}
 
+	if header != "" {
+		args = append(args, "--header="+header)
+	}
+
 	cancel, err := fzf(src, dst, os.Stderr, args)
 	if cancel {
 		return nil, nil
@@ -186,6 +207,9 @@ func selectMultiTransactions(db *sql.DB, checkAccountId int) ([]transaction, err
 	}
 
 	arr, err := readInts(dst.String())
+	if err != nil {
+		return nil, err
+	}
 
 	var res []transaction
 	for _, i := range arr {
@@ -321,6 +345,9 @@ func selectGroupItems(db *sql.DB, gr *group) ([]transaction, error) {
 	}
 
 	arr, err := readInts(dst.String())
+	if err != nil {
+		return nil, err
+	}
 
 	var res []transaction
 	for _, i := range arr {
@@ -388,10 +415,10 @@ func dbGetGroups(db *sql.DB) ([]group, error) {
 }
 
 const sqlGetGroupBalance = `
-SELECT SUM(CASE WHEN tr.debit_id = $2 THEN tr.amount ELSE 0 END),
-       SUM(CASE WHEN tr.credit_id = $2 THEN tr.amount ELSE 0 END)
+SELECT SUM(CASE WHEN td.account_id = $2 THEN td.debit_amount ELSE 0 END),
+       SUM(CASE WHEN td.account_id = $2 THEN td.credit_amount ELSE 0 END)
 FROM groups_detail AS gd
-LEFT JOIN transactions AS tr ON gd.transaction_id = tr.transaction_id
+LEFT JOIN transactions_detail AS td ON gd.transaction_id = td.transaction_id
 WHERE gd.group_id = $1
 GROUP BY gd.group_id
 `
@@ -404,7 +431,7 @@ const sqlGetGroupItems = `
 SELECT ` + transactionRows + `
 FROM transactions_view
 WHERE transaction_id IN (SELECT transaction_id FROM groups_detail WHERE group_id = $1)
-ORDER BY date, transaction_id
+ORDER BY date, transaction_id, no
 `
 
 func dbGetGroupItems(db *sql.DB, id int) ([]transaction, error) {
@@ -61,26 +61,62 @@ func cmdListHistory(context *cli.Context) error {
 		}
 	}
 
+	if isRecordOutput() {
+		return printRecords(histories2records(history))
+	}
+
 	src := getHistoryReader(history)
 	print(src)
 
 	return nil
 }
 
+// 明細1行につき1レコード
+func histories2records(histories []history) *recordTable {
+	t := newRecordTable(append([]string{"operation", "operate_time"}, transactionColumns...)...)
+
+	for _, d := range histories {
+		operateTime := d.operateTime.Local().Format("2006-01-02 15:04:05")
+
+		for _, values := range transaction2values(&d.tr) {
+			t.add(append([]interface{}{d.operation, operateTime}, values...)...)
+		}
+	}
+
+	return t
+}
+
+/*
+履歴ビューの行を履歴に変換
+履歴ビューは明細1行につき1行なので、同じ履歴の明細が連続するように並べておくこと
+*/
 func rows2histories(rows *sql.Rows) ([]history, error) {
 	var items []history
 
 	for rows.Next() {
 		var d history
+		var no int
+		var item transactionItem
+		var tags string
 
 		if err := rows.Scan(&d.operation, &d.operateTime,
 			&d.tr.id, &d.tr.version, &d.tr.date,
-			&d.tr.debit.id, &d.tr.debit.name, &d.tr.credit.id, &d.tr.credit.name,
-			&d.tr.amount, &d.tr.note, &d.tr.start, &d.tr.end); err != nil {
+			&d.tr.note, &d.tr.start, &d.tr.end,
+			&no, &item.account.id, &item.account.name,
+			&item.debit, &item.credit,
+			&item.account.currency, &item.currencyAmount, &item.rate, &tags); err != nil {
 			return nil, err
 		}
 
-		items = append(items, d)
+		last := len(items) - 1
+
+		if last >= 0 && items[last].tr.id == d.tr.id && items[last].tr.version == d.tr.version {
+			items[last].tr.items = append(items[last].tr.items, item)
+		} else {
+			d.tr.items = []transactionItem{item}
+			d.tr.tags = strings.Fields(tags)
+			items = append(items, d)
+		}
 	}
 	rows.Close()
 
@@ -89,8 +125,9 @@ func rows2histories(rows *sql.Rows) ([]history, error) {
 
 const historyRows = `
 operation, operate_time, transaction_id, version, date,
-debit_id, debit, credit_id, credit,
-amount, description, start_month, end_month
+description, start_month, end_month,
+no, account_id, account, debit_amount, credit_amount,
+currency, currency_amount, rate, tags
 `
 
 const sqlGetAllHistory = `
@@ -110,12 +147,14 @@ func dbGetAllHistory(db *sql.DB) ([]history, error) {
 const sqlGetHistoryByMonth = `
 SELECT ` + historyRows + `
 FROM history_view
-WHERE EXTRACT(year FROM "operate_time") = $1
-      AND EXTRACT(month FROM "operate_time") = $2
+WHERE operate_time >= $1 AND operate_time < $2
 `
 
 func dbGetHistoryByMonth(db *sql.DB, year int, month int) ([]history, error) {
-	rows, err := db.Query(sqlGetHistoryByMonth, year, month)
+	from := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 1, 0)
+
+	rows, err := db.Query(sqlGetHistoryByMonth, from.Format("2006-01-02"), to.Format("2006-01-02"))
 	if err != nil {
 		return nil, err
 	}
@@ -169,7 +208,7 @@ WHERE version > 0 AND version =
 (SELECT MAX(h2.version)
 FROM transactions_history h2
 WHERE h1.transaction_id = h2.transaction_id)
-ORDER BY operate_time DESC
+ORDER BY operate_time DESC, transaction_id, no
 `
 
 func dbGetUndoableHistory(db *sql.DB) ([]history, error) {
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	_ "github.com/lib/pq"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+取引のインポートで、既に登録されている取引を二重に追加しないための処理
+
+取引の指紋(日付、勘定科目と金額、摘要)が一致する取引が登録されていれば重複としてスキップする。
+日付、勘定科目と金額は一致するが摘要が違う取引は、同じ取引かどうか判断できないので競合として追加しない。
+外部ID(銀行の明細の取引番号など)があれば、それで登録済みかどうかを判断する。
+同じファイルの中で外部IDが繰り返されたら、2件目からは重複とする。
+*/
+
+// インポートする1件の取引
+type importEntry struct {
+	lineNo     int
+	tr         *transaction
+	externalID string
+}
+
+type importResult struct {
+	inserted   int
+	duplicates int
+	conflicts  int
+	skipped    int
+}
+
+func (d *importResult) String() string {
+	return fmt.Sprintf("追加: %d, 重複: %d, 競合: %d, スキップ: %d", d.inserted, d.duplicates, d.conflicts, d.skipped)
+}
+
+type importer struct {
+	db       *sql.DB
+	isDryRun bool
+	existing []transaction   // インポートする期間に登録されている取引
+	used     []bool          // existing のうち、既にインポートする取引と対応づけたもの
+	entries  []importEntry   // 追加する取引
+	seen     map[string]bool // このインポートで既に扱った外部ID
+	result   importResult
+}
+
+// from から to までに登録されている取引と比較する importer を作る
+func newImporter(db *sql.DB, from time.Time, to time.Time, isDryRun bool) (*importer, error) {
+	existing, err := dbGetTransactionsByDate(db, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return &importer{
+		db:       db,
+		isDryRun: isDryRun,
+		existing: existing,
+		used:     make([]bool, len(existing)),
+		seen:     make(map[string]bool),
+	}, nil
+}
+
+// 取引の指紋。明細の順番は問わない
+func fingerprint(tr *transaction, withNote bool) string {
+	var items []string
+
+	for _, item := range tr.items {
+		items = append(items, fmt.Sprintf("%d:%d:%d", item.account.id, item.debit, item.credit))
+	}
+
+	sort.Strings(items)
+
+	fp := tr.date.Format("2006-01-02") + "|" + strings.Join(items, ",")
+
+	if withNote {
+		fp += "|" + tr.note
+	}
+
+	return fp
+}
+
+// 指紋が一致する未使用の登録済み取引を探して使用済みにする
+func (d *importer) use(fp string, withNote bool) bool {
+	for i := range d.existing {
+		if !d.used[i] && fingerprint(&d.existing[i], withNote) == fp {
+			d.used[i] = true
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *importer) useID(id int) {
+	for i := range d.existing {
+		if d.existing[i].id == id {
+			d.used[i] = true
+		}
+	}
+}
+
+// 取引を分類して、新しい取引なら追加する取引に加える
+func (d *importer) add(entry importEntry) error {
+	if entry.externalID != "" {
+		if d.seen[entry.externalID] {
+			d.duplicate(entry.lineNo, entry.tr)
+			return nil
+		}
+
+		d.seen[entry.externalID] = true
+
+		id, err := dbGetImportedTransactionID(d.db, entry.externalID)
+		if err != nil {
+			return err
+		}
+
+		if id != 0 {
+			d.useID(id)
+
+			tr, err := dbGetTransaction(d.db, id)
+			if err != nil {
+				return err
+			}
+
+			if fingerprint(tr, true) == fingerprint(entry.tr, true) {
+				d.duplicate(entry.lineNo, entry.tr)
+			} else {
+				d.conflict(entry.lineNo, entry.tr)
+			}
+
+			return nil
+		}
+	}
+
+	if d.use(fingerprint(entry.tr, true), true) {
+		d.duplicate(entry.lineNo, entry.tr)
+		return nil
+	}
+
+	if d.use(fingerprint(entry.tr, false), false) {
+		d.conflict(entry.lineNo, entry.tr)
+		return nil
+	}
+
+	if d.isDryRun {
+		println(fmt.Sprintf("%d:追加 %v", entry.lineNo, entry.tr))
+	}
+
+	d.entries = append(d.entries, entry)
+	d.result.inserted++
+
+	return nil
+}
+
+/*
+外部IDが登録済みか、date の取引で、明細 item を持ち、摘要が note の取引が登録されていれば重複とする
+明細CSVの行は相手の勘定科目が決まる前に、口座側の明細だけで調べる
+*/
+func (d *importer) addIfImported(lineNo int, externalID string, date time.Time, item transactionItem, note string,
+	s fmt.Stringer) (bool, error) {
+	if externalID != "" {
+		if d.seen[externalID] {
+			d.duplicate(lineNo, s)
+			return true, nil
+		}
+
+		id, err := dbGetImportedTransactionID(d.db, externalID)
+		if err != nil {
+			return false, err
+		}
+
+		if id != 0 {
+			d.seen[externalID] = true
+			d.useID(id)
+			d.duplicate(lineNo, s)
+			return true, nil
+		}
+	}
+
+	for i := range d.existing {
+		tr := &d.existing[i]
+
+		if d.used[i] || tr.date.Format("2006-01-02") != date.Format("2006-01-02") || tr.note != note {
+			continue
+		}
+
+		for _, it := range tr.items {
+			if it.account.id == item.account.id && it.debit == item.debit && it.credit == item.credit {
+				if externalID != "" {
+					d.seen[externalID] = true
+				}
+				d.used[i] = true
+				d.duplicate(lineNo, s)
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (d *importer) duplicate(lineNo int, s fmt.Stringer) {
+	println(fmt.Sprintf("%d:重複 %v", lineNo, s))
+	d.result.duplicates++
+}
+
+func (d *importer) conflict(lineNo int, s fmt.Stringer) {
+	println(fmt.Sprintf("%d:競合 %v", lineNo, s))
+	d.result.conflicts++
+}
+
+func (d *importer) skip(lineNo int, s fmt.Stringer) {
+	println(fmt.Sprintf("%d:スキップ %v", lineNo, s))
+	d.result.skipped++
+}
+
+// 新しい取引を追加して、結果を表示する。dry-run なら追加しない
+func (d *importer) commit() error {
+	if d.isDryRun {
+		println(&d.result, "(dry-run のため追加してない)")
+		return nil
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range d.entries {
+		id, err := dbAddTransaction(tx, entry.tr)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%d:%s", entry.lineNo, err)
+		}
+
+		if entry.externalID != "" {
+			if err := dbAddImportedTransactionID(tx, entry.externalID, id); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("%d:%s", entry.lineNo, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	println(&d.result)
+
+	return nil
+}
+
+// 取引の日付の範囲
+func entriesDateRange(entries []importEntry) (time.Time, time.Time) {
+	var from, to time.Time
+
+	for i, entry := range entries {
+		if i == 0 || entry.tr.date.Before(from) {
+			from = entry.tr.date
+		}
+
+		if i == 0 || entry.tr.date.After(to) {
+			to = entry.tr.date
+		}
+	}
+
+	return from, to
+}
+
+const sqlGetTransactionsByDate = `
+SELECT ` + transactionRows + `
+FROM transactions_view
+WHERE date BETWEEN $1 AND $2
+ORDER BY date, transaction_id, no
+`
+
+func dbGetTransactionsByDate(db *sql.DB, from time.Time, to time.Time) ([]transaction, error) {
+	rows, err := db.Query(sqlGetTransactionsByDate, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+
+	return rows2transactions(rows)
+}
+
+// transactions_import の external_id の長さ
+const maxExternalIDLen = 64
+
+/*
+外部IDをテーブルに保存する形にする
+OFX の FITID は255文字まであり、勘定科目名を付けると列に入らないことがあるので、
+長い外部IDは SHA-256 の16進数(64文字)にする。
+短い外部IDはそのままなので、既にインポートした取引と一致する。
+外部IDは「勘定科目:ID」の形で ':' を含むので、SHA-256 と重なることはない
+*/
+func externalIDKey(externalID string) string {
+	if utf8.RuneCountInString(externalID) <= maxExternalIDLen {
+		return externalID
+	}
+
+	sum := sha256.Sum256([]byte(externalID))
+
+	return hex.EncodeToString(sum[:])
+}
+
+const sqlGetImportedTransactionID = `
+SELECT transaction_id
+FROM transactions_import
+WHERE external_id = $1
+`
+
+// 外部IDからインポート済みの取引IDを取得する。なければ0
+func dbGetImportedTransactionID(db *sql.DB, externalID string) (int, error) {
+	var id int
+
+	err := db.QueryRow(sqlGetImportedTransactionID, externalIDKey(externalID)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return id, err
+}
+
+const sqlAddImportedTransactionID = `
+INSERT INTO transactions_import(external_id, transaction_id)
+VALUES($1, $2)
+`
+
+func dbAddImportedTransactionID(db dbtx, externalID string, id string) error {
+	_, err := db.Exec(sqlAddImportedTransactionID, externalIDKey(externalID), id)
+
+	return err
+}
+
+// 最後に削除したときの外部IDを戻す。既に同じ外部IDで取り込み直していれば、そちらを残す
+const sqlRestoreImportedTransactionIDs = `
+INSERT INTO transactions_import(external_id, transaction_id)
+SELECT external_id, transaction_id
+FROM transactions_import_history
+WHERE transaction_id = $1 AND version =
+    (SELECT MAX(version) FROM transactions_history WHERE transaction_id = $1 AND operation = 'D')
+ON CONFLICT (external_id) DO NOTHING
+`
+
+// 削除された取引を追加し直したあとに、削除したときの外部IDを戻す
+func dbRestoreImportedTransactionIDs(tx *sql.Tx, id int) error {
+	_, err := tx.Exec(sqlRestoreImportedTransactionIDs, id)
+
+	return err
+}
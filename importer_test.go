@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	_ "github.com/lib/pq"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	food := account{id: 1, name: "食費"}
+	book := account{id: 2, name: "書籍"}
+	card := account{id: 3, name: "Aカード"}
+
+	var a, b transaction
+	a.date = ymd(2019, 12, 10)
+	a.note = "スーパー"
+	a.items = []transactionItem{{account: food, debit: 800}, {account: book, debit: 600}, {account: card, credit: 1400}}
+
+	b = a
+	b.items = []transactionItem{{account: card, credit: 1400}, {account: book, debit: 600}, {account: food, debit: 800}}
+
+	// 明細の順番は問わない
+	if fingerprint(&a, true) != fingerprint(&b, true) {
+		t.Errorf("got = %s, %s", fingerprint(&a, true), fingerprint(&b, true))
+	}
+
+	b.note = "コンビニ"
+
+	if fingerprint(&a, true) == fingerprint(&b, true) || fingerprint(&a, false) != fingerprint(&b, false) {
+		t.Errorf("摘要が違う, got = %s, %s", fingerprint(&a, true), fingerprint(&b, true))
+	}
+}
+
+func TestExternalIDKey(t *testing.T) {
+	short := "A銀行:" + strings.Repeat("1", 60)
+	if externalIDKey(short) != short {
+		t.Error("短い外部IDはそのまま, got =", externalIDKey(short))
+	}
+
+	long := "A銀行:" + strings.Repeat("1", 255)
+	key := externalIDKey(long)
+
+	if len(key) != maxExternalIDLen || strings.Contains(key, ":") || key != externalIDKey(long) {
+		t.Error("長い外部IDは SHA-256, got =", key)
+	}
+
+	if key == externalIDKey(long+"2") {
+		t.Error("違う外部IDが同じになった")
+	}
+}
+
+func TestImportDuplicates(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := getTransactions(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じファイルを再びインポートしても追加されない
+	f, err := os.Open(filepath.Join("testdata", "transactions.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := new(bytes.Buffer)
+	stdout = buf
+
+	if err := readTransactions(db, f, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "追加: 0, 重複: 26, 競合: 0") {
+		t.Errorf("got = %s", buf.String())
+	}
+
+	src := strings.Join([]string{
+		"2019-11-01\t現金\t開始残高\t30000\t\t0\t0",      // 重複
+		"2019-11-01\t家賃\t前払費用\t40000\t11月分\t0\t0",  // 摘要だけ違うので競合
+		"2019-11-02\t食費\t現金\t500\tパン\t0\t0",        // 追加
+		"2019-11-02\t食費\t現金\t500\tパン\t0\t0",        // ファイル内の同じ取引は両方追加
+		"2019-11-03\t食費\t現金\t300\t弁当\t0\t0\tX0001", // 外部ID付き
+	}, "\n")
+
+	// dry-run では追加しない
+	buf.Reset()
+
+	if err := readTransactions(db, strings.NewReader(src), true); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "追加: 3, 重複: 1, 競合: 1") {
+		t.Errorf("dry-run, got = %s", buf.String())
+	}
+
+	transactions, err := getTransactions(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != len(before) {
+		t.Fatal("dry-run なのに取引が追加された:", len(transactions))
+	}
+
+	buf.Reset()
+
+	if err := readTransactions(db, strings.NewReader(src), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "追加: 3, 重複: 1, 競合: 1") {
+		t.Errorf("got = %s", buf.String())
+	}
+
+	transactions, err = getTransactions(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != len(before)+3 {
+		t.Fatal("len(transactions) != len(before)+3:", len(transactions))
+	}
+
+	// 外部IDが同じで内容が違えば競合
+	buf.Reset()
+
+	if err := readTransactions(db, strings.NewReader("2019-11-04\t食費\t現金\t300\t弁当\t0\t0\tX0001"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "追加: 0, 重複: 0, 競合: 1") {
+		t.Errorf("外部ID, got = %s", buf.String())
+	}
+
+	// 同じファイルの中で繰り返された外部IDは重複
+	src = strings.Join([]string{
+		"2019-11-05\t食費\t現金\t400\t弁当\t0\t0\tX0002",
+		"2019-11-05\t食費\t現金\t400\t弁当\t0\t0\tX0002",
+		"2019-11-06\t食費\t現金\t450\t弁当\t0\t0\tX0002",
+	}, "\n")
+
+	for _, isDryRun := range []bool{true, false} {
+		buf.Reset()
+
+		if err := readTransactions(db, strings.NewReader(src), isDryRun); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(buf.String(), "追加: 1, 重複: 2, 競合: 0") {
+			t.Errorf("繰り返した外部ID, dry-run = %v, got = %s", isDryRun, buf.String())
+		}
+	}
+}
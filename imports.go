@@ -0,0 +1,723 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	_ "github.com/lib/pq"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+銀行やクレジットカードの明細CSVの形式
+
+列番号は1から数える。0は列がないことを表す。
+金額は amount_column の1列で入出金を正負で表すか、
+withdrawal_column(出金)と deposit_column(入金)の2列で表す。
+入金(口座の残高が増える)を正とし、カードのように支払いが正の場合は negate を true にする。
+*/
+type importProfile struct {
+	Account           string `toml:"account"`  // CSVの口座に対応する勘定科目
+	Encoding          string `toml:"encoding"` // "utf8" または "sjis"
+	Delimiter         string `toml:"delimiter"`
+	Skip              int    `toml:"skip"` // 読み飛ばすヘッダの行数
+	DateColumn        int    `toml:"date_column"`
+	DateFormat        string `toml:"date_format"` // Goの時刻の書式(例: "2006/01/02")。空ならmitaの日付の形式
+	DescriptionColumn int    `toml:"description_column"`
+	AmountColumn      int    `toml:"amount_column"`
+	WithdrawalColumn  int    `toml:"withdrawal_column"`
+	DepositColumn     int    `toml:"deposit_column"`
+	Negate            bool   `toml:"negate"`
+	IDColumn          int    `toml:"id_column"` // 明細の取引番号。重複の判定に使う
+}
+
+// 摘要の正規表現から相手の勘定科目を決める規則
+type importRule struct {
+	id      int
+	pattern string
+	re      *regexp.Regexp
+	account account
+}
+
+func (d *importRule) String() string {
+	return fmt.Sprintf("%s => %s", d.pattern, d.account.name)
+}
+
+// CSVの1行を解析した結果
+type importRow struct {
+	lineNo         int
+	date           time.Time
+	note           string
+	amount         int    // 入金なら正、出金なら負
+	currencyAmount int    // 外貨建ての口座なら外貨の金額(補助単位)
+	id             string // 外部ID
+	category       string // 明細に書かれた相手の勘定科目(QIF の分類)
+}
+
+// 1つの口座の明細
+type importStatement struct {
+	account account
+	rows    []*importRow
+}
+
+func (d *importRow) String() string {
+	return fmt.Sprintf("%s %s %s", d.date.Format("2006-01-02"), d.note, int2str(d.amount))
+}
+
+const profilesFileName = "profiles.toml"
+
+/*
+名前から明細CSVの形式を取得する
+設定ファイルの [profiles.名前] と、設定ディレクトリの profiles.toml を探す
+*/
+func getImportProfile(name string) (*importProfile, error) {
+	profiles := make(map[string]importProfile)
+
+	for k, v := range configData.Profiles {
+		profiles[k] = v
+	}
+
+	filename := filepath.Join(getConfigDir(), profilesFileName)
+
+	if _, err := os.Stat(filename); err == nil {
+		if _, err := toml.DecodeFile(filename, &profiles); err != nil {
+			return nil, fmt.Errorf("%s:%s", profilesFileName, err)
+		}
+	}
+
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("存在しない形式'%s'", name)
+	}
+
+	if err := profile.validate(); err != nil {
+		return nil, fmt.Errorf("形式'%s':%s", name, err)
+	}
+
+	return &profile, nil
+}
+
+func (d *importProfile) validate() error {
+	if d.Account == "" {
+		return errors.New("account が設定されてない")
+	}
+
+	if d.DateColumn <= 0 {
+		return errors.New("date_column が設定されてない")
+	}
+
+	if d.AmountColumn <= 0 && d.WithdrawalColumn <= 0 && d.DepositColumn <= 0 {
+		return errors.New("amount_column か withdrawal_column, deposit_column を設定する")
+	}
+
+	switch strings.ToLower(d.Encoding) {
+	case "", "utf8", "utf-8", "sjis", "shift_jis", "cp932":
+	default:
+		return fmt.Errorf("未対応の文字コード'%s'", d.Encoding)
+	}
+
+	if utf8.RuneCountInString(d.Delimiter) > 1 {
+		return fmt.Errorf("区切り文字は1文字'%s'", d.Delimiter)
+	}
+
+	return nil
+}
+
+func (d *importProfile) newReader(f io.Reader) *csv.Reader {
+	switch strings.ToLower(d.Encoding) {
+	case "sjis", "shift_jis", "cp932":
+		f = transform.NewReader(f, japanese.ShiftJIS.NewDecoder())
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	if d.Delimiter != "" {
+		r.Comma, _ = utf8.DecodeRuneInString(d.Delimiter)
+	}
+
+	return r
+}
+
+// CSVの1行を解析する
+func (d *importProfile) parseRecord(record []string) (*importRow, error) {
+	var row importRow
+
+	col := func(no int) string {
+		if no <= 0 || no > len(record) {
+			return ""
+		}
+
+		return strings.TrimSpace(record[no-1])
+	}
+
+	var err error
+
+	if d.DateFormat == "" {
+		row.date, err = str2date(col(d.DateColumn))
+	} else {
+		row.date, err = time.ParseInLocation(d.DateFormat, col(d.DateColumn), time.Local)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("日付:%s", err)
+	}
+
+	if id := col(d.IDColumn); id != "" {
+		row.id = d.Account + ":" + id
+	}
+
+	row.note = col(d.DescriptionColumn)
+	if utf8.RuneCountInString(row.note) > 64 {
+		row.note = string([]rune(row.note)[:64])
+	}
+
+	if d.AmountColumn > 0 {
+		row.amount, err = parseCSVAmount(col(d.AmountColumn))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		withdrawal, err := parseCSVAmount(col(d.WithdrawalColumn))
+		if err != nil {
+			return nil, err
+		}
+
+		deposit, err := parseCSVAmount(col(d.DepositColumn))
+		if err != nil {
+			return nil, err
+		}
+
+		row.amount = deposit - withdrawal
+	}
+
+	if d.Negate {
+		row.amount = -row.amount
+	}
+
+	return &row, nil
+}
+
+// "1,234円" や "¥-1,234" のような金額を数値に変換。空なら0
+func parseCSVAmount(s string) (int, error) {
+	s = strings.NewReplacer(",", "", "¥", "", "￥", "", "円", "", " ", "").Replace(s)
+
+	if s == "" {
+		return 0, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("金額:不正な金額'%s'", s)
+	}
+
+	return v, nil
+}
+
+// 摘要に一致する最初の規則の勘定科目を返す。一致しなければ nil
+func matchImportRule(rules []importRule, note string) *account {
+	for _, rule := range rules {
+		if rule.re.MatchString(note) {
+			ac := rule.account
+			return &ac
+		}
+	}
+
+	return nil
+}
+
+/*
+明細CSVを読み込んで取引を追加する
+
+登録済みの取引は追加しない。
+相手の勘定科目は規則で決め、一致する規則がなければ仮勘定か、fzf で選択する。
+選択をキャンセルした行と、dry-run で相手の勘定科目が決まらない行は追加しない。
+*/
+func readCSVTransactions(db *sql.DB, f io.Reader, profile *importProfile, suspense string, isDryRun bool) error {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	var target *account
+	for _, ac := range accounts {
+		if ac.name == profile.Account {
+			target = &ac
+			break
+		}
+	}
+
+	if target == nil {
+		return fmt.Errorf("存在しない勘定科目'%s'", profile.Account)
+	}
+
+	r := profile.newReader(f)
+
+	var rows []*importRow
+	lineNo := 0
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		lineNo++
+
+		if lineNo <= profile.Skip || (len(record) == 1 && strings.TrimSpace(record[0]) == "") {
+			continue
+		}
+
+		row, err := profile.parseRecord(record)
+		if err != nil {
+			return fmt.Errorf("%d:%s", lineNo, err)
+		}
+
+		if row.amount == 0 {
+			continue
+		}
+
+		row.lineNo = lineNo
+		rows = append(rows, row)
+	}
+
+	return importStatements(db, accounts, []importStatement{{*target, rows}}, suspense, isDryRun)
+}
+
+/*
+明細の行から取引を作って追加する
+
+相手の勘定科目は、明細の分類と同じ名前の勘定科目、規則、仮勘定 suspense の順に決め、
+どれもなければ fzf で選択する。明細の勘定科目自身は相手にしない。
+*/
+func importStatements(db *sql.DB, accounts []account, statements []importStatement, suspense string,
+	isDryRun bool) error {
+	var suspenseAccount *account
+
+	if suspense != "" {
+		suspenseAccount = findAccount(accounts, suspense)
+		if suspenseAccount == nil {
+			return fmt.Errorf("存在しない勘定科目'%s'", suspense)
+		}
+	}
+
+	rules, err := dbGetImportRules(db)
+	if err != nil {
+		return err
+	}
+
+	var entries []importEntry
+
+	for _, st := range statements {
+		for _, row := range st.rows {
+			entries = append(entries, importEntry{tr: &transaction{date: row.date}})
+		}
+	}
+
+	from, to := entriesDateRange(entries)
+
+	im, err := newImporter(db, from, to, isDryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, st := range statements {
+		target := st.account
+
+		// 自分自身への振替は意味がないので、相手の候補から除く
+		notTarget := func(d *account) *account {
+			if d != nil && d.id == target.id {
+				return nil
+			}
+
+			return d
+		}
+
+		// 明細の勘定科目自身の規則は除いてから、一致する最初の規則を使う
+		var targetRules []importRule
+		for _, rule := range rules {
+			if notTarget(&rule.account) != nil {
+				targetRules = append(targetRules, rule)
+			}
+		}
+
+		for _, row := range st.rows {
+			item := transactionItem{account: target, debit: row.amount}
+			if row.amount < 0 {
+				item = transactionItem{account: target, credit: -row.amount}
+			}
+
+			imported, err := im.addIfImported(row.lineNo, row.id, row.date, item, row.note, row)
+			if err != nil {
+				return err
+			}
+
+			if imported {
+				continue
+			}
+
+			other := notTarget(findAccount(accounts, row.category))
+			if other == nil {
+				other = matchImportRule(targetRules, row.note)
+			}
+
+			if other == nil {
+				other = notTarget(suspenseAccount)
+			}
+
+			if other == nil {
+				if isDryRun {
+					im.skip(row.lineNo, row)
+					continue
+				}
+
+				other, err = selectAccount(accounts, row.String()+" の相手勘定科目")
+				if err != nil {
+					return err
+				}
+
+				if other != nil && other.id == target.id {
+					eprintln("明細の勘定科目と同じ勘定科目は相手にできない")
+					other = nil
+				}
+
+				if other == nil {
+					im.skip(row.lineNo, row)
+					continue
+				}
+			}
+
+			var tr transaction
+			tr.date = row.date
+			tr.note = row.note
+
+			if row.amount > 0 {
+				tr.setSimple(target, *other, row.amount)
+			} else {
+				tr.setSimple(*other, target, -row.amount)
+			}
+
+			for i := range tr.items {
+				if tr.items[i].account.id == target.id {
+					tr.items[i].currencyAmount = abs(row.currencyAmount)
+				}
+			}
+
+			if err := fillCurrencyAmounts(db, accounts, &tr); err != nil {
+				return fmt.Errorf("%d:%s", row.lineNo, err)
+			}
+
+			if err := im.add(importEntry{lineNo: row.lineNo, tr: &tr, externalID: row.id}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return im.commit()
+}
+
+func cmdListImportRules(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runListImportRules(db)
+}
+
+func runListImportRules(db *sql.DB) error {
+	rules, err := dbGetImportRules(db)
+	if err != nil {
+		return err
+	}
+
+	for i, d := range rules {
+		println(i, &d)
+	}
+
+	return nil
+}
+
+func cmdAddImportRule(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runAddImportRule(db, context.Args().Slice())
+}
+
+func runAddImportRule(db *sql.DB, args []string) error {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	var d *importRule
+
+	switch len(args) {
+	case 0:
+		d = &importRule{}
+
+		for {
+			d.pattern = scanText("摘要の正規表現", 1, 128)
+
+			if d.re, err = regexp.Compile(d.pattern); err == nil {
+				break
+			}
+
+			eprintln("エラー:", err)
+		}
+
+		ac, err := selectAccount(accounts, "相手の勘定科目")
+		if ac == nil || err != nil {
+			return err
+		}
+		d.account = *ac
+	case 2:
+		d, err = arr2importRule(accounts, args)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("Usage: mita rule add pattern account")
+	}
+
+	return dbAddImportRule(db, d)
+}
+
+func arr2importRule(accounts []account, arr []string) (*importRule, error) {
+	if len(arr) != 2 {
+		return nil, errors.New("項目数が2でない")
+	}
+
+	var d importRule
+	var err error
+
+	d.pattern = arr[0]
+
+	d.re, err = regexp.Compile(d.pattern)
+	if err != nil {
+		return nil, fmt.Errorf("正規表現:%s", err)
+	}
+
+	for _, ac := range accounts {
+		if ac.name == arr[1] {
+			d.account = ac
+		}
+	}
+
+	if d.account.id == 0 {
+		return nil, fmt.Errorf("存在しない勘定科目'%s'", arr[1])
+	}
+
+	return &d, nil
+}
+
+func cmdRemoveImportRule(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runRemoveImportRule(db)
+}
+
+func runRemoveImportRule(db *sql.DB) error {
+	d, err := selectImportRule(db)
+	if d == nil || err != nil {
+		return err
+	}
+
+	if confirmYesNo("本当に削除する?") {
+		return dbRemoveImportRule(db, d.id)
+	}
+
+	return nil
+}
+
+func cmdImportImportRules(context *cli.Context) error {
+	return importItems(context.Args().First(), readImportRules)
+}
+
+func readImportRules(db *sql.DB, f io.Reader) error {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(f)
+
+	lineNo := 0
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for scanner.Scan() {
+		lineNo++
+
+		line := skipSpace(scanner.Text())
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		d, err := arr2importRule(accounts, strings.Split(line, "\t"))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%d:%s", lineNo, err)
+		}
+
+		if err := dbAddImportRule(tx, d); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func cmdExportImportRules(context *cli.Context) error {
+	return exportItems(context.Args().First(), writeImportRules)
+}
+
+func writeImportRules(db *sql.DB, f io.Writer) error {
+	b := bufio.NewWriter(f)
+
+	rules, err := dbGetImportRules(db)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range rules {
+		_, err := b.WriteString(fmt.Sprintf("%s\t%s\n", d.pattern, d.account.name))
+		if err != nil {
+			return err
+		}
+	}
+
+	b.Flush()
+
+	return nil
+}
+
+func selectImportRule(db *sql.DB) (*importRule, error) {
+	rules, err := dbGetImportRules(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	src := new(bytes.Buffer)
+
+	for i, d := range rules {
+		src.Write([]byte(fmt.Sprintf("%d %v\n", i, &d)))
+	}
+
+	dst := new(bytes.Buffer)
+	args := []string{}
+
+	cancel, err := fzf(src, dst, os.Stderr, args)
+	if cancel {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	arr := strings.Split(dst.String(), " ")
+
+	i, err := strconv.Atoi(arr[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &rules[i], nil
+}
+
+const sqlGetImportRules = `
+SELECT r.rule_id, r.pattern, r.account_id, ac.name, ac.search_words
+FROM import_rules AS r
+JOIN accounts AS ac ON r.account_id = ac.account_id
+ORDER BY r.rule_id
+`
+
+func dbGetImportRules(db *sql.DB) ([]importRule, error) {
+	rows, err := db.Query(sqlGetImportRules)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []importRule
+
+	for rows.Next() {
+		var d importRule
+
+		if err := rows.Scan(&d.id, &d.pattern, &d.account.id, &d.account.name, &d.account.searchWords); err != nil {
+			return nil, err
+		}
+
+		d.re, err = regexp.Compile(d.pattern)
+		if err != nil {
+			return nil, fmt.Errorf("規則'%s':%s", d.pattern, err)
+		}
+
+		rules = append(rules, d)
+	}
+	rows.Close()
+
+	return rules, nil
+}
+
+const sqlAddImportRule = `
+INSERT INTO import_rules(pattern, account_id)
+VALUES($1, $2)
+`
+
+func dbAddImportRule(db dbtx, d *importRule) error {
+	_, err := db.Exec(sqlAddImportRule, d.pattern, d.account.id)
+
+	return err
+}
+
+const sqlRemoveImportRule = `
+DELETE FROM import_rules
+WHERE rule_id = $1
+`
+
+func dbRemoveImportRule(db dbtx, id int) error {
+	_, err := db.Exec(sqlRemoveImportRule, id)
+
+	return err
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	_ "github.com/lib/pq"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type parseCSVAmountTest struct {
+	s     string
+	res   int
+	isErr bool
+}
+
+var parseCSVAmountTests = []parseCSVAmountTest{
+	{"", 0, false},
+	{"1234", 1234, false},
+	{"1,234", 1234, false},
+	{"-1,234", -1234, false},
+	{"¥1,234", 1234, false},
+	{"1,234円", 1234, false},
+	{"12.5", 0, true},
+	{"abc", 0, true},
+}
+
+func TestParseCSVAmount(t *testing.T) {
+	for _, tt := range parseCSVAmountTests {
+		res, err := parseCSVAmount(tt.s)
+
+		if tt.isErr {
+			if err == nil {
+				t.Errorf("parseCSVAmount(%s) エラーになるはず", tt.s)
+			}
+		} else if err != nil || res != tt.res {
+			t.Errorf("parseCSVAmount(%s), got = %d, %v", tt.s, res, err)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	// 1列で入出金を表す
+	p := importProfile{Account: "A銀行", DateColumn: 1, DescriptionColumn: 2, AmountColumn: 3}
+
+	row, err := p.parseRecord([]string{"2019-12-25", " スーパー ", "-1,200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row.date.Format("2006-01-02") != "2019-12-25" || row.note != "スーパー" || row.amount != -1200 {
+		t.Errorf("1列, got = %v", row)
+	}
+
+	// 出金と入金の2列
+	p = importProfile{Account: "A銀行", DateColumn: 1, DateFormat: "2006/01/02", DescriptionColumn: 4,
+		WithdrawalColumn: 2, DepositColumn: 3}
+
+	row, err = p.parseRecord([]string{"2019/12/25", "", "200,000", "給与"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row.date.Format("2006-01-02") != "2019-12-25" || row.note != "給与" || row.amount != 200000 {
+		t.Errorf("2列, got = %v", row)
+	}
+
+	// カードの支払いは正
+	p = importProfile{Account: "Aカード", DateColumn: 1, DescriptionColumn: 2, AmountColumn: 3, Negate: true}
+
+	row, err = p.parseRecord([]string{"2019-12-25", "書店", "1500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row.amount != -1500 {
+		t.Errorf("negate, got = %v", row)
+	}
+
+	if _, err := p.parseRecord([]string{"12月25日", "書店", "1500"}); err == nil {
+		t.Error("日付が不正なのでエラーになるはず")
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	p := importProfile{Account: "A銀行", DateColumn: 1, AmountColumn: 3}
+
+	if err := p.validate(); err != nil {
+		t.Error(err)
+	}
+
+	p.Encoding = "euc-jp"
+
+	if err := p.validate(); err == nil {
+		t.Error("未対応の文字コードなのでエラーになるはず")
+	}
+
+	p = importProfile{Account: "A銀行", DateColumn: 1}
+
+	if err := p.validate(); err == nil {
+		t.Error("金額の列がないのでエラーになるはず")
+	}
+}
+
+func TestMatchImportRule(t *testing.T) {
+	rules := []importRule{
+		{pattern: "^イオン", re: regexp.MustCompile("^イオン"), account: account{id: 1, name: "食費"}},
+		{pattern: "電力", re: regexp.MustCompile("電力"), account: account{id: 2, name: "電気代"}},
+		{pattern: ".", re: regexp.MustCompile("."), account: account{id: 3, name: "雑費"}},
+	}
+
+	if ac := matchImportRule(rules, "イオン東店"); ac == nil || ac.name != "食費" {
+		t.Errorf("イオン東店, got = %v", ac)
+	}
+
+	if ac := matchImportRule(rules, "東京電力"); ac == nil || ac.name != "電気代" {
+		t.Errorf("東京電力, got = %v", ac)
+	}
+
+	// 先に登録した規則が優先
+	if ac := matchImportRule(rules, "東イオン"); ac == nil || ac.name != "雑費" {
+		t.Errorf("東イオン, got = %v", ac)
+	}
+
+	if ac := matchImportRule(rules, ""); ac != nil {
+		t.Errorf("空, got = %v", ac)
+	}
+}
+
+func TestReadCSVTransactions(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	db, err := setupAccounts()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{{"^イオン", "食費"}, {"給与", "給与"}} {
+		if err := runAddImportRule(db, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runAddImportRule(db, []string{"(", "食費"}); err == nil {
+		t.Fatal("正規表現が不正なのでエラーになるはず")
+	}
+
+	src := strings.Join([]string{
+		"日付,摘要,出金,入金",
+		"2019/12/10,イオン東店,\"1,200\",",
+		"2019/12/25,給与,,\"200,000\"",
+		"2019/12/26,イオン西店,0,",
+		"",
+	}, "\r\n")
+
+	// 明細は Shift_JIS
+	b, err := ioutil.ReadAll(transform.NewReader(strings.NewReader(src), japanese.ShiftJIS.NewEncoder()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := &importProfile{Account: "A銀行", Encoding: "sjis", Skip: 1, DateColumn: 1, DateFormat: "2006/01/02",
+		DescriptionColumn: 2, WithdrawalColumn: 3, DepositColumn: 4}
+
+	if err := readCSVTransactions(db, bytes.NewReader(b), profile, "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err := getTransactions(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 金額が0の行は取り込まない
+	if len(transactions) != 2 {
+		t.Fatal("len(transactions) != 2:", len(transactions))
+	}
+
+	for _, tr := range transactions {
+		switch tr.note {
+		case "イオン東店":
+			if tr.debit().name != "食費" || tr.credit().name != "A銀行" || tr.amount() != 1200 {
+				t.Errorf("イオン東店, got = %v", &tr)
+			}
+		case "給与":
+			if tr.debit().name != "A銀行" || tr.credit().name != "給与" || tr.amount() != 200000 {
+				t.Errorf("給与, got = %v", &tr)
+			}
+		default:
+			t.Errorf("got = %v", &tr)
+		}
+	}
+
+	// 同じ明細を再びインポートしても追加されない
+	buf := new(bytes.Buffer)
+	stdout = buf
+
+	if err := readCSVTransactions(db, bytes.NewReader(b), profile, "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "追加: 0, 重複: 2") {
+		t.Errorf("再インポート, got = %s", buf.String())
+	}
+
+	buf.Reset()
+
+	if err := writeImportRules(db, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "^イオン\t食費\n給与\t給与\n" {
+		t.Errorf("writeImportRules, got = %s", buf.String())
+	}
+}
+
+func TestImportRuleForTargetAccount(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	db, err := setupAccounts()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 最初に一致する規則は明細の勘定科目自身なので、次に一致する規則を使う
+	for _, args := range [][]string{{"^振込", "A銀行"}, {"振込", "雑費"}} {
+		if err := runAddImportRule(db, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := "日付,摘要,出金,入金\n2019/12/27,振込手数料,330,\n"
+
+	profile := &importProfile{Account: "A銀行", Skip: 1, DateColumn: 1, DateFormat: "2006/01/02",
+		DescriptionColumn: 2, WithdrawalColumn: 3, DepositColumn: 4}
+
+	buf := new(bytes.Buffer)
+	stdout = buf
+
+	if err := readCSVTransactions(db, strings.NewReader(src), profile, "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "追加: 1, 重複: 0, 競合: 0, スキップ: 0") {
+		t.Errorf("dry-run, got = %s", buf.String())
+	}
+
+	if err := readCSVTransactions(db, strings.NewReader(src), profile, "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err := getTransactions(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != 1 {
+		t.Fatal("len(transactions) != 1:", len(transactions))
+	}
+
+	testTransaction(t, transactions[0], "2019-12-27", "雑費", "A銀行", 330, "振込手数料", 0, 0)
+}
@@ -0,0 +1,1072 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+プレーンテキスト会計の形式
+
+ledger(hledger)と beancount の形式で取引を書き出し、同じ形式のファイルから取引を読み込む。
+勘定科目は "Expenses:水道光熱費:電気代" のように、タイプの英語名、親、自分の名前を ':' でつなげる。
+円は JPY、外貨建ての明細は "100.50 USD @@ 15000 JPY" のように円の金額を合計の価格で付ける。
+開始月と終了月、タグは取引のメタデータにする。
+*/
+const (
+	ledgerFormatLedger    = "ledger"
+	ledgerFormatBeancount = "beancount"
+)
+
+const ledgerYen = "JPY"
+
+var acType2ledgerRoot = map[int]string{
+	acTypeAsset:     "Assets",
+	acTypeLiability: "Liabilities",
+	acTypeIncome:    "Income",
+	acTypeExpense:   "Expenses",
+	acTypeEquity:    "Equity",
+}
+
+// hledger の勘定科目のタイプ
+var acType2ledgerType = map[int]string{
+	acTypeAsset:     "A",
+	acTypeLiability: "L",
+	acTypeIncome:    "R",
+	acTypeExpense:   "X",
+	acTypeEquity:    "E",
+}
+
+func isLedgerFormat(format string) bool {
+	return format == ledgerFormatLedger || format == ledgerFormatBeancount
+}
+
+/*
+勘定科目の名前を ledger の勘定科目の1つの階層にする
+
+ledger は ':' で階層を区切り、2つ以上の空白かタブで勘定科目が終わる。
+beancount は英大文字、数字か ASCII 以外の文字で始まり、英数字、'-' と ASCII 以外の文字だけを使える。
+*/
+func ledgerAccountComponent(name string, format string) string {
+	var b strings.Builder
+
+	for i, r := range name {
+		switch {
+		case r == ':' || r == '\t':
+			r = '-'
+		case format != ledgerFormatBeancount || r >= utf8.RuneSelf:
+		case i == 0 && r >= 'a' && r <= 'z':
+			r = unicode.ToUpper(r)
+		case i == 0 && !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'):
+			b.WriteRune('X')
+			r = '-'
+		case !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-'):
+			r = '-'
+		}
+
+		b.WriteRune(r)
+	}
+
+	s := b.String()
+
+	if format != ledgerFormatBeancount {
+		for strings.Contains(s, "  ") {
+			s = strings.ReplaceAll(s, "  ", " ")
+		}
+	}
+
+	return s
+}
+
+// 勘定科目IDごとの ledger の勘定科目名。祖先の名前を上から並べる
+func ledgerAccountNames(accounts []account, format string) map[int]string {
+	id2parent := accountParents(accounts)
+
+	id2ac := make(map[int]account)
+	for _, d := range accounts {
+		id2ac[d.id] = d
+	}
+
+	id2name := make(map[int]string)
+
+	for _, d := range accounts {
+		name := ledgerAccountComponent(d.name, format)
+
+		for _, p := range accountAncestors(id2parent, d.id) {
+			name = ledgerAccountComponent(id2ac[p].name, format) + ":" + name
+		}
+
+		id2name[d.id] = acType2ledgerRoot[d.accountType] + ":" + name
+	}
+
+	return id2name
+}
+
+// 検索条件に一致する取引を ledger か beancount の形式で書き出す
+func writeLedgerTransactions(db *sql.DB, f io.Writer, terms []string, format string) error {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	transactions, err := findTransactions(db, terms)
+	if err != nil {
+		return err
+	}
+
+	b := bufio.NewWriter(f)
+
+	id2name := ledgerAccountNames(accounts, format)
+
+	if format == ledgerFormatBeancount {
+		openDate := time.Now()
+		if len(transactions) != 0 {
+			openDate = transactions[0].date
+		}
+
+		writeBeancountAccounts(b, accounts, id2name, openDate)
+	} else {
+		writeLedgerAccounts(b, accounts, id2name)
+	}
+
+	for _, d := range transactions {
+		b.WriteString("\n")
+
+		if format == ledgerFormatBeancount {
+			writeBeancountTransaction(b, &d, id2name)
+		} else {
+			writeLedgerTransaction(b, &d, id2name)
+		}
+	}
+
+	return b.Flush()
+}
+
+// hledger の account ディレクティブ。タイプ等はコメントのタグにする
+func writeLedgerAccounts(b *bufio.Writer, accounts []account, id2name map[int]string) {
+	b.WriteString("; mita からエクスポート\n\n")
+
+	for _, d := range accounts {
+		tags := []string{"type: " + acType2ledgerType[d.accountType]}
+
+		if d.currency != "" {
+			tags = append(tags, "currency: "+d.currency)
+		}
+
+		if d.isExtraordinary {
+			tags = append(tags, "extraordinary: true")
+		}
+
+		if name := id2name[d.id]; name[strings.LastIndex(name, ":")+1:] != d.name {
+			tags = append(tags, "name: "+d.name)
+		}
+
+		b.WriteString(fmt.Sprintf("account %s  ; %s\n", id2name[d.id], strings.Join(tags, ", ")))
+	}
+}
+
+func writeLedgerTransaction(b *bufio.Writer, d *transaction, id2name map[int]string) {
+	b.WriteString(strings.TrimSpace(d.date.Format("2006-01-02")+" "+d.note) + "\n")
+
+	if d.start != 0 {
+		b.WriteString(fmt.Sprintf("    ; start: %s\n    ; end: %s\n", month2str(d.start), month2str(d.end)))
+	}
+
+	for _, tag := range d.tags {
+		b.WriteString(fmt.Sprintf("    ; %s:\n", tag))
+	}
+
+	writeLedgerPostings(b, d, id2name, "    ")
+}
+
+// beancount の open ディレクティブ。勘定科目の通貨を制約にする
+func writeBeancountAccounts(b *bufio.Writer, accounts []account, id2name map[int]string, openDate time.Time) {
+	b.WriteString("; mita からエクスポート\n\n")
+	b.WriteString(fmt.Sprintf("option \"operating_currency\" \"%s\"\n\n", ledgerYen))
+
+	for _, d := range accounts {
+		currency := d.currency
+		if currency == "" {
+			currency = ledgerYen
+		}
+
+		b.WriteString(fmt.Sprintf("%s open %s %s\n", openDate.Format("2006-01-02"), id2name[d.id], currency))
+
+		if d.isExtraordinary {
+			b.WriteString("  extraordinary: TRUE\n")
+		}
+
+		if name := id2name[d.id]; name[strings.LastIndex(name, ":")+1:] != d.name {
+			b.WriteString(fmt.Sprintf("  name: %s\n", beancountString(d.name)))
+		}
+	}
+}
+
+// beancount のタグに使える文字
+var reBeancountTag = regexp.MustCompile(`^[A-Za-z0-9_/.-]+$`)
+
+func writeBeancountTransaction(b *bufio.Writer, d *transaction, id2name map[int]string) {
+	// beancount のタグに使えない文字を含むタグはメタデータにする
+	var tags, metaTags []string
+
+	for _, tag := range d.tags {
+		if reBeancountTag.MatchString(tag) {
+			tags = append(tags, " #"+tag)
+		} else {
+			metaTags = append(metaTags, tag)
+		}
+	}
+
+	b.WriteString(fmt.Sprintf("%s * %s%s\n", d.date.Format("2006-01-02"), beancountString(d.note), strings.Join(tags, "")))
+
+	if d.start != 0 {
+		b.WriteString(fmt.Sprintf("  start: \"%s\"\n  end: \"%s\"\n", month2str(d.start), month2str(d.end)))
+	}
+
+	if len(metaTags) != 0 {
+		b.WriteString(fmt.Sprintf("  tags: %s\n", beancountString(tags2str(metaTags))))
+	}
+
+	writeLedgerPostings(b, d, id2name, "  ")
+}
+
+func beancountString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// 借方を正、貸方を負の金額にして明細を書く
+func writeLedgerPostings(b *bufio.Writer, d *transaction, id2name map[int]string, indent string) {
+	for _, items := range [][]transactionItem{d.debits(), d.credits()} {
+		for _, item := range items {
+			yen, n := item.debit, item.currencyAmount
+			if item.credit != 0 {
+				yen, n = -item.credit, -n
+			}
+
+			amount := fmt.Sprintf("%d %s", yen, ledgerYen)
+
+			if item.account.currency != "" {
+				amount = fmt.Sprintf("%s %s @@ %d %s",
+					strings.ReplaceAll(currency2str(n, item.account.currency), ",", ""), item.account.currency,
+					int(math.Abs(float64(yen))), ledgerYen)
+			}
+
+			b.WriteString(fmt.Sprintf("%s%s  %s\n", indent, id2name[item.account.id], amount))
+		}
+	}
+}
+
+// ファイルで宣言された勘定科目
+type ledgerAccount struct {
+	fullName        string
+	name            string // mita の勘定科目名。空なら最後の階層
+	accountType     int
+	currency        string
+	isExtraordinary bool
+}
+
+// ファイルから読んだ取引
+type ledgerEntry struct {
+	lineNo   int
+	date     time.Time
+	note     string
+	start    int
+	end      int
+	tags     []string
+	postings []ledgerPosting
+}
+
+/*
+取引の明細
+
+commodity が円でなければ、amount は外貨の金額(補助単位)で yen は価格から求めた円の金額
+hasAmount が false なら、金額は他の明細から決まる
+*/
+type ledgerPosting struct {
+	lineNo    int
+	account   string
+	hasAmount bool
+	commodity string
+	amount    int
+	yen       int
+}
+
+type ledgerJournal struct {
+	accounts []*ledgerAccount
+	entries  []*ledgerEntry
+}
+
+var reLedgerAmount = regexp.MustCompile(`^(-?)\s*([A-Za-z]+|¥|￥)?\s*(-?[0-9][0-9,]*(?:\.[0-9]+)?)\s*([A-Za-z]+)?$`)
+
+// beancount のメタデータのキー
+var reBeancountMeta = regexp.MustCompile(`^([a-z][A-Za-z0-9_-]*):\s*(.*)$`)
+
+/*
+ledger か beancount のファイルを読む
+
+取引、勘定科目の宣言、コメント以外のディレクティブ(commodity, option, price 等)は読み飛ばす。
+*/
+func parseLedger(f io.Reader, format string) (*ledgerJournal, error) {
+	var journal ledgerJournal
+
+	var curEntry *ledgerEntry
+	var curAccount *ledgerAccount
+
+	scanner := bufio.NewScanner(f)
+
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+
+		if line == "" {
+			curEntry, curAccount = nil, nil
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			s := strings.TrimSpace(line)
+
+			switch {
+			case curEntry == nil && curAccount == nil:
+				// 読み飛ばすディレクティブの続き
+			case s[0] == ';' || s[0] == '#':
+				if err := applyLedgerComment(curEntry, curAccount, s[1:]); err != nil {
+					return nil, fmt.Errorf("%d:%s", lineNo, err)
+				}
+			case format == ledgerFormatBeancount && reBeancountMeta.MatchString(s):
+				m := reBeancountMeta.FindStringSubmatch(s)
+
+				if err := applyLedgerMeta(curEntry, curAccount, m[1], unquoteBeancount(m[2])); err != nil {
+					return nil, fmt.Errorf("%d:%s", lineNo, err)
+				}
+			case curEntry != nil:
+				p, err := parseLedgerPosting(s)
+				if err != nil {
+					return nil, fmt.Errorf("%d:%s", lineNo, err)
+				}
+
+				p.lineNo = lineNo
+				curEntry.postings = append(curEntry.postings, *p)
+			}
+
+			continue
+		}
+
+		curEntry, curAccount = nil, nil
+
+		switch {
+		case strings.ContainsRune(";#*%|", rune(line[0])):
+			continue
+		case strings.HasPrefix(line, "account "):
+			curAccount = &ledgerAccount{}
+
+			name, comment := splitLedgerComment(strings.TrimSpace(line[len("account "):]))
+			curAccount.fullName = name
+
+			if err := applyLedgerComment(nil, curAccount, comment); err != nil {
+				return nil, fmt.Errorf("%d:%s", lineNo, err)
+			}
+
+			journal.accounts = append(journal.accounts, curAccount)
+		case line[0] >= '0' && line[0] <= '9':
+			fields := strings.Fields(line)
+
+			// 2019/11/01=2019/11/05 のような補助日付は使わない
+			date, err := str2date(strings.Split(fields[0], "=")[0])
+			if err != nil {
+				return nil, fmt.Errorf("%d:日付:%s", lineNo, err)
+			}
+
+			if format == ledgerFormatBeancount && len(fields) >= 3 && fields[1] == "open" {
+				curAccount = &ledgerAccount{fullName: fields[2]}
+
+				// 通貨の制約が1つだけなら、その通貨の勘定科目にする
+				if len(fields) >= 4 && !strings.Contains(fields[3], ",") && fields[3] != ledgerYen {
+					if curAccount.currency, err = str2currencyCode(fields[3]); err != nil {
+						return nil, fmt.Errorf("%d:%s", lineNo, err)
+					}
+				}
+
+				journal.accounts = append(journal.accounts, curAccount)
+				continue
+			}
+
+			if format == ledgerFormatBeancount && len(fields) >= 2 && !(fields[1] == "*" || fields[1] == "!" || fields[1] == "txn") {
+				continue
+			}
+
+			curEntry = &ledgerEntry{lineNo: lineNo, date: date}
+
+			rest := strings.TrimSpace(line[len(fields[0]):])
+
+			if format == ledgerFormatBeancount {
+				err = parseBeancountHeader(curEntry, rest)
+			} else {
+				err = parseLedgerHeader(curEntry, rest)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("%d:%s", lineNo, err)
+			}
+
+			journal.entries = append(journal.entries, curEntry)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &journal, nil
+}
+
+// "内容  ; コメント" を内容とコメントに分ける
+func splitLedgerComment(s string) (string, string) {
+	for _, sep := range []string{"  ;", "\t;"} {
+		if i := strings.Index(s, sep); i != -1 {
+			return strings.TrimSpace(s[:i]), s[i+len(sep):]
+		}
+	}
+
+	if strings.HasPrefix(s, ";") {
+		return "", s[1:]
+	}
+
+	return s, ""
+}
+
+// "* (番号) 摘要  ; コメント"
+func parseLedgerHeader(d *ledgerEntry, s string) error {
+	if strings.HasPrefix(s, "* ") || strings.HasPrefix(s, "! ") || s == "*" || s == "!" {
+		s = strings.TrimSpace(s[1:])
+	}
+
+	if strings.HasPrefix(s, "(") {
+		if i := strings.Index(s, ")"); i != -1 {
+			s = strings.TrimSpace(s[i+1:])
+		}
+	}
+
+	note, comment := splitLedgerComment(s)
+	d.note = note
+
+	return applyLedgerComment(d, nil, comment)
+}
+
+// `* "支払先" "摘要" #タグ ^リンク`
+func parseBeancountHeader(d *ledgerEntry, s string) error {
+	var strs []string
+
+	for s != "" {
+		s = strings.TrimSpace(s)
+
+		switch {
+		case s == "":
+		case s[0] == ';':
+			s = ""
+		case s[0] == '"':
+			str, rest, err := readBeancountString(s)
+			if err != nil {
+				return err
+			}
+
+			strs = append(strs, str)
+			s = rest
+		default:
+			token := s
+			if i := strings.IndexAny(s, " \t"); i != -1 {
+				token, s = s[:i], s[i:]
+			} else {
+				s = ""
+			}
+
+			if strings.HasPrefix(token, "#") {
+				d.tags = append(d.tags, token[1:])
+			}
+		}
+	}
+
+	switch len(strs) {
+	case 1:
+		d.note = strs[0]
+	case 2:
+		d.note = strs[1]
+		if d.note == "" {
+			d.note = strs[0]
+		}
+	}
+
+	return nil
+}
+
+// 先頭の "文字列" を読んで、残りを返す
+func readBeancountString(s string) (string, string, error) {
+	var b strings.Builder
+
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return "", "", errors.New("文字列の '\"' が閉じてない")
+}
+
+func unquoteBeancount(s string) string {
+	if strings.HasPrefix(s, `"`) {
+		if str, _, err := readBeancountString(s); err == nil {
+			return str
+		}
+	}
+
+	return s
+}
+
+/*
+コメントのタグを取引か勘定科目に設定する
+
+"key: value, key: value" は hledger のタグ、":tag1:tag2:" は ledger のタグ
+*/
+func applyLedgerComment(d *ledgerEntry, ac *ledgerAccount, comment string) error {
+	comment = strings.TrimSpace(comment)
+
+	if len(comment) >= 2 && comment[0] == ':' && comment[len(comment)-1] == ':' && !strings.ContainsAny(comment, " \t") {
+		for _, tag := range strings.Split(comment[1:len(comment)-1], ":") {
+			if err := applyLedgerMeta(d, ac, tag, ""); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, part := range strings.Split(comment, ",") {
+		i := strings.Index(part, ":")
+		if i == -1 {
+			continue
+		}
+
+		key := strings.TrimSpace(part[:i])
+		if key == "" || strings.ContainsAny(key, " \t") {
+			continue
+		}
+
+		if err := applyLedgerMeta(d, ac, key, strings.TrimSpace(part[i+1:])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// メタデータを取引か勘定科目に設定する。知らないキーは無視する
+func applyLedgerMeta(d *ledgerEntry, ac *ledgerAccount, key string, value string) error {
+	var err error
+
+	if d != nil {
+		switch key {
+		case "start":
+			d.start, err = str2month(value)
+		case "end":
+			d.end, err = str2month(value)
+		case "tags":
+			d.tags = append(d.tags, strings.Fields(value)...)
+		default:
+			if value == "" {
+				d.tags = append(d.tags, key)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s:%s", key, err)
+		}
+
+		return nil
+	}
+
+	if ac == nil {
+		return nil
+	}
+
+	switch key {
+	case "type":
+		ac.accountType = ledgerType2acType(value)
+	case "currency":
+		ac.currency, err = str2currencyCode(value)
+	case "extraordinary":
+		ac.isExtraordinary = strings.EqualFold(value, "true")
+	case "name":
+		ac.name = value
+	}
+
+	return err
+}
+
+// hledger のタイプか、勘定科目の最上位の名前からタイプを求める。不明なら 0
+func ledgerType2acType(s string) int {
+	switch strings.ToLower(s) {
+	case "a", "c", "asset", "assets", "cash", "資産":
+		return acTypeAsset
+	case "l", "liability", "liabilities", "負債":
+		return acTypeLiability
+	case "r", "income", "revenue", "revenues", "収入":
+		return acTypeIncome
+	case "x", "expense", "expenses", "費用":
+		return acTypeExpense
+	case "e", "equity", "資本":
+		return acTypeEquity
+	}
+
+	return 0
+}
+
+// "勘定科目  金額 [@@ 円の金額 | @ 単価]  ; コメント"
+func parseLedgerPosting(s string) (*ledgerPosting, error) {
+	s, _ = splitLedgerComment(s)
+
+	// beancount の明細のフラグ
+	if strings.HasPrefix(s, "* ") || strings.HasPrefix(s, "! ") {
+		s = strings.TrimSpace(s[2:])
+	}
+
+	if strings.HasPrefix(s, "(") || strings.HasPrefix(s, "[") {
+		return nil, errors.New("仮想の明細は未対応: " + s)
+	}
+
+	var p ledgerPosting
+
+	i := strings.IndexAny(s, "\t")
+	if j := strings.Index(s, "  "); j != -1 && (i == -1 || j < i) {
+		i = j
+	}
+
+	if i == -1 {
+		p.account = s
+		return &p, nil
+	}
+
+	p.account = s[:i]
+	amountStr := strings.TrimSpace(s[i:])
+
+	// 残高の確認は使わない
+	if j := strings.Index(amountStr, "="); j != -1 {
+		amountStr = strings.TrimSpace(amountStr[:j])
+	}
+
+	if amountStr == "" {
+		return &p, nil
+	}
+
+	if strings.ContainsAny(amountStr, "{}") {
+		return nil, errors.New("取得原価は未対応: " + amountStr)
+	}
+
+	priceStr := ""
+	isTotal := false
+
+	if j := strings.Index(amountStr, "@"); j != -1 {
+		priceStr = amountStr[j+1:]
+		if strings.HasPrefix(priceStr, "@") {
+			priceStr = priceStr[1:]
+			isTotal = true
+		}
+
+		amountStr = strings.TrimSpace(amountStr[:j])
+	}
+
+	commodity, n, err := parseLedgerAmount(amountStr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.hasAmount = true
+	p.commodity = commodity
+	p.amount = n
+
+	if commodity == ledgerYen {
+		if priceStr != "" {
+			return nil, errors.New("円の金額に価格は付けられない: " + s)
+		}
+
+		p.yen = n
+		return &p, nil
+	}
+
+	if priceStr == "" {
+		return nil, fmt.Errorf("%sの金額には @@ で円の金額を付ける: %s", commodity, s)
+	}
+
+	m := reLedgerAmount.FindStringSubmatch(strings.TrimSpace(priceStr))
+	if m == nil || m[1] != "" || strings.HasPrefix(m[3], "-") {
+		return nil, fmt.Errorf("不正な価格'%s'", priceStr)
+	}
+
+	if c := m[2] + m[4]; c != ledgerYen && c != "¥" && c != "￥" {
+		return nil, errors.New("価格は円にする: " + s)
+	}
+
+	price, err := strconv.ParseFloat(strings.ReplaceAll(m[3], ",", ""), 64)
+	if err != nil {
+		return nil, err
+	}
+
+	if isTotal {
+		p.yen = int(math.Round(price))
+		if n < 0 {
+			p.yen = -p.yen
+		}
+	} else {
+		p.yen = currency2yen(n, commodity, price)
+	}
+
+	return &p, nil
+}
+
+/*
+"1000 JPY", "JPY 1000", "¥1,000", "-100.50 USD" 等を解析して、通貨コードと金額(補助単位)を返す
+通貨がなければ円とする
+*/
+func parseLedgerAmount(s string) (string, int, error) {
+	m := reLedgerAmount.FindStringSubmatch(s)
+	if m == nil {
+		return "", 0, fmt.Errorf("不正な金額'%s'", s)
+	}
+
+	commodity := m[2]
+	if m[4] != "" {
+		if commodity != "" {
+			return "", 0, fmt.Errorf("不正な金額'%s'", s)
+		}
+
+		commodity = m[4]
+	}
+
+	switch commodity {
+	case "", "¥", "￥":
+		commodity = ledgerYen
+	}
+
+	commodity, err := str2currencyCode(commodity)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// hledger は "1000.00 JPY" のように小数点以下の 0 を付けることがある
+	num := m[3]
+	if strings.Contains(num, ".") {
+		num = strings.TrimSuffix(strings.TrimRight(num, "0"), ".")
+	}
+
+	if m[1] == "-" {
+		if strings.HasPrefix(num, "-") {
+			return "", 0, fmt.Errorf("不正な金額'%s'", s)
+		}
+
+		num = "-" + num
+	}
+
+	n, err := str2currency(num, commodity)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return commodity, n, nil
+}
+
+func readLedgerTransactions(db *sql.DB, f io.Reader, format string, isDryRun bool) error {
+	journal, err := parseLedger(f, format)
+	if err != nil {
+		return err
+	}
+
+	return importLedgerJournal(db, journal, isDryRun)
+}
+
+/*
+ファイルの取引を追加する
+
+勘定科目は最後の階層の名前(宣言に name があればその名前)で mita の勘定科目を探す。
+なければタイプ(宣言の type か最上位の名前)が分かる場合だけ勘定科目を追加する。
+1つ上の階層(最上位の名前を除く)を親にし、親もなければ追加する。
+*/
+func importLedgerJournal(db *sql.DB, journal *ledgerJournal, isDryRun bool) error {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	r := &ledgerResolver{
+		declared: make(map[string]*ledgerAccount),
+		name2ac:  make(map[string]*account),
+		resolved: make(map[string]*account),
+	}
+
+	for i := range accounts {
+		r.name2ac[accounts[i].name] = &accounts[i]
+	}
+
+	for _, d := range journal.accounts {
+		r.declared[d.fullName] = d
+	}
+
+	// 宣言された勘定科目は使われてなくても追加する
+	for _, d := range journal.accounts {
+		if _, err := r.resolve(d.fullName); err != nil {
+			return err
+		}
+	}
+
+	var entries []importEntry
+
+	for _, d := range journal.entries {
+		tr, err := r.transaction(d)
+		if err != nil {
+			return fmt.Errorf("%d:%s", d.lineNo, err)
+		}
+
+		entries = append(entries, importEntry{lineNo: d.lineNo, tr: tr})
+	}
+
+	for _, ac := range r.added {
+		if ac.parent.id != 0 {
+			println("勘定科目を追加:", ac.name, "(親: "+ac.parent.name+")")
+		} else {
+			println("勘定科目を追加:", ac.name)
+		}
+	}
+
+	if !isDryRun && len(r.added) != 0 {
+		if err := r.addAccounts(db); err != nil {
+			return err
+		}
+	}
+
+	allAccounts := accounts
+	for _, ac := range r.added {
+		allAccounts = append(allAccounts, *ac)
+	}
+
+	for _, entry := range entries {
+		for i := range entry.tr.items {
+			item := &entry.tr.items[i]
+			item.account = *r.resolved[item.account.name]
+		}
+
+		if err := fillCurrencyAmounts(db, allAccounts, entry.tr); err != nil {
+			return fmt.Errorf("%d:%s", entry.lineNo, err)
+		}
+	}
+
+	from, to := entriesDateRange(entries)
+
+	im, err := newImporter(db, from, to, isDryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := im.add(entry); err != nil {
+			return err
+		}
+	}
+
+	return im.commit()
+}
+
+// ファイルの勘定科目を mita の勘定科目に対応づける
+type ledgerResolver struct {
+	declared map[string]*ledgerAccount
+	name2ac  map[string]*account
+	resolved map[string]*account // ファイルの勘定科目名ごと
+	added    []*account          // 追加する勘定科目。親が先
+	lastID   int                 // 追加する勘定科目の仮のID
+}
+
+func (r *ledgerResolver) resolve(fullName string) (*account, error) {
+	if ac, ok := r.resolved[fullName]; ok {
+		return ac, nil
+	}
+
+	components := strings.Split(fullName, ":")
+
+	name := components[len(components)-1]
+	decl := r.declared[fullName]
+
+	if decl != nil && decl.name != "" {
+		name = decl.name
+	}
+
+	if ac, ok := r.name2ac[name]; ok {
+		r.resolved[fullName] = ac
+		return ac, nil
+	}
+
+	ac := &account{name: name}
+
+	ac.accountType = ledgerType2acType(components[0])
+	if decl != nil {
+		if decl.accountType != 0 {
+			ac.accountType = decl.accountType
+		}
+
+		ac.currency = decl.currency
+		ac.isExtraordinary = decl.isExtraordinary
+	}
+
+	if ac.accountType == 0 {
+		return nil, fmt.Errorf("存在しない勘定科目'%s'(タイプが分からないので追加できない)", fullName)
+	}
+
+	if len(components) < 2 {
+		return nil, fmt.Errorf("勘定科目'%s'に最上位の階層がない", fullName)
+	}
+
+	if ac.currency != "" && ac.accountType != acTypeAsset && ac.accountType != acTypeLiability {
+		return nil, fmt.Errorf("外貨建てにできるのは資産と負債だけ: %s", fullName)
+	}
+
+	if len(components) >= 3 {
+		parent, err := r.resolve(strings.Join(components[:len(components)-1], ":"))
+		if err != nil {
+			return nil, err
+		}
+
+		ac.parent.id = parent.id
+		ac.parent.name = parent.name
+	}
+
+	r.lastID--
+	ac.id = r.lastID
+
+	r.added = append(r.added, ac)
+	r.name2ac[name] = ac
+	r.resolved[fullName] = ac
+
+	return ac, nil
+}
+
+// 明細の勘定科目は追加する勘定科目の ID が決まってから設定するので、ファイルの勘定科目名だけにしておく
+func (r *ledgerResolver) transaction(d *ledgerEntry) (*transaction, error) {
+	tr := &transaction{date: d.date, note: d.note, start: d.start, end: d.end}
+
+	if (tr.start == 0) != (tr.end == 0) {
+		return nil, errors.New("開始月と終了月は両方設定するか、両方設定しない")
+	}
+
+	tags, err := normalizeTags(d.tags)
+	if err != nil {
+		return nil, err
+	}
+	tr.tags = tags
+
+	sum := 0
+	elided := -1
+
+	for i, p := range d.postings {
+		ac, err := r.resolve(p.account)
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.hasAmount {
+			if elided != -1 {
+				return nil, errors.New("金額を省略できる明細は1つだけ")
+			}
+
+			elided = i
+			continue
+		}
+
+		if p.commodity != ledgerYen && p.commodity != ac.currency {
+			return nil, fmt.Errorf("%sの金額は外貨建て(%s)の勘定科目でないと使えない: %s", p.commodity, p.commodity, p.account)
+		}
+
+		sum += p.yen
+	}
+
+	for i, p := range d.postings {
+		var item transactionItem
+
+		item.account = account{name: p.account}
+
+		yen := p.yen
+		if i == elided {
+			yen = -sum
+		}
+
+		if p.commodity != ledgerYen && p.hasAmount {
+			item.currencyAmount = int(math.Abs(float64(p.amount)))
+		}
+
+		switch {
+		case yen > 0:
+			item.debit = yen
+		case yen < 0:
+			item.credit = -yen
+		default:
+			return nil, fmt.Errorf("%d:金額が 0 の明細", p.lineNo)
+		}
+
+		tr.items = append(tr.items, item)
+	}
+
+	// 借方を先に並べる
+	sort.SliceStable(tr.items, func(i, j int) bool {
+		return tr.items[i].debit != 0 && tr.items[j].debit == 0
+	})
+
+	if err := tr.validate(); err != nil {
+		return nil, err
+	}
+
+	return tr, nil
+}
+
+// 追加する勘定科目を親から順に追加して、ID を本当の ID にする
+func (r *ledgerResolver) addAccounts(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	tmp2id := make(map[int]int)
+
+	for _, ac := range r.added {
+		if ac.parent.id < 0 {
+			ac.parent.id = tmp2id[ac.parent.id]
+		}
+
+		id, err := dbAddAccount(tx, ac)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s:%s", ac.name, err)
+		}
+
+		tmp2id[ac.id] = id
+		ac.id = id
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLedgerRoundTrip(t *testing.T) {
+	for _, format := range []string{ledgerFormatLedger, ledgerFormatBeancount} {
+		t.Run(format, func(t *testing.T) {
+			testLedgerRoundTrip(t, format)
+		})
+	}
+}
+
+func testLedgerRoundTrip(t *testing.T, format string) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAddAccount(db, []string{"資産", "USD預金", "", "", "USD"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 外貨建て、開始月と終了月、タグのある取引
+	tsv := "2019-12-10\tUSD預金@100.50\tA銀行\t15000\t両替\t0\t0\n" +
+		"2019-12-20\t保険\tA銀行\t12000\t年払い \"火災\"\t2019-12\t2020-11\t\t保険 hoken\n"
+
+	if err := readTransactions(db, strings.NewReader(tsv), false); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := findTransactions(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exported := new(bytes.Buffer)
+	if err := writeLedgerTransactions(db, exported, nil, format); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(exported.String(), "Expenses:水道光熱費:電気代") ||
+		!strings.Contains(exported.String(), "100.50 USD @@ 15000 JPY") {
+		t.Fatal("勘定科目か外貨の金額が違う:\n" + exported.String())
+	}
+
+	// 空のデータベースに読み込むと、勘定科目も追加される
+	if err := dbClean(db); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := parseLedger(bytes.NewReader(exported.Bytes()), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := importLedgerJournal(db, journal, false); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := findTransactions(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(after) != len(before) {
+		t.Fatalf("len(after) = %d, len(before) = %d", len(after), len(before))
+	}
+
+	for i := range before {
+		b := strings.Join(transaction2tsv(&before[i]), "\t")
+		a := strings.Join(transaction2tsv(&after[i]), "\t")
+
+		if a != b {
+			t.Errorf("before = %s\nafter = %s", b, a)
+		}
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range accounts {
+		if d.name == "電気代" && d.parent.name != "水道光熱費" {
+			t.Error("親が違う:", d.parent.name)
+		}
+
+		if d.name == "USD預金" && d.currency != "USD" {
+			t.Error("通貨が違う:", d.currency)
+		}
+	}
+
+	reexported := new(bytes.Buffer)
+	if err := writeLedgerTransactions(db, reexported, nil, format); err != nil {
+		t.Fatal(err)
+	}
+
+	if reexported.String() != exported.String() {
+		t.Errorf("書き出し直すと違う:\n%s\n%s", exported.String(), reexported.String())
+	}
+
+	// もう一度読み込んでも重複なので追加しない
+	if err := readLedgerTransactions(db, bytes.NewReader(exported.Bytes()), format, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := findTransactions(db, nil); err != nil || len(found) != len(before) {
+		t.Fatal("重複が追加された:", len(found), err)
+	}
+}
+
+func TestParseLedger(t *testing.T) {
+	src := `; hledger の書式
+account Assets:Cash  ; type: A
+account Expenses:Food
+
+2019/11/03 * (12) スーパー  ; :食材:旅行:
+    Expenses:Food    ¥1,200
+    Assets:Cash
+
+2019-11-04 両替
+    Assets:USD  100.50 USD @ 150 JPY  ; 単価
+    Assets:Cash  -15075.00 JPY = 0 JPY
+
+~ monthly
+    Expenses:Food  100 JPY
+    Assets:Cash
+`
+
+	journal, err := parseLedger(strings.NewReader(src), ledgerFormatLedger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(journal.accounts) != 2 || journal.accounts[0].accountType != acTypeAsset {
+		t.Fatal("勘定科目の宣言が違う:", journal.accounts)
+	}
+
+	if len(journal.entries) != 2 {
+		t.Fatal("len(journal.entries) != 2:", len(journal.entries))
+	}
+
+	d := journal.entries[0]
+	if d.note != "スーパー" || strings.Join(d.tags, " ") != "食材 旅行" || len(d.postings) != 2 ||
+		d.postings[0].yen != 1200 || d.postings[1].hasAmount {
+		t.Fatalf("取引が違う: %+v", d)
+	}
+
+	p := journal.entries[1].postings
+	if p[0].commodity != "USD" || p[0].amount != 10050 || p[0].yen != 15075 || p[1].yen != -15075 {
+		t.Fatalf("明細が違う: %+v", p)
+	}
+
+	errTests := []string{
+		"2019-11-01 x\n    Assets:Cash  100 USD\n",
+		"2019-11-01 x\n    (Assets:Cash)  100 JPY\n",
+		"2019-11-01 x\n    Assets:Cash  100.5 JPY\n",
+		"2019-11-01 x\n    Assets:Cash  100 USD @@ 1 EUR\n",
+		"2019-11-01 x\n    ; start: abc\n",
+	}
+
+	for _, s := range errTests {
+		if _, err := parseLedger(strings.NewReader(s), ledgerFormatLedger); err == nil {
+			t.Errorf("%q: エラーになるはず", s)
+		}
+	}
+
+	src = `option "operating_currency" "JPY"
+
+2019-11-01 open Assets:Cash JPY
+2019-11-01 open Assets:Bank-USD USD
+  name: "USD預金"
+
+2019-11-03 * "店" "夕食" #travel
+  tags: "北海道"
+  start: "2019-11"
+  end: "2019-12"
+  Expenses:Food  1200 JPY
+  Assets:Cash
+
+2019-11-05 balance Assets:Cash  -1200 JPY
+`
+
+	journal, err = parseLedger(strings.NewReader(src), ledgerFormatBeancount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(journal.accounts) != 2 || journal.accounts[1].currency != "USD" || journal.accounts[1].name != "USD預金" {
+		t.Fatalf("勘定科目の宣言が違う: %+v", journal.accounts[1])
+	}
+
+	d = journal.entries[0]
+	if len(journal.entries) != 1 || d.note != "夕食" || strings.Join(d.tags, " ") != "travel 北海道" ||
+		d.start != 201911 || d.end != 201912 {
+		t.Fatalf("取引が違う: %+v", d)
+	}
+}
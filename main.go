@@ -26,26 +26,49 @@ import (
 const appName = "mita"
 const version = "0.9.0"
 
+const defaultDBDriver = "postgres"
 const defaultDBName = "mita"
 const defaultPort = 5001
 
 type config struct {
-	DB     database `toml:"database"`
-	Server server   `toml:"server"`
+	FiscalYearStartMonth int                      `toml:"fiscal_year_start_month"` // 年度の開始月
+	DB                   database                 `toml:"database"`
+	Server               server                   `toml:"server"`
+	Schedule             scheduleConfig           `toml:"schedule"`
+	UI                   uiConfig                 `toml:"ui"`
+	Attachment           attachmentConfig         `toml:"attachment"`
+	Profiles             map[string]importProfile `toml:"profiles"`           // 明細CSVの形式
+	StatementAccounts    map[string]string        `toml:"statement_accounts"` // OFX と QIF の口座に対応する勘定科目
 }
 
 type database struct {
+	Driver   string `toml:"driver"` // postgres または sqlite
 	Name     string `toml:"name"`
 	User     string `toml:"user"`
 	Password string `toml:"password"`
+	Path     string `toml:"path"` // SQLite のファイル。省略すると設定ディレクトリの<name>.db
 }
 
 type server struct {
 	Port int `toml:"port"`
 }
 
+type scheduleConfig struct {
+	AutoRun bool `toml:"auto_run"` // コマンドの開始時にスケジュールを実行する
+}
+
+type uiConfig struct {
+	Selector string `toml:"selector"` // auto, fzf, builtin。auto は fzf があれば fzf を使う
+}
+
+type attachmentConfig struct {
+	Dir string `toml:"dir"` // 添付ファイルを保存するディレクトリ。省略すると設定ディレクトリの attachments
+}
+
 var configData = config{
+	1,
 	database{
+		Driver:   defaultDBDriver,
 		Name:     defaultDBName,
 		User:     "",
 		Password: "",
@@ -53,6 +76,15 @@ var configData = config{
 	server{
 		Port: defaultPort,
 	},
+	scheduleConfig{
+		AutoRun: true,
+	},
+	uiConfig{
+		Selector: selectorAuto,
+	},
+	attachmentConfig{},
+	nil,
+	nil,
 }
 
 var testMode = false
@@ -68,10 +100,32 @@ func main() {
 		return
 	}
 
+	operationCommand = strings.Join(os.Args[1:], " ")
+
 	app := &cli.App{
 		Name:    appName,
 		Usage:   "家計簿のミタ",
 		Version: version,
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Value: outputText,
+				Usage: "一覧と報告の出力形式 (text, json, csv, tsv)"},
+		},
+		Before: func(context *cli.Context) error {
+			if err := setOutputFormat(context.String("output")); err != nil {
+				return err
+			}
+
+			if configData.Schedule.AutoRun {
+				autoRunSchedules(context.Args().First())
+			}
+
+			return nil
+		},
+		After: func(context *cli.Context) error {
+			recordCommandOperation(context.Args().First())
+
+			return nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:    "transaction",
@@ -84,9 +138,18 @@ func main() {
 						Usage:   "取引を一覧",
 						Flags: []cli.Flag{
 							&cli.BoolFlag{Name: "all", Aliases: []string{"a"}},
+							&cli.StringFlag{Name: "query", Aliases: []string{"q"}, Usage: "検索条件"},
+							&cli.StringSliceFlag{Name: "tag", Aliases: []string{"t"}, Usage: "タグの付いた取引だけ"},
 						},
 						Action: cmdListTransactions,
 					},
+					{
+						Name:      "find",
+						Aliases:   []string{"f"},
+						Usage:     "検索条件に一致する取引を一覧",
+						ArgsUsage: "[条件...]",
+						Action:    cmdFindTransactions,
+					},
 					{
 						Name:    "search",
 						Aliases: []string{"s"},
@@ -97,13 +160,19 @@ func main() {
 						Name:    "add",
 						Aliases: []string{"a"},
 						Usage:   "取引を追加",
-						Action:  cmdAddTransaction,
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{Name: "tag", Aliases: []string{"t"}, Usage: "取引に付けるタグ"},
+						},
+						Action: cmdAddTransaction,
 					},
 					{
 						Name:    "edit",
 						Aliases: []string{"e"},
 						Usage:   "取引を編集",
-						Action:  cmdEditTransaction,
+						Flags: []cli.Flag{
+							&cli.BoolFlag{Name: "editor", Usage: "月の取引をまとめてエディタで編集する"},
+						},
+						Action: cmdEditTransaction,
 					},
 					{
 						Name:    "remove",
@@ -112,15 +181,66 @@ func main() {
 						Action:  cmdRemoveTransaction,
 					},
 					{
-						Name:   "import",
-						Usage:  "取引のインポート",
+						Name:  "bulk-edit",
+						Usage: "選んだ取引をまとめて変更",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "query", Aliases: []string{"q"}, Usage: "検索条件。省略するとfzfで選ぶ"},
+							&cli.StringSliceFlag{Name: "debit", Usage: "借方の勘定科目を置き換える(置き換え元=置き換え先)"},
+							&cli.StringSliceFlag{Name: "credit", Usage: "貸方の勘定科目を置き換える(置き換え元=置き換え先)"},
+							&cli.StringSliceFlag{Name: "account", Usage: "勘定科目を置き換える(置き換え元=置き換え先)"},
+							&cli.IntFlag{Name: "shift-days", Usage: "日付をずらす日数"},
+							&cli.StringFlag{Name: "note", Usage: "摘要を置き換える"},
+							&cli.BoolFlag{Name: "dry-run", Aliases: []string{"n"}, Usage: "変更せずに結果だけ表示"},
+						},
+						Action: cmdBulkEditTransactions,
+					},
+					{
+						Name:  "bulk-remove",
+						Usage: "選んだ取引をまとめて削除",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "query", Aliases: []string{"q"}, Usage: "検索条件。省略するとfzfで選ぶ"},
+							&cli.BoolFlag{Name: "dry-run", Aliases: []string{"n"}, Usage: "削除せずに結果だけ表示"},
+						},
+						Action: cmdBulkRemoveTransactions,
+					},
+					{
+						Name:  "import",
+						Usage: "取引のインポート",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "format", Aliases: []string{"f"}, Usage: "明細CSVの形式の名前、または ledger, beancount, ofx, qif"},
+							&cli.StringFlag{Name: "account", Usage: "OFX か QIF の明細の勘定科目"},
+							&cli.StringFlag{Name: "suspense", Usage: "相手の勘定科目が決まらない明細に使う仮勘定"},
+							&cli.BoolFlag{Name: "dry-run", Aliases: []string{"n"}, Usage: "追加せずに結果だけ表示"},
+						},
 						Action: cmdImportTransactions,
 					},
 					{
-						Name:   "export",
-						Usage:  "取引のエクスポート",
+						Name:  "export",
+						Usage: "取引のエクスポート",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "query", Aliases: []string{"q"}, Usage: "検索条件"},
+							&cli.StringFlag{Name: "format", Aliases: []string{"f"}, Value: "tsv", Usage: "出力形式 (tsv, ledger, beancount)"},
+							&cli.StringFlag{Name: "attachments", Usage: "添付ファイルも書き出すディレクトリ"},
+						},
 						Action: cmdExportTransactions,
 					},
+					{
+						Name:      "attach",
+						Usage:     "取引にファイルを添付",
+						ArgsUsage: "ファイル...",
+						Flags: []cli.Flag{
+							&cli.IntFlag{Name: "id", Usage: "取引ID。省略するとfzfで選ぶ"},
+						},
+						Action: cmdAttach,
+					},
+					{
+						Name:  "attachments",
+						Usage: "添付ファイルを一覧",
+						Flags: []cli.Flag{
+							&cli.IntFlag{Name: "id", Usage: "取引ID。省略すると全ての取引"},
+						},
+						Action: cmdListAttachments,
+					},
 				},
 			},
 			{
@@ -248,6 +368,176 @@ func main() {
 					},
 				},
 			},
+			{
+				Name:    "schedule",
+				Aliases: []string{"sc"},
+				Usage:   "定期的な取引のスケジュールのオプション",
+				Subcommands: []*cli.Command{
+					{
+						Name:    "list",
+						Aliases: []string{"ls"},
+						Usage:   "スケジュールを一覧",
+						Action:  cmdListSchedules,
+					},
+					{
+						Name:    "add",
+						Aliases: []string{"a"},
+						Usage:   "スケジュールを追加",
+						Action:  cmdAddSchedule,
+					},
+					{
+						Name:    "edit",
+						Aliases: []string{"e"},
+						Usage:   "スケジュールを編集",
+						Action:  cmdEditSchedule,
+					},
+					{
+						Name:    "remove",
+						Aliases: []string{"r"},
+						Usage:   "スケジュールを削除",
+						Action:  cmdRemoveSchedule,
+					},
+					{
+						Name:   "run",
+						Usage:  "期日が来たスケジュールの取引を追加",
+						Action: cmdRunSchedules,
+					},
+				},
+			},
+			{
+				Name:    "budget",
+				Aliases: []string{"bu"},
+				Usage:   "予算のオプション",
+				Subcommands: []*cli.Command{
+					{
+						Name:    "list",
+						Aliases: []string{"ls"},
+						Usage:   "月の予算を一覧",
+						Action:  cmdListBudgets,
+					},
+					{
+						Name:    "set",
+						Aliases: []string{"s"},
+						Usage:   "予算を設定",
+						Action:  cmdSetBudget,
+					},
+					{
+						Name:   "import",
+						Usage:  "予算のインポート",
+						Action: cmdImportBudgets,
+					},
+					{
+						Name:   "export",
+						Usage:  "予算のエクスポート",
+						Action: cmdExportBudgets,
+					},
+				},
+			},
+			{
+				Name:    "assert",
+				Aliases: []string{"as"},
+				Usage:   "残高の確認のオプション",
+				Subcommands: []*cli.Command{
+					{
+						Name:    "list",
+						Aliases: []string{"ls"},
+						Usage:   "残高の確認を一覧",
+						Action:  cmdListAssertions,
+					},
+					{
+						Name:    "add",
+						Aliases: []string{"a"},
+						Usage:   "残高の確認を追加",
+						Action:  cmdAddAssertion,
+					},
+					{
+						Name:    "remove",
+						Aliases: []string{"r"},
+						Usage:   "残高の確認を削除",
+						Action:  cmdRemoveAssertion,
+					},
+					{
+						Name:   "import",
+						Usage:  "残高の確認のインポート",
+						Action: cmdImportAssertions,
+					},
+					{
+						Name:   "export",
+						Usage:  "残高の確認のエクスポート",
+						Action: cmdExportAssertions,
+					},
+				},
+			},
+			{
+				Name:  "check",
+				Usage: "残高の確認と帳簿を比較",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "no-fix", Usage: "調整の取引を追加するか確認しない"},
+				},
+				Action: cmdCheck,
+			},
+			{
+				Name:  "rule",
+				Usage: "明細CSVの取り込み規則のオプション",
+				Subcommands: []*cli.Command{
+					{
+						Name:    "list",
+						Aliases: []string{"ls"},
+						Usage:   "取り込み規則を一覧",
+						Action:  cmdListImportRules,
+					},
+					{
+						Name:    "add",
+						Aliases: []string{"a"},
+						Usage:   "取り込み規則を追加",
+						Action:  cmdAddImportRule,
+					},
+					{
+						Name:    "remove",
+						Aliases: []string{"r"},
+						Usage:   "取り込み規則を削除",
+						Action:  cmdRemoveImportRule,
+					},
+					{
+						Name:   "import",
+						Usage:  "取り込み規則のインポート",
+						Action: cmdImportImportRules,
+					},
+					{
+						Name:   "export",
+						Usage:  "取り込み規則のエクスポート",
+						Action: cmdExportImportRules,
+					},
+				},
+			},
+			{
+				Name:  "rate",
+				Usage: "為替レートのオプション",
+				Subcommands: []*cli.Command{
+					{
+						Name:    "list",
+						Aliases: []string{"ls"},
+						Usage:   "為替レートを一覧",
+						Action:  cmdListRates,
+					},
+					{
+						Name:    "add",
+						Aliases: []string{"a"},
+						Usage:   "為替レートを追加",
+						Action:  cmdAddRate,
+					},
+					{
+						Name:   "import",
+						Usage:  "為替レートのインポート",
+						Action: cmdImportRates,
+					},
+					{
+						Name:   "export",
+						Usage:  "為替レートのエクスポート",
+						Action: cmdExportRates,
+					},
+				},
+			},
 			{
 				Name:  "history",
 				Usage: "履歴のオプション",
@@ -273,9 +563,36 @@ func main() {
 				Usage: "月の収入・費用の一覧",
 				Flags: []cli.Flag{
 					&cli.BoolFlag{Name: "cash", Aliases: []string{"c"}},
+					&cli.BoolFlag{Name: "budget", Aliases: []string{"b"}, Usage: "予算と比較する"},
+					&cli.StringFlag{Name: "from", Usage: "開始月"},
+					&cli.StringFlag{Name: "to", Usage: "終了月"},
+					&cli.IntFlag{Name: "last", Aliases: []string{"l"}, Usage: "終了月までの月数"},
+					&cli.BoolFlag{Name: "monthly", Aliases: []string{"m"}, Usage: "月ごとに列を並べて表示"},
 				},
 				Action: cmdPL,
 			},
+			{
+				Name:  "report",
+				Usage: "報告のオプション",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "annual",
+						Usage:  "年度の報告",
+						Action: cmdReportAnnual,
+					},
+					{
+						Name:      "tag",
+						Usage:     "タグの付いた取引だけのP/L",
+						ArgsUsage: "タグ",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{Name: "cash", Aliases: []string{"c"}},
+							&cli.StringFlag{Name: "from", Usage: "開始月"},
+							&cli.StringFlag{Name: "to", Usage: "終了月"},
+						},
+						Action: cmdReportTag,
+					},
+				},
+			},
 			{
 				Name:  "server",
 				Usage: "グラフサイトを表示するHTTPサーバを起動",
@@ -294,9 +611,64 @@ func main() {
 				Action: cmdData,
 			},
 			{
-				Name:   "undo",
-				Usage:  "取引への操作を元に戻す",
-				Action: cmdUndoTransaction,
+				Name:   "backup",
+				Usage:  "データベースをファイルにバックアップ",
+				Action: cmdBackup,
+			},
+			{
+				Name:   "restore",
+				Usage:  "バックアップファイルから新しいデータベースに復元",
+				Action: cmdRestore,
+			},
+			{
+				Name:  "db",
+				Usage: "データベースの作成・更新",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "init",
+						Usage:  "新しいデータベースにテーブル等を作成",
+						Action: cmdDBInit,
+					},
+					{
+						Name:   "migrate",
+						Usage:  "既存のデータベースのスキーマを最新にする",
+						Action: cmdDBMigrate,
+					},
+					{
+						Name:   "version",
+						Usage:  "スキーマのバージョンを表示",
+						Action: cmdDBVersion,
+					},
+					{
+						Name:   "verify",
+						Usage:  "集計テーブルが取引と一致するか確認",
+						Action: cmdDBVerify,
+					},
+					{
+						Name:   "rebuild",
+						Usage:  "集計テーブルを取引から作り直す",
+						Action: cmdDBRebuild,
+					},
+				},
+			},
+			{
+				Name:  "undo",
+				Usage: "最新の操作で変更した取引をまとめて元に戻す",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "list", Aliases: []string{"l"}, Usage: "操作を一覧"},
+					&cli.BoolFlag{Name: "select", Aliases: []string{"s"}, Usage: "履歴を1件選んで元に戻す"},
+				},
+				Action: cmdUndoOperation,
+			},
+			{
+				Name:   "redo",
+				Usage:  "最後に元に戻した操作をやり直す",
+				Action: cmdRedoOperation,
+			},
+			{
+				Name:   "tui",
+				Usage:  "全画面で取引を閲覧・編集する",
+				Action: cmdTUI,
 			},
 		},
 	}
@@ -336,6 +708,10 @@ func loadOrCreateConfig() error {
 		}
 	}
 
+	if conf.DB.Driver == "" {
+		conf.DB.Driver = defaultDBDriver
+	}
+
 	if conf.DB.Name == "" {
 		conf.DB.Name = defaultDBName
 	}
@@ -344,6 +720,11 @@ func loadOrCreateConfig() error {
 		conf.Server.Port = defaultPort
 	}
 
+	// 省略すると configData の初期値の 1 のままなので、0 も範囲外として扱う
+	if conf.FiscalYearStartMonth < 1 || conf.FiscalYearStartMonth > 12 {
+		return fmt.Errorf("設定ファイルの fiscal_year_start_month は1から12: %d", conf.FiscalYearStartMonth)
+	}
+
 	return nil
 }
 
@@ -366,43 +747,55 @@ type dbtx interface {
 	Exec(string, ...interface{}) (sql.Result, error)
 }
 
-const pgDomain = "/var/run/postgresql/"
-
+// データベースへ接続して、スキーマが最新か確認する
 func connectDB() (*sql.DB, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkSchemaVersion(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// スキーマを確認せずにデータベースへ接続する
+func openDB() (*sql.DB, error) {
+	st, err := getStorage()
+	if err != nil {
+		return nil, err
+	}
+
 	name := configData.DB.Name
 
 	if s := os.Getenv("MITA_DB"); s != "" {
 		name = s
 	}
 
-	if runtime.GOOS != "windows" {
-		if _, err := os.Stat(pgDomain); err == nil {
-			/* peer認証で接続するために、hostを指定して
-			   UNIXドメインで接続してみる */
-			db, err := sql.Open("postgres",
-				fmt.Sprintf("host=%s dbname=%s sslmode=disable", pgDomain, name))
-			if err == nil {
-				return db, nil
-			}
-		}
-	}
-
-	var dataSrcName string
+	return st.open(name)
+}
 
-	user := configData.DB.User
-	password := configData.DB.Password
+var fzfFound *bool
 
-	if user != "" {
-		dataSrcName = fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", user, password, name)
-	} else {
-		dataSrcName = fmt.Sprintf("dbname=%s sslmode=disable", name)
+func hasFzf() bool {
+	if fzfFound == nil {
+		_, err := exec.LookPath("fzf")
+		found := err == nil
+		fzfFound = &found
 	}
 
-	return sql.Open("postgres", dataSrcName)
+	return *fzfFound
 }
 
-var isFirstRunFzf = true
+/*
+選択肢から選ぶ
 
+src の1行が1つの選択肢で、選んだ行を dst に書く。キャンセルされたら true を返す。
+設定により fzf か組み込みの選択画面(selector.go)を使う。
+*/
 func fzf(src io.Reader, dst io.Writer, errDst io.Writer, args []string) (bool, error) {
 	if testMode {
 		s, err := input()
@@ -418,15 +811,23 @@ func fzf(src io.Reader, dst io.Writer, errDst io.Writer, args []string) (bool, e
 		return false, nil
 	}
 
-	if isFirstRunFzf {
-		_, err := exec.LookPath("fzf")
-		if err != nil {
-			return false, errors.New("実行ファイル'fzf'が見つからない")
-		}
+	name, err := selectorName()
+	if err != nil {
+		return false, err
+	}
+
+	if name == selectorBuiltin {
+		return builtinSelect(src, dst, args)
+	}
 
-		isFirstRunFzf = false
+	if !hasFzf() {
+		return false, errors.New("実行ファイル'fzf'が見つからない")
 	}
 
+	return runFzf(src, dst, errDst, args)
+}
+
+func runFzf(src io.Reader, dst io.Writer, errDst io.Writer, args []string) (bool, error) {
 	cmd := exec.Command("fzf", args...)
 
 	stdin, _ := cmd.StdinPipe()
@@ -478,7 +879,9 @@ func fzf(src io.Reader, dst io.Writer, errDst io.Writer, args []string) (bool, e
 	return false, err
 }
 
-/* テキストエディタを開いてユーザからテキストを得る
+/*
+	テキストエディタを開いてユーザからテキストを得る
+
 戻り値のboolはcancel
 */
 func scanWithEditor(text string) (string, bool, error) {
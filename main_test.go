@@ -5,19 +5,49 @@ import (
 	_ "github.com/lib/pq"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
+var isFirstSetup = true
+
 func setup() (*sql.DB, error) {
 	testMode = true
 
 	configData.DB.Name = "mita_test"
+	configData.Attachment.Dir = filepath.Join(os.TempDir(), "mita_test_attachments")
+
+	if storageName() == "sqlite" {
+		configData.DB.Path = filepath.Join(os.TempDir(), "mita_test.db")
+
+		if isFirstSetup {
+			// 前回のテストのデータベースは使わずに作り直す
+			for _, suffix := range []string{"", "-wal", "-shm"} {
+				os.Remove(configData.DB.Path + suffix)
+			}
+		}
+	}
+
+	isFirstSetup = false
 
-	db, err := connectDB()
+	db, err := openDB()
 	if err != nil {
 		return nil, err
 	}
 
+	version, err := dbGetSchemaVersion(db)
+	if err != nil {
+		return db, err
+	}
+
+	if version == 0 {
+		if err := runDBInit(db); err != nil {
+			return db, err
+		}
+	} else if err := checkSchemaVersion(db); err != nil {
+		return db, err
+	}
+
 	err = dbClean(db)
 	if err != nil {
 		return db, err
@@ -57,15 +87,34 @@ func setupAcAndTr() (*sql.DB, error) {
 	}
 	defer f.Close()
 
-	if err := readTransactions(db, f); err != nil {
+	if err := readTransactions(db, f, false); err != nil {
 		return db, err
 	}
 
 	return db, nil
 }
 
+var cleanTables = []string{"assertions", "import_rules", "budgets", "schedules_log", "schedules",
+	"transactions_import", "transactions_tags", "tags", "attachments", "transactions_detail", "transactions",
+	"transactions_import_history", "attachments_history", "transactions_detail_history", "transactions_history",
+	"operations", "templates_detail", "templates", "exchange_rates", "transactions_month", "transactions_summary",
+	"groups_detail", "groups", "accounts"}
+
 func dbClean(db *sql.DB) error {
-	_, err := db.Exec("TRUNCATE transactions, transactions_history, templates_detail, templates, transactions_month, transactions_summary, accounts RESTART IDENTITY")
+	if storageName() == "sqlite" {
+		// 連番は最大値の次から振られるので、全行を削除すれば1に戻る
+		var b strings.Builder
+
+		for _, table := range append(cleanTables, "transactions_dirty") {
+			b.WriteString("DELETE FROM " + table + ";\n")
+		}
+
+		_, err := db.Exec(b.String())
+
+		return err
+	}
+
+	_, err := db.Exec("TRUNCATE " + strings.Join(cleanTables, ", ") + " RESTART IDENTITY")
 
 	return err
 }
@@ -117,16 +166,16 @@ func testTransaction(t *testing.T, d transaction, date string, debit string, cre
 		t.Fatalf("wrong transaction.date, got= %s, want = %s", d.date.Format("2006-01-02"), date)
 	}
 
-	if d.debit.name != debit {
-		t.Fatalf("wrong transaction.debit.name, got= %s, want = %s", d.debit.name, debit)
+	if d.debit().name != debit {
+		t.Fatalf("wrong transaction.debit.name, got= %s, want = %s", d.debit().name, debit)
 	}
 
-	if d.credit.name != credit {
-		t.Fatalf("wrong transaction.credit.name, got= %s, want = %s", d.credit.name, credit)
+	if d.credit().name != credit {
+		t.Fatalf("wrong transaction.credit.name, got= %s, want = %s", d.credit().name, credit)
 	}
 
-	if d.amount != amount {
-		t.Fatalf("wrong transaction.amount, got= %d, want = %d", d.amount, amount)
+	if d.amount() != amount {
+		t.Fatalf("wrong transaction.amount, got= %d, want = %d", d.amount(), amount)
 	}
 
 	if d.note != note {
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/rakyll/statik/fs"
+	"github.com/urfave/cli/v2"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+スキーマのバージョン
+
+スキーマを変更したら schemaVersion を 1 増やし、
+public/data/migrations/<driver>/ に既存のデータベースを変更する SQL を
+"<新しいバージョン>_<名前>.sql" というファイル名で追加する。
+
+バージョン 1 は 0.9.0 のスキーマ(schema_version テーブルがない)。
+*/
+const schemaVersion = 9
+
+const migrationsDir = "/data/migrations/"
+
+type migration struct {
+	version  int
+	filename string
+}
+
+// 埋め込んだマイグレーションをバージョン順に返す
+func getMigrations(driver string) ([]migration, error) {
+	statikFS, err := fs.New()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := statikFS.Open(migrationsDir + driver)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer dir.Close()
+
+	files, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".sql") {
+			continue
+		}
+
+		i := strings.Index(f.Name(), "_")
+		if i == -1 {
+			return nil, fmt.Errorf("マイグレーションのファイル名が不正: %s", f.Name())
+		}
+
+		version, err := strconv.Atoi(f.Name()[:i])
+		if err != nil {
+			return nil, fmt.Errorf("マイグレーションのファイル名が不正: %s", f.Name())
+		}
+
+		migrations = append(migrations, migration{
+			version:  version,
+			filename: path.Join("migrations", driver, f.Name()),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
+
+/*
+データベースのスキーマのバージョンを返す
+
+テーブルが1つもなければ 0、
+schema_version テーブルがなく accounts テーブルがあれば 1(0.9.0)
+*/
+func dbGetSchemaVersion(db *sql.DB) (int, error) {
+	st, err := getStorage()
+	if err != nil {
+		return 0, err
+	}
+
+	ok, err := st.hasTable(db, "schema_version")
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		ok, err := st.hasTable(db, "accounts")
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			return 1, nil
+		}
+
+		return 0, nil
+	}
+
+	var version int
+
+	if err := db.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// スキーマが最新でなければ、何をすればいいかをエラーで返す
+func checkSchemaVersion(db *sql.DB) error {
+	version, err := dbGetSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version == 0 {
+		return errors.New("データベースが初期化されてない。mita db init を実行してください")
+	}
+
+	if version < schemaVersion {
+		return fmt.Errorf("データベースのスキーマが古い(バージョン %d, 必要なバージョン %d)。mita db migrate を実行してください",
+			version, schemaVersion)
+	}
+
+	if version > schemaVersion {
+		return fmt.Errorf("データベースのスキーマがこの mita より新しい(バージョン %d, 対応しているバージョン %d)。mita を更新してください",
+			version, schemaVersion)
+	}
+
+	return nil
+}
+
+func cmdDBInit(context *cli.Context) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := runDBInit(db); err != nil {
+		return err
+	}
+
+	printf("データベースを作成した(バージョン %d)\n", schemaVersion)
+
+	return nil
+}
+
+func runDBInit(db *sql.DB) error {
+	version, err := dbGetSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version != 0 {
+		return fmt.Errorf("データベースは初期化済み(バージョン %d)", version)
+	}
+
+	st, err := getStorage()
+	if err != nil {
+		return err
+	}
+
+	schema, err := readDataFile(st.schemaFile())
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(schema); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func cmdDBMigrate(context *cli.Context) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runDBMigrate(db)
+}
+
+func runDBMigrate(db *sql.DB) error {
+	version, err := dbGetSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version == 0 {
+		return errors.New("データベースが初期化されてない。mita db init を実行してください")
+	}
+
+	if version > schemaVersion {
+		return fmt.Errorf("データベースのスキーマがこの mita より新しい(バージョン %d)。mita を更新してください", version)
+	}
+
+	if version == schemaVersion {
+		printf("スキーマは最新(バージョン %d)\n", version)
+		return nil
+	}
+
+	migrations, err := getMigrations(storageName())
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		if m.version > schemaVersion {
+			break
+		}
+
+		if err := dbApplyMigration(db, m); err != nil {
+			return fmt.Errorf("%s: %s", m.filename, err)
+		}
+
+		printf("適用: %s\n", m.filename)
+
+		version = m.version
+	}
+
+	if version != schemaVersion {
+		return fmt.Errorf("バージョン %d へのマイグレーションがない", version+1)
+	}
+
+	return nil
+}
+
+// マイグレーションを1つのトランザクションで適用する
+func dbApplyMigration(db *sql.DB, m migration) error {
+	contents, err := readDataFile(m.filename)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(contents); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE schema_version SET version = $1", m.version); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func cmdDBVersion(context *cli.Context) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	version, err := dbGetSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	printf("データベース: %d\nmita: %d\n", version, schemaVersion)
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+// 最新のスキーマへのマイグレーションがある
+func TestGetMigrations(t *testing.T) {
+	migrations, err := getMigrations("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) == 0 {
+		t.Fatal("len(migrations) == 0")
+	}
+
+	for i, m := range migrations {
+		if m.version != i+2 {
+			t.Errorf("%s: version = %d", m.filename, m.version)
+		}
+	}
+
+	if m := migrations[len(migrations)-1]; m.version != schemaVersion {
+		t.Errorf("最新のマイグレーション %d, schemaVersion %d", m.version, schemaVersion)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	db, err := setup()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := dbGetSchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != schemaVersion {
+		t.Errorf("version = %d", version)
+	}
+
+	if err := runDBInit(db); err == nil {
+		t.Error("初期化済みなのでエラーになるはず")
+	}
+
+	if err := runDBMigrate(db); err != nil {
+		t.Error(err)
+	}
+}
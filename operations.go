@@ -0,0 +1,595 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+操作
+
+コマンド1回で追加された履歴を1つの操作にまとめ、undo と redo はこの単位で取引を戻す。
+プロセスごとにセッションを決めておき、履歴を追加するトランザクションの中で、
+そのセッションのまとめ途中の操作(なければ追加する)に履歴を入れる。
+コマンドの終了時に、まとめ途中の操作にコマンドを記録して閉じる。
+他のプロセスが同時に追加した履歴は、そのプロセスの操作に入る。
+*/
+const (
+	operationNormal = "N"
+	operationUndo   = "U"
+	operationRedo   = "R"
+)
+
+const maxOperationCommandLen = 256
+
+// 操作として記録するコマンド。main で設定する
+var operationCommand string
+
+// このプロセスのセッション。PostgreSQL では接続の mita.session に設定する
+var operationSession = newOperationSession()
+
+func newOperationSession() string {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x-%x", time.Now().UnixNano(), os.Getpid())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+type operation struct {
+	id          int
+	operateTime time.Time
+	command     string
+	kind        string
+	targetID    int
+	isUndone    bool
+	count       int // 履歴の数
+}
+
+func (d *operation) String() string {
+	operateTime := d.operateTime.Local().Format("2006-01-02 15:04:05")
+
+	command := d.command
+	switch d.kind {
+	case operationUndo:
+		command = fmt.Sprintf("UNDO #%d", d.targetID)
+	case operationRedo:
+		command = fmt.Sprintf("REDO #%d", d.targetID)
+	}
+
+	if command == "" {
+		command = "(不明)"
+	}
+
+	undone := ""
+	if d.isUndone {
+		undone = " [取消]"
+	}
+
+	return fmt.Sprintf("#%d %s %3d件 %s%s", d.id, operateTime, d.count, command, undone)
+}
+
+/*
+コマンドの終了時に、そのコマンドで追加された履歴をまとめた操作を閉じる
+データベースを使わないコマンドと、履歴をそのまま扱うコマンドは除く
+*/
+func recordCommandOperation(cmdName string) {
+	switch cmdName {
+	case "", "help", "h", "data", "db", "backup", "restore":
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	if _, err := dbRecordOperation(db, operationCommand, operationNormal, 0); err != nil {
+		eprintln("操作の記録に失敗:", err)
+	}
+}
+
+const sqlGetOpenOperationID = `
+SELECT operation_id
+FROM operations
+WHERE session = $1
+`
+
+const sqlAddOperation = `
+INSERT INTO operations (operate_time, command, kind, target_id)
+VALUES ($1, $2, $3, $4)
+RETURNING operation_id
+`
+
+const sqlCloseOperation = `
+UPDATE operations
+SET operate_time = $2, command = $3, kind = $4, target_id = $5, session = NULL
+WHERE operation_id = $1
+`
+
+const sqlSetOperationUndone = `
+UPDATE operations
+SET is_undone = $2
+WHERE operation_id = $1
+`
+
+/*
+このプロセスのまとめ途中の操作を閉じて、操作のIDを返す
+UNDO と REDO の場合は、対象の操作の取り消し状態も更新する。
+通常の操作で、まとめ途中の操作がなければ何もしないで0を返す
+*/
+func dbRecordOperation(db *sql.DB, command string, kind string, targetID int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+
+	err = tx.QueryRow(sqlGetOpenOperationID, operationSession).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if id == 0 && kind == operationNormal {
+		tx.Rollback()
+		return 0, nil
+	}
+
+	if r := []rune(command); len(r) > maxOperationCommandLen {
+		command = string(r[:maxOperationCommandLen])
+	}
+
+	var target interface{}
+	if targetID != 0 {
+		target = targetID
+	}
+
+	if id == 0 {
+		err = tx.QueryRow(sqlAddOperation, time.Now(), command, kind, target).Scan(&id)
+	} else {
+		_, err = tx.Exec(sqlCloseOperation, id, time.Now(), command, kind, target)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if kind != operationNormal {
+		if _, err := tx.Exec(sqlSetOperationUndone, targetID, kind == operationUndo); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+const sqlGetOperationsSelect = `
+SELECT o.operation_id, o.operate_time, o.command, o.kind, COALESCE(o.target_id, 0), o.is_undone,
+       (SELECT COUNT(*) FROM transactions_history AS h WHERE h.operation_id = o.operation_id)
+FROM operations AS o
+`
+
+const sqlGetOperations = sqlGetOperationsSelect + `
+ORDER BY o.operation_id DESC
+`
+
+// 取り消されてない通常の操作で最新のもの。まとめ途中の操作は除く
+const sqlGetUndoTarget = sqlGetOperationsSelect + `
+WHERE o.kind = 'N' AND NOT o.is_undone AND o.session IS NULL
+ORDER BY o.operation_id DESC
+LIMIT 1
+`
+
+// 取り消された通常の操作で、その後に通常の操作がなく、最も古いもの
+const sqlGetRedoTarget = sqlGetOperationsSelect + `
+WHERE o.kind = 'N' AND o.is_undone AND o.session IS NULL AND o.operation_id >
+    (SELECT COALESCE(MAX(operation_id), 0) FROM operations WHERE kind = 'N' AND NOT is_undone)
+ORDER BY o.operation_id
+LIMIT 1
+`
+
+func rows2operations(rows *sql.Rows) ([]operation, error) {
+	var items []operation
+
+	for rows.Next() {
+		var d operation
+
+		if err := rows.Scan(&d.id, &d.operateTime, &d.command, &d.kind, &d.targetID, &d.isUndone, &d.count); err != nil {
+			return nil, err
+		}
+
+		items = append(items, d)
+	}
+	rows.Close()
+
+	return items, nil
+}
+
+func dbGetOperations(db *sql.DB) ([]operation, error) {
+	rows, err := db.Query(sqlGetOperations)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows2operations(rows)
+}
+
+func dbGetOperation1(db *sql.DB, sqlStr string) (*operation, error) {
+	rows, err := db.Query(sqlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := rows2operations(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	return &items[0], nil
+}
+
+const sqlGetOperationHistory = `
+SELECT ` + historyRows + `
+FROM history_view
+WHERE operation_id = $1
+ORDER BY transaction_id, version, no
+`
+
+const sqlGetPrevHistory = `
+SELECT ` + historyRows + `
+FROM history_view
+WHERE transaction_id = $1 AND version =
+    (SELECT MAX(version) FROM transactions_history WHERE transaction_id = $1 AND version < $2)
+ORDER BY no
+`
+
+// 操作による取引の変更。取引がない状態は nil
+type operationChange struct {
+	id     int
+	before *transaction
+	after  *transaction
+}
+
+// 操作の履歴から、取引ごとの操作の前後の状態を求める
+func dbGetOperationChanges(db *sql.DB, op *operation) ([]operationChange, error) {
+	rows, err := db.Query(sqlGetOperationHistory, op.id)
+	if err != nil {
+		return nil, err
+	}
+
+	histories, err := rows2histories(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []operationChange
+
+	for i := 0; i < len(histories); {
+		first := &histories[i]
+
+		j := i
+		for j+1 < len(histories) && histories[j+1].tr.id == first.tr.id {
+			j++
+		}
+		last := &histories[j]
+
+		c := operationChange{id: first.tr.id}
+
+		switch first.operation {
+		case "DELETE":
+			// 削除の履歴は削除する前の取引
+			c.before = &first.tr
+		case "UPDATE":
+			rows, err := db.Query(sqlGetPrevHistory, first.tr.id, first.tr.version)
+			if err != nil {
+				return nil, err
+			}
+
+			prev, err := rows2histories(rows)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(prev) == 0 || prev[0].operation == "DELETE" {
+				return nil, fmt.Errorf("取引 %d の変更前の履歴がない", first.tr.id)
+			}
+
+			c.before = &prev[0].tr
+		}
+
+		if last.operation != "DELETE" {
+			c.after = &last.tr
+		}
+
+		changes = append(changes, c)
+
+		i = j + 1
+	}
+
+	return changes, nil
+}
+
+// 取引の状態を比べるための文字列。取引がなければ空文字
+func transactionState(d *transaction) string {
+	if d == nil {
+		return ""
+	}
+
+	return strings.Join(transaction2tsv(d), "\t")
+}
+
+// ID の取引。なければ nil
+func dbFindTransaction(db *sql.DB, id int) (*transaction, error) {
+	rows, err := db.Query(sqlGetTransaction, id)
+	if err != nil {
+		return nil, err
+	}
+
+	transactions, err := rows2transactions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(transactions) == 0 {
+		return nil, nil
+	}
+
+	return &transactions[0], nil
+}
+
+const sqlGetNextVersion = `
+SELECT COALESCE(MAX(version), 0) + 1
+FROM transactions_history
+WHERE transaction_id = $1
+`
+
+/*
+取引を from の状態から to の状態に変える
+
+全ての取引が from の状態のままか確認してから、1つのトランザクションで変更する。
+後の操作で変更されている取引があれば何もしない
+*/
+func dbApplyOperationChanges(db *sql.DB, changes []operationChange, isUndo bool) error {
+	currents := make([]*transaction, len(changes))
+
+	for i, c := range changes {
+		from := c.after
+		if !isUndo {
+			from = c.before
+		}
+
+		cur, err := dbFindTransaction(db, c.id)
+		if err != nil {
+			return err
+		}
+
+		if transactionState(cur) != transactionState(from) {
+			return fmt.Errorf("取引 %d は後の操作で変更されているので戻せない", c.id)
+		}
+
+		currents[i] = cur
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for i, c := range changes {
+		to := c.before
+		if !isUndo {
+			to = c.after
+		}
+
+		if err := dbSetTransactionState(tx, c.id, currents[i], to); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("取引 %d: %s", c.id, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// 取引 id を cur の状態から to の状態にする
+func dbSetTransactionState(tx *sql.Tx, id int, cur *transaction, to *transaction) error {
+	if cur != nil {
+		if err := dbCheckTransactionVersion(tx, id, cur.version); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case to == nil && cur == nil:
+		return nil
+	case to == nil:
+		return dbRemoveTransaction(tx, id)
+	case cur != nil:
+		d := *to
+		d.id = id
+
+		return dbEditTransaction(tx, &d)
+	}
+
+	// 削除された取引を同じIDで追加し直す。バージョンは履歴と重ならないようにする
+	var version int
+
+	if err := tx.QueryRow(sqlGetNextVersion, id).Scan(&version); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(sqlAddTransactionForUndo, id, version, to.date, to.note, to.start, to.end); err != nil {
+		return err
+	}
+
+	if err := dbAddTransactionItems(tx, id, to.items); err != nil {
+		return err
+	}
+
+	if err := dbSetTransactionTags(tx, id, to.tags); err != nil {
+		return err
+	}
+
+	if err := dbRestoreAttachments(tx, id); err != nil {
+		return err
+	}
+
+	return dbRestoreImportedTransactionIDs(tx, id)
+}
+
+/*
+操作を取り消して UNDO として記録するか、取り消した操作をやり直して REDO として記録する
+変更した取引の、変更後の状態を返す
+*/
+func undoOperation(db *sql.DB, op *operation, isUndo bool) ([]*transaction, error) {
+	changes, err := dbGetOperationChanges(db, op)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dbApplyOperationChanges(db, changes, isUndo); err != nil {
+		return nil, err
+	}
+
+	kind := operationUndo
+	if !isUndo {
+		kind = operationRedo
+	}
+
+	if _, err := dbRecordOperation(db, "", kind, op.id); err != nil {
+		return nil, err
+	}
+
+	var items []*transaction
+
+	for _, c := range changes {
+		if isUndo {
+			items = append(items, c.before)
+		} else {
+			items = append(items, c.after)
+		}
+	}
+
+	return items, nil
+}
+
+func cmdUndoOperation(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if context.Bool("list") {
+		return runListOperations(db)
+	}
+
+	if context.Bool("select") {
+		return runUndoTransaction(db)
+	}
+
+	return runUndoOperation(db, true)
+}
+
+func cmdRedoOperation(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runUndoOperation(db, false)
+}
+
+func runListOperations(db *sql.DB) error {
+	items, err := dbGetOperations(db)
+	if err != nil {
+		return err
+	}
+
+	if isRecordOutput() {
+		t := newRecordTable("operation_id", "operate_time", "command", "kind", "target_id", "is_undone", "count")
+
+		for _, d := range items {
+			t.add(d.id, d.operateTime, d.command, d.kind, d.targetID, d.isUndone, d.count)
+		}
+
+		return printRecords(t)
+	}
+
+	for _, d := range items {
+		println(&d)
+	}
+
+	return nil
+}
+
+// 最新の操作を UNDO するか、最後に UNDO した操作を REDO する
+func runUndoOperation(db *sql.DB, isUndo bool) error {
+	// 記録されてない履歴があれば、それを先に1つの操作にする
+	if _, err := dbRecordOperation(db, "", operationNormal, 0); err != nil {
+		return err
+	}
+
+	sqlStr, name := sqlGetUndoTarget, "UNDO"
+	if !isUndo {
+		sqlStr, name = sqlGetRedoTarget, "REDO"
+	}
+
+	op, err := dbGetOperation1(db, sqlStr)
+	if err != nil {
+		return err
+	}
+
+	if op == nil {
+		println(name + "できる操作がない")
+		return nil
+	}
+
+	changes, err := dbGetOperationChanges(db, op)
+	if err != nil {
+		return err
+	}
+
+	println(op)
+
+	for _, c := range changes {
+		from, to := c.after, c.before
+		if !isUndo {
+			from, to = c.before, c.after
+		}
+
+		switch {
+		case to == nil:
+			printf("  削除: %v\n", from)
+		case from == nil:
+			printf("  追加: %v\n", to)
+		default:
+			printf("  変更: %v\n", to)
+		}
+	}
+
+	if !confirmYesNo("本当に" + name + "する?") {
+		return nil
+	}
+
+	_, err = undoOperation(db, op, isUndo)
+
+	return err
+}
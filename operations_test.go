@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestUndoRedoOperation(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// テストデータの履歴を1つの操作にする
+	if _, err := dbRecordOperation(db, "import", operationNormal, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// 記録する履歴がなければ操作は追加しない
+	if id, err := dbRecordOperation(db, "tr ls", operationNormal, 0); err != nil || id != 0 {
+		t.Fatal("id != 0:", id, err)
+	}
+
+	// 一括変更と一括削除をそれぞれ1つの操作にする
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := str2accountReplace(accounts, "食費=娯楽", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err := findTransactions(db, []string{"account:食費"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := len(transactions)
+
+	stdin = bytes.NewBufferString("y\ny\n")
+	scanner = bufio.NewScanner(stdin)
+
+	if err := runBulkEdit(db, transactions, &bulkEdit{replaces: []accountReplace{r}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbRecordOperation(db, "tr bulk-edit -q account:食費 --debit 食費=娯楽", operationNormal, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := findTransactions(db, []string{"date:2019-12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runBulkRemove(db, removed, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbRecordOperation(db, "tr bulk-remove -q date:2019-12", operationNormal, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	countFound := func(query ...string) int {
+		found, err := findTransactions(db, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(found)
+	}
+
+	// 一括削除をまとめて戻す
+	stdin = bytes.NewBufferString("y\n")
+	scanner = bufio.NewScanner(stdin)
+
+	if err := runUndoOperation(db, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := countFound("date:2019-12"); c != len(removed) {
+		t.Fatal("削除した取引が戻ってない:", c)
+	}
+
+	// 一括変更をまとめて戻す
+	stdin = bytes.NewBufferString("y\n")
+	scanner = bufio.NewScanner(stdin)
+
+	if err := runUndoOperation(db, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := countFound("debit:食費"); c != n {
+		t.Fatal("変更が戻ってない:", c)
+	}
+
+	// 一括変更をやり直す
+	stdin = bytes.NewBufferString("y\n")
+	scanner = bufio.NewScanner(stdin)
+
+	if err := runUndoOperation(db, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := countFound("debit:食費"); c != 0 {
+		t.Fatal("やり直せてない:", c)
+	}
+
+	ops, err := dbGetOperations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ops) != 6 {
+		t.Fatal("len(ops) != 6:", len(ops))
+	}
+
+	if ops[0].kind != operationRedo || ops[0].targetID != ops[4].id || ops[4].isUndone {
+		t.Fatal("REDO が記録されてない:", &ops[0], &ops[4])
+	}
+
+	if !ops[3].isUndone || !strings.HasPrefix(ops[3].command, "tr bulk-remove") {
+		t.Fatal("一括削除が取り消しになってない:", &ops[3])
+	}
+
+	// 一括削除もやり直せる
+	redo, err := dbGetOperation1(db, sqlGetRedoTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if redo == nil || redo.id != ops[3].id {
+		t.Fatal("REDO の対象が一括削除でない:", redo)
+	}
+
+	// 新しい操作をすると、取り消した操作はやり直せない
+	d := removed[0]
+	d.id = 0
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbAddTransaction(tx, &d); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbRecordOperation(db, "tr add", operationNormal, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	redo, err = dbGetOperation1(db, sqlGetRedoTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if redo != nil {
+		t.Fatal("やり直せないはず:", redo)
+	}
+
+	if err := runListOperations(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUndoOperationConflict(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbRecordOperation(db, "import", operationNormal, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err := findTransactions(db, []string{"date:2019-12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range transactions {
+		transactions[i].note += "!"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range transactions {
+		if err := dbEditTransaction(tx, &transactions[i]); err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	op, err := dbRecordOperation(db, "edit", operationNormal, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 操作の後で変更された取引があれば、何も戻さない
+	d := transactions[len(transactions)-1]
+	d.note = "後で変更"
+
+	if err := dbEditTransactionTx(db, &d); err != nil {
+		t.Fatal(err)
+	}
+
+	target := &operation{id: op}
+
+	if _, err := undoOperation(db, target, true); err == nil {
+		t.Fatal("後で変更されているのでエラーになるはず")
+	}
+
+	found, err := findTransactions(db, []string{"date:2019-12", "note~!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != len(transactions)-1 {
+		t.Fatal("エラーなのに戻された:", len(found))
+	}
+}
+
+func TestOperationSession(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbRecordOperation(db, "import", operationNormal, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// 他のプロセスが追加した取引。操作を閉じないまま終わった
+	session := operationSession
+	operationSession = newOperationSession()
+
+	other, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runAddTransaction(other, []string{"2019-12-30", "食費", "現金", "500", "他のプロセス"}, nil)
+	other.Close()
+	operationSession = session
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 他のプロセスの履歴はこのプロセスの操作にまとめない
+	if id, err := dbRecordOperation(db, "tr ls", operationNormal, 0); err != nil || id != 0 {
+		t.Fatal("id != 0:", id, err)
+	}
+
+	if err := runAddTransaction(db, []string{"2019-12-31", "食費", "現金", "700", "このプロセス"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := dbRecordOperation(db, "tr add", operationNormal, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 閉じてない操作は UNDO の対象にしない
+	op, err := dbGetOperation1(db, sqlGetUndoTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if op == nil || op.id != id || op.count != 1 {
+		t.Fatal("UNDO の対象が違う:", op)
+	}
+
+	if _, err := undoOperation(db, op, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for note, want := range map[string]int{"このプロセス": 0, "他のプロセス": 1} {
+		found, err := findTransactions(db, []string{note})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(found) != want {
+			t.Errorf("%s: len(found) = %d", note, len(found))
+		}
+	}
+
+	// UNDO の操作にも他のプロセスの履歴は入らない
+	undo, err := dbGetOperation1(db, sqlGetOperations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if undo.kind != operationUndo || undo.targetID != id || undo.count != 1 {
+		t.Fatal("UNDO の操作が違う:", undo)
+	}
+}
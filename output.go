@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+/*
+機械で読める出力
+
+一覧や報告のコマンドは、グローバルオプション --output に json, csv, tsv を指定すると、
+表示用に整形した文字列の代わりに、列名の決まったレコードを出力する。
+金額はカンマ区切りにせず、日付は YYYY-MM-DD、月は YYYYMM の数値で出力する。
+*/
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputCSV  = "csv"
+	outputTSV  = "tsv"
+)
+
+var outputFormat = outputText
+
+func setOutputFormat(format string) error {
+	switch format {
+	case "", outputText:
+		outputFormat = outputText
+	case outputJSON, outputCSV, outputTSV:
+		outputFormat = format
+	default:
+		return fmt.Errorf("未対応の出力形式'%s'。text, json, csv, tsv のどれか", format)
+	}
+
+	return nil
+}
+
+// 整形した文字列ではなく、レコードを出力するか
+func isRecordOutput() bool {
+	return outputFormat != outputText
+}
+
+// 出力するレコードの集まり
+type recordTable struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+func newRecordTable(columns ...string) *recordTable {
+	return &recordTable{columns: columns}
+}
+
+// 列の順番に値を追加する
+func (d *recordTable) add(values ...interface{}) {
+	d.rows = append(d.rows, values)
+}
+
+// 現在の出力形式でレコードを出力する
+func printRecords(d *recordTable) error {
+	return writeRecords(stdout, outputFormat, d)
+}
+
+func writeRecords(f io.Writer, format string, d *recordTable) error {
+	switch format {
+	case outputJSON:
+		return writeRecordsJSON(f, d)
+	case outputCSV:
+		return writeRecordsCSV(f, ',', d)
+	case outputTSV:
+		return writeRecordsCSV(f, '\t', d)
+	}
+
+	return fmt.Errorf("未対応の出力形式'%s'", format)
+}
+
+// オブジェクトの配列。キーは列の順番に並べる
+func writeRecordsJSON(f io.Writer, d *recordTable) error {
+	b := bufio.NewWriter(f)
+
+	b.WriteString("[")
+
+	for i, row := range d.rows {
+		if i != 0 {
+			b.WriteString(",")
+		}
+
+		b.WriteString("\n  {")
+
+		for j, col := range d.columns {
+			if j != 0 {
+				b.WriteString(", ")
+			}
+
+			key, err := json.Marshal(col)
+			if err != nil {
+				return err
+			}
+
+			value, err := json.Marshal(jsonValue(row[j]))
+			if err != nil {
+				return err
+			}
+
+			b.Write(key)
+			b.WriteString(": ")
+			b.Write(value)
+		}
+
+		b.WriteString("}")
+	}
+
+	if len(d.rows) != 0 {
+		b.WriteString("\n")
+	}
+
+	b.WriteString("]\n")
+
+	return b.Flush()
+}
+
+func jsonValue(v interface{}) interface{} {
+	if t, ok := v.(time.Time); ok {
+		return t.Format("2006-01-02")
+	}
+
+	return v
+}
+
+// 1行目は列名
+func writeRecordsCSV(f io.Writer, comma rune, d *recordTable) error {
+	w := csv.NewWriter(f)
+	w.Comma = comma
+
+	if err := w.Write(d.columns); err != nil {
+		return err
+	}
+
+	for _, row := range d.rows {
+		arr := make([]string, len(row))
+
+		for i, v := range row {
+			arr[i] = recordValue2str(v)
+		}
+
+		if err := w.Write(arr); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
+
+func recordValue2str(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case int:
+		return strconv.Itoa(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	case time.Time:
+		return t.Format("2006-01-02")
+	}
+
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestSetOutputFormat(t *testing.T) {
+	defer setOutputFormat(outputText)
+
+	for _, format := range []string{"", "text", "json", "csv", "tsv"} {
+		if err := setOutputFormat(format); err != nil {
+			t.Errorf("setOutputFormat(%s), got = %v", format, err)
+		}
+	}
+
+	if err := setOutputFormat("xml"); err == nil {
+		t.Error("未対応の出力形式なのでエラーになるはず")
+	}
+}
+
+func TestWriteRecords(t *testing.T) {
+	d := newRecordTable("id", "date", "name", "amount", "ok")
+	d.add(1, ymd(2019, 12, 25), "食費, 雑費", -1200, true)
+	d.add(2, ymd(2019, 12, 26), "家賃", 40000, false)
+
+	buf := new(bytes.Buffer)
+
+	if err := writeRecords(buf, outputCSV, d); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := buf.String(); s != "id,date,name,amount,ok\n1,2019-12-25,\"食費, 雑費\",-1200,true\n2,2019-12-26,家賃,40000,false\n" {
+		t.Errorf("csv, got = %s", s)
+	}
+
+	buf.Reset()
+
+	if err := writeRecords(buf, outputTSV, d); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := buf.String(); s != "id\tdate\tname\tamount\tok\n1\t2019-12-25\t食費, 雑費\t-1200\ttrue\n2\t2019-12-26\t家賃\t40000\tfalse\n" {
+		t.Errorf("tsv, got = %s", s)
+	}
+
+	buf.Reset()
+
+	if err := writeRecords(buf, outputJSON, d); err != nil {
+		t.Fatal(err)
+	}
+
+	var res []map[string]interface{}
+
+	if err := json.Unmarshal(buf.Bytes(), &res); err != nil {
+		t.Fatal(err, buf.String())
+	}
+
+	if len(res) != 2 || res[0]["date"] != "2019-12-25" || res[0]["amount"] != float64(-1200) || res[1]["ok"] != false {
+		t.Errorf("json, got = %s", buf.String())
+	}
+
+	// レコードがなくても配列
+	buf.Reset()
+
+	if err := writeRecords(buf, outputJSON, newRecordTable("id")); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "[]\n" {
+		t.Errorf("json, got = %s", buf.String())
+	}
+}
+
+func TestTransactions2records(t *testing.T) {
+	var tr transaction
+	tr.id = 3
+	tr.version = 1
+	tr.date = ymd(2019, 12, 10)
+	tr.note = "スーパー"
+	tr.items = []transactionItem{
+		{account: account{id: 1, name: "食費"}, debit: 800},
+		{account: account{id: 2, name: "書籍"}, debit: 600},
+		{account: account{id: 3, name: "Aカード"}, credit: 1400},
+	}
+
+	d := transactions2records([]transaction{tr})
+
+	if len(d.rows) != 3 || len(d.rows[0]) != len(d.columns) {
+		t.Fatal("len(d.rows) != 3:", len(d.rows))
+	}
+
+	if row := d.rows[2]; row[0] != 3 || row[3] != 3 || row[5] != "Aカード" || row[7] != 1400 {
+		t.Errorf("got = %v", row)
+	}
+}
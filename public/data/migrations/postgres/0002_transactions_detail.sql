@@ -0,0 +1,487 @@
+/*
+ * 0.9.0 のスキーマからの移行
+ *
+ * 取引の借方・貸方の勘定科目と金額を明細テーブルへ移し、
+ * 外貨、スケジュール、残高の確認、予算、取り込み規則のテーブルを追加する。
+ */
+CREATE TABLE schema_version (
+    version integer NOT NULL
+);
+
+INSERT INTO schema_version VALUES (1);
+
+DROP TRIGGER update_transactions_history ON transactions;
+DROP TRIGGER update_transactions_month ON transactions;
+DROP FUNCTION insert_months(integer, integer, integer, integer, integer, integer);
+DROP VIEW enum_pl_years_view;
+DROP VIEW transactions_view;
+DROP VIEW history_view;
+
+ALTER TABLE accounts ADD COLUMN currency varchar(3) NOT NULL DEFAULT '';
+
+
+/*
+ * 為替レートテーブル
+ *
+ * 外貨1単位あたりの円の金額
+ */
+CREATE TABLE exchange_rates (
+    currency varchar(3) NOT NULL,
+    date date NOT NULL,
+    rate numeric(18, 6) NOT NULL CHECK(rate > 0),
+
+    PRIMARY KEY (currency, date)
+);
+
+
+/*
+ * 取引明細テーブル
+ *
+ * 1つの取引は2行以上の明細を持ち、
+ * 借方金額の合計と貸方金額の合計は一致しなければならない。
+ * 1行の明細には借方金額か貸方金額のどちらか一方だけを設定する。
+ * 金額は円で、外貨建ての勘定科目の場合は外貨の金額とレートも保持する。
+ */
+CREATE TABLE transactions_detail (
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    no integer NOT NULL,
+
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+    debit_amount integer NOT NULL,
+    credit_amount integer NOT NULL,
+    currency_amount integer NOT NULL DEFAULT 0,  -- 外貨の金額(補助単位。USDならセント)
+    rate numeric(18, 6) NOT NULL DEFAULT 0,  -- 取引時の為替レート
+
+    PRIMARY KEY (transaction_id, no),
+    CHECK ((debit_amount = 0) <> (credit_amount = 0))
+);
+
+
+/*
+ * 明細の履歴テーブル
+ *
+ * transactions_history テーブルの各バージョンの明細を保持する。
+ */
+CREATE TABLE transactions_detail_history (
+    transaction_id integer NOT NULL,
+    version integer NOT NULL,
+    no integer NOT NULL,
+
+    -- 以下は transactions_detail テーブルと同じ内容
+
+    account_id integer NOT NULL,
+    debit_amount integer NOT NULL,
+    credit_amount integer NOT NULL,
+    currency_amount integer NOT NULL,
+    rate numeric(18, 6) NOT NULL,
+
+    PRIMARY KEY (transaction_id, version, no),
+    FOREIGN KEY (transaction_id, version) REFERENCES transactions_history (transaction_id, version) ON DELETE CASCADE
+);
+
+
+/*
+ * 借方・貸方の勘定科目と金額を明細に移す
+ */
+INSERT INTO transactions_detail (transaction_id, no, account_id, debit_amount, credit_amount)
+SELECT transaction_id, 1, debit_id, amount, 0 FROM transactions WHERE amount <> 0
+UNION ALL
+SELECT transaction_id, 2, credit_id, 0, amount FROM transactions WHERE amount <> 0;
+
+INSERT INTO transactions_detail_history (transaction_id, version, no, account_id,
+    debit_amount, credit_amount, currency_amount, rate)
+SELECT transaction_id, version, 1, debit_id, amount, 0, 0, 0 FROM transactions_history WHERE amount <> 0
+UNION ALL
+SELECT transaction_id, version, 2, credit_id, 0, amount, 0, 0 FROM transactions_history WHERE amount <> 0;
+
+ALTER TABLE transactions DROP COLUMN debit_id, DROP COLUMN credit_id, DROP COLUMN amount;
+ALTER TABLE transactions_history DROP COLUMN debit_id, DROP COLUMN credit_id, DROP COLUMN amount;
+
+
+/*
+ * インポートした取引の外部IDテーブル
+ *
+ * 銀行の明細の取引番号などの外部IDと、それをインポートした取引を対応づける。
+ * 同じ明細を再びインポートしたときに重複を判断するために使う。
+ */
+CREATE TABLE transactions_import (
+    external_id varchar(64) NOT NULL,
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+
+    PRIMARY KEY (external_id)
+);
+
+
+/*
+ * スケジュールテーブル
+ *
+ * 定期的な取引を自動で追加するためのテーブル。
+ * template_id が 0 以外ならテンプレートから、0 なら debit_id, credit_id, amount から取引を作成する。
+ *
+ * rule は繰り返しの規則
+ * 'M': 毎月 rule_value 日(月末より後なら月末)
+ * 'W': start_date から rule_value 週ごと
+ * 'B': 毎月の最終営業日(土日以外)
+ *
+ * last_date は最後に取引を追加した日。NULL ならまだ一度も追加していない。
+ */
+CREATE TABLE schedules (
+    schedule_id SERIAL,
+    name varchar(16) NOT NULL UNIQUE,
+    template_id integer NOT NULL DEFAULT 0,
+    debit_id integer NOT NULL DEFAULT 0,
+    credit_id integer NOT NULL DEFAULT 0,
+    amount integer NOT NULL DEFAULT 0,
+    description varchar(64) NOT NULL DEFAULT '',
+    rule char(1) NOT NULL CHECK(rule IN ('M', 'W', 'B')),
+    rule_value integer NOT NULL DEFAULT 0,
+    start_date date NOT NULL,
+    last_date date,
+
+    PRIMARY KEY (schedule_id)
+);
+
+/*
+ * スケジュールから追加した取引の記録
+ * 同じ日の取引を二重に追加しないように、(schedule_id, date, no) を主キーにしている。
+ */
+CREATE TABLE schedules_log (
+    schedule_id integer NOT NULL REFERENCES schedules (schedule_id) ON DELETE CASCADE,
+    date date NOT NULL,
+    no integer NOT NULL,
+    transaction_id integer NOT NULL,
+    operate_time timestamp NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (schedule_id, date, no)
+);
+
+
+/*
+ * 残高の確認テーブル
+ *
+ * date の終わりの実際の残高(通帳や明細の残高)を記録する。
+ * 外貨建ての勘定科目の amount は外貨の金額(補助単位)。
+ */
+CREATE TABLE assertions (
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+    date date NOT NULL,
+    amount integer NOT NULL,
+
+    PRIMARY KEY (account_id, date)
+);
+
+
+/*
+ * 予算テーブル
+ *
+ * 収入・費用の勘定科目の月ごとの予算。金額は収入・費用ともに正の値。
+ * 親の勘定科目にも予算を設定できる。
+ */
+CREATE TABLE budgets (
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+    month integer NOT NULL,
+    amount integer NOT NULL,
+
+    PRIMARY KEY (account_id, month)
+);
+
+
+/*
+ * 取り込み規則テーブル
+ *
+ * 明細CSVを取り込むときに、摘要が pattern (正規表現)に一致したら
+ * account_id を相手の勘定科目にする。rule_id の小さいものから順に調べる。
+ */
+CREATE TABLE import_rules (
+    rule_id SERIAL,
+    pattern varchar(128) NOT NULL,
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+
+    PRIMARY KEY (rule_id)
+);
+
+
+/*
+ * 予算ビュー
+ */
+CREATE OR REPLACE VIEW budgets_view AS
+SELECT b.month, b.account_id, ac.account_type, ac.name,
+       p.account_id AS parent_id, p.name AS parent_name, b.amount
+FROM budgets AS b
+JOIN accounts AS ac ON b.account_id = ac.account_id
+JOIN accounts AS p ON ac.parent = p.account_id
+ORDER BY b.month, ac.account_type, p.order_no, ac.order_no, ac.account_id;
+
+
+/*
+ * 取引ビュー
+ * 明細1行につき1行
+ */
+CREATE OR REPLACE VIEW transactions_view AS
+SELECT tr.transaction_id, tr.version, tr.date,
+       tr.description, tr.start_month, tr.end_month,
+       td.no, td.account_id, ac.name AS account, ac.search_words, ac.currency,
+       td.debit_amount, td.credit_amount, td.currency_amount, td.rate
+FROM transactions AS tr
+JOIN transactions_detail AS td ON tr.transaction_id = td.transaction_id
+LEFT JOIN accounts AS ac ON td.account_id = ac.account_id;
+
+
+/*
+ * 外貨残高ビュー
+ * 外貨建ての勘定科目の月ごとの外貨の残高(累計)
+ */
+CREATE OR REPLACE VIEW currency_balance_view AS
+SELECT m.month, ac.account_id, ac.account_type, ac.name, ac.currency,
+       SUM(CASE WHEN td.debit_amount <> 0 THEN td.currency_amount ELSE -td.currency_amount END) AS currency_balance
+FROM accounts AS ac
+JOIN transactions_detail AS td ON ac.account_id = td.account_id
+JOIN transactions AS tr ON td.transaction_id = tr.transaction_id
+JOIN (SELECT DISTINCT month FROM transactions_summary) AS m ON get_month(tr.date) <= m.month
+WHERE ac.currency <> ''
+GROUP BY m.month, ac.account_id, ac.account_type, ac.name, ac.currency;
+
+
+/*
+ * 履歴ビュー
+ * 明細1行につき1行
+ */
+CREATE OR REPLACE VIEW history_view AS
+SELECT CASE tr.operation
+       WHEN 'I' THEN 'INSERT'
+       WHEN 'U' THEN 'UPDATE'
+       WHEN 'D' THEN 'DELETE'
+                ELSE 'UNKNOWN'
+       END AS operation,
+       tr.operate_time,
+       tr.transaction_id, tr.version, tr.date,
+       tr.description, tr.start_month, tr.end_month,
+       td.no, td.account_id, COALESCE(ac.name, 'DELETED') AS account, COALESCE(ac.currency, '') AS currency,
+       td.debit_amount, td.credit_amount, td.currency_amount, td.rate
+FROM transactions_history AS tr
+JOIN transactions_detail_history AS td
+    ON tr.transaction_id = td.transaction_id AND tr.version = td.version
+LEFT JOIN accounts AS ac ON td.account_id = ac.account_id
+ORDER BY tr.operate_time, tr.transaction_id, tr.version, td.no;
+
+
+/*
+ * スケジュールビュー
+ */
+CREATE OR REPLACE VIEW schedules_view AS
+SELECT s.schedule_id, s.name,
+       s.template_id, COALESCE(t.name, '') AS template_name,
+       s.debit_id, COALESCE(de.name, '') AS debit_name,
+       s.credit_id, COALESCE(cr.name, '') AS credit_name,
+       s.amount, s.description, s.rule, s.rule_value, s.start_date, s.last_date
+FROM schedules AS s
+LEFT JOIN templates AS t ON s.template_id = t.template_id
+LEFT JOIN accounts AS de ON s.debit_id = de.account_id
+LEFT JOIN accounts AS cr ON s.credit_id = cr.account_id;
+
+
+/*
+ * 履歴テーブルへ取引と明細を追加する補助関数
+ */
+CREATE OR REPLACE FUNCTION insert_history(a_operation char(1), a_tr transactions, a_version integer) RETURNS void AS $$
+    INSERT INTO transactions_history (operation, operate_time, transaction_id, version, date, description, start_month, end_month)
+    VALUES (a_operation, now(), a_tr.transaction_id, a_version, a_tr.date, a_tr.description, a_tr.start_month, a_tr.end_month);
+
+    INSERT INTO transactions_detail_history (transaction_id, version, no, account_id,
+        debit_amount, credit_amount, currency_amount, rate)
+    SELECT transaction_id, a_version, no, account_id, debit_amount, credit_amount, currency_amount, rate
+    FROM transactions_detail
+    WHERE transaction_id = a_tr.transaction_id;
+$$ LANGUAGE SQL;
+
+
+/*
+ * トリガー：取引テーブルが変更されると履歴テーブルに履歴を追加する
+ *
+ * 明細は取引の後に追加されるので、INSERT と UPDATE の場合は
+ * コミット時まで遅延させてから明細も含めた履歴を追加する。
+ * DELETE の場合は明細がカスケード削除される前に履歴を追加する。
+ */
+CREATE OR REPLACE FUNCTION update_transactions_history() RETURNS TRIGGER AS $$
+BEGIN
+    IF (TG_OP = 'DELETE') THEN
+        PERFORM insert_history('D', OLD, OLD.version + 1);
+
+        RETURN OLD;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM transactions WHERE transaction_id = NEW.transaction_id AND version = NEW.version) THEN
+        -- 同じトランザクション内で削除または更新された
+        RETURN NULL;
+    END IF;
+
+    IF (TG_OP = 'UPDATE') THEN
+        PERFORM insert_history('U', NEW, NEW.version);
+    ELSIF (TG_OP = 'INSERT') THEN
+        PERFORM insert_history('I', NEW, NEW.version);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER update_transactions_history
+AFTER INSERT OR UPDATE ON transactions
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE update_transactions_history();
+
+CREATE TRIGGER delete_transactions_history
+BEFORE DELETE ON transactions
+    FOR EACH ROW EXECUTE PROCEDURE update_transactions_history();
+
+
+/*
+ * トリガー：取引の借方金額の合計と貸方金額の合計が一致するか確認する
+ */
+CREATE OR REPLACE FUNCTION check_transactions_balance() RETURNS TRIGGER AS $$
+DECLARE
+    v_transaction_id integer;
+    v_count integer;
+    v_diff integer;
+BEGIN
+    IF (TG_OP = 'DELETE') THEN
+        v_transaction_id := OLD.transaction_id;
+    ELSE
+        v_transaction_id := NEW.transaction_id;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM transactions WHERE transaction_id = v_transaction_id) THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT COUNT(*), COALESCE(SUM(debit_amount - credit_amount), 0) INTO v_count, v_diff
+    FROM transactions_detail
+    WHERE transaction_id = v_transaction_id;
+
+    IF v_count < 2 THEN
+        RAISE 'transaction % must have at least 2 lines', v_transaction_id;
+    END IF;
+
+    IF v_diff <> 0 THEN
+        RAISE 'transaction % is not balanced: debit - credit = %', v_transaction_id, v_diff;
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER check_transactions_balance
+AFTER INSERT OR UPDATE ON transactions
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE check_transactions_balance();
+
+CREATE CONSTRAINT TRIGGER check_transactions_detail_balance
+AFTER INSERT OR UPDATE OR DELETE ON transactions_detail
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE check_transactions_balance();
+
+
+/*
+ * transactions_month テーブルへの行追加の補助関数
+ */
+CREATE OR REPLACE FUNCTION insert_month(a_transaction_id integer, a_account_id integer, a_month integer,
+    a_accrual_debit_amount integer, a_accrual_credit_amount integer,
+    a_cash_debit_amount integer, a_cash_credit_amount integer) RETURNS void AS $$
+
+    INSERT INTO transactions_month (transaction_id, account_id, month,
+    accrual_debit_amount, accrual_credit_amount, cash_debit_amount, cash_credit_amount)
+    VALUES (a_transaction_id, a_account_id, a_month,
+    a_accrual_debit_amount, a_accrual_credit_amount, a_cash_debit_amount, a_cash_credit_amount);
+$$ LANGUAGE SQL;
+
+
+/*
+ * トリガー：取引を月ごとに分ける
+ *
+ * 取引に開始月と終了月が指定されている場合は、
+ * 発生主義の金額を計算するために、明細ごとに金額を期間内の各月に振り分ける。
+ * 明細は取引の後に追加されるので、INSERT と UPDATE の場合はコミット時に実行する。
+ */
+CREATE OR REPLACE FUNCTION update_transactions_month() RETURNS TRIGGER AS $$
+DECLARE
+    v_transaction_id integer;
+    v_month integer;
+    v_num_months integer;
+    v_line RECORD;
+    v_remain_debit integer;
+    v_remain_credit integer;
+    v_debit integer;
+    v_credit integer;
+BEGIN
+    IF (TG_OP = 'DELETE') THEN
+        v_transaction_id := OLD.transaction_id;
+    ELSE
+        v_transaction_id := NEW.transaction_id;
+    END IF;
+
+    DELETE FROM transactions_month WHERE transaction_id = v_transaction_id;
+
+    IF (TG_OP = 'DELETE') THEN
+        RETURN NULL;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM transactions WHERE transaction_id = NEW.transaction_id AND version = NEW.version) THEN
+        -- 同じトランザクション内で削除または更新された
+        RETURN NULL;
+    END IF;
+
+    v_month := get_month(NEW.date);
+
+    IF NEW.start_month = 0 AND NEW.end_month = 0 THEN
+        -- 期間が指定されてなければ、取引日の月に金額を振り分ける
+        FOR v_line IN SELECT * FROM transactions_detail WHERE transaction_id = v_transaction_id ORDER BY no LOOP
+            PERFORM insert_month(v_transaction_id, v_line.account_id, v_month,
+                v_line.debit_amount, v_line.credit_amount, v_line.debit_amount, v_line.credit_amount);
+        END LOOP;
+
+        RETURN NULL;
+    END IF;
+
+    -- 期間が指定されている場合は、開始月から終了月の間の各月に金額を振り分ける
+
+    SELECT COUNT(*) INTO v_num_months FROM get_months(NEW.start_month, NEW.end_month);
+
+    FOR v_line IN SELECT * FROM transactions_detail WHERE transaction_id = v_transaction_id ORDER BY no LOOP
+        PERFORM insert_month(v_transaction_id, v_line.account_id, v_month,
+            0, 0, v_line.debit_amount, v_line.credit_amount);
+
+        v_remain_debit := v_line.debit_amount;  -- まだ振り分けてない金額
+        v_remain_credit := v_line.credit_amount;
+        v_debit := ceil(v_line.debit_amount::real / v_num_months);  -- 各月に振り分ける金額
+        v_credit := ceil(v_line.credit_amount::real / v_num_months);
+
+        FOR v_month IN SELECT get_months(NEW.start_month, NEW.end_month) LOOP
+            IF v_debit > v_remain_debit THEN
+                v_debit := v_remain_debit;
+            END IF;
+
+            IF v_credit > v_remain_credit THEN
+                v_credit := v_remain_credit;
+            END IF;
+
+            PERFORM insert_month(v_transaction_id, v_line.account_id, v_month, v_debit, v_credit, 0, 0);
+
+            v_remain_debit := v_remain_debit - v_debit;
+            v_remain_credit := v_remain_credit - v_credit;
+        END LOOP;
+
+        ASSERT v_remain_debit = 0 AND v_remain_credit = 0, 'v_remain_amount <> 0';
+    END LOOP;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER update_transactions_month
+AFTER INSERT OR UPDATE ON transactions
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE update_transactions_month();
+
+CREATE TRIGGER delete_transactions_month
+AFTER DELETE ON transactions
+    FOR EACH ROW EXECUTE PROCEDURE update_transactions_month();
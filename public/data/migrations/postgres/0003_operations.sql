@@ -0,0 +1,47 @@
+/*
+ * 操作テーブルの追加
+ *
+ * 履歴を操作ごとにまとめて UNDO と REDO の単位にする。
+ * 既存の履歴は、同じ時刻に追加されたもの(同じトランザクションで追加されたもの)を1つの操作にまとめる。
+ */
+CREATE TABLE operations (
+    operation_id SERIAL,
+    operate_time timestamp NOT NULL,
+    command varchar(256) NOT NULL,
+    kind char(1) NOT NULL CHECK(kind in ('N', 'U', 'R')),
+    target_id integer,
+    is_undone boolean NOT NULL DEFAULT FALSE,
+
+    PRIMARY KEY (operation_id)
+);
+
+ALTER TABLE transactions_history ADD COLUMN operation_id integer;
+
+INSERT INTO operations (operate_time, command, kind)
+SELECT DISTINCT operate_time, '', 'N'
+FROM transactions_history
+ORDER BY operate_time;
+
+UPDATE transactions_history AS h
+SET operation_id = o.operation_id
+FROM operations AS o
+WHERE h.operate_time = o.operate_time;
+
+CREATE OR REPLACE VIEW history_view AS
+SELECT CASE tr.operation
+       WHEN 'I' THEN 'INSERT'
+       WHEN 'U' THEN 'UPDATE'
+       WHEN 'D' THEN 'DELETE'
+                ELSE 'UNKNOWN'
+       END AS operation,
+       tr.operate_time,
+       tr.transaction_id, tr.version, tr.date,
+       tr.description, tr.start_month, tr.end_month,
+       td.no, td.account_id, COALESCE(ac.name, 'DELETED') AS account, COALESCE(ac.currency, '') AS currency,
+       td.debit_amount, td.credit_amount, td.currency_amount, td.rate,
+       tr.operation_id
+FROM transactions_history AS tr
+JOIN transactions_detail_history AS td
+    ON tr.transaction_id = td.transaction_id AND tr.version = td.version
+LEFT JOIN accounts AS ac ON td.account_id = ac.account_id
+ORDER BY tr.operate_time, tr.transaction_id, tr.version, td.no;
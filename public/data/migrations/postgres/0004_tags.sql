@@ -0,0 +1,98 @@
+/*
+ * タグの追加
+ *
+ * 取引とタグを多対多で対応づけ、タグの付いた取引だけのP/Lを集計できるようにする。
+ * 履歴にも取引のタグを残す。
+ */
+
+/*
+ * タグテーブル
+ *
+ * 勘定科目とは別の切り口で取引を集計するために、取引にタグを付ける。
+ * 取引とタグは多対多で、transactions_tags テーブルで対応づける。
+ */
+CREATE TABLE tags (
+    tag_id SERIAL,
+    name varchar(32) NOT NULL UNIQUE,
+
+    PRIMARY KEY (tag_id)
+);
+
+CREATE TABLE transactions_tags (
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    tag_id integer NOT NULL REFERENCES tags (tag_id) ON DELETE CASCADE,
+
+    PRIMARY KEY (transaction_id, tag_id)
+);
+
+ALTER TABLE transactions_history ADD COLUMN tags varchar(256) NOT NULL DEFAULT '';
+
+CREATE OR REPLACE VIEW tag_pl_view AS
+SELECT tg.name AS tag, tm.month,
+       ac.is_extraordinary,
+       ac.account_id, ac.account_type, ac.name, ac.parent,
+       SUM(tm.accrual_credit_amount - tm.accrual_debit_amount) AS accrual_balance,
+       SUM(tm.cash_credit_amount - tm.cash_debit_amount) AS cash_balance
+FROM transactions_month AS tm
+JOIN transactions_tags AS tt ON tm.transaction_id = tt.transaction_id
+JOIN tags AS tg ON tt.tag_id = tg.tag_id
+LEFT JOIN accounts AS ac ON tm.account_id = ac.account_id
+WHERE ac.account_type = 3 OR ac.account_type = 4
+GROUP BY tg.name, tm.month, ac.account_id, ac.account_type, ac.name, ac.parent, ac.is_extraordinary
+HAVING SUM(tm.accrual_credit_amount - tm.accrual_debit_amount) <> 0
+       OR SUM(tm.cash_credit_amount - tm.cash_debit_amount) <> 0;
+
+CREATE OR REPLACE VIEW tag_grouped_pl_view AS
+SELECT pl.tag, pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary, SUM(pl.accrual_balance) AS accrual_balance, SUM(pl.cash_balance) AS cash_balance
+FROM tag_pl_view AS pl
+LEFT JOIN accounts AS ac ON pl.parent = ac.account_id
+GROUP BY pl.tag, pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary
+HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0;
+
+CREATE OR REPLACE VIEW transaction_tags_view AS
+SELECT tt.transaction_id, string_agg(tg.name, ' ' ORDER BY tg.name) AS tags
+FROM transactions_tags AS tt
+JOIN tags AS tg ON tt.tag_id = tg.tag_id
+GROUP BY tt.transaction_id;
+
+CREATE OR REPLACE VIEW transactions_view AS
+SELECT tr.transaction_id, tr.version, tr.date,
+       tr.description, tr.start_month, tr.end_month,
+       td.no, td.account_id, ac.name AS account, ac.search_words, ac.currency,
+       td.debit_amount, td.credit_amount, td.currency_amount, td.rate,
+       COALESCE(tv.tags, '') AS tags
+FROM transactions AS tr
+JOIN transactions_detail AS td ON tr.transaction_id = td.transaction_id
+LEFT JOIN accounts AS ac ON td.account_id = ac.account_id
+LEFT JOIN transaction_tags_view AS tv ON tr.transaction_id = tv.transaction_id;
+
+CREATE OR REPLACE VIEW history_view AS
+SELECT CASE tr.operation
+       WHEN 'I' THEN 'INSERT'
+       WHEN 'U' THEN 'UPDATE'
+       WHEN 'D' THEN 'DELETE'
+                ELSE 'UNKNOWN'
+       END AS operation,
+       tr.operate_time,
+       tr.transaction_id, tr.version, tr.date,
+       tr.description, tr.start_month, tr.end_month,
+       td.no, td.account_id, COALESCE(ac.name, 'DELETED') AS account, COALESCE(ac.currency, '') AS currency,
+       td.debit_amount, td.credit_amount, td.currency_amount, td.rate,
+       tr.operation_id, tr.tags
+FROM transactions_history AS tr
+JOIN transactions_detail_history AS td
+    ON tr.transaction_id = td.transaction_id AND tr.version = td.version
+LEFT JOIN accounts AS ac ON td.account_id = ac.account_id
+ORDER BY tr.operate_time, tr.transaction_id, tr.version, td.no;
+
+CREATE OR REPLACE FUNCTION insert_history(a_operation char(1), a_tr transactions, a_version integer) RETURNS void AS $$
+    INSERT INTO transactions_history (operation, operate_time, transaction_id, version, date, description, start_month, end_month, tags)
+    VALUES (a_operation, now(), a_tr.transaction_id, a_version, a_tr.date, a_tr.description, a_tr.start_month, a_tr.end_month,
+            COALESCE((SELECT tags FROM transaction_tags_view WHERE transaction_id = a_tr.transaction_id), ''));
+
+    INSERT INTO transactions_detail_history (transaction_id, version, no, account_id,
+        debit_amount, credit_amount, currency_amount, rate)
+    SELECT transaction_id, a_version, no, account_id, debit_amount, credit_amount, currency_amount, rate
+    FROM transactions_detail
+    WHERE transaction_id = a_tr.transaction_id;
+$$ LANGUAGE SQL;
@@ -0,0 +1,24 @@
+/*
+ * 添付ファイルの追加
+ *
+ * 取引に領収書などのファイルを添付できるようにする。
+ */
+
+/*
+ * 添付ファイルテーブル
+ *
+ * 領収書や保証書などのファイルを取引に添付する。
+ * ファイルの中身は添付ファイルのディレクトリに SHA-256 の名前で保存し、ここには元の名前等を記録する。
+ */
+CREATE TABLE attachments (
+    attachment_id SERIAL,
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    name varchar(256) NOT NULL,  -- 添付したときのファイル名
+    sha256 char(64) NOT NULL,
+    size bigint NOT NULL,
+    attach_time timestamp NOT NULL,
+
+    PRIMARY KEY (attachment_id)
+);
+
+CREATE INDEX attachments_transaction_id ON attachments (transaction_id);
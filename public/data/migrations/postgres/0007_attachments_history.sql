@@ -0,0 +1,55 @@
+/*
+ * 添付ファイルの履歴の追加
+ *
+ * 取引を削除したときの添付を履歴に残し、UNDO で取引と一緒に戻せるようにする。
+ */
+
+/*
+ * 添付ファイルの履歴テーブル
+ *
+ * 取引を削除すると添付の記録もカスケード削除されるので、
+ * 削除の履歴と一緒に残しておき、UNDO で取引を戻すときに添付も戻す。
+ */
+CREATE TABLE attachments_history (
+    transaction_id integer NOT NULL,
+    version integer NOT NULL,
+
+    -- 以下は attachments テーブルと同じ内容
+
+    attachment_id integer NOT NULL,
+    name varchar(256) NOT NULL,
+    sha256 char(64) NOT NULL,
+    size bigint NOT NULL,
+    attach_time timestamp NOT NULL,
+
+    PRIMARY KEY (transaction_id, version, attachment_id),
+    FOREIGN KEY (transaction_id, version) REFERENCES transactions_history (transaction_id, version) ON DELETE CASCADE
+);
+
+CREATE OR REPLACE FUNCTION update_transactions_history() RETURNS TRIGGER AS $$
+BEGIN
+    IF (TG_OP = 'DELETE') THEN
+        PERFORM insert_history('D', OLD, OLD.version + 1);
+
+        INSERT INTO attachments_history (transaction_id, version, attachment_id, name, sha256, size, attach_time)
+        SELECT transaction_id, OLD.version + 1, attachment_id, name, sha256, size, attach_time
+        FROM attachments
+        WHERE transaction_id = OLD.transaction_id;
+
+        RETURN OLD;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM transactions WHERE transaction_id = NEW.transaction_id AND version = NEW.version) THEN
+        -- 同じトランザクション内で削除または更新された
+        RETURN NULL;
+    END IF;
+
+    IF (TG_OP = 'UPDATE') THEN
+        PERFORM insert_history('U', NEW, NEW.version);
+    ELSIF (TG_OP = 'INSERT') THEN
+        PERFORM insert_history('I', NEW, NEW.version);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,55 @@
+/*
+ * 履歴を追加するトランザクションで操作にまとめる
+ *
+ * これまではコマンドの終了時に operation_id のない履歴をまとめていたので、
+ * 同時に動いている他のプロセスの履歴が混ざることがあった。
+ * プロセスごとのセッションを操作に記録し、履歴を追加するときにそのセッションの操作に入れる。
+ */
+
+ALTER TABLE operations ADD COLUMN session varchar(32);
+
+CREATE UNIQUE INDEX operations_session ON operations (session);
+
+/*
+ * 接続の mita.session のまとめ途中の操作のIDを返す補助関数
+ *
+ * まとめ途中の操作がなければ追加する。mita.session がなければ NULL。
+ */
+CREATE OR REPLACE FUNCTION current_operation_id() RETURNS integer AS $$
+DECLARE
+    v_session text := current_setting('mita.session', true);
+    v_id integer;
+BEGIN
+    IF v_session IS NULL OR v_session = '' THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT operation_id INTO v_id FROM operations WHERE session = v_session;
+
+    IF NOT FOUND THEN
+        INSERT INTO operations (operate_time, command, kind, session)
+        VALUES (now(), '', 'N', v_session)
+        RETURNING operation_id INTO v_id;
+    END IF;
+
+    RETURN v_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+/*
+ * 履歴テーブルへ取引と明細を追加する補助関数
+ */
+CREATE OR REPLACE FUNCTION insert_history(a_operation char(1), a_tr transactions, a_version integer) RETURNS void AS $$
+    INSERT INTO transactions_history (operation, operate_time, transaction_id, version, date, description, start_month, end_month,
+        operation_id, tags)
+    VALUES (a_operation, now(), a_tr.transaction_id, a_version, a_tr.date, a_tr.description, a_tr.start_month, a_tr.end_month,
+            current_operation_id(),
+            COALESCE((SELECT tags FROM transaction_tags_view WHERE transaction_id = a_tr.transaction_id), ''));
+
+    INSERT INTO transactions_detail_history (transaction_id, version, no, account_id,
+        debit_amount, credit_amount, currency_amount, rate)
+    SELECT transaction_id, a_version, no, account_id, debit_amount, credit_amount, currency_amount, rate
+    FROM transactions_detail
+    WHERE transaction_id = a_tr.transaction_id;
+$$ LANGUAGE SQL;
@@ -0,0 +1,54 @@
+/*
+ * インポートした取引の外部IDの履歴の追加
+ *
+ * 取引を削除したときの外部IDを履歴に残し、UNDO で取引を戻したあとに
+ * 同じ明細をインポートしても二重に追加しないようにする。
+ */
+
+/*
+ * インポートした取引の外部IDの履歴テーブル
+ *
+ * 取引を削除すると外部IDもカスケード削除されるので、
+ * 削除の履歴と一緒に残しておき、UNDO で取引を戻すときに外部IDも戻す。
+ */
+CREATE TABLE transactions_import_history (
+    transaction_id integer NOT NULL,
+    version integer NOT NULL,
+    external_id varchar(64) NOT NULL,
+
+    PRIMARY KEY (transaction_id, version, external_id),
+    FOREIGN KEY (transaction_id, version) REFERENCES transactions_history (transaction_id, version) ON DELETE CASCADE
+);
+
+CREATE OR REPLACE FUNCTION update_transactions_history() RETURNS TRIGGER AS $$
+BEGIN
+    IF (TG_OP = 'DELETE') THEN
+        PERFORM insert_history('D', OLD, OLD.version + 1);
+
+        INSERT INTO attachments_history (transaction_id, version, attachment_id, name, sha256, size, attach_time)
+        SELECT transaction_id, OLD.version + 1, attachment_id, name, sha256, size, attach_time
+        FROM attachments
+        WHERE transaction_id = OLD.transaction_id;
+
+        INSERT INTO transactions_import_history (transaction_id, version, external_id)
+        SELECT transaction_id, OLD.version + 1, external_id
+        FROM transactions_import
+        WHERE transaction_id = OLD.transaction_id;
+
+        RETURN OLD;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM transactions WHERE transaction_id = NEW.transaction_id AND version = NEW.version) THEN
+        -- 同じトランザクション内で削除または更新された
+        RETURN NULL;
+    END IF;
+
+    IF (TG_OP = 'UPDATE') THEN
+        PERFORM insert_history('U', NEW, NEW.version);
+    ELSIF (TG_OP = 'INSERT') THEN
+        PERFORM insert_history('I', NEW, NEW.version);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,21 @@
+/*
+ * 添付ファイルの追加
+ *
+ * 取引に領収書などのファイルを添付できるようにする。
+ */
+
+/*
+ * 添付ファイルテーブル
+ */
+CREATE TABLE attachments (
+    attachment_id integer NOT NULL,
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    name varchar(256) NOT NULL,  -- 添付したときのファイル名
+    sha256 char(64) NOT NULL,
+    size integer NOT NULL,
+    attach_time timestamp NOT NULL,
+
+    PRIMARY KEY (attachment_id)
+);
+
+CREATE INDEX attachments_transaction_id ON attachments (transaction_id);
@@ -0,0 +1,43 @@
+/*
+ * 勘定科目の階層を何段でも持てるようにする
+ *
+ * 大分類でまとめるP/Lのビューを、親ではなく最上位の祖先で集計する。
+ */
+
+/*
+ * 勘定科目の階層ビュー
+ * 勘定科目と、自分自身を含む全ての祖先の組
+ */
+CREATE VIEW account_tree_view AS
+WITH RECURSIVE tree(account_id, ancestor_id) AS (
+    SELECT account_id, account_id FROM accounts
+    UNION
+    SELECT tree.account_id, ac.parent
+    FROM tree
+    JOIN accounts AS ac ON tree.ancestor_id = ac.account_id
+    WHERE ac.parent <> ac.account_id
+)
+SELECT account_id, ancestor_id FROM tree;
+
+DROP VIEW grouped_pl_view;
+
+CREATE VIEW grouped_pl_view AS
+SELECT pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary, SUM(pl.accrual_balance) AS accrual_balance, SUM(pl.cash_balance) AS cash_balance
+FROM pl_view AS pl
+JOIN account_tree_view AS t ON pl.account_id = t.account_id
+JOIN accounts AS ac ON t.ancestor_id = ac.account_id
+WHERE ac.parent = ac.account_id
+GROUP BY pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary
+HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0
+ORDER BY ac.account_type, ac.order_no, ac.account_id;
+
+DROP VIEW tag_grouped_pl_view;
+
+CREATE VIEW tag_grouped_pl_view AS
+SELECT pl.tag, pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary, SUM(pl.accrual_balance) AS accrual_balance, SUM(pl.cash_balance) AS cash_balance
+FROM tag_pl_view AS pl
+JOIN account_tree_view AS t ON pl.account_id = t.account_id
+JOIN accounts AS ac ON t.ancestor_id = ac.account_id
+WHERE ac.parent = ac.account_id
+GROUP BY pl.tag, pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary
+HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0;
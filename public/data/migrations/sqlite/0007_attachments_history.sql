@@ -0,0 +1,50 @@
+/*
+ * 添付ファイルの履歴の追加
+ *
+ * 取引を削除したときの添付を履歴に残し、UNDO で取引と一緒に戻せるようにする。
+ */
+
+/*
+ * 添付ファイルの履歴テーブル
+ */
+CREATE TABLE attachments_history (
+    transaction_id integer NOT NULL,
+    version integer NOT NULL,
+
+    -- 以下は attachments テーブルと同じ内容
+
+    attachment_id integer NOT NULL,
+    name varchar(256) NOT NULL,
+    sha256 char(64) NOT NULL,
+    size integer NOT NULL,
+    attach_time timestamp NOT NULL,
+
+    PRIMARY KEY (transaction_id, version, attachment_id),
+    FOREIGN KEY (transaction_id, version) REFERENCES transactions_history (transaction_id, version) ON DELETE CASCADE
+);
+
+DROP TRIGGER delete_transactions_history;
+
+CREATE TRIGGER delete_transactions_history
+BEFORE DELETE ON transactions
+FOR EACH ROW
+BEGIN
+    INSERT INTO transactions_history (operation, operate_time, transaction_id, version, date, description, start_month, end_month, tags)
+    VALUES ('D', strftime('%Y-%m-%d %H:%M:%f', 'now', 'localtime'), OLD.transaction_id, OLD.version + 1,
+            OLD.date, OLD.description, OLD.start_month, OLD.end_month,
+            COALESCE((SELECT tags FROM transaction_tags_view WHERE transaction_id = OLD.transaction_id), ''));
+
+    INSERT INTO transactions_detail_history (transaction_id, version, no, account_id,
+        debit_amount, credit_amount, currency_amount, rate)
+    SELECT transaction_id, OLD.version + 1, no, account_id, debit_amount, credit_amount, currency_amount, rate
+    FROM transactions_detail
+    WHERE transaction_id = OLD.transaction_id;
+
+    INSERT INTO attachments_history (transaction_id, version, attachment_id, name, sha256, size, attach_time)
+    SELECT transaction_id, OLD.version + 1, attachment_id, name, sha256, size, attach_time
+    FROM attachments
+    WHERE transaction_id = OLD.transaction_id;
+
+    INSERT INTO transactions_dirty VALUES (OLD.transaction_id, 'D')
+    ON CONFLICT (transaction_id) DO UPDATE SET operation = excluded.operation;
+END;
@@ -0,0 +1,11 @@
+/*
+ * 履歴を追加するトランザクションで操作にまとめる
+ *
+ * これまではコマンドの終了時に operation_id のない履歴をまとめていたので、
+ * 同時に動いている他のプロセスの履歴が混ざることがあった。
+ * プロセスごとのセッションを操作に記録し、履歴を追加するときにそのセッションの操作に入れる。
+ */
+
+ALTER TABLE operations ADD COLUMN session varchar(32);
+
+CREATE UNIQUE INDEX operations_session ON operations (session);
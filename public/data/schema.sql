@@ -1,3 +1,15 @@
+/*
+ * スキーマのバージョン
+ *
+ * mita db migrate でマイグレーションを適用するとバージョンが上がる。
+ */
+CREATE TABLE schema_version (
+    version integer NOT NULL
+);
+
+INSERT INTO schema_version VALUES (9);
+
+
 /*
  * 勘定科目テーブル
  */
@@ -9,6 +21,7 @@ CREATE TABLE accounts (
     parent integer NOT NULL REFERENCES accounts (account_id),
     order_no integer NOT NULL DEFAULT 999,
     is_extraordinary boolean NOT NULL DEFAULT FALSE,
+    currency varchar(3) NOT NULL DEFAULT '',  -- 外貨建ての勘定科目の通貨コード。空文字は円
 
     PRIMARY KEY (account_id)
 );
@@ -30,16 +43,30 @@ WHEN (NEW.parent = 0 OR NEW.parent IS NULL)
 EXECUTE PROCEDURE set_default_parent();
 
 
+/*
+ * 為替レートテーブル
+ *
+ * 外貨1単位あたりの円の金額
+ */
+CREATE TABLE exchange_rates (
+    currency varchar(3) NOT NULL,
+    date date NOT NULL,
+    rate numeric(18, 6) NOT NULL CHECK(rate > 0),
+
+    PRIMARY KEY (currency, date)
+);
+
+
 /*
  * 取引テーブル
+ *
+ * 日付や摘要等の取引全体に関する情報を保持する。
+ * 借方・貸方の勘定科目と金額は transactions_detail テーブルに保持する。
  */
 CREATE TABLE transactions (
     transaction_id SERIAL,
     version integer NOT NULL DEFAULT 0,  -- 0 から始まって、更新するごとに 1 増える
     date date NOT NULL,  -- 実際に取引があった日
-    debit_id integer NOT NULL REFERENCES accounts (account_id),
-    credit_id integer NOT NULL REFERENCES accounts (account_id),
-    amount integer NOT NULL,
     description varchar (64) NOT NULL,
     start_month integer NOT NULL,  -- 発生主義から見た開始月
     end_month integer NOT NULL,  -- 発生主義から見た終了月
@@ -49,6 +76,107 @@ CREATE TABLE transactions (
 );
 
 
+/*
+ * 取引明細テーブル
+ *
+ * 1つの取引は2行以上の明細を持ち、
+ * 借方金額の合計と貸方金額の合計は一致しなければならない。
+ * 1行の明細には借方金額か貸方金額のどちらか一方だけを設定する。
+ * 金額は円で、外貨建ての勘定科目の場合は外貨の金額とレートも保持する。
+ */
+CREATE TABLE transactions_detail (
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    no integer NOT NULL,
+
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+    debit_amount integer NOT NULL,
+    credit_amount integer NOT NULL,
+    currency_amount integer NOT NULL DEFAULT 0,  -- 外貨の金額(補助単位。USDならセント)
+    rate numeric(18, 6) NOT NULL DEFAULT 0,  -- 取引時の為替レート
+
+    PRIMARY KEY (transaction_id, no),
+    CHECK ((debit_amount = 0) <> (credit_amount = 0))
+);
+
+
+/*
+ * インポートした取引の外部IDテーブル
+ *
+ * 銀行の明細の取引番号などの外部IDと、それをインポートした取引を対応づける。
+ * 同じ明細を再びインポートしたときに重複を判断するために使う。
+ */
+CREATE TABLE transactions_import (
+    external_id varchar(64) NOT NULL,
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+
+    PRIMARY KEY (external_id)
+);
+
+
+/*
+ * タグテーブル
+ *
+ * 勘定科目とは別の切り口で取引を集計するために、取引にタグを付ける。
+ * 取引とタグは多対多で、transactions_tags テーブルで対応づける。
+ */
+CREATE TABLE tags (
+    tag_id SERIAL,
+    name varchar(32) NOT NULL UNIQUE,
+
+    PRIMARY KEY (tag_id)
+);
+
+CREATE TABLE transactions_tags (
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    tag_id integer NOT NULL REFERENCES tags (tag_id) ON DELETE CASCADE,
+
+    PRIMARY KEY (transaction_id, tag_id)
+);
+
+
+/*
+ * 添付ファイルテーブル
+ *
+ * 領収書や保証書などのファイルを取引に添付する。
+ * ファイルの中身は添付ファイルのディレクトリに SHA-256 の名前で保存し、ここには元の名前等を記録する。
+ */
+CREATE TABLE attachments (
+    attachment_id SERIAL,
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    name varchar(256) NOT NULL,  -- 添付したときのファイル名
+    sha256 char(64) NOT NULL,
+    size bigint NOT NULL,
+    attach_time timestamp NOT NULL,
+
+    PRIMARY KEY (attachment_id)
+);
+
+CREATE INDEX attachments_transaction_id ON attachments (transaction_id);
+
+
+/*
+ * 操作テーブル
+ *
+ * mita のコマンド1回で追加された履歴をまとめて、UNDO と REDO の単位にする。
+ * 履歴は、接続の mita.session と同じ session のまとめ途中の操作に入れる。
+ * kind は 'N': 通常の操作, 'U': UNDO, 'R': REDO。
+ * UNDO と REDO は target_id の操作を対象にし、is_undone は通常の操作が取り消されているか。
+ */
+CREATE TABLE operations (
+    operation_id SERIAL,
+    operate_time timestamp NOT NULL,
+    command varchar(256) NOT NULL,
+    kind char(1) NOT NULL CHECK(kind in ('N', 'U', 'R')),
+    target_id integer,
+    is_undone boolean NOT NULL DEFAULT FALSE,
+    session varchar(32),  -- まとめ途中の操作に履歴を追加しているプロセス。閉じた操作は NULL
+
+    PRIMARY KEY (operation_id)
+);
+
+CREATE UNIQUE INDEX operations_session ON operations (session);
+
+
 /*
  * 履歴テーブル
  *
@@ -64,17 +192,79 @@ CREATE TABLE transactions_history (
     transaction_id integer NOT NULL,
     version integer NOT NULL,
     date date NOT NULL,
-    debit_id integer NOT NULL,
-    credit_id integer NOT NULL,
-    amount integer NOT NULL,
     description varchar (64) NOT NULL,
     start_month integer NOT NULL,
     end_month integer NOT NULL,
 
+    operation_id integer,  -- 履歴をまとめた操作。NULL は mita 以外で変更した履歴
+    tags varchar(256) NOT NULL DEFAULT '',  -- 取引のタグを空白で区切って並べたもの
+
     PRIMARY KEY (transaction_id, version)
 );
 
 
+/*
+ * 明細の履歴テーブル
+ *
+ * transactions_history テーブルの各バージョンの明細を保持する。
+ */
+CREATE TABLE transactions_detail_history (
+    transaction_id integer NOT NULL,
+    version integer NOT NULL,
+    no integer NOT NULL,
+
+    -- 以下は transactions_detail テーブルと同じ内容
+
+    account_id integer NOT NULL,
+    debit_amount integer NOT NULL,
+    credit_amount integer NOT NULL,
+    currency_amount integer NOT NULL,
+    rate numeric(18, 6) NOT NULL,
+
+    PRIMARY KEY (transaction_id, version, no),
+    FOREIGN KEY (transaction_id, version) REFERENCES transactions_history (transaction_id, version) ON DELETE CASCADE
+);
+
+
+/*
+ * 添付ファイルの履歴テーブル
+ *
+ * 取引を削除すると添付の記録もカスケード削除されるので、
+ * 削除の履歴と一緒に残しておき、UNDO で取引を戻すときに添付も戻す。
+ */
+CREATE TABLE attachments_history (
+    transaction_id integer NOT NULL,
+    version integer NOT NULL,
+
+    -- 以下は attachments テーブルと同じ内容
+
+    attachment_id integer NOT NULL,
+    name varchar(256) NOT NULL,
+    sha256 char(64) NOT NULL,
+    size bigint NOT NULL,
+    attach_time timestamp NOT NULL,
+
+    PRIMARY KEY (transaction_id, version, attachment_id),
+    FOREIGN KEY (transaction_id, version) REFERENCES transactions_history (transaction_id, version) ON DELETE CASCADE
+);
+
+
+/*
+ * インポートした取引の外部IDの履歴テーブル
+ *
+ * 取引を削除すると外部IDもカスケード削除されるので、
+ * 削除の履歴と一緒に残しておき、UNDO で取引を戻すときに外部IDも戻す。
+ */
+CREATE TABLE transactions_import_history (
+    transaction_id integer NOT NULL,
+    version integer NOT NULL,
+    external_id varchar(64) NOT NULL,
+
+    PRIMARY KEY (transaction_id, version, external_id),
+    FOREIGN KEY (transaction_id, version) REFERENCES transactions_history (transaction_id, version) ON DELETE CASCADE
+);
+
+
 /*
  * 月ごとの集計を容易にするための作業用テーブル
  *
@@ -154,6 +344,95 @@ CREATE TABLE templates_detail (
     PRIMARY KEY (template_id, no)
 );
 
+/*
+ * スケジュールテーブル
+ *
+ * 定期的な取引を自動で追加するためのテーブル。
+ * template_id が 0 以外ならテンプレートから、0 なら debit_id, credit_id, amount から取引を作成する。
+ *
+ * rule は繰り返しの規則
+ * 'M': 毎月 rule_value 日(月末より後なら月末)
+ * 'W': start_date から rule_value 週ごと
+ * 'B': 毎月の最終営業日(土日以外)
+ *
+ * last_date は最後に取引を追加した日。NULL ならまだ一度も追加していない。
+ */
+CREATE TABLE schedules (
+    schedule_id SERIAL,
+    name varchar(16) NOT NULL UNIQUE,
+    template_id integer NOT NULL DEFAULT 0,
+    debit_id integer NOT NULL DEFAULT 0,
+    credit_id integer NOT NULL DEFAULT 0,
+    amount integer NOT NULL DEFAULT 0,
+    description varchar(64) NOT NULL DEFAULT '',
+    rule char(1) NOT NULL CHECK(rule IN ('M', 'W', 'B')),
+    rule_value integer NOT NULL DEFAULT 0,
+    start_date date NOT NULL,
+    last_date date,
+
+    PRIMARY KEY (schedule_id)
+);
+
+/*
+ * スケジュールから追加した取引の記録
+ * 同じ日の取引を二重に追加しないように、(schedule_id, date, no) を主キーにしている。
+ */
+CREATE TABLE schedules_log (
+    schedule_id integer NOT NULL REFERENCES schedules (schedule_id) ON DELETE CASCADE,
+    date date NOT NULL,
+    no integer NOT NULL,
+    transaction_id integer NOT NULL,
+    operate_time timestamp NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (schedule_id, date, no)
+);
+
+
+/*
+ * 残高の確認テーブル
+ *
+ * date の終わりの実際の残高(通帳や明細の残高)を記録する。
+ * 外貨建ての勘定科目の amount は外貨の金額(補助単位)。
+ */
+CREATE TABLE assertions (
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+    date date NOT NULL,
+    amount integer NOT NULL,
+
+    PRIMARY KEY (account_id, date)
+);
+
+
+/*
+ * 予算テーブル
+ *
+ * 収入・費用の勘定科目の月ごとの予算。金額は収入・費用ともに正の値。
+ * 親の勘定科目にも予算を設定できる。
+ */
+CREATE TABLE budgets (
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+    month integer NOT NULL,
+    amount integer NOT NULL,
+
+    PRIMARY KEY (account_id, month)
+);
+
+
+/*
+ * 取り込み規則テーブル
+ *
+ * 明細CSVを取り込むときに、摘要が pattern (正規表現)に一致したら
+ * account_id を相手の勘定科目にする。rule_id の小さいものから順に調べる。
+ */
+CREATE TABLE import_rules (
+    rule_id SERIAL,
+    pattern varchar(128) NOT NULL,
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+
+    PRIMARY KEY (rule_id)
+);
+
+
 /*
  * グループテーブル
  *
@@ -213,10 +492,25 @@ WHERE ts.month <= get_month(current_date)
 GROUP BY ts.month
 ORDER BY ts.month;
 
+/*
+ * 勘定科目の階層ビュー
+ * 勘定科目と、自分自身を含む全ての祖先の組
+ */
+CREATE OR REPLACE VIEW account_tree_view AS
+WITH RECURSIVE tree(account_id, ancestor_id) AS (
+    SELECT account_id, account_id FROM accounts
+    UNION
+    SELECT tree.account_id, ac.parent
+    FROM tree
+    JOIN accounts AS ac ON tree.ancestor_id = ac.account_id
+    WHERE ac.parent <> ac.account_id
+)
+SELECT account_id, ancestor_id FROM tree;
+
 /*
  * 用語定義
- * 大分類: account_id == parent な勘定科目
- * 小分類: account_id != parent な勘定科目
+ * 大分類: account_id == parent な勘定科目(最上位)
+ * 小分類: account_id != parent な勘定科目。小分類の下にも小分類を置ける
  */
 
 /*
@@ -244,35 +538,81 @@ ORDER BY ac.account_type, ac.order_no, ac.account_id, ac.is_extraordinary;
 CREATE OR REPLACE VIEW grouped_pl_view AS
 SELECT pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary, SUM(pl.accrual_balance) AS accrual_balance, SUM(pl.cash_balance) AS cash_balance
 FROM pl_view AS pl
-LEFT JOIN accounts AS ac ON pl.parent = ac.account_id
+JOIN account_tree_view AS t ON pl.account_id = t.account_id
+JOIN accounts AS ac ON t.ancestor_id = ac.account_id
+WHERE ac.parent = ac.account_id
 GROUP BY pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary
 HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0
 ORDER BY ac.account_type, ac.order_no, ac.account_id;
 
-/**
- * P/Lの年を列挙
+/*
+ * タグP/Lビュー
+ * タグの付いた取引だけの、小分類も含めたP/L
+ * 集計テーブルは取引を区別しないので、transactions_month から集計する
  */
-CREATE OR REPLACE VIEW enum_pl_years_view AS
-SELECT pl.month / 100 AS year
-FROM pl_view AS pl
-WHERE pl.month <= get_month(current_date)
-GROUP BY pl.month / 100
-HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0
-ORDER BY pl.month / 100 DESC;
+CREATE OR REPLACE VIEW tag_pl_view AS
+SELECT tg.name AS tag, tm.month,
+       ac.is_extraordinary,
+       ac.account_id, ac.account_type, ac.name, ac.parent,
+       SUM(tm.accrual_credit_amount - tm.accrual_debit_amount) AS accrual_balance,
+       SUM(tm.cash_credit_amount - tm.cash_debit_amount) AS cash_balance
+FROM transactions_month AS tm
+JOIN transactions_tags AS tt ON tm.transaction_id = tt.transaction_id
+JOIN tags AS tg ON tt.tag_id = tg.tag_id
+LEFT JOIN accounts AS ac ON tm.account_id = ac.account_id
+WHERE ac.account_type = 3 OR ac.account_type = 4
+GROUP BY tg.name, tm.month, ac.account_id, ac.account_type, ac.name, ac.parent, ac.is_extraordinary
+HAVING SUM(tm.accrual_credit_amount - tm.accrual_debit_amount) <> 0
+       OR SUM(tm.cash_credit_amount - tm.cash_debit_amount) <> 0;
+
+/*
+ * タグのグループ化P/Lビュー
+ * タグの付いた取引だけの、大分類のみのP/L
+ */
+CREATE OR REPLACE VIEW tag_grouped_pl_view AS
+SELECT pl.tag, pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary, SUM(pl.accrual_balance) AS accrual_balance, SUM(pl.cash_balance) AS cash_balance
+FROM tag_pl_view AS pl
+JOIN account_tree_view AS t ON pl.account_id = t.account_id
+JOIN accounts AS ac ON t.ancestor_id = ac.account_id
+WHERE ac.parent = ac.account_id
+GROUP BY pl.tag, pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary
+HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0;
+
+/*
+ * 予算ビュー
+ */
+CREATE OR REPLACE VIEW budgets_view AS
+SELECT b.month, b.account_id, ac.account_type, ac.name,
+       p.account_id AS parent_id, p.name AS parent_name, b.amount
+FROM budgets AS b
+JOIN accounts AS ac ON b.account_id = ac.account_id
+JOIN accounts AS p ON ac.parent = p.account_id
+ORDER BY b.month, ac.account_type, p.order_no, ac.order_no, ac.account_id;
 
+/*
+ * 取引のタグビュー
+ * 取引1件につき1行で、タグを名前順に空白で区切って並べる
+ */
+CREATE OR REPLACE VIEW transaction_tags_view AS
+SELECT tt.transaction_id, string_agg(tg.name, ' ' ORDER BY tg.name) AS tags
+FROM transactions_tags AS tt
+JOIN tags AS tg ON tt.tag_id = tg.tag_id
+GROUP BY tt.transaction_id;
 
 /*
  * 取引ビュー
+ * 明細1行につき1行
  */
 CREATE OR REPLACE VIEW transactions_view AS
-SELECT tr.transaction_id, tr.version, tr.date, tr.debit_id, de.name AS debit,
-       tr.credit_id, cr.name AS credit, tr.amount,
+SELECT tr.transaction_id, tr.version, tr.date,
        tr.description, tr.start_month, tr.end_month,
-       de.search_words as debit_search_words,
-       cr.search_words as credit_search_words
+       td.no, td.account_id, ac.name AS account, ac.search_words, ac.currency,
+       td.debit_amount, td.credit_amount, td.currency_amount, td.rate,
+       COALESCE(tv.tags, '') AS tags
 FROM transactions AS tr
-LEFT JOIN accounts AS de ON tr.debit_id = de.account_id
-LEFT JOIN accounts AS cr ON tr.credit_id = cr.account_id;
+JOIN transactions_detail AS td ON tr.transaction_id = td.transaction_id
+LEFT JOIN accounts AS ac ON td.account_id = ac.account_id
+LEFT JOIN transaction_tags_view AS tv ON tr.transaction_id = tv.transaction_id;
 
 
 /*
@@ -288,8 +628,24 @@ GROUP BY ts.month, ts.account_id, ac.account_type, ac.name, ac.order_no
 ORDER BY ts.month, ac.account_type, ac.order_no, ts.account_id;
 
 
+/*
+ * 外貨残高ビュー
+ * 外貨建ての勘定科目の月ごとの外貨の残高(累計)
+ */
+CREATE OR REPLACE VIEW currency_balance_view AS
+SELECT m.month, ac.account_id, ac.account_type, ac.name, ac.currency,
+       SUM(CASE WHEN td.debit_amount <> 0 THEN td.currency_amount ELSE -td.currency_amount END) AS currency_balance
+FROM accounts AS ac
+JOIN transactions_detail AS td ON ac.account_id = td.account_id
+JOIN transactions AS tr ON td.transaction_id = tr.transaction_id
+JOIN (SELECT DISTINCT month FROM transactions_summary) AS m ON get_month(tr.date) <= m.month
+WHERE ac.currency <> ''
+GROUP BY m.month, ac.account_id, ac.account_type, ac.name, ac.currency;
+
+
 /*
  * 履歴ビュー
+ * 明細1行につき1行
  */
 CREATE OR REPLACE VIEW history_view AS
 SELECT CASE tr.operation
@@ -300,13 +656,15 @@ SELECT CASE tr.operation
        END AS operation,
        tr.operate_time,
        tr.transaction_id, tr.version, tr.date,
-       tr.debit_id, COALESCE(de.name, 'DELETED') AS debit,
-       tr.credit_id, COALESCE(cr.name, 'DELETED') AS credit,
-       tr.amount, tr.description, tr.start_month, tr.end_month
+       tr.description, tr.start_month, tr.end_month,
+       td.no, td.account_id, COALESCE(ac.name, 'DELETED') AS account, COALESCE(ac.currency, '') AS currency,
+       td.debit_amount, td.credit_amount, td.currency_amount, td.rate,
+       tr.operation_id, tr.tags
 FROM transactions_history AS tr
-LEFT JOIN accounts AS de ON tr.debit_id = de.account_id
-LEFT JOIN accounts AS cr ON tr.credit_id = cr.account_id
-ORDER BY tr.operate_time;
+JOIN transactions_detail_history AS td
+    ON tr.transaction_id = td.transaction_id AND tr.version = td.version
+LEFT JOIN accounts AS ac ON td.account_id = ac.account_id
+ORDER BY tr.operate_time, tr.transaction_id, tr.version, td.no;
 
 
 /*
@@ -322,8 +680,27 @@ LEFT JOIN accounts AS de ON t.debit_id = de.account_id
 LEFT JOIN accounts AS cr ON t.credit_id = cr.account_id;
 
 
+/*
+ * スケジュールビュー
+ */
+CREATE OR REPLACE VIEW schedules_view AS
+SELECT s.schedule_id, s.name,
+       s.template_id, COALESCE(t.name, '') AS template_name,
+       s.debit_id, COALESCE(de.name, '') AS debit_name,
+       s.credit_id, COALESCE(cr.name, '') AS credit_name,
+       s.amount, s.description, s.rule, s.rule_value, s.start_date, s.last_date
+FROM schedules AS s
+LEFT JOIN templates AS t ON s.template_id = t.template_id
+LEFT JOIN accounts AS de ON s.debit_id = de.account_id
+LEFT JOIN accounts AS cr ON s.credit_id = cr.account_id;
+
+
 /*
  * 取引テーブルのバージョン番号を 1 増やす
+ *
+ * 明細だけを変更する場合もバージョンを増やす必要があるので、
+ * 取引を編集するときは明細を書き換えたうえで、
+ * 同じトランザクション内で transactions テーブルも必ず UPDATE すること。
  */
 CREATE OR REPLACE FUNCTION update_version() RETURNS TRIGGER AS $$
 BEGIN
@@ -344,42 +721,158 @@ BEFORE UPDATE ON transactions
     FOR EACH ROW EXECUTE PROCEDURE update_version();
 
 
+/*
+ * 接続の mita.session のまとめ途中の操作のIDを返す補助関数
+ *
+ * まとめ途中の操作がなければ追加する。mita.session がなければ NULL。
+ */
+CREATE OR REPLACE FUNCTION current_operation_id() RETURNS integer AS $$
+DECLARE
+    v_session text := current_setting('mita.session', true);
+    v_id integer;
+BEGIN
+    IF v_session IS NULL OR v_session = '' THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT operation_id INTO v_id FROM operations WHERE session = v_session;
+
+    IF NOT FOUND THEN
+        INSERT INTO operations (operate_time, command, kind, session)
+        VALUES (now(), '', 'N', v_session)
+        RETURNING operation_id INTO v_id;
+    END IF;
+
+    RETURN v_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+/*
+ * 履歴テーブルへ取引と明細を追加する補助関数
+ */
+CREATE OR REPLACE FUNCTION insert_history(a_operation char(1), a_tr transactions, a_version integer) RETURNS void AS $$
+    INSERT INTO transactions_history (operation, operate_time, transaction_id, version, date, description, start_month, end_month,
+        operation_id, tags)
+    VALUES (a_operation, now(), a_tr.transaction_id, a_version, a_tr.date, a_tr.description, a_tr.start_month, a_tr.end_month,
+            current_operation_id(),
+            COALESCE((SELECT tags FROM transaction_tags_view WHERE transaction_id = a_tr.transaction_id), ''));
+
+    INSERT INTO transactions_detail_history (transaction_id, version, no, account_id,
+        debit_amount, credit_amount, currency_amount, rate)
+    SELECT transaction_id, a_version, no, account_id, debit_amount, credit_amount, currency_amount, rate
+    FROM transactions_detail
+    WHERE transaction_id = a_tr.transaction_id;
+$$ LANGUAGE SQL;
+
+
 /*
  * トリガー：取引テーブルが変更されると履歴テーブルに履歴を追加する
+ *
+ * 明細は取引の後に追加されるので、INSERT と UPDATE の場合は
+ * コミット時まで遅延させてから明細も含めた履歴を追加する。
+ * DELETE の場合は明細と添付と外部IDがカスケード削除される前に履歴を追加する。
  */
 CREATE OR REPLACE FUNCTION update_transactions_history() RETURNS TRIGGER AS $$
 BEGIN
     IF (TG_OP = 'DELETE') THEN
-        OLD.version := OLD.version + 1;
-        INSERT INTO transactions_history SELECT 'D', now(), OLD.*;
-    ELSIF (TG_OP = 'UPDATE') THEN
-        INSERT INTO transactions_history SELECT 'U', now(), NEW.*;
+        PERFORM insert_history('D', OLD, OLD.version + 1);
+
+        INSERT INTO attachments_history (transaction_id, version, attachment_id, name, sha256, size, attach_time)
+        SELECT transaction_id, OLD.version + 1, attachment_id, name, sha256, size, attach_time
+        FROM attachments
+        WHERE transaction_id = OLD.transaction_id;
+
+        INSERT INTO transactions_import_history (transaction_id, version, external_id)
+        SELECT transaction_id, OLD.version + 1, external_id
+        FROM transactions_import
+        WHERE transaction_id = OLD.transaction_id;
+
+        RETURN OLD;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM transactions WHERE transaction_id = NEW.transaction_id AND version = NEW.version) THEN
+        -- 同じトランザクション内で削除または更新された
+        RETURN NULL;
+    END IF;
+
+    IF (TG_OP = 'UPDATE') THEN
+        PERFORM insert_history('U', NEW, NEW.version);
     ELSIF (TG_OP = 'INSERT') THEN
-        INSERT INTO transactions_history SELECT 'I', now(), NEW.*;
+        PERFORM insert_history('I', NEW, NEW.version);
     END IF;
 
     RETURN NULL;
 END;
 $$ LANGUAGE plpgsql;
 
-CREATE TRIGGER update_transactions_history
-AFTER INSERT OR UPDATE OR DELETE ON transactions
+CREATE CONSTRAINT TRIGGER update_transactions_history
+AFTER INSERT OR UPDATE ON transactions
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE update_transactions_history();
+
+CREATE TRIGGER delete_transactions_history
+BEFORE DELETE ON transactions
     FOR EACH ROW EXECUTE PROCEDURE update_transactions_history();
 
 
 /*
- * transactions_month テーブルへの行追加の補助関数
+ * トリガー：取引の借方金額の合計と貸方金額の合計が一致するか確認する
  */
-CREATE OR REPLACE FUNCTION insert_months(a_transaction_id integer, a_debit_id integer, a_credit_id integer, a_month integer,
-    a_accrual_amount integer, a_cash_amount integer) RETURNS void AS $$
+CREATE OR REPLACE FUNCTION check_transactions_balance() RETURNS TRIGGER AS $$
+DECLARE
+    v_transaction_id integer;
+    v_count integer;
+    v_diff integer;
+BEGIN
+    IF (TG_OP = 'DELETE') THEN
+        v_transaction_id := OLD.transaction_id;
+    ELSE
+        v_transaction_id := NEW.transaction_id;
+    END IF;
 
-    INSERT INTO transactions_month (transaction_id, account_id, month,
-    accrual_debit_amount, accrual_credit_amount, cash_debit_amount, cash_credit_amount)
-    VALUES (a_transaction_id, a_debit_id, a_month, a_accrual_amount, 0, a_cash_amount, 0);
+    IF NOT EXISTS (SELECT 1 FROM transactions WHERE transaction_id = v_transaction_id) THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT COUNT(*), COALESCE(SUM(debit_amount - credit_amount), 0) INTO v_count, v_diff
+    FROM transactions_detail
+    WHERE transaction_id = v_transaction_id;
+
+    IF v_count < 2 THEN
+        RAISE 'transaction % must have at least 2 lines', v_transaction_id;
+    END IF;
+
+    IF v_diff <> 0 THEN
+        RAISE 'transaction % is not balanced: debit - credit = %', v_transaction_id, v_diff;
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER check_transactions_balance
+AFTER INSERT OR UPDATE ON transactions
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE check_transactions_balance();
+
+CREATE CONSTRAINT TRIGGER check_transactions_detail_balance
+AFTER INSERT OR UPDATE OR DELETE ON transactions_detail
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE check_transactions_balance();
+
+
+/*
+ * transactions_month テーブルへの行追加の補助関数
+ */
+CREATE OR REPLACE FUNCTION insert_month(a_transaction_id integer, a_account_id integer, a_month integer,
+    a_accrual_debit_amount integer, a_accrual_credit_amount integer,
+    a_cash_debit_amount integer, a_cash_credit_amount integer) RETURNS void AS $$
 
     INSERT INTO transactions_month (transaction_id, account_id, month,
     accrual_debit_amount, accrual_credit_amount, cash_debit_amount, cash_credit_amount)
-    VALUES (a_transaction_id, a_credit_id, a_month, 0, a_accrual_amount, 0, a_cash_amount);
+    VALUES (a_transaction_id, a_account_id, a_month,
+    a_accrual_debit_amount, a_accrual_credit_amount, a_cash_debit_amount, a_cash_credit_amount);
 $$ LANGUAGE SQL;
 
 
@@ -455,15 +948,19 @@ $$ LANGUAGE plpgsql;
  * トリガー：取引を月ごとに分ける
  *
  * 取引に開始月と終了月が指定されている場合は、
- * 発生主義の金額を計算するために、金額を期間内の各月に振り分ける。
+ * 発生主義の金額を計算するために、明細ごとに金額を期間内の各月に振り分ける。
+ * 明細は取引の後に追加されるので、INSERT と UPDATE の場合はコミット時に実行する。
  */
 CREATE OR REPLACE FUNCTION update_transactions_month() RETURNS TRIGGER AS $$
 DECLARE
     v_transaction_id integer;
     v_month integer;
     v_num_months integer;
-    v_remain_amount integer;
-    v_amount integer;
+    v_line RECORD;
+    v_remain_debit integer;
+    v_remain_credit integer;
+    v_debit integer;
+    v_credit integer;
 BEGIN
     IF (TG_OP = 'DELETE') THEN
         v_transaction_id := OLD.transaction_id;
@@ -477,41 +974,65 @@ BEGIN
         RETURN NULL;
     END IF;
 
+    IF NOT EXISTS (SELECT 1 FROM transactions WHERE transaction_id = NEW.transaction_id AND version = NEW.version) THEN
+        -- 同じトランザクション内で削除または更新された
+        RETURN NULL;
+    END IF;
+
     v_month := get_month(NEW.date);
 
     IF NEW.start_month = 0 AND NEW.end_month = 0 THEN
         -- 期間が指定されてなければ、取引日の月に金額を振り分ける
-        PERFORM insert_months(v_transaction_id, NEW.debit_id, NEW.credit_id, v_month, NEW.amount, NEW.amount);
+        FOR v_line IN SELECT * FROM transactions_detail WHERE transaction_id = v_transaction_id ORDER BY no LOOP
+            PERFORM insert_month(v_transaction_id, v_line.account_id, v_month,
+                v_line.debit_amount, v_line.credit_amount, v_line.debit_amount, v_line.credit_amount);
+        END LOOP;
 
         RETURN NULL;
     END IF;
 
     -- 期間が指定されている場合は、開始月から終了月の間の各月に金額を振り分ける
 
-    PERFORM insert_months(v_transaction_id, NEW.debit_id, NEW.credit_id, v_month, 0, NEW.amount);
-
     SELECT COUNT(*) INTO v_num_months FROM get_months(NEW.start_month, NEW.end_month);
-    v_remain_amount := NEW.amount;  -- まだ振り分けてない金額
-    v_amount := ceil(NEW.amount::real / v_num_months);  -- 各月に振り分ける金額
 
-    FOR v_month IN SELECT get_months(NEW.start_month, NEW.end_month) LOOP
-        IF v_amount > v_remain_amount THEN
-            v_amount := v_remain_amount;
-        END IF;
+    FOR v_line IN SELECT * FROM transactions_detail WHERE transaction_id = v_transaction_id ORDER BY no LOOP
+        PERFORM insert_month(v_transaction_id, v_line.account_id, v_month,
+            0, 0, v_line.debit_amount, v_line.credit_amount);
 
-        PERFORM insert_months(v_transaction_id, NEW.debit_id, NEW.credit_id, v_month, v_amount, 0);
+        v_remain_debit := v_line.debit_amount;  -- まだ振り分けてない金額
+        v_remain_credit := v_line.credit_amount;
+        v_debit := ceil(v_line.debit_amount::real / v_num_months);  -- 各月に振り分ける金額
+        v_credit := ceil(v_line.credit_amount::real / v_num_months);
 
-        v_remain_amount := v_remain_amount - v_amount;
-    END LOOP;
+        FOR v_month IN SELECT get_months(NEW.start_month, NEW.end_month) LOOP
+            IF v_debit > v_remain_debit THEN
+                v_debit := v_remain_debit;
+            END IF;
 
-    ASSERT v_remain_amount = 0, 'v_remain_amount <> 0';
+            IF v_credit > v_remain_credit THEN
+                v_credit := v_remain_credit;
+            END IF;
+
+            PERFORM insert_month(v_transaction_id, v_line.account_id, v_month, v_debit, v_credit, 0, 0);
+
+            v_remain_debit := v_remain_debit - v_debit;
+            v_remain_credit := v_remain_credit - v_credit;
+        END LOOP;
+
+        ASSERT v_remain_debit = 0 AND v_remain_credit = 0, 'v_remain_amount <> 0';
+    END LOOP;
 
     RETURN NULL;
 END;
 $$ LANGUAGE plpgsql;
 
-CREATE TRIGGER update_transactions_month
-AFTER INSERT OR UPDATE OR DELETE ON transactions
+CREATE CONSTRAINT TRIGGER update_transactions_month
+AFTER INSERT OR UPDATE ON transactions
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE update_transactions_month();
+
+CREATE TRIGGER delete_transactions_month
+AFTER DELETE ON transactions
     FOR EACH ROW EXECUTE PROCEDURE update_transactions_month();
 
 
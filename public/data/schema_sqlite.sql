@@ -0,0 +1,746 @@
+/*
+ * SQLite 用のスキーマ
+ *
+ * テーブルとビューは schema.sql (PostgreSQL 用)と同じ構成にしている。
+ * SQLite のトリガーは遅延できないので、コミット時に必要な処理
+ * (貸借の確認、INSERT と UPDATE の履歴の追加、月ごとの集計)は mita 側で行う。
+ * トリガーは変更された取引を transactions_dirty テーブルに記録するだけ。
+ *
+ * 日付は 'YYYY-MM-DD' の文字列で保持する。
+ */
+
+/*
+ * スキーマのバージョン
+ *
+ * mita db migrate でマイグレーションを適用するとバージョンが上がる。
+ */
+CREATE TABLE schema_version (
+    version integer NOT NULL
+);
+
+INSERT INTO schema_version VALUES (9);
+
+
+/*
+ * 勘定科目テーブル
+ */
+CREATE TABLE accounts (
+    account_id integer NOT NULL,
+    account_type integer NOT NULL CHECK(account_type BETWEEN 1 AND 5),
+    name varchar(8) NOT NULL UNIQUE,
+    search_words varchar(32) NOT NULL DEFAULT '',
+    parent integer NOT NULL REFERENCES accounts (account_id) DEFERRABLE INITIALLY DEFERRED,
+    order_no integer NOT NULL DEFAULT 999,
+    is_extraordinary boolean NOT NULL DEFAULT FALSE,
+    currency varchar(3) NOT NULL DEFAULT '',  -- 外貨建ての勘定科目の通貨コード。空文字は円
+
+    PRIMARY KEY (account_id)
+);
+
+/*
+ * parentが設定されてなければ、自分のaccount_idを設定する
+ */
+CREATE TRIGGER set_default_parent_insert
+AFTER INSERT ON accounts
+FOR EACH ROW
+WHEN (NEW.parent = 0 OR NEW.parent IS NULL)
+BEGIN
+    UPDATE accounts SET parent = NEW.account_id WHERE account_id = NEW.account_id;
+END;
+
+CREATE TRIGGER set_default_parent_update
+AFTER UPDATE ON accounts
+FOR EACH ROW
+WHEN (NEW.parent = 0 OR NEW.parent IS NULL)
+BEGIN
+    UPDATE accounts SET parent = NEW.account_id WHERE account_id = NEW.account_id;
+END;
+
+
+/*
+ * 為替レートテーブル
+ *
+ * 外貨1単位あたりの円の金額
+ */
+CREATE TABLE exchange_rates (
+    currency varchar(3) NOT NULL,
+    date date NOT NULL,
+    rate numeric(18, 6) NOT NULL CHECK(rate > 0),
+
+    PRIMARY KEY (currency, date)
+);
+
+
+/*
+ * 取引テーブル
+ */
+CREATE TABLE transactions (
+    transaction_id integer NOT NULL,
+    version integer NOT NULL DEFAULT 0,  -- 0 から始まって、更新するごとに 1 増える
+    date date NOT NULL,  -- 実際に取引があった日
+    description varchar (64) NOT NULL,
+    start_month integer NOT NULL,  -- 発生主義から見た開始月
+    end_month integer NOT NULL,  -- 発生主義から見た終了月
+
+    PRIMARY KEY (transaction_id),
+    CHECK ((start_month = 0 AND end_month = 0) OR (start_month > 0 AND end_month > 0 AND start_month <= end_month))
+);
+
+
+/*
+ * 取引明細テーブル
+ */
+CREATE TABLE transactions_detail (
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    no integer NOT NULL,
+
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+    debit_amount integer NOT NULL,
+    credit_amount integer NOT NULL,
+    currency_amount integer NOT NULL DEFAULT 0,  -- 外貨の金額(補助単位。USDならセント)
+    rate numeric(18, 6) NOT NULL DEFAULT 0,  -- 取引時の為替レート
+
+    PRIMARY KEY (transaction_id, no),
+    CHECK ((debit_amount = 0) <> (credit_amount = 0))
+);
+
+
+/*
+ * インポートした取引の外部IDテーブル
+ */
+CREATE TABLE transactions_import (
+    external_id varchar(64) NOT NULL,
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+
+    PRIMARY KEY (external_id)
+);
+
+
+/*
+ * タグテーブル
+ */
+CREATE TABLE tags (
+    tag_id integer NOT NULL,
+    name varchar(32) NOT NULL UNIQUE,
+
+    PRIMARY KEY (tag_id)
+);
+
+CREATE TABLE transactions_tags (
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    tag_id integer NOT NULL REFERENCES tags (tag_id) ON DELETE CASCADE,
+
+    PRIMARY KEY (transaction_id, tag_id)
+);
+
+
+/*
+ * 添付ファイルテーブル
+ */
+CREATE TABLE attachments (
+    attachment_id integer NOT NULL,
+    transaction_id integer NOT NULL REFERENCES transactions (transaction_id) ON DELETE CASCADE,
+    name varchar(256) NOT NULL,  -- 添付したときのファイル名
+    sha256 char(64) NOT NULL,
+    size integer NOT NULL,
+    attach_time timestamp NOT NULL,
+
+    PRIMARY KEY (attachment_id)
+);
+
+CREATE INDEX attachments_transaction_id ON attachments (transaction_id);
+
+
+/*
+ * 変更された取引テーブル
+ *
+ * トリガーにより変更された取引を記録して、コミット時に mita が処理する。
+ * operation は 'I': insert, 'U': update, 'D': delete で、明細だけの変更は空文字。
+ */
+CREATE TABLE transactions_dirty (
+    transaction_id integer NOT NULL,
+    operation char(1) NOT NULL CHECK(operation in ('', 'I', 'U', 'D')),
+
+    PRIMARY KEY (transaction_id)
+);
+
+
+/*
+ * 操作テーブル
+ *
+ * mita のコマンド1回で追加された履歴をまとめて、UNDO と REDO の単位にする。
+ * kind は 'N': 通常の操作, 'U': UNDO, 'R': REDO。
+ * UNDO と REDO は target_id の操作を対象にし、is_undone は通常の操作が取り消されているか。
+ */
+CREATE TABLE operations (
+    operation_id integer NOT NULL,
+    operate_time timestamp NOT NULL,
+    command varchar(256) NOT NULL,
+    kind char(1) NOT NULL CHECK(kind in ('N', 'U', 'R')),
+    target_id integer,
+    is_undone boolean NOT NULL DEFAULT FALSE,
+    session varchar(32),  -- まとめ途中の操作に履歴を追加しているプロセス。閉じた操作は NULL
+
+    PRIMARY KEY (operation_id)
+);
+
+CREATE UNIQUE INDEX operations_session ON operations (session);
+
+
+/*
+ * 履歴テーブル
+ */
+CREATE TABLE transactions_history (
+    operation char(1) NOT NULL CHECK(operation in ('I', 'U', 'D')), -- 'I': insert, 'U': update, 'D': delete
+    operate_time timestamp NOT NULL,
+
+    -- 以下は transactions テーブルと同じ内容
+
+    transaction_id integer NOT NULL,
+    version integer NOT NULL,
+    date date NOT NULL,
+    description varchar (64) NOT NULL,
+    start_month integer NOT NULL,
+    end_month integer NOT NULL,
+
+    operation_id integer,  -- 履歴をまとめた操作。NULL は mita 以外で変更した履歴
+    tags varchar(256) NOT NULL DEFAULT '',  -- 取引のタグを空白で区切って並べたもの
+
+    PRIMARY KEY (transaction_id, version)
+);
+
+
+/*
+ * 明細の履歴テーブル
+ */
+CREATE TABLE transactions_detail_history (
+    transaction_id integer NOT NULL,
+    version integer NOT NULL,
+    no integer NOT NULL,
+
+    -- 以下は transactions_detail テーブルと同じ内容
+
+    account_id integer NOT NULL,
+    debit_amount integer NOT NULL,
+    credit_amount integer NOT NULL,
+    currency_amount integer NOT NULL,
+    rate numeric(18, 6) NOT NULL,
+
+    PRIMARY KEY (transaction_id, version, no),
+    FOREIGN KEY (transaction_id, version) REFERENCES transactions_history (transaction_id, version) ON DELETE CASCADE
+);
+
+
+/*
+ * 添付ファイルの履歴テーブル
+ */
+CREATE TABLE attachments_history (
+    transaction_id integer NOT NULL,
+    version integer NOT NULL,
+
+    -- 以下は attachments テーブルと同じ内容
+
+    attachment_id integer NOT NULL,
+    name varchar(256) NOT NULL,
+    sha256 char(64) NOT NULL,
+    size integer NOT NULL,
+    attach_time timestamp NOT NULL,
+
+    PRIMARY KEY (transaction_id, version, attachment_id),
+    FOREIGN KEY (transaction_id, version) REFERENCES transactions_history (transaction_id, version) ON DELETE CASCADE
+);
+
+
+/*
+ * インポートした取引の外部IDの履歴テーブル
+ */
+CREATE TABLE transactions_import_history (
+    transaction_id integer NOT NULL,
+    version integer NOT NULL,
+    external_id varchar(64) NOT NULL,
+
+    PRIMARY KEY (transaction_id, version, external_id),
+    FOREIGN KEY (transaction_id, version) REFERENCES transactions_history (transaction_id, version) ON DELETE CASCADE
+);
+
+
+/*
+ * 月ごとの集計を容易にするための作業用テーブル
+ */
+CREATE TABLE transactions_month (
+    tm_id integer NOT NULL,
+
+    transaction_id integer NOT NULL,
+    account_id integer NOT NULL REFERENCES accounts (account_id) ON DELETE CASCADE,
+    month integer NOT NULL,
+
+    accrual_debit_amount integer NOT NULL,
+    accrual_credit_amount integer NOT NULL,
+
+    cash_debit_amount integer NOT NULL,
+    cash_credit_amount integer NOT NULL,
+
+    PRIMARY KEY (tm_id)
+);
+
+CREATE INDEX transactions_month_transaction_id ON transactions_month (transaction_id);
+
+
+/*
+ * 月ごとの集計テーブル
+ */
+CREATE TABLE transactions_summary (
+    account_id integer NOT NULL REFERENCES accounts (account_id) ON DELETE CASCADE,
+    month integer NOT NULL,
+
+    -- 発生主義
+    accrual_debit_amount integer NOT NULL,  -- 月ごとの借方金額
+    accrual_credit_amount integer NOT NULL,  -- 月ごとの貸方金額
+    accrual_accum_diff integer NOT NULL,  -- accrual_debit_amount - accrual_credit_amount の累計
+
+    -- 現金主義
+    cash_debit_amount integer NOT NULL,  -- 月ごとの借方金額
+    cash_credit_amount integer NOT NULL,  -- 月ごとの貸方金額
+    cash_accum_diff integer NOT NULL,  -- cash_debit_amount - cash_credit_amount の累計
+
+    PRIMARY KEY (account_id, month)
+);
+
+
+/*
+ * テンプレートテーブル
+ */
+CREATE TABLE templates (
+    template_id integer NOT NULL,
+    name varchar(8) NOT NULL UNIQUE,
+
+    PRIMARY KEY (template_id)
+);
+
+
+/*
+ * テンプレート詳細テーブル
+ */
+CREATE TABLE templates_detail (
+    template_id integer NOT NULL REFERENCES templates (template_id),
+    no integer NOT NULL,
+
+    order_no integer NOT NULL,
+
+    debit_id integer NOT NULL REFERENCES accounts (account_id),
+    credit_id integer NOT NULL REFERENCES accounts (account_id),
+    amount integer NOT NULL,
+    description varchar (64) NOT NULL,
+
+    PRIMARY KEY (template_id, no)
+);
+
+/*
+ * スケジュールテーブル
+ */
+CREATE TABLE schedules (
+    schedule_id integer NOT NULL,
+    name varchar(16) NOT NULL UNIQUE,
+    template_id integer NOT NULL DEFAULT 0,
+    debit_id integer NOT NULL DEFAULT 0,
+    credit_id integer NOT NULL DEFAULT 0,
+    amount integer NOT NULL DEFAULT 0,
+    description varchar(64) NOT NULL DEFAULT '',
+    rule char(1) NOT NULL CHECK(rule IN ('M', 'W', 'B')),
+    rule_value integer NOT NULL DEFAULT 0,
+    start_date date NOT NULL,
+    last_date date,
+
+    PRIMARY KEY (schedule_id)
+);
+
+/*
+ * スケジュールから追加した取引の記録
+ */
+CREATE TABLE schedules_log (
+    schedule_id integer NOT NULL REFERENCES schedules (schedule_id) ON DELETE CASCADE,
+    date date NOT NULL,
+    no integer NOT NULL,
+    transaction_id integer NOT NULL,
+    operate_time timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now', 'localtime')),
+
+    PRIMARY KEY (schedule_id, date, no)
+);
+
+
+/*
+ * 残高の確認テーブル
+ */
+CREATE TABLE assertions (
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+    date date NOT NULL,
+    amount integer NOT NULL,
+
+    PRIMARY KEY (account_id, date)
+);
+
+
+/*
+ * 予算テーブル
+ */
+CREATE TABLE budgets (
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+    month integer NOT NULL,
+    amount integer NOT NULL,
+
+    PRIMARY KEY (account_id, month)
+);
+
+
+/*
+ * 取り込み規則テーブル
+ */
+CREATE TABLE import_rules (
+    rule_id integer NOT NULL,
+    pattern varchar(128) NOT NULL,
+    account_id integer NOT NULL REFERENCES accounts (account_id),
+
+    PRIMARY KEY (rule_id)
+);
+
+
+/*
+ * グループテーブル
+ */
+CREATE TABLE groups (
+    group_id integer NOT NULL,
+    name varchar(16) NOT NULL,
+    check_account_id integer,
+
+    PRIMARY KEY (group_id)
+);
+
+CREATE TABLE groups_detail (
+    group_id integer NOT NULL REFERENCES groups (group_id) ON DELETE CASCADE,
+    transaction_id integer NOT NULL,
+
+    PRIMARY KEY (group_id, transaction_id)
+);
+
+
+/*
+ * 収支ビュー
+ */
+CREATE VIEW bp_view AS
+SELECT ts.month,
+       SUM(CASE WHEN ac.account_type = 3 THEN accrual_credit_amount - accrual_debit_amount ELSE 0 END)
+       -
+       SUM(CASE WHEN ac.account_type = 4 THEN accrual_debit_amount - accrual_credit_amount ELSE 0 END)
+       AS extra_accrual_balance,
+       SUM(CASE WHEN ac.account_type = 3 THEN cash_credit_amount - cash_debit_amount ELSE 0 END)
+       -
+       SUM(CASE WHEN ac.account_type = 4 THEN cash_debit_amount - cash_credit_amount ELSE 0 END)
+       AS extra_cash_balance,
+       SUM(CASE WHEN ac.account_type = 3 AND ac.is_extraordinary = FALSE THEN accrual_credit_amount - accrual_debit_amount ELSE 0 END)
+       -
+       SUM(CASE WHEN ac.account_type = 4 AND ac.is_extraordinary = FALSE THEN accrual_debit_amount - accrual_credit_amount ELSE 0 END)
+       AS accrual_balance,
+       SUM(CASE WHEN ac.account_type = 3 AND ac.is_extraordinary = FALSE THEN cash_credit_amount - cash_debit_amount ELSE 0 END)
+       -
+       SUM(CASE WHEN ac.account_type = 4 AND ac.is_extraordinary = FALSE THEN cash_debit_amount - cash_credit_amount ELSE 0 END)
+       AS cash_balance
+FROM transactions_summary AS ts
+LEFT JOIN accounts AS ac ON ts.account_id = ac.account_id
+WHERE ts.month <= CAST(strftime('%Y%m', 'now', 'localtime') AS integer)
+GROUP BY ts.month
+ORDER BY ts.month;
+
+/*
+ * 勘定科目の階層ビュー
+ * 勘定科目と、自分自身を含む全ての祖先の組
+ */
+CREATE VIEW account_tree_view AS
+WITH RECURSIVE tree(account_id, ancestor_id) AS (
+    SELECT account_id, account_id FROM accounts
+    UNION
+    SELECT tree.account_id, ac.parent
+    FROM tree
+    JOIN accounts AS ac ON tree.ancestor_id = ac.account_id
+    WHERE ac.parent <> ac.account_id
+)
+SELECT account_id, ancestor_id FROM tree;
+
+/*
+ * P/Lビュー
+ * 小分類も含めたP/L
+ */
+CREATE VIEW pl_view AS
+SELECT ts.month,
+       ac.is_extraordinary,
+       ac.account_id, ac.account_type, ac.name, ac.parent,
+       SUM(accrual_credit_amount - accrual_debit_amount) AS accrual_balance,
+       SUM(cash_credit_amount - cash_debit_amount) AS cash_balance
+FROM transactions_summary AS ts
+LEFT JOIN accounts AS ac ON ts.account_id = ac.account_id
+WHERE ac.account_type = 3 OR ac.account_type = 4
+GROUP BY ts.month, ac.account_id, ac.account_type, ac.name, ac.parent, ac.is_extraordinary
+HAVING SUM(accrual_credit_amount - accrual_debit_amount) <> 0
+       OR SUM(cash_credit_amount - cash_debit_amount) <> 0
+ORDER BY ac.account_type, ac.order_no, ac.account_id, ac.is_extraordinary;
+
+/*
+ * グループ化P/Lビュー
+ * 大分類のみのP/L
+ */
+CREATE VIEW grouped_pl_view AS
+SELECT pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary, SUM(pl.accrual_balance) AS accrual_balance, SUM(pl.cash_balance) AS cash_balance
+FROM pl_view AS pl
+JOIN account_tree_view AS t ON pl.account_id = t.account_id
+JOIN accounts AS ac ON t.ancestor_id = ac.account_id
+WHERE ac.parent = ac.account_id
+GROUP BY pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary
+HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0
+ORDER BY ac.account_type, ac.order_no, ac.account_id;
+
+/*
+ * タグP/Lビュー
+ * タグの付いた取引だけの、小分類も含めたP/L
+ */
+CREATE VIEW tag_pl_view AS
+SELECT tg.name AS tag, tm.month,
+       ac.is_extraordinary,
+       ac.account_id, ac.account_type, ac.name, ac.parent,
+       SUM(tm.accrual_credit_amount - tm.accrual_debit_amount) AS accrual_balance,
+       SUM(tm.cash_credit_amount - tm.cash_debit_amount) AS cash_balance
+FROM transactions_month AS tm
+JOIN transactions_tags AS tt ON tm.transaction_id = tt.transaction_id
+JOIN tags AS tg ON tt.tag_id = tg.tag_id
+LEFT JOIN accounts AS ac ON tm.account_id = ac.account_id
+WHERE ac.account_type = 3 OR ac.account_type = 4
+GROUP BY tg.name, tm.month, ac.account_id, ac.account_type, ac.name, ac.parent, ac.is_extraordinary
+HAVING SUM(tm.accrual_credit_amount - tm.accrual_debit_amount) <> 0
+       OR SUM(tm.cash_credit_amount - tm.cash_debit_amount) <> 0;
+
+/*
+ * タグのグループ化P/Lビュー
+ */
+CREATE VIEW tag_grouped_pl_view AS
+SELECT pl.tag, pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary, SUM(pl.accrual_balance) AS accrual_balance, SUM(pl.cash_balance) AS cash_balance
+FROM tag_pl_view AS pl
+JOIN account_tree_view AS t ON pl.account_id = t.account_id
+JOIN accounts AS ac ON t.ancestor_id = ac.account_id
+WHERE ac.parent = ac.account_id
+GROUP BY pl.tag, pl.month, ac.account_id, ac.account_type, ac.name, ac.is_extraordinary
+HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0;
+
+/*
+ * 予算ビュー
+ */
+CREATE VIEW budgets_view AS
+SELECT b.month, b.account_id, ac.account_type, ac.name,
+       p.account_id AS parent_id, p.name AS parent_name, b.amount
+FROM budgets AS b
+JOIN accounts AS ac ON b.account_id = ac.account_id
+JOIN accounts AS p ON ac.parent = p.account_id
+ORDER BY b.month, ac.account_type, p.order_no, ac.order_no, ac.account_id;
+
+/*
+ * 取引のタグビュー
+ * 取引1件につき1行で、タグを名前順に空白で区切って並べる
+ */
+CREATE VIEW transaction_tags_view AS
+SELECT transaction_id, group_concat(name, ' ') AS tags
+FROM (SELECT tt.transaction_id, tg.name
+      FROM transactions_tags AS tt
+      JOIN tags AS tg ON tt.tag_id = tg.tag_id
+      ORDER BY tt.transaction_id, tg.name)
+GROUP BY transaction_id;
+
+/*
+ * 取引ビュー
+ * 明細1行につき1行
+ */
+CREATE VIEW transactions_view AS
+SELECT tr.transaction_id, tr.version, tr.date,
+       tr.description, tr.start_month, tr.end_month,
+       td.no, td.account_id, ac.name AS account, ac.search_words, ac.currency,
+       td.debit_amount, td.credit_amount, td.currency_amount, td.rate,
+       COALESCE(tv.tags, '') AS tags
+FROM transactions AS tr
+JOIN transactions_detail AS td ON tr.transaction_id = td.transaction_id
+LEFT JOIN accounts AS ac ON td.account_id = ac.account_id
+LEFT JOIN transaction_tags_view AS tv ON tr.transaction_id = tv.transaction_id;
+
+
+/*
+ * 残高ビュー
+ */
+CREATE VIEW balance_view AS
+SELECT ts.month, ts.account_id, ac.account_type, ac.name, SUM(ts.cash_accum_diff) AS balance
+FROM  transactions_summary AS ts
+LEFT JOIN accounts AS ac ON ts.account_id = ac.account_id
+WHERE ts.month <= CAST(strftime('%Y%m', 'now', 'localtime') AS integer) AND
+      (ac.account_type = 1 OR ac.account_type = 2)
+GROUP BY ts.month, ts.account_id, ac.account_type, ac.name, ac.order_no
+ORDER BY ts.month, ac.account_type, ac.order_no, ts.account_id;
+
+
+/*
+ * 外貨残高ビュー
+ * 外貨建ての勘定科目の月ごとの外貨の残高(累計)
+ */
+CREATE VIEW currency_balance_view AS
+SELECT m.month, ac.account_id, ac.account_type, ac.name, ac.currency,
+       SUM(CASE WHEN td.debit_amount <> 0 THEN td.currency_amount ELSE -td.currency_amount END) AS currency_balance
+FROM accounts AS ac
+JOIN transactions_detail AS td ON ac.account_id = td.account_id
+JOIN transactions AS tr ON td.transaction_id = tr.transaction_id
+JOIN (SELECT DISTINCT month FROM transactions_summary) AS m ON CAST(strftime('%Y%m', tr.date) AS integer) <= m.month
+WHERE ac.currency <> ''
+GROUP BY m.month, ac.account_id, ac.account_type, ac.name, ac.currency;
+
+
+/*
+ * 履歴ビュー
+ * 明細1行につき1行
+ */
+CREATE VIEW history_view AS
+SELECT CASE tr.operation
+       WHEN 'I' THEN 'INSERT'
+       WHEN 'U' THEN 'UPDATE'
+       WHEN 'D' THEN 'DELETE'
+                ELSE 'UNKNOWN'
+       END AS operation,
+       tr.operate_time,
+       tr.transaction_id, tr.version, tr.date,
+       tr.description, tr.start_month, tr.end_month,
+       td.no, td.account_id, COALESCE(ac.name, 'DELETED') AS account, COALESCE(ac.currency, '') AS currency,
+       td.debit_amount, td.credit_amount, td.currency_amount, td.rate,
+       tr.operation_id, tr.tags
+FROM transactions_history AS tr
+JOIN transactions_detail_history AS td
+    ON tr.transaction_id = td.transaction_id AND tr.version = td.version
+LEFT JOIN accounts AS ac ON td.account_id = ac.account_id
+ORDER BY tr.operate_time, tr.transaction_id, tr.version, td.no;
+
+
+/*
+ * テンプレート詳細ビュー
+ */
+CREATE VIEW templates_detail_view AS
+SELECT t.template_id, t.no, t.order_no,
+       t.debit_id, de.name AS debit_name, de.search_words AS debit_search_words,
+       t.credit_id, cr.name AS credit_name, cr.search_words AS credit_search_words,
+       t.amount, t.description
+FROM templates_detail AS t
+LEFT JOIN accounts AS de ON t.debit_id = de.account_id
+LEFT JOIN accounts AS cr ON t.credit_id = cr.account_id;
+
+
+/*
+ * スケジュールビュー
+ */
+CREATE VIEW schedules_view AS
+SELECT s.schedule_id, s.name,
+       s.template_id, COALESCE(t.name, '') AS template_name,
+       s.debit_id, COALESCE(de.name, '') AS debit_name,
+       s.credit_id, COALESCE(cr.name, '') AS credit_name,
+       s.amount, s.description, s.rule, s.rule_value, s.start_date, s.last_date
+FROM schedules AS s
+LEFT JOIN templates AS t ON s.template_id = t.template_id
+LEFT JOIN accounts AS de ON s.debit_id = de.account_id
+LEFT JOIN accounts AS cr ON s.credit_id = cr.account_id;
+
+
+/*
+ * 取引テーブルのバージョン番号を 1 増やす
+ */
+CREATE TRIGGER update_version
+AFTER UPDATE ON transactions
+FOR EACH ROW
+WHEN NEW.version = OLD.version AND
+     (NEW.date IS NOT OLD.date OR NEW.description IS NOT OLD.description OR
+      NEW.start_month IS NOT OLD.start_month OR NEW.end_month IS NOT OLD.end_month)
+BEGIN
+    UPDATE transactions SET version = OLD.version + 1 WHERE transaction_id = NEW.transaction_id;
+END;
+
+
+/*
+ * トリガー：変更された取引を記録する
+ *
+ * 同じトランザクション内で何度も変更された場合は、最後の操作を記録する。
+ * 明細だけの変更は、取引の操作を上書きしない。
+ */
+CREATE TRIGGER insert_transactions_dirty
+AFTER INSERT ON transactions
+FOR EACH ROW
+BEGIN
+    INSERT INTO transactions_dirty VALUES (NEW.transaction_id, 'I')
+    ON CONFLICT (transaction_id) DO UPDATE SET operation = excluded.operation;
+END;
+
+CREATE TRIGGER update_transactions_dirty
+AFTER UPDATE ON transactions
+FOR EACH ROW
+WHEN NEW.version IS NOT OLD.version OR
+     NEW.date IS NOT OLD.date OR NEW.description IS NOT OLD.description OR
+     NEW.start_month IS NOT OLD.start_month OR NEW.end_month IS NOT OLD.end_month
+BEGIN
+    INSERT INTO transactions_dirty VALUES (NEW.transaction_id, 'U')
+    ON CONFLICT (transaction_id) DO UPDATE SET operation = excluded.operation;
+END;
+
+CREATE TRIGGER insert_transactions_detail_dirty
+AFTER INSERT ON transactions_detail
+FOR EACH ROW
+BEGIN
+    INSERT INTO transactions_dirty VALUES (NEW.transaction_id, '')
+    ON CONFLICT (transaction_id) DO NOTHING;
+END;
+
+CREATE TRIGGER update_transactions_detail_dirty
+AFTER UPDATE ON transactions_detail
+FOR EACH ROW
+BEGIN
+    INSERT INTO transactions_dirty VALUES (NEW.transaction_id, '')
+    ON CONFLICT (transaction_id) DO NOTHING;
+END;
+
+CREATE TRIGGER delete_transactions_detail_dirty
+AFTER DELETE ON transactions_detail
+FOR EACH ROW
+BEGIN
+    INSERT INTO transactions_dirty VALUES (OLD.transaction_id, '')
+    ON CONFLICT (transaction_id) DO NOTHING;
+END;
+
+
+/*
+ * トリガー：取引を削除すると履歴テーブルに履歴を追加する
+ *
+ * 明細と添付と外部IDがカスケード削除される前に履歴を追加する。
+ */
+CREATE TRIGGER delete_transactions_history
+BEFORE DELETE ON transactions
+FOR EACH ROW
+BEGIN
+    INSERT INTO transactions_history (operation, operate_time, transaction_id, version, date, description, start_month, end_month, tags)
+    VALUES ('D', strftime('%Y-%m-%d %H:%M:%f', 'now', 'localtime'), OLD.transaction_id, OLD.version + 1,
+            OLD.date, OLD.description, OLD.start_month, OLD.end_month,
+            COALESCE((SELECT tags FROM transaction_tags_view WHERE transaction_id = OLD.transaction_id), ''));
+
+    INSERT INTO transactions_detail_history (transaction_id, version, no, account_id,
+        debit_amount, credit_amount, currency_amount, rate)
+    SELECT transaction_id, OLD.version + 1, no, account_id, debit_amount, credit_amount, currency_amount, rate
+    FROM transactions_detail
+    WHERE transaction_id = OLD.transaction_id;
+
+    INSERT INTO attachments_history (transaction_id, version, attachment_id, name, sha256, size, attach_time)
+    SELECT transaction_id, OLD.version + 1, attachment_id, name, sha256, size, attach_time
+    FROM attachments
+    WHERE transaction_id = OLD.transaction_id;
+
+    INSERT INTO transactions_import_history (transaction_id, version, external_id)
+    SELECT transaction_id, OLD.version + 1, external_id
+    FROM transactions_import
+    WHERE transaction_id = OLD.transaction_id;
+
+    INSERT INTO transactions_dirty VALUES (OLD.transaction_id, 'D')
+    ON CONFLICT (transaction_id) DO UPDATE SET operation = excluded.operation;
+END;
@@ -0,0 +1,130 @@
+'use strict';
+
+var budgetChart = (function () {
+
+    function budgetChart() {
+        var div,
+            svg,
+            g,
+            data,
+            margin = {top: 50, right: 10, bottom: 10, left: 100},
+            width = 720,  // 最小幅
+            curWidth = width,  // 実際のsvg幅
+            rowHeight = 30,
+            height,
+            xScale = d3.scaleLinear(),
+            yScale = d3.scaleBand().paddingOuter(0.1).paddingInner(0.3),
+            xAxis = d3.axisTop(xScale),
+            yAxis = d3.axisLeft(yScale);
+
+        function chart(selection) {
+            window.addEventListener("resize", resize);
+            div = selection;
+
+            selection.each(function(data0) {
+                // 予算が設定されている行だけを表示する
+                data = data0.values.filter(function(d) { return d.has_budget; });
+
+                height = margin.top + margin.bottom + rowHeight * Math.max(1, data.length);
+
+                yScale
+                    .domain(data.map(function(d) { return d.name; }))
+                    .range([0, height - margin.top - margin.bottom]);
+
+                var svg0 = div.selectAll("svg").data([data]);
+
+                if (svg0.size() > 0) {
+                    svg = svg0;
+                } else {
+                    svg = svg0.enter().append("svg");
+
+                    g = svg.append("g")
+                        .attr("transform", "translate(" + margin.left + "," + margin.top + ")");
+
+                    g.append("g").attr("class", "x axis");
+                    g.append("g").attr("class", "y axis");
+                    g.append("g").attr("class", "bars");
+                }
+
+                svg.attr("height", height);
+
+                g.select(".y.axis").call(yAxis);
+
+                resize();
+            });
+        }
+
+        function resize() {
+            curWidth = getWidth();
+            redraw();
+        }
+
+        function redraw() {
+            svg.attr("width", curWidth);
+
+            var w = curWidth - margin.left - margin.right,
+                maxX = d3.max(data, function(d) { return Math.max(d.budget, d.actual); }) || 1;
+
+            xScale
+                .domain([0, maxX])
+                .range([0, w]);
+
+            g.select(".x.axis").call(xAxis);
+
+            var rows = g.select(".bars").selectAll("g.budget-row")
+                .data(data, function(d) { return d.name; });
+
+            rows.exit().remove();
+
+            var rowsEnter = rows.enter()
+                .append("g")
+                .attr("class", "budget-row");
+
+            rowsEnter.append("rect").attr("class", "budget-actual");
+            rowsEnter.append("line").attr("class", "budget-line");
+            rowsEnter.append("title");
+
+            rows = rowsEnter.merge(rows);
+
+            rows.select(".budget-actual")
+                .attr("x", 0)
+                .attr("y", function(d) { return yScale(d.name); })
+                .attr("height", yScale.bandwidth())
+                .attr("width", function(d) { return xScale(d.actual); })
+                .classed("over-budget", isOverBudget);
+
+            rows.select(".budget-line")
+                .attr("x1", function(d) { return xScale(d.budget); })
+                .attr("x2", function(d) { return xScale(d.budget); })
+                .attr("y1", function(d) { return yScale(d.name) - 3; })
+                .attr("y2", function(d) { return yScale(d.name) + yScale.bandwidth() + 3; });
+
+            rows.select("title")
+                .text(function(d) {
+                    return d.name + "\n予算: " + d.budget.toLocaleString() +
+                        "\n実績: " + d.actual.toLocaleString();
+                });
+        }
+
+        // 費用は予算を超えたら、収入は予算に届かなければ予算オーバー
+        function isOverBudget(d) {
+            if (d.account_type == 3) {
+                return d.actual < d.budget;
+            }
+
+            return d.actual > d.budget;
+        }
+
+        function getWidth() {
+            if (typeof div === "undefined") {
+                return width;
+            }
+
+            return Math.max(width, parseInt(div.style("width"), 10));
+        }
+
+        return chart;
+    }
+
+    return budgetChart;
+})();
@@ -25,6 +25,14 @@ d3.json("/api/pl").then(function(data) {
         .call(myPLChart);
 });
 
+var myBudgetChart = budgetChart();
+
+d3.json("/api/budget").then(function(data) {
+    d3.select("#budget-chart")
+        .datum(data)
+        .call(myBudgetChart);
+});
+
 var curYear = 0,
     isCurCash = false,
     curShowExtra = false;
@@ -66,5 +74,11 @@ function changeMode(isCash, showExtra) {
                 .datum(data)
                 .call(myPLChart);
         });
+
+        d3.json("/api/budget" + (isCash ? "?cash=true" : "")).then(function(data) {
+            d3.select("#budget-chart")
+                .datum(data)
+                .call(myBudgetChart);
+        });
     }
 }
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+取引の検索条件
+
+空白で区切った条件を全て満たす取引を探す。条件の前に - を付けると否定になる。
+空白を含む値は "" で囲む。条件全体を "" で囲むと、: などを含んでいても演算子のない条件になる。
+
+	account:食費          勘定科目。親の勘定科目なら子も含む
+	debit:食費            借方の勘定科目
+	credit:現金           貸方の勘定科目
+	type:expense          勘定科目のタイプ(asset, liability, income, expense, equity または 資産 など)
+	amount>=1000          金額。演算子は : = != > >= < <=
+	date:2019-11..2019-12 日付。日(2019-11-05)か月(2019-11)で、.. で範囲。演算子は金額と同じ
+	note~からあげ         摘要に含む。note:からあげ は摘要が一致
+	group:none            グループに入っていない。group:名前 はそのグループに入っている
+	からあげ              演算子がなければ、摘要、勘定科目名、勘定科目の検索語のどれかに含む
+*/
+type queryTerm struct {
+	not   bool
+	key   string
+	op    string
+	value string
+}
+
+// 長い演算子から先に調べる
+var queryOps = []string{"!=", ">=", "<=", ":", "~", "=", ">", "<"}
+
+func parseQueryTerm(s string) (queryTerm, error) {
+	var t queryTerm
+
+	if strings.HasPrefix(s, "-") && len(s) > 1 {
+		t.not = true
+		s = s[1:]
+	}
+
+	// splitQuery で "" で囲んだ条件
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		t.value = s[1 : len(s)-1]
+		return t, nil
+	}
+
+	i := strings.IndexAny(s, ":~=!<>")
+	if i <= 0 {
+		t.value = s
+		return t, nil
+	}
+
+	t.key = strings.ToLower(s[:i])
+
+	for _, op := range queryOps {
+		if strings.HasPrefix(s[i:], op) {
+			t.op = op
+			break
+		}
+	}
+
+	if t.op == "" {
+		return t, fmt.Errorf("不正な条件 '%s'", s)
+	}
+
+	t.value = s[i+len(t.op):]
+
+	if t.value == "" {
+		return t, fmt.Errorf("値がない '%s'", s)
+	}
+
+	return t, nil
+}
+
+/*
+検索条件の文字列を、空白で区切った条件に分ける。"" で囲んだ部分は区切らない
+条件の先頭(- の後)から "" で囲んだ場合は、演算子として解析しないように "" を残す
+*/
+func splitQuery(s string) ([]string, error) {
+	var terms []string
+	var term []rune
+	inQuote, hasTerm := false, false
+	isQuoted, isNot := false, false
+
+	addTerm := func() {
+		t := string(term)
+
+		if isQuoted {
+			if isNot {
+				t = `-"` + t[1:] + `"`
+			} else {
+				t = `"` + t + `"`
+			}
+		}
+
+		terms = append(terms, t)
+		term = term[:0]
+		hasTerm, isQuoted, isNot = false, false, false
+	}
+
+	for _, ch := range s {
+		switch {
+		case ch == '"':
+			if !inQuote && !isQuoted && (!hasTerm || string(term) == "-") {
+				isQuoted, isNot = true, hasTerm
+			}
+
+			inQuote = !inQuote
+			hasTerm = true
+		case !inQuote && (ch == ' ' || ch == '\t' || ch == '\n' || ch == '　'):
+			if hasTerm {
+				addTerm()
+			}
+		default:
+			term = append(term, ch)
+			hasTerm = true
+		}
+	}
+
+	if inQuote {
+		return nil, errors.New("\" が閉じてない")
+	}
+
+	if hasTerm {
+		addTerm()
+	}
+
+	return terms, nil
+}
+
+// 検索条件から作った transactions_view の WHERE 句と引数
+type transactionQuery struct {
+	conds []string
+	args  []interface{}
+}
+
+// 引数を追加して、そのプレースホルダを返す
+func (q *transactionQuery) arg(v interface{}) string {
+	q.args = append(q.args, v)
+
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+func (q *transactionQuery) where() string {
+	if len(q.conds) == 0 {
+		return ""
+	}
+
+	return "WHERE " + strings.Join(q.conds, " AND ") + "\n"
+}
+
+func newTransactionQuery(accounts []account, terms []string) (*transactionQuery, error) {
+	q := &transactionQuery{}
+
+	for _, s := range terms {
+		t, err := parseQueryTerm(s)
+		if err != nil {
+			return nil, err
+		}
+
+		cond, err := q.cond(accounts, t)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", s, err)
+		}
+
+		if t.not {
+			cond = "NOT (" + cond + ")"
+		}
+
+		q.conds = append(q.conds, cond)
+	}
+
+	return q, nil
+}
+
+func (q *transactionQuery) cond(accounts []account, t queryTerm) (string, error) {
+	switch t.key {
+	case "":
+		like := q.arg("%" + escapeLike(t.value) + "%")
+
+		return fmt.Sprintf(`transaction_id IN (SELECT transaction_id FROM transactions_view
+WHERE description LIKE %[1]s ESCAPE '\' OR account LIKE %[1]s ESCAPE '\' OR search_words LIKE %[1]s ESCAPE '\'
+OR tags LIKE %[1]s ESCAPE '\')`, like), nil
+	case "account", "debit", "credit", "type":
+		if t.op != ":" && t.op != "=" {
+			return "", fmt.Errorf("%s に使えない演算子 '%s'", t.key, t.op)
+		}
+
+		var ids []int
+
+		if t.key == "type" {
+			accountType, err := str2queryAcType(t.value)
+			if err != nil {
+				return "", err
+			}
+
+			for _, d := range accounts {
+				if d.accountType == accountType {
+					ids = append(ids, d.id)
+				}
+			}
+		} else {
+			d := findAccount(accounts, t.value)
+			if d == nil {
+				return "", fmt.Errorf("存在しない勘定科目 '%s'", t.value)
+			}
+
+			ids = accountDescendants(accounts, d.id)
+		}
+
+		if len(ids) == 0 {
+			return "1 = 0", nil
+		}
+
+		var placeholders []string
+		for _, id := range ids {
+			placeholders = append(placeholders, q.arg(id))
+		}
+
+		side := ""
+		if t.key == "debit" {
+			side = " AND debit_amount <> 0"
+		} else if t.key == "credit" {
+			side = " AND credit_amount <> 0"
+		}
+
+		return fmt.Sprintf("transaction_id IN (SELECT transaction_id FROM transactions_view WHERE account_id IN (%s)%s)",
+			strings.Join(placeholders, ", "), side), nil
+	case "amount":
+		op, err := queryCompareOp(t)
+		if err != nil {
+			return "", err
+		}
+
+		amount, err := strconv.Atoi(strings.ReplaceAll(t.value, ",", ""))
+		if err != nil {
+			return "", errors.New("金額が数値でない")
+		}
+
+		return fmt.Sprintf("transaction_id IN (SELECT transaction_id FROM transactions_view GROUP BY transaction_id HAVING SUM(debit_amount) %s %s)",
+			op, q.arg(amount)), nil
+	case "date":
+		op, err := queryCompareOp(t)
+		if err != nil {
+			return "", err
+		}
+
+		if op != "=" && op != "<>" && strings.Contains(t.value, "..") {
+			return "", errors.New("範囲に使えるのは : = != だけ")
+		}
+
+		from, to, err := str2dateRange(t.value)
+		if err != nil {
+			return "", err
+		}
+
+		fromStr, toStr := from.Format("2006-01-02"), to.Format("2006-01-02")
+
+		switch op {
+		case "=":
+			return q.dateBetween(from, to), nil
+		case "<>":
+			return "NOT (" + q.dateBetween(from, to) + ")", nil
+		case ">", "<=":
+			return fmt.Sprintf("date %s %s", op, q.arg(toStr)), nil
+		default:
+			return fmt.Sprintf("date %s %s", op, q.arg(fromStr)), nil
+		}
+	case "note":
+		switch t.op {
+		case "~":
+			return fmt.Sprintf("description LIKE %s ESCAPE '\\'", q.arg("%"+escapeLike(t.value)+"%")), nil
+		case ":", "=":
+			return fmt.Sprintf("description = %s", q.arg(t.value)), nil
+		}
+
+		return "", fmt.Errorf("note に使えない演算子 '%s'", t.op)
+	case "group":
+		if t.op != ":" && t.op != "=" {
+			return "", fmt.Errorf("group に使えない演算子 '%s'", t.op)
+		}
+
+		if t.value == "none" {
+			return "transaction_id NOT IN (SELECT transaction_id FROM groups_detail)", nil
+		}
+
+		return fmt.Sprintf(`transaction_id IN (SELECT gd.transaction_id FROM groups_detail AS gd
+JOIN groups AS g ON gd.group_id = g.group_id WHERE g.name = %s)`, q.arg(t.value)), nil
+	case "tag":
+		if t.op != ":" && t.op != "=" {
+			return "", fmt.Errorf("tag に使えない演算子 '%s'", t.op)
+		}
+
+		if t.value == "none" {
+			return "transaction_id NOT IN (SELECT transaction_id FROM transactions_tags)", nil
+		}
+
+		return fmt.Sprintf(`transaction_id IN (SELECT tt.transaction_id FROM transactions_tags AS tt
+JOIN tags AS tg ON tt.tag_id = tg.tag_id WHERE tg.name = %s)`, q.arg(strings.TrimPrefix(t.value, "#"))), nil
+	}
+
+	return "", fmt.Errorf("不明な項目 '%s'", t.key)
+}
+
+// 日付の範囲の条件。ゼロ値の端は制限しない
+func (q *transactionQuery) dateBetween(from time.Time, to time.Time) string {
+	var conds []string
+
+	if !from.IsZero() {
+		conds = append(conds, "date >= "+q.arg(from.Format("2006-01-02")))
+	}
+
+	if !to.IsZero() {
+		conds = append(conds, "date <= "+q.arg(to.Format("2006-01-02")))
+	}
+
+	if len(conds) == 0 {
+		return "1 = 1"
+	}
+
+	return strings.Join(conds, " AND ")
+}
+
+// 比較の演算子をSQLの演算子に変換する
+func queryCompareOp(t queryTerm) (string, error) {
+	switch t.op {
+	case ":", "=":
+		return "=", nil
+	case "!=":
+		return "<>", nil
+	case ">", ">=", "<", "<=":
+		return t.op, nil
+	}
+
+	return "", fmt.Errorf("%s に使えない演算子 '%s'", t.key, t.op)
+}
+
+/*
+日付または月の範囲を解析する
+
+y-m-d のような日付はその日だけ、月ならその月の1日から末日まで。
+"from..to" で範囲になり、片方を省略するとその側は制限なしでゼロ値を返す
+*/
+func str2dateRange(s string) (time.Time, time.Time, error) {
+	if i := strings.Index(s, ".."); i != -1 {
+		var from, to time.Time
+		var err error
+
+		if s[:i] != "" {
+			from, _, err = str2dateRange(s[:i])
+			if err != nil {
+				return from, to, err
+			}
+		}
+
+		if s[i+2:] != "" {
+			_, to, err = str2dateRange(s[i+2:])
+			if err != nil {
+				return from, to, err
+			}
+		}
+
+		if !from.IsZero() && !to.IsZero() && from.After(to) {
+			return from, to, errors.New("開始が終了より後ろ")
+		}
+
+		return from, to, nil
+	}
+
+	if strings.Count(s, "-")+strings.Count(s, "/") == 2 {
+		date, err := str2date(s)
+		if err != nil {
+			return date, date, err
+		}
+
+		return date, date, nil
+	}
+
+	month, err := str2month(s)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	from := time.Date(month/100, time.Month(month%100), 1, 0, 0, 0, 0, time.Local)
+
+	return from, from.AddDate(0, 1, -1), nil
+}
+
+func str2queryAcType(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "asset", "資産", "1":
+		return acTypeAsset, nil
+	case "liability", "負債", "2":
+		return acTypeLiability, nil
+	case "income", "収入", "3":
+		return acTypeIncome, nil
+	case "expense", "費用", "4":
+		return acTypeExpense, nil
+	case "equity", "資本", "5":
+		return acTypeEquity, nil
+	}
+
+	return 0, fmt.Errorf("不明なタイプ '%s'", s)
+}
+
+// LIKE の % と _ をそのままの文字として扱う
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func findAccount(accounts []account, name string) *account {
+	for i := range accounts {
+		if accounts[i].name == name {
+			return &accounts[i]
+		}
+	}
+
+	return nil
+}
+
+// 勘定科目とその下にある全ての勘定科目のID
+func accountDescendants(accounts []account, id int) []int {
+	ids := []int{id}
+
+	for _, d := range accounts {
+		if d.parent.id == id && d.id != id {
+			ids = append(ids, accountDescendants(accounts, d.id)...)
+		}
+	}
+
+	return ids
+}
+
+// 検索条件に一致する取引を日付順に返す。条件がなければ全ての取引
+func findTransactions(db *sql.DB, terms []string) ([]transaction, error) {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := newTransactionQuery(accounts, terms)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(sqlGetTransactions+q.where()+"ORDER BY date, transaction_id, no", q.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows2transactions(rows)
+}
+
+func cmdFindTransactions(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runFindTransactions(db, context.Args().Slice())
+}
+
+func runFindTransactions(db *sql.DB, terms []string) error {
+	transactions, err := findTransactions(db, terms)
+	if err != nil {
+		return err
+	}
+
+	return printTransactions(transactions)
+}
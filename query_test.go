@@ -0,0 +1,164 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitQuery(t *testing.T) {
+	terms, err := splitQuery(` account:食費  note~"から あげ"　amount>=1000 `)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"account:食費", "note~から あげ", "amount>=1000"}
+
+	if len(terms) != len(want) {
+		t.Fatalf("terms = %q", terms)
+	}
+
+	for i := range want {
+		if terms[i] != want[i] {
+			t.Errorf("%d: got = %q, want = %q", i, terms[i], want[i])
+		}
+	}
+
+	if _, err := splitQuery(`note~"abc`); err == nil {
+		t.Error("\" が閉じてないのでエラーになるはず")
+	}
+
+	// 条件全体を囲んだ場合は "" を残して、演算子として解析しない
+	terms, err = splitQuery(`"10:30" -"http://example.com" "-x" "a b"c`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = []string{`"10:30"`, `-"http://example.com"`, `"-x"`, `"a bc"`}
+
+	if len(terms) != len(want) {
+		t.Fatalf("terms = %q", terms)
+	}
+
+	for i := range want {
+		if terms[i] != want[i] {
+			t.Errorf("%d: got = %q, want = %q", i, terms[i], want[i])
+		}
+	}
+}
+
+func TestParseQueryTerm(t *testing.T) {
+	tests := []struct {
+		s    string
+		want queryTerm
+	}{
+		{"account:食費", queryTerm{false, "account", ":", "食費"}},
+		{"-Account:食費", queryTerm{true, "account", ":", "食費"}},
+		{"amount>=1000", queryTerm{false, "amount", ">=", "1000"}},
+		{"amount!=1000", queryTerm{false, "amount", "!=", "1000"}},
+		{"date<2019-11", queryTerm{false, "date", "<", "2019-11"}},
+		{"note~からあげ", queryTerm{false, "note", "~", "からあげ"}},
+		{"からあげ", queryTerm{false, "", "", "からあげ"}},
+		{"-", queryTerm{false, "", "", "-"}},
+		{`"10:30"`, queryTerm{false, "", "", "10:30"}},
+		{`-"a<b"`, queryTerm{true, "", "", "a<b"}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseQueryTerm(tt.s)
+		if err != nil {
+			t.Errorf("%s: %s", tt.s, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("%s: got = %v, want = %v", tt.s, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"amount!1000", "account:"} {
+		if _, err := parseQueryTerm(s); err == nil {
+			t.Errorf("%s: エラーになるはず", s)
+		}
+	}
+}
+
+func TestStr2DateRange(t *testing.T) {
+	date := func(y int, m int, d int) time.Time {
+		return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		s    string
+		from time.Time
+		to   time.Time
+	}{
+		{"2019-11-05", date(2019, 11, 5), date(2019, 11, 5)},
+		{"2019-11", date(2019, 11, 1), date(2019, 11, 30)},
+		{"2019-11..2020-02", date(2019, 11, 1), date(2020, 2, 29)},
+		{"2019-11-05..", date(2019, 11, 5), time.Time{}},
+		{"..2019-12", time.Time{}, date(2019, 12, 31)},
+	}
+
+	for _, tt := range tests {
+		from, to, err := str2dateRange(tt.s)
+		if err != nil {
+			t.Errorf("%s: %s", tt.s, err)
+			continue
+		}
+
+		if !from.Equal(tt.from) || !to.Equal(tt.to) {
+			t.Errorf("%s: got = %v - %v", tt.s, from, to)
+		}
+	}
+
+	if _, _, err := str2dateRange("2019-12..2019-11"); err == nil {
+		t.Error("開始が終了より後ろなのでエラーになるはず")
+	}
+}
+
+func TestFindTransactions(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		terms []string
+		want  int
+	}{
+		{nil, 26},
+		{[]string{"account:自動車"}, 5}, // 子のガソリン代と駐車料を含む
+		{[]string{"account:食費", "amount>=7000"}, 1},
+		{[]string{"date:2019-12"}, 7},
+		{[]string{"date:2019-11..2019-12", "type:expense"}, 18},
+		{[]string{"date>=2019-12-20"}, 3},
+		{[]string{"note~ジャケット"}, 1},
+		{[]string{"-account:現金", "date:2019-11"}, 12},
+		{[]string{"credit:A銀行"}, 5},
+		{[]string{"debit:A銀行"}, 2},
+		{[]string{"group:none"}, 26},
+		{[]string{"gasorin"}, 2},
+		{[]string{`"note~ジャケット"`}, 0}, // 演算子として解析しない
+	}
+
+	for _, tt := range tests {
+		transactions, err := findTransactions(db, tt.terms)
+		if err != nil {
+			t.Errorf("%q: %s", tt.terms, err)
+			continue
+		}
+
+		if len(transactions) != tt.want {
+			t.Errorf("%q: len(transactions) = %d, want = %d", tt.terms, len(transactions), tt.want)
+		}
+	}
+
+	for _, s := range []string{"account:存在しない", "unknown:1", "amount~1", "date>2019-11..2019-12"} {
+		if _, err := findTransactions(db, []string{s}); err == nil {
+			t.Errorf("%s: エラーになるはず", s)
+		}
+	}
+}
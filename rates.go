@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/urfave/cli/v2"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 通貨の補助単位の桁数。ここにない通貨は2桁とする
+var currencyDecimals = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"VND": 0,
+	"BHD": 3,
+	"KWD": 3,
+}
+
+type exchangeRate struct {
+	currency string
+	date     time.Time
+	rate     float64
+}
+
+func (d *exchangeRate) String() string {
+	return fmt.Sprintf("%s %s %s", d.date.Format("2006-01-02"), d.currency, rate2str(d.rate))
+}
+
+/*
+外貨建ての勘定科目の評価
+
+book は円で記録された帳簿上の残高(取得時のレートで換算した金額の累計)
+value は月末のレートで換算した残高
+*/
+type fxValuation struct {
+	account account
+	balance int // 外貨の残高(補助単位)
+	rate    float64
+	book    int
+	value   int
+	hasRate bool
+}
+
+// 評価損益
+func (d *fxValuation) gain() int {
+	return d.value - d.book
+}
+
+func getCurrencyDecimals(currency string) int {
+	if n, ok := currencyDecimals[currency]; ok {
+		return n
+	}
+
+	return 2
+}
+
+func str2currencyCode(s string) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(s))
+
+	if len(code) != 3 {
+		return "", fmt.Errorf("不正な通貨コード'%s'", s)
+	}
+
+	for _, ch := range code {
+		if ch < 'A' || ch > 'Z' {
+			return "", fmt.Errorf("不正な通貨コード'%s'", s)
+		}
+	}
+
+	return code, nil
+}
+
+/*
+外貨の金額(補助単位)を小数点付きの文字列に変換
+(例) 12345, "USD" は "123.45"
+*/
+func currency2str(n int, currency string) string {
+	decimals := getCurrencyDecimals(currency)
+
+	if decimals == 0 {
+		return int2str(n)
+	}
+
+	unit := int(math.Pow10(decimals))
+
+	sign := ""
+	if n < 0 {
+		sign = "-"
+		n = -n
+	}
+
+	return fmt.Sprintf("%s%s.%0*d", sign, int2str(n/unit), decimals, n%unit)
+}
+
+/*
+小数点付きの文字列を外貨の金額(補助単位)に変換
+(例) "123.45", "USD" は 12345
+*/
+func str2currency(s string, currency string) (int, error) {
+	decimals := getCurrencyDecimals(currency)
+
+	s = strings.ReplaceAll(s, ",", "")
+
+	minus := strings.HasPrefix(s, "-")
+	if minus {
+		s = s[1:]
+	}
+
+	arr := strings.Split(s, ".")
+	if len(arr) > 2 || arr[0] == "" {
+		return 0, fmt.Errorf("不正な金額'%s'", s)
+	}
+
+	intPart, err := strconv.Atoi(arr[0])
+	if err != nil {
+		return 0, fmt.Errorf("不正な金額'%s'", s)
+	}
+
+	fracPart := 0
+
+	if len(arr) == 2 {
+		frac := arr[1]
+
+		if len(frac) > decimals {
+			return 0, fmt.Errorf("%sの小数点以下は%d桁まで'%s'", currency, decimals, s)
+		}
+
+		frac += strings.Repeat("0", decimals-len(frac))
+
+		if frac != "" {
+			fracPart, err = strconv.Atoi(frac)
+			if err != nil {
+				return 0, fmt.Errorf("不正な金額'%s'", s)
+			}
+		}
+	}
+
+	v := intPart*int(math.Pow10(decimals)) + fracPart
+
+	if minus {
+		v = -v
+	}
+
+	return v, nil
+}
+
+func rate2str(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', -1, 64)
+}
+
+// 外貨の金額(補助単位)をレートで円に換算する
+func currency2yen(n int, currency string, rate float64) int {
+	return int(math.Round(float64(n) / math.Pow10(getCurrencyDecimals(currency)) * rate))
+}
+
+// 円と外貨の金額(補助単位)からレートを求める
+func calcRate(yen int, n int, currency string) float64 {
+	if n == 0 {
+		return 0
+	}
+
+	rate := float64(yen) / (float64(n) / math.Pow10(getCurrencyDecimals(currency)))
+
+	return math.Round(rate*1000000) / 1000000
+}
+
+func cmdListRates(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runListRates(db, context.Args().First())
+}
+
+func runListRates(db *sql.DB, currency string) error {
+	rates, err := dbGetRates(db, strings.ToUpper(currency))
+	if err != nil {
+		return err
+	}
+
+	for _, d := range rates {
+		println(&d)
+	}
+
+	return nil
+}
+
+func cmdAddRate(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runAddRate(db, context.Args().Slice())
+}
+
+func runAddRate(db *sql.DB, args []string) error {
+	if len(args) != 3 {
+		return errors.New("Usage: mita rate add date currency rate")
+	}
+
+	d, err := arr2rate(args)
+	if err != nil {
+		return err
+	}
+
+	return dbSetRate(db, d)
+}
+
+func cmdImportRates(context *cli.Context) error {
+	return importItems(context.Args().First(), readRates)
+}
+
+func readRates(db *sql.DB, f io.Reader) error {
+	scanner := bufio.NewScanner(f)
+
+	lineNo := 0
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for scanner.Scan() {
+		lineNo++
+
+		line := skipSpace(scanner.Text())
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		arr := strings.Split(line, "\t")
+
+		d, err := arr2rate(arr)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%d:%s", lineNo, err)
+		}
+
+		if err := dbSetRate(tx, d); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func arr2rate(arr []string) (*exchangeRate, error) {
+	if len(arr) != 3 {
+		return nil, errors.New("項目数が3でない")
+	}
+
+	var d exchangeRate
+
+	date, err := str2date(arr[0])
+	if err != nil {
+		return nil, fmt.Errorf("日付:%s", err)
+	}
+	d.date = date
+
+	d.currency, err = str2currencyCode(arr[1])
+	if err != nil {
+		return nil, err
+	}
+
+	d.rate, err = strconv.ParseFloat(arr[2], 64)
+	if err != nil || d.rate <= 0 {
+		return nil, fmt.Errorf("不正なレート'%s'", arr[2])
+	}
+
+	return &d, nil
+}
+
+func cmdExportRates(context *cli.Context) error {
+	return exportItems(context.Args().First(), writeRates)
+}
+
+func writeRates(db *sql.DB, f io.Writer) error {
+	b := bufio.NewWriter(f)
+
+	rates, err := dbGetRates(db, "")
+	if err != nil {
+		return err
+	}
+
+	for _, d := range rates {
+		_, err := b.WriteString(fmt.Sprintf("%s\t%s\t%s\n",
+			d.date.Format("2006-01-02"), d.currency, rate2str(d.rate)))
+		if err != nil {
+			return err
+		}
+	}
+
+	b.Flush()
+
+	return nil
+}
+
+/*
+外貨建ての明細に外貨の金額とレートを設定する
+
+外貨の金額が入力されていれば、円の金額からレートを求める。
+入力されてなければ、取引日のレートから外貨の金額を求める。
+*/
+func fillCurrencyAmounts(db *sql.DB, accounts []account, tr *transaction) error {
+	id2currency := make(map[int]string)
+
+	for _, d := range accounts {
+		id2currency[d.id] = d.currency
+	}
+
+	for i := range tr.items {
+		item := &tr.items[i]
+
+		currency := id2currency[item.account.id]
+		item.account.currency = currency
+
+		if currency == "" {
+			item.currencyAmount = 0
+			item.rate = 0
+			continue
+		}
+
+		yen := item.debit + item.credit
+
+		if item.currencyAmount != 0 {
+			item.rate = calcRate(yen, item.currencyAmount, currency)
+			continue
+		}
+
+		rate, err := dbGetRate(db, currency, tr.date)
+		if err != nil {
+			return err
+		}
+
+		if rate == 0 {
+			return fmt.Errorf("%sの%s以前の為替レートが見つからない", currency, tr.date.Format("2006-01-02"))
+		}
+
+		item.rate = rate
+		item.currencyAmount = int(math.Round(float64(yen) / rate * math.Pow10(getCurrencyDecimals(currency))))
+	}
+
+	return nil
+}
+
+// 月末のレートで外貨建ての勘定科目を評価する
+func getFXValuations(db *sql.DB, month int) ([]fxValuation, error) {
+	items, err := dbGetCurrencyBalances(db, month)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		return items, nil
+	}
+
+	balances, err := dbGetBalances(db, month)
+	if err != nil {
+		return nil, err
+	}
+
+	id2book := make(map[int]int)
+	for _, d := range balances {
+		id2book[d.id] = d.balance
+	}
+
+	monthEnd := time.Date(month/100, time.Month(month%100)+1, 0, 0, 0, 0, 0, time.Local)
+
+	for i := range items {
+		d := &items[i]
+
+		d.book = id2book[d.account.id]
+
+		d.rate, err = dbGetRate(db, d.account.currency, monthEnd)
+		if err != nil {
+			return nil, err
+		}
+
+		d.hasRate = d.rate != 0
+
+		if d.hasRate {
+			d.value = currency2yen(d.balance, d.account.currency, d.rate)
+		} else {
+			// レートが無ければ帳簿の金額で評価する
+			d.value = d.book
+		}
+	}
+
+	return items, nil
+}
+
+// 月末の評価損益の合計
+func getFXGain(db *sql.DB, month int) (int, error) {
+	items, err := getFXValuations(db, month)
+	if err != nil {
+		return 0, err
+	}
+
+	var sum int
+
+	for _, d := range items {
+		sum += d.gain()
+	}
+
+	return sum, nil
+}
+
+func fxValuation2str(d *fxValuation) string {
+	src := new(bytes.Buffer)
+
+	src.WriteString(fmt.Sprintf("(%s %s", currency2str(d.balance, d.account.currency), d.account.currency))
+
+	if d.hasRate {
+		src.WriteString(fmt.Sprintf(" @ %s, 簿価 %s", rate2str(d.rate), int2str(d.book)))
+	} else {
+		src.WriteString(", レートなし")
+	}
+
+	src.WriteString(")")
+
+	return src.String()
+}
+
+const sqlGetRates = `
+SELECT currency, date, rate
+FROM exchange_rates
+WHERE $1 = '' OR currency = $1
+ORDER BY currency, date
+`
+
+func dbGetRates(db *sql.DB, currency string) ([]exchangeRate, error) {
+	rows, err := db.Query(sqlGetRates, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	var rates []exchangeRate
+
+	for rows.Next() {
+		var d exchangeRate
+
+		if err := rows.Scan(&d.currency, &d.date, &d.rate); err != nil {
+			return nil, err
+		}
+
+		rates = append(rates, d)
+	}
+	rows.Close()
+
+	return rates, nil
+}
+
+const sqlGetRate = `
+SELECT rate
+FROM exchange_rates
+WHERE currency = $1 AND date <= $2
+ORDER BY date DESC
+LIMIT 1
+`
+
+// date以前の最新のレートを取得する。見つからなければ0
+func dbGetRate(db dbtx, currency string, date time.Time) (float64, error) {
+	var rate float64
+
+	err := db.QueryRow(sqlGetRate, currency, date).Scan(&rate)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return rate, err
+}
+
+const sqlSetRate = `
+INSERT INTO exchange_rates(currency, date, rate)
+VALUES($1, $2, $3)
+ON CONFLICT (currency, date) DO UPDATE SET rate = EXCLUDED.rate
+`
+
+func dbSetRate(db dbtx, d *exchangeRate) error {
+	_, err := db.Exec(sqlSetRate, d.currency, d.date, d.rate)
+
+	return err
+}
+
+const sqlGetCurrencyBalances = `
+SELECT account_id, account_type, name, currency, currency_balance
+FROM currency_balance_view
+WHERE month = $1
+ORDER BY account_type, account_id
+`
+
+func dbGetCurrencyBalances(db *sql.DB, month int) ([]fxValuation, error) {
+	rows, err := db.Query(sqlGetCurrencyBalances, month)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []fxValuation
+
+	for rows.Next() {
+		var d fxValuation
+
+		if err := rows.Scan(&d.account.id, &d.account.accountType, &d.account.name,
+			&d.account.currency, &d.balance); err != nil {
+			return nil, err
+		}
+
+		items = append(items, d)
+	}
+	rows.Close()
+
+	return items, nil
+}
+
+func scanCurrencyCode() string {
+	for {
+		print("通貨コード (例: USD, 空文字で円): ")
+		s, _ := input()
+
+		if s == "" {
+			return ""
+		}
+
+		code, err := str2currencyCode(s)
+		if err == nil {
+			return code
+		}
+
+		eprintln(err)
+	}
+}
+
+func scanCurrencyAmount(currency string) int {
+	for {
+		printf("外貨金額(%s。空文字で取引日のレートから計算): ", currency)
+		s, _ := input()
+
+		if s == "" {
+			return 0
+		}
+
+		v, err := str2currency(s, currency)
+		if err == nil {
+			return v
+		}
+
+		eprintln(err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	_ "github.com/lib/pq"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type currency2strTest struct {
+	n        int
+	currency string
+	res      string
+}
+
+var currency2strTests = []currency2strTest{
+	{0, "USD", "0.00"},
+	{5, "USD", "0.05"},
+	{12345, "USD", "123.45"},
+	{123456789, "EUR", "1,234,567.89"},
+	{-12345, "USD", "-123.45"},
+	{1234, "KRW", "1,234"},
+	{1234, "KWD", "1.234"},
+}
+
+func TestCurrency2str(t *testing.T) {
+	for i, test := range currency2strTests {
+		res := currency2str(test.n, test.currency)
+		if res != test.res {
+			t.Errorf("#%d: got: %#v want: %#v", i, res, test.res)
+		}
+
+		n, err := str2currency(res, test.currency)
+		if err != nil || n != test.n {
+			t.Errorf("#%d: str2currency got: %d, %v want: %d", i, n, err, test.n)
+		}
+	}
+
+	if n, err := str2currency("100.5", "USD"); err != nil || n != 10050 {
+		t.Errorf(`str2currency("100.5"), got = %d, %v`, n, err)
+	}
+
+	if n, err := str2currency("100", "USD"); err != nil || n != 10000 {
+		t.Errorf(`str2currency("100"), got = %d, %v`, n, err)
+	}
+
+	errTests := []string{"", "1.234", "1.2.3", "a", ".5"}
+
+	for _, test := range errTests {
+		if _, err := str2currency(test, "USD"); err == nil {
+			t.Errorf("str2currency(%q) should be error", test)
+		}
+	}
+}
+
+func TestStr2currencyCode(t *testing.T) {
+	if code, err := str2currencyCode("usd"); err != nil || code != "USD" {
+		t.Fatalf(`str2currencyCode("usd"), got = %s, %v`, code, err)
+	}
+
+	for _, test := range []string{"", "US", "USDX", "U$D"} {
+		if _, err := str2currencyCode(test); err == nil {
+			t.Errorf("str2currencyCode(%q) should be error", test)
+		}
+	}
+}
+
+func TestStr2itemsCurrency(t *testing.T) {
+	name2id := map[string]int{"現金": 1, "USD預金": 2}
+	id2currency := map[int]string{2: "USD"}
+
+	items, err := str2items(name2id, id2currency, "USD預金@100.50", 15000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 1 || items[0].currencyAmount != 10050 || items[0].account.currency != "USD" {
+		t.Fatalf("str2items, got = %v", items)
+	}
+
+	if s := items2tsv(items, true); s != "USD預金@100.50" {
+		t.Fatalf("items2tsv, got = %s", s)
+	}
+
+	items, err = str2items(name2id, id2currency, "USD預金@1000:150000,現金:500", 150500, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 || items[0].currencyAmount != 100000 || items[0].debit != 150000 {
+		t.Fatalf("str2items, got = %v", items)
+	}
+
+	if s := items2tsv(items, true); s != "USD預金@1000.00:150000,現金:500" {
+		t.Fatalf("items2tsv, got = %s", s)
+	}
+
+	errTests := []string{"現金@100", "USD預金@1.001", "USD預金@abc"}
+
+	for _, test := range errTests {
+		if _, err := str2items(name2id, id2currency, test, 1000, true); err == nil {
+			t.Errorf("str2items(%q) should be error", test)
+		}
+	}
+}
+
+func TestRateCommands(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	db, err := setup()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join("testdata", "rates.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := readRates(db, f); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAddRate(db, []string{"2020-01-31", "usd", "109.5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2020, 1, 15, 0, 0, 0, 0, time.Local)
+
+	if rate, err := dbGetRate(db, "USD", date); err != nil || rate != 108.0 {
+		t.Fatalf("dbGetRate, got = %v, %v", rate, err)
+	}
+
+	if rate, err := dbGetRate(db, "USD", date.AddDate(-1, 0, 0)); err != nil || rate != 0 {
+		t.Fatalf("dbGetRate, got = %v, %v", rate, err)
+	}
+
+	wf := new(bytes.Buffer)
+
+	if err := writeRates(db, wf); err != nil {
+		t.Fatal(err)
+	}
+
+	rf, err := os.Open(filepath.Join("testdata", "rates.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	bytes, err := ioutil.ReadAll(rf)
+	if wf.String() != string(bytes)+"2020-01-31\tUSD\t109.5\n" {
+		t.Fatal("writeRates:", wf.String())
+	}
+
+	accounts := []account{{id: 1, name: "USD預金", currency: "USD"}, {id: 2, name: "現金"}}
+
+	var tr transaction
+	tr.date = date
+	tr.setSimple(accounts[0], accounts[1], 10800)
+
+	if err := fillCurrencyAmounts(db, accounts, &tr); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.items[0].currencyAmount != 10000 || tr.items[0].rate != 108.0 || tr.items[1].rate != 0 {
+		t.Fatalf("fillCurrencyAmounts, got = %v", tr.items)
+	}
+
+	tr.date = date.AddDate(-1, 0, 0)
+	tr.items[0].currencyAmount = 0
+
+	if err := fillCurrencyAmounts(db, accounts, &tr); err == nil {
+		t.Fatal("レートがないのでエラーになるはず")
+	}
+}
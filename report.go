@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/urfave/cli/v2"
+	"strconv"
+	"time"
+)
+
+/*
+年度
+
+年度は開始月の年で表す。開始月が4月なら、2019年度は2019-04から2020-03まで。
+開始月は設定ファイルの fiscal_year_start_month で変更できる(省略すると1月)。
+範囲外の値は設定ファイルを読むときにエラーにする。
+*/
+func fiscalYearStartMonth() int {
+	m := configData.FiscalYearStartMonth
+	if m == 0 {
+		return 1
+	}
+
+	return m
+}
+
+// 年度の開始月と終了月
+func fiscalYearRange(year int) (int, int) {
+	from := year*100 + fiscalYearStartMonth()
+
+	return from, subtractMonth(from+100, 1)
+}
+
+// 月が含まれる年度
+func month2fiscalYear(ym int) int {
+	if ym%100 >= fiscalYearStartMonth() {
+		return ym / 100
+	}
+
+	return ym/100 - 1
+}
+
+func fiscalYear2str(year int) string {
+	if fiscalYearStartMonth() == 1 {
+		return fmt.Sprintf("%d年", year)
+	}
+
+	return fmt.Sprintf("%d年度", year)
+}
+
+/*
+年度の文字列を解析して数値へ変換
+
+空文字 : 今年度
+-n : 今年度から-nした年度。例えば-1は前年度
+y : y年度
+*/
+func str2fiscalYear(s string) (int, error) {
+	thisYear := month2fiscalYear(time2month(time.Now()))
+
+	if s == "" {
+		return thisYear, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("不正な年度'%s'", s)
+	}
+
+	if v <= 0 {
+		return thisYear + v, nil
+	}
+
+	return v, nil
+}
+
+func cmdReportAnnual(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runReportAnnual(db, context.Args().First())
+}
+
+/*
+年度の報告を表示する
+
+期首の B/S、年度の P/L(発生主義と現金主義)、期末の B/S と純資産の増減
+*/
+func runReportAnnual(db *sql.DB, yearStr string) error {
+	year, err := str2fiscalYear(yearStr)
+	if err != nil {
+		return err
+	}
+
+	from, to := fiscalYearRange(year)
+
+	if err := updateTransactionsSummary(db); err != nil {
+		return err
+	}
+
+	println(fiscalYear2str(year), range2str(from, to))
+
+	opening := subtractMonth(from, 1)
+
+	println()
+	printf("期首 B/S (%s末)\n", month2str(opening))
+	println()
+
+	openingNet, err := printBS(db, opening)
+	if err != nil {
+		return err
+	}
+
+	println()
+	println("P/L (発生主義)")
+	println()
+
+	if _, err := printPL(db, false, from, to); err != nil {
+		return err
+	}
+
+	println()
+	println("P/L (現金主義)")
+	println()
+
+	if _, err := printPL(db, true, from, to); err != nil {
+		return err
+	}
+
+	println()
+	printf("期末 B/S (%s末)\n", month2str(to))
+	println()
+
+	closingNet, err := printBS(db, to)
+	if err != nil {
+		return err
+	}
+
+	println()
+	printf("純資産の増減: %14s\n", int2str(closingNet-openingNet))
+
+	return nil
+}
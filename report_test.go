@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	_ "github.com/lib/pq"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFiscalYear(t *testing.T) {
+	defer func(m int) { configData.FiscalYearStartMonth = m }(configData.FiscalYearStartMonth)
+
+	configData.FiscalYearStartMonth = 1
+
+	if from, to := fiscalYearRange(2019); from != 201901 || to != 201912 {
+		t.Errorf("fiscalYearRange(2019), got = %d, %d", from, to)
+	}
+
+	if y := month2fiscalYear(201903); y != 2019 {
+		t.Errorf("month2fiscalYear(201903), got = %d", y)
+	}
+
+	configData.FiscalYearStartMonth = 4
+
+	if from, to := fiscalYearRange(2019); from != 201904 || to != 202003 {
+		t.Errorf("fiscalYearRange(2019), got = %d, %d", from, to)
+	}
+
+	if y := month2fiscalYear(202003); y != 2019 {
+		t.Errorf("month2fiscalYear(202003), got = %d", y)
+	}
+
+	if y := month2fiscalYear(202004); y != 2020 {
+		t.Errorf("month2fiscalYear(202004), got = %d", y)
+	}
+
+	if s := fiscalYear2str(2019); s != "2019年度" {
+		t.Errorf("fiscalYear2str(2019), got = %s", s)
+	}
+
+	if y, err := str2fiscalYear("2018"); err != nil || y != 2018 {
+		t.Errorf("str2fiscalYear(2018), got = %d, %v", y, err)
+	}
+
+	if _, err := str2fiscalYear("abc"); err == nil {
+		t.Error("不正な年度なのでエラーになるはず")
+	}
+}
+
+func TestRunReportAnnual(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	stdout = buf
+	stderr = new(bytes.Buffer)
+
+	if err := runReportAnnual(db, "2019"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"2019年 2019-01 - 2019-12\n", "期首 B/S (2018-12末)\n", "P/L (発生主義)\n",
+		"P/L (現金主義)\n", "期末 B/S (2019-12末)\n", fmt.Sprintf("純資産の増減: %14s\n", "179,700")} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("'%s' がない\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestFiscalYearStartMonthConfig(t *testing.T) {
+	defer func(c config) { configData = c }(configData)
+	defer func(home string) { os.Setenv("HOME", home) }(os.Getenv("HOME"))
+
+	home, err := ioutil.TempDir("", "mita")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	os.Setenv("HOME", home)
+
+	if err := os.MkdirAll(getConfigDir(), 0777); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(getConfigDir(), "config.toml")
+
+	tests := []struct {
+		content string
+		want    int
+		isErr   bool
+	}{
+		{"fiscal_year_start_month = 4\n", 4, false},
+		{"fiscal_year_start_month = 12\n", 12, false},
+		{"", 1, false}, // 省略すると1月
+		{"fiscal_year_start_month = 0\n", 0, true},
+		{"fiscal_year_start_month = 13\n", 0, true},
+		{"fiscal_year_start_month = -1\n", 0, true},
+	}
+
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(filename, []byte(tt.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		configData.FiscalYearStartMonth = 1
+		err := loadOrCreateConfig()
+		if tt.isErr {
+			if err == nil {
+				t.Errorf("%q, want error", tt.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q, got error %v", tt.content, err)
+		} else if configData.FiscalYearStartMonth != tt.want {
+			t.Errorf("%q, got = %d, want = %d", tt.content, configData.FiscalYearStartMonth, tt.want)
+		}
+	}
+}
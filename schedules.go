@@ -0,0 +1,868 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/urfave/cli/v2"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 繰り返しの規則
+const (
+	ruleMonthly         = "M" // 毎月N日
+	ruleWeekly          = "W" // N週ごと
+	ruleLastBusinessDay = "B" // 月末営業日
+)
+
+/*
+定期的な取引のスケジュール
+
+tmpl.id が 0 以外ならテンプレートから取引を作成する。
+0 なら debit, credit, amount, note から取引を作成する。
+last は最後に取引を追加した日。まだ追加してなければゼロ値
+*/
+type schedule struct {
+	id        int
+	name      string
+	tmpl      template
+	debit     account
+	credit    account
+	amount    int
+	note      string
+	rule      string
+	ruleValue int
+	start     time.Time
+	last      time.Time
+}
+
+func (d *schedule) String() string {
+	last := "未実行"
+	if !d.last.IsZero() {
+		last = "最終:" + d.last.Format("2006-01-02")
+	}
+
+	return fmt.Sprintf("%s %s %s〜 %s (%s)", d.name, rule2str(d.rule, d.ruleValue),
+		d.start.Format("2006-01-02"), d.target(), last)
+}
+
+// 作成する取引の内容を表す文字列
+func (d *schedule) target() string {
+	if d.tmpl.id != 0 {
+		return "テンプレート:" + d.tmpl.name
+	}
+
+	return fmt.Sprintf("%s / %s %s %s", d.debit.name, d.credit.name, int2str(d.amount), d.note)
+}
+
+func (d *schedule) validate() error {
+	if d.name == "" {
+		return errors.New("名前が空")
+	}
+
+	if d.tmpl.id == 0 && (d.debit.id == 0 || d.credit.id == 0) {
+		return errors.New("テンプレートか借方・貸方の勘定科目を設定する")
+	}
+
+	if d.tmpl.id == 0 && d.amount == 0 {
+		return errors.New("金額が0")
+	}
+
+	if d.start.IsZero() {
+		return errors.New("開始日が設定されてない")
+	}
+
+	return checkRule(d.rule, d.ruleValue)
+}
+
+func rule2str(rule string, value int) string {
+	switch rule {
+	case ruleMonthly:
+		return fmt.Sprintf("毎月%d日", value)
+	case ruleWeekly:
+		return fmt.Sprintf("%d週ごと", value)
+	case ruleLastBusinessDay:
+		return "月末営業日"
+	}
+
+	return "不明"
+}
+
+/*
+繰り返しの規則の文字列を解析
+"M25": 毎月25日, "W2": 2週ごと, "B": 月末営業日
+*/
+func str2rule(s string) (string, int, error) {
+	s = strings.ToUpper(s)
+
+	if s == "" {
+		return "", 0, errors.New("繰り返しの規則が空")
+	}
+
+	rule := s[:1]
+	value := 0
+
+	if rule != ruleLastBusinessDay {
+		v, err := strconv.Atoi(s[1:])
+		if err != nil {
+			return "", 0, fmt.Errorf("不正な繰り返しの規則'%s'", s)
+		}
+		value = v
+	} else if len(s) != 1 {
+		return "", 0, fmt.Errorf("不正な繰り返しの規則'%s'", s)
+	}
+
+	if err := checkRule(rule, value); err != nil {
+		return "", 0, err
+	}
+
+	return rule, value, nil
+}
+
+func checkRule(rule string, value int) error {
+	switch rule {
+	case ruleMonthly:
+		if value < 1 || value > 31 {
+			return fmt.Errorf("日が範囲外 [1, 31]: %d", value)
+		}
+	case ruleWeekly:
+		if value < 1 || value > 52 {
+			return fmt.Errorf("週が範囲外 [1, 52]: %d", value)
+		}
+	case ruleLastBusinessDay:
+	default:
+		return fmt.Errorf("不明な繰り返しの規則'%s'", rule)
+	}
+
+	return nil
+}
+
+/*
+until までの間で、まだ取引を追加してない日の一覧を返す
+until の時刻は無視する
+*/
+func (d *schedule) dueDates(until time.Time) []time.Time {
+	var dates []time.Time
+
+	from := truncateDate(d.start)
+	if !d.last.IsZero() && !truncateDate(d.last).Before(from) {
+		from = truncateDate(d.last).AddDate(0, 0, 1)
+	}
+
+	until = truncateDate(until)
+
+	if from.After(until) {
+		return nil
+	}
+
+	if d.rule == ruleWeekly {
+		for date := truncateDate(d.start); !date.After(until); date = date.AddDate(0, 0, 7*d.ruleValue) {
+			if !date.Before(from) {
+				dates = append(dates, date)
+			}
+		}
+
+		return dates
+	}
+
+	for ym := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.Local); !ym.After(until); ym = ym.AddDate(0, 1, 0) {
+		var date time.Time
+
+		if d.rule == ruleMonthly {
+			date = monthDay(ym, d.ruleValue)
+		} else {
+			date = lastBusinessDay(ym)
+		}
+
+		if !date.Before(from) && !date.After(until) {
+			dates = append(dates, date)
+		}
+	}
+
+	return dates
+}
+
+func truncateDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// ym の月の day 日。月末より後なら月末
+func monthDay(ym time.Time, day int) time.Time {
+	lastDay := time.Date(ym.Year(), ym.Month()+1, 0, 0, 0, 0, 0, time.Local)
+
+	if day > lastDay.Day() {
+		return lastDay
+	}
+
+	return time.Date(ym.Year(), ym.Month(), day, 0, 0, 0, 0, time.Local)
+}
+
+// ym の月の最終営業日。祝日は考慮しない
+func lastBusinessDay(ym time.Time) time.Time {
+	date := time.Date(ym.Year(), ym.Month()+1, 0, 0, 0, 0, 0, time.Local)
+
+	for date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+		date = date.AddDate(0, 0, -1)
+	}
+
+	return date
+}
+
+func cmdListSchedules(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runListSchedules(db)
+}
+
+func runListSchedules(db *sql.DB) error {
+	schedules, err := dbGetSchedules(db)
+	if err != nil {
+		return err
+	}
+
+	for i, d := range schedules {
+		println(i, &d)
+	}
+
+	return nil
+}
+
+func cmdAddSchedule(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runAddSchedule(db, context.Args().Slice())
+}
+
+func runAddSchedule(db *sql.DB, args []string) error {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	var d *schedule
+
+	switch len(args) {
+	case 0:
+		d, err = scanSchedule(db, accounts)
+		if err != nil {
+			return err
+		}
+		if d == nil {
+			return nil
+		}
+
+		ok, err := confirmSchedule(db, accounts, d)
+		if err != nil {
+			return err
+		}
+
+		if ok == false {
+			return nil
+		}
+	case 4, 6, 7:
+		templates, err := dbGetTemplates(db)
+		if err != nil {
+			return err
+		}
+
+		d, err = arr2schedule(accounts, templates, args)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("Usage: mita schedule add name rule startDate (template | debit credit amount [description])")
+	}
+
+	_, err = dbAddSchedule(db, d)
+
+	return err
+}
+
+/*
+引数からスケジュールを作成
+
+4個: 名前 規則 開始日 テンプレート名
+6, 7個: 名前 規則 開始日 借方 貸方 金額 [摘要]
+*/
+func arr2schedule(accounts []account, templates []template, arr []string) (*schedule, error) {
+	var d schedule
+	var err error
+
+	d.name = arr[0]
+
+	d.rule, d.ruleValue, err = str2rule(arr[1])
+	if err != nil {
+		return nil, err
+	}
+
+	d.start, err = str2date(arr[2])
+	if err != nil {
+		return nil, fmt.Errorf("開始日:%s", err)
+	}
+
+	if len(arr) == 4 {
+		for _, tmpl := range templates {
+			if tmpl.name == arr[3] {
+				d.tmpl = tmpl
+			}
+		}
+
+		if d.tmpl.id == 0 {
+			return nil, fmt.Errorf("存在しないテンプレート'%s'", arr[3])
+		}
+	} else {
+		name2ac := make(map[string]account)
+		for _, ac := range accounts {
+			name2ac[ac.name] = ac
+		}
+
+		var ok bool
+
+		if d.debit, ok = name2ac[arr[3]]; !ok {
+			return nil, fmt.Errorf("借方:存在しない勘定科目'%s'", arr[3])
+		}
+
+		if d.credit, ok = name2ac[arr[4]]; !ok {
+			return nil, fmt.Errorf("貸方:存在しない勘定科目'%s'", arr[4])
+		}
+
+		d.amount, err = strconv.Atoi(arr[5])
+		if err != nil {
+			return nil, fmt.Errorf("金額:%s", err)
+		}
+
+		if len(arr) == 7 {
+			d.note = arr[6]
+		}
+	}
+
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func cmdEditSchedule(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runEditSchedule(db)
+}
+
+func runEditSchedule(db *sql.DB) error {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	d, err := selectSchedule(db)
+	if d == nil || err != nil {
+		return err
+	}
+
+	ok, err := confirmSchedule(db, accounts, d)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return dbEditSchedule(db, d)
+	}
+
+	return nil
+}
+
+func cmdRemoveSchedule(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runRemoveSchedule(db)
+}
+
+func runRemoveSchedule(db *sql.DB) error {
+	d, err := selectSchedule(db)
+	if d == nil || err != nil {
+		return err
+	}
+
+	if confirmYesNo("本当に削除する?") {
+		return dbRemoveSchedule(db, d.id)
+	}
+
+	return nil
+}
+
+func cmdRunSchedules(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = runSchedules(db, time.Now(), false)
+
+	return err
+}
+
+/*
+コマンドの開始時にスケジュールを実行する
+設定ファイルの schedule.auto_run が true のときだけ実行する。
+undo と redo の対象がコマンドの直前の操作からずれないように、操作を扱うコマンドでは実行しない。
+出力をエクスポート等の邪魔をしないように、メッセージは標準エラー出力に出す。
+*/
+func autoRunSchedules(cmdName string) {
+	switch cmdName {
+	case "", "help", "h", "schedule", "sc", "data", "db", "backup", "restore", "undo", "redo", "tui":
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		// 接続できない場合やスキーマが古い場合は、コマンド自身がエラーを表示する
+		return
+	}
+	defer db.Close()
+
+	runAutoSchedules(db, time.Now())
+}
+
+// 自動で追加した取引を、コマンドの操作とは別の操作にする
+func runAutoSchedules(db *sql.DB, until time.Time) {
+	n, err := runSchedules(db, until, true)
+	if err != nil {
+		eprintln("スケジュールの実行に失敗:", err)
+	}
+
+	if n == 0 {
+		return
+	}
+
+	if _, err := dbRecordOperation(db, "(自動) schedule run", operationNormal, 0); err != nil {
+		eprintln("操作の記録に失敗:", err)
+	}
+}
+
+/*
+until までに期日が来たスケジュールの取引を追加する
+追加した取引の数を返す
+*/
+func runSchedules(db *sql.DB, until time.Time, isQuiet bool) (int, error) {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return 0, err
+	}
+
+	schedules, err := dbGetSchedules(db)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for _, d := range schedules {
+		n, err := runSchedule(db, accounts, &d, until, isQuiet)
+		if err != nil {
+			return count, fmt.Errorf("スケジュール'%s':%s", d.name, err)
+		}
+
+		count += n
+	}
+
+	return count, nil
+}
+
+// 1つのスケジュールを実行する。二重に追加しないように行をロックしてから確認する
+func runSchedule(db *sql.DB, accounts []account, d *schedule, until time.Time, isQuiet bool) (int, error) {
+	if len(d.dueDates(until)) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	last, err := dbLockSchedule(tx, d.id)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	d.last = last
+
+	dates := d.dueDates(until)
+	count := 0
+
+	for _, date := range dates {
+		trs, err := schedule2transactions(db, d, date)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		for i, tr := range trs {
+			if err := fillCurrencyAmounts(db, accounts, &tr); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+
+			id, err := dbAddTransaction(tx, &tr)
+			if err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+
+			if err := dbAddScheduleLog(tx, d.id, date, i+1, id); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+
+			if isQuiet {
+				eprintln("スケジュール:", &tr)
+			} else {
+				println(&tr)
+			}
+
+			count++
+		}
+	}
+
+	if len(dates) != 0 {
+		if err := dbUpdateScheduleLastDate(tx, d.id, dates[len(dates)-1]); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return count, tx.Commit()
+}
+
+// date の日付でスケジュールの取引を作成する。テンプレートの金額が0の行は追加しない
+func schedule2transactions(db *sql.DB, d *schedule, date time.Time) ([]transaction, error) {
+	var trs []transaction
+
+	if d.tmpl.id == 0 {
+		var tr transaction
+		tr.date = date
+		tr.setSimple(d.debit, d.credit, d.amount)
+		tr.note = d.note
+
+		return append(trs, tr), nil
+	}
+
+	items, err := dbGetTemplateItems(db, d.tmpl.id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if item.amount == 0 {
+			continue
+		}
+
+		var tr transaction
+		tr.date = date
+		tr.setSimple(item.debit, item.credit, item.amount)
+		tr.note = item.note
+
+		trs = append(trs, tr)
+	}
+
+	return trs, nil
+}
+
+func confirmSchedule(db *sql.DB, accounts []account, d *schedule) (bool, error) {
+	for {
+		println()
+		println(d)
+
+		print("y(es), n(ame), t(arget), r(ule), s(tart), q(uit): ")
+		s, err := input()
+		if err != nil {
+			return false, err
+		}
+		a := strings.ToLower(s)
+
+		switch a {
+		case "q", "quit":
+			return false, nil
+		case "y", "yes":
+			if err := d.validate(); err != nil {
+				eprintln("エラー:", err)
+				break
+			}
+
+			return true, nil
+		case "n", "name":
+			d.name = scanScheduleName()
+		case "t", "target":
+			ok, err := scanScheduleTarget(db, accounts, d)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				eprintln("変更しなかった")
+			}
+		case "r", "rule":
+			d.rule, d.ruleValue = scanRule()
+		case "s", "start":
+			d.start = scanDate()
+		}
+	}
+}
+
+func scanSchedule(db *sql.DB, accounts []account) (*schedule, error) {
+	var d schedule
+
+	d.name = scanScheduleName()
+
+	ok, err := scanScheduleTarget(db, accounts, &d)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	d.rule, d.ruleValue = scanRule()
+
+	println("開始日")
+	d.start = scanDate()
+
+	return &d, nil
+}
+
+func scanScheduleName() string {
+	return scanText("名前", 1, 16)
+}
+
+// 取引の作成元(勘定科目かテンプレート)を入力する。キャンセルされたら false
+func scanScheduleTarget(db *sql.DB, accounts []account, d *schedule) (bool, error) {
+	kind := scanInt("1: 勘定科目, 2: テンプレート", 1, 2)
+
+	if kind == 2 {
+		tmpl, err := selectTemplate(db)
+		if tmpl == nil || err != nil {
+			return false, err
+		}
+
+		d.tmpl = *tmpl
+		d.debit = account{}
+		d.credit = account{}
+		d.amount = 0
+		d.note = ""
+
+		return true, nil
+	}
+
+	debit, err := selectAccount(accounts, "借方")
+	if debit == nil || err != nil {
+		return false, err
+	}
+
+	credit, err := selectAccount(accounts, "貸方")
+	if credit == nil || err != nil {
+		return false, err
+	}
+
+	d.tmpl = template{}
+	d.debit = *debit
+	d.credit = *credit
+	d.amount = scanAmount()
+	d.note = scanNote()
+
+	return true, nil
+}
+
+func scanRule() (string, int) {
+	switch scanInt("1: 毎月N日, 2: N週ごと, 3: 月末営業日", 1, 3) {
+	case 1:
+		return ruleMonthly, scanInt("日", 1, 31)
+	case 2:
+		return ruleWeekly, scanInt("何週ごと", 1, 52)
+	}
+
+	return ruleLastBusinessDay, 0
+}
+
+func selectSchedule(db *sql.DB) (*schedule, error) {
+	schedules, err := dbGetSchedules(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(schedules) == 0 {
+		return nil, nil
+	}
+
+	src := new(bytes.Buffer)
+
+	for i, d := range schedules {
+		src.Write([]byte(fmt.Sprintf("%d %v\n", i, &d)))
+	}
+
+	dst := new(bytes.Buffer)
+	args := []string{}
+
+	cancel, err := fzf(src, dst, os.Stderr, args)
+	if cancel {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	arr := strings.Split(dst.String(), " ")
+
+	i, err := strconv.Atoi(arr[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &schedules[i], nil
+}
+
+const sqlGetSchedules = `
+SELECT schedule_id, name, template_id, template_name,
+       debit_id, debit_name, credit_id, credit_name,
+       amount, description, rule, rule_value, start_date, last_date
+FROM schedules_view
+ORDER BY schedule_id
+`
+
+func dbGetSchedules(db *sql.DB) ([]schedule, error) {
+	rows, err := db.Query(sqlGetSchedules)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedules []schedule
+
+	for rows.Next() {
+		var d schedule
+		var last sql.NullTime
+
+		if err := rows.Scan(&d.id, &d.name, &d.tmpl.id, &d.tmpl.name,
+			&d.debit.id, &d.debit.name, &d.credit.id, &d.credit.name,
+			&d.amount, &d.note, &d.rule, &d.ruleValue, &d.start, &last); err != nil {
+			return nil, err
+		}
+
+		if last.Valid {
+			d.last = last.Time
+		}
+
+		schedules = append(schedules, d)
+	}
+	rows.Close()
+
+	return schedules, nil
+}
+
+const sqlAddSchedule = `
+INSERT INTO schedules(name, template_id, debit_id, credit_id, amount, description,
+                      rule, rule_value, start_date)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+RETURNING schedule_id
+`
+
+func dbAddSchedule(db dbtx, d *schedule) (int, error) {
+	var idStr string
+	err := db.QueryRow(sqlAddSchedule, d.name, d.tmpl.id, d.debit.id, d.credit.id,
+		d.amount, d.note, d.rule, d.ruleValue, d.start).Scan(&idStr)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(idStr)
+}
+
+const sqlEditSchedule = `
+UPDATE schedules SET
+name = $2,
+template_id = $3,
+debit_id = $4,
+credit_id = $5,
+amount = $6,
+description = $7,
+rule = $8,
+rule_value = $9,
+start_date = $10
+WHERE schedule_id = $1
+`
+
+func dbEditSchedule(db dbtx, d *schedule) error {
+	_, err := db.Exec(sqlEditSchedule, d.id, d.name, d.tmpl.id, d.debit.id, d.credit.id,
+		d.amount, d.note, d.rule, d.ruleValue, d.start)
+
+	return err
+}
+
+const sqlRemoveSchedule = `
+DELETE FROM schedules
+WHERE schedule_id = $1
+`
+
+func dbRemoveSchedule(db dbtx, id int) error {
+	_, err := db.Exec(sqlRemoveSchedule, id)
+
+	return err
+}
+
+const sqlLockSchedule = `
+SELECT last_date
+FROM schedules
+WHERE schedule_id = $1
+FOR UPDATE
+`
+
+// 行をロックして最新の last_date を取得する
+func dbLockSchedule(db dbtx, id int) (time.Time, error) {
+	var last sql.NullTime
+
+	if err := db.QueryRow(sqlLockSchedule, id).Scan(&last); err != nil {
+		return time.Time{}, err
+	}
+
+	return last.Time, nil
+}
+
+const sqlUpdateScheduleLastDate = `
+UPDATE schedules
+SET last_date = $2
+WHERE schedule_id = $1
+`
+
+func dbUpdateScheduleLastDate(db dbtx, id int, date time.Time) error {
+	_, err := db.Exec(sqlUpdateScheduleLastDate, id, date)
+
+	return err
+}
+
+const sqlAddScheduleLog = `
+INSERT INTO schedules_log(schedule_id, date, no, transaction_id)
+VALUES($1, $2, $3, $4)
+`
+
+func dbAddScheduleLog(db dbtx, id int, date time.Time, no int, transactionID string) error {
+	_, err := db.Exec(sqlAddScheduleLog, id, date, no, transactionID)
+
+	return err
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func ymd(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
+
+func TestStr2rule(t *testing.T) {
+	if rule, value, err := str2rule("m25"); err != nil || rule != ruleMonthly || value != 25 {
+		t.Fatalf(`str2rule("m25"), got = %s, %d, %v`, rule, value, err)
+	}
+
+	if rule, value, err := str2rule("W2"); err != nil || rule != ruleWeekly || value != 2 {
+		t.Fatalf(`str2rule("W2"), got = %s, %d, %v`, rule, value, err)
+	}
+
+	if rule, _, err := str2rule("B"); err != nil || rule != ruleLastBusinessDay {
+		t.Fatalf(`str2rule("B"), got = %s, %v`, rule, err)
+	}
+
+	errTests := []string{"", "M", "M0", "M32", "W0", "W53", "B1", "X1"}
+
+	for _, test := range errTests {
+		if _, _, err := str2rule(test); err == nil {
+			t.Errorf("str2rule(%q) should be error", test)
+		}
+	}
+}
+
+type dueDatesTest struct {
+	rule      string
+	ruleValue int
+	start     time.Time
+	last      time.Time
+	until     time.Time
+	res       []time.Time
+}
+
+var dueDatesTests = []dueDatesTest{
+	{ruleMonthly, 25, ymd(2020, 1, 1), time.Time{}, ymd(2020, 3, 24),
+		[]time.Time{ymd(2020, 1, 25), ymd(2020, 2, 25)}},
+	{ruleMonthly, 31, ymd(2020, 1, 1), time.Time{}, ymd(2020, 4, 30),
+		[]time.Time{ymd(2020, 1, 31), ymd(2020, 2, 29), ymd(2020, 3, 31), ymd(2020, 4, 30)}},
+	{ruleMonthly, 25, ymd(2020, 1, 1), ymd(2020, 2, 25), ymd(2020, 3, 25),
+		[]time.Time{ymd(2020, 3, 25)}},
+	{ruleMonthly, 25, ymd(2020, 1, 1), ymd(2020, 3, 25), ymd(2020, 3, 25), nil},
+	{ruleWeekly, 2, ymd(2020, 1, 6), time.Time{}, ymd(2020, 2, 3),
+		[]time.Time{ymd(2020, 1, 6), ymd(2020, 1, 20), ymd(2020, 2, 3)}},
+	{ruleWeekly, 2, ymd(2020, 1, 6), ymd(2020, 1, 20), ymd(2020, 2, 16),
+		[]time.Time{ymd(2020, 2, 3)}},
+	// 2020-02-29 と 2020-05-31 は土日
+	{ruleLastBusinessDay, 0, ymd(2020, 2, 1), time.Time{}, ymd(2020, 5, 31),
+		[]time.Time{ymd(2020, 2, 28), ymd(2020, 3, 31), ymd(2020, 4, 30), ymd(2020, 5, 29)}},
+	{ruleMonthly, 25, ymd(2020, 4, 1), time.Time{}, ymd(2020, 3, 31), nil},
+}
+
+func TestDueDates(t *testing.T) {
+	for i, test := range dueDatesTests {
+		d := schedule{rule: test.rule, ruleValue: test.ruleValue, start: test.start, last: test.last}
+
+		res := d.dueDates(test.until)
+
+		if len(res) != len(test.res) {
+			t.Errorf("#%d: got: %v want: %v", i, res, test.res)
+			continue
+		}
+
+		for j := range res {
+			if !res[j].Equal(test.res[j]) {
+				t.Errorf("#%d: got: %v want: %v", i, res, test.res)
+				break
+			}
+		}
+	}
+}
+
+func TestScheduleCommands(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	t.Run("TestRunSchedules", func(t *testing.T) {
+		db, err := setupAccounts()
+		if db != nil {
+			defer db.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args := []string{"家賃", "M25", "2020-01-01", "家賃", "A銀行", "80000", "家賃"}
+		if err := runAddSchedule(db, args); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := runSchedules(db, ymd(2020, 3, 24), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 2 {
+			t.Fatal("n != 2:", n)
+		}
+
+		// 同じ期間で実行しても二重に追加されない
+		n, err = runSchedules(db, ymd(2020, 3, 24), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 0 {
+			t.Fatal("n != 0:", n)
+		}
+
+		n, err = runSchedules(db, ymd(2020, 3, 25), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 1 {
+			t.Fatal("n != 1:", n)
+		}
+
+		transactions, err := getTransactions(db, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(transactions) != 3 {
+			t.Fatal("len(transactions) != 3:", len(transactions))
+		}
+
+		testTransaction(t, transactions[2], "2020-03-25", "家賃", "A銀行", 80000, "家賃", 0, 0)
+
+		schedules, err := dbGetSchedules(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(schedules) != 1 || schedules[0].last.Format("2006-01-02") != "2020-03-25" {
+			t.Fatal("wrong last date:", schedules)
+		}
+	})
+
+	t.Run("TestRunAddScheduleErrors", func(t *testing.T) {
+		db, err := setupAccounts()
+		if db != nil {
+			defer db.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errTests := [][]string{
+			{"家賃", "X25", "2020-01-01", "家賃", "A銀行", "80000"},
+			{"家賃", "M25", "2020-01-01", "なし", "A銀行", "80000"},
+			{"家賃", "M25", "2020-01-01", "なしテンプレ"},
+			{"家賃", "M25"},
+		}
+
+		for _, args := range errTests {
+			if err := runAddSchedule(db, args); err == nil {
+				t.Errorf("runAddSchedule(%v) should be error", args)
+			}
+		}
+	})
+}
+
+func TestAutoRunSchedules(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	db, err := setupAccounts()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"家賃", "M25", "2020-01-01", "家賃", "A銀行", "80000", "家賃"}
+	if err := runAddSchedule(db, args); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAddTransaction(db, []string{"2020-01-10", "食費", "現金", "500", "ユーザー"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := dbRecordOperation(db, "tr add", operationNormal, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countFound := func(query string) int {
+		found, err := findTransactions(db, []string{query})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(found)
+	}
+
+	countOperations := func() int {
+		operations, err := dbGetOperations(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(operations)
+	}
+
+	// undo の前には実行しない
+	autoRunSchedules("undo")
+
+	if n := countFound("家賃"); n != 0 {
+		t.Fatal("undo の前に実行された:", n)
+	}
+
+	stdin = bytes.NewBufferString("y\n")
+	scanner = bufio.NewScanner(stdin)
+
+	if err := runUndoOperation(db, true); err != nil {
+		t.Fatal(err)
+	}
+
+	undo, err := dbGetOperation1(db, sqlGetOperations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if undo.kind != operationUndo || undo.targetID != id {
+		t.Fatal("UNDO の対象が違う:", undo)
+	}
+
+	if n := countFound("ユーザー"); n != 0 {
+		t.Fatal("ユーザーの取引が戻されてない:", n)
+	}
+
+	// 自動で追加した取引は1つの操作にする。追加しなければ操作も追加しない
+	n := countOperations()
+
+	runAutoSchedules(db, ymd(2020, 3, 24))
+
+	if c := countFound("家賃"); c != 2 {
+		t.Fatal("len(家賃) != 2:", c)
+	}
+
+	if c := countOperations(); c != n+1 {
+		t.Fatal("自動実行の操作の数が違う:", c-n)
+	}
+
+	runAutoSchedules(db, ymd(2020, 3, 24))
+
+	if c := countOperations(); c != n+1 {
+		t.Fatal("何も追加しないのに操作が追加された:", c-n)
+	}
+}
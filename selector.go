@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+組み込みの選択画面
+
+fzf がない環境や、設定ファイルの [ui] で selector = "builtin" を指定したときに fzf の代わりに使う。
+fzf と同じように、1行に1つの選択肢を受け取り、選んだ行をそのまま出力する。
+使える fzf のオプションは --header と --multi だけ。
+
+入力した文字列を空白で区切り、全ての語が(大文字と小文字を区別せず)
+この順に含まれる行に絞り込む。語の文字は飛び飛びでもよい。
+
+キー操作
+
+	Enter           決定
+	Esc, Ctrl-C     キャンセル
+	↑, Ctrl-P       上へ
+	↓, Ctrl-N       下へ
+	Tab             選択の切り替え(--multi のとき)
+	Backspace       1文字削除
+	Ctrl-U          入力をすべて削除
+*/
+const (
+	selectorAuto    = "auto"
+	selectorFzf     = "fzf"
+	selectorBuiltin = "builtin"
+)
+
+// fzf と組み込みの選択画面のどちらを使うか
+func selectorName() (string, error) {
+	switch configData.UI.Selector {
+	case "", selectorAuto:
+		if hasFzf() {
+			return selectorFzf, nil
+		}
+
+		return selectorBuiltin, nil
+	case selectorFzf, selectorBuiltin:
+		return configData.UI.Selector, nil
+	}
+
+	return "", fmt.Errorf("未対応の selector '%s'。auto, fzf, builtin のどれか", configData.UI.Selector)
+}
+
+type selector struct {
+	lines    []string
+	lower    []string // 絞り込み用に小文字にした行
+	header   string
+	multi    bool
+	query    []rune
+	matches  []int // 絞り込んだ行の番号
+	cursor   int   // matches の中の位置
+	offset   int   // 表示している最初の matches の位置
+	selected map[int]bool
+}
+
+func newSelector(lines []string, header string, multi bool) *selector {
+	s := &selector{
+		lines:    lines,
+		header:   header,
+		multi:    multi,
+		selected: make(map[int]bool),
+	}
+
+	for _, line := range lines {
+		s.lower = append(s.lower, strings.ToLower(line))
+	}
+
+	s.filter()
+
+	return s
+}
+
+// fzf の引数から、組み込みの選択画面で使うものを読む
+func parseSelectorArgs(args []string) (header string, multi bool) {
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--header="):
+			header = strings.TrimPrefix(arg, "--header=")
+		case arg == "--multi", arg == "-m":
+			multi = true
+		}
+	}
+
+	return header, multi
+}
+
+// 入力した文字列で行を絞り込む
+func (s *selector) filter() {
+	words := strings.Fields(strings.ToLower(string(s.query)))
+
+	s.matches = s.matches[:0]
+
+	for i, line := range s.lower {
+		if matchWords(line, words) {
+			s.matches = append(s.matches, i)
+		}
+	}
+
+	s.cursor = 0
+	s.offset = 0
+}
+
+// 全ての語の文字が、この順に line に含まれるか
+func matchWords(line string, words []string) bool {
+	for _, w := range words {
+		rest := line
+
+		for _, ch := range w {
+			i := strings.IndexRune(rest, ch)
+			if i == -1 {
+				return false
+			}
+
+			rest = rest[i+utf8.RuneLen(ch):]
+		}
+	}
+
+	return true
+}
+
+// キーの種類
+const (
+	keyRune = iota
+	keyEnter
+	keyCancel
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyTab
+	keyBackTab
+	keyBackspace
+	keyClear
+	keyUnknown
+)
+
+type selectorKey struct {
+	kind int
+	r    rune
+}
+
+// 端末から読んだバイト列をキーに分ける
+func parseSelectorKeys(b []byte) []selectorKey {
+	var keys []selectorKey
+
+	for len(b) != 0 {
+		switch {
+		case b[0] == 27 && len(b) == 1:
+			keys = append(keys, selectorKey{kind: keyCancel})
+			b = b[1:]
+		case b[0] == 27 && len(b) >= 3 && (b[1] == '[' || b[1] == 'O'):
+			switch b[2] {
+			case 'A':
+				keys = append(keys, selectorKey{kind: keyUp})
+			case 'B':
+				keys = append(keys, selectorKey{kind: keyDown})
+			case 'C':
+				keys = append(keys, selectorKey{kind: keyRight})
+			case 'D':
+				keys = append(keys, selectorKey{kind: keyLeft})
+			case 'Z':
+				keys = append(keys, selectorKey{kind: keyBackTab})
+			default:
+				keys = append(keys, selectorKey{kind: keyUnknown})
+			}
+			b = b[3:]
+		case b[0] == 27:
+			keys = append(keys, selectorKey{kind: keyUnknown})
+			b = b[2:]
+		case b[0] == '\r' || b[0] == '\n':
+			keys = append(keys, selectorKey{kind: keyEnter})
+			b = b[1:]
+		case b[0] == 3 || b[0] == 7: // Ctrl-C, Ctrl-G
+			keys = append(keys, selectorKey{kind: keyCancel})
+			b = b[1:]
+		case b[0] == 16 || b[0] == 11: // Ctrl-P, Ctrl-K
+			keys = append(keys, selectorKey{kind: keyUp})
+			b = b[1:]
+		case b[0] == 14: // Ctrl-N
+			keys = append(keys, selectorKey{kind: keyDown})
+			b = b[1:]
+		case b[0] == '\t':
+			keys = append(keys, selectorKey{kind: keyTab})
+			b = b[1:]
+		case b[0] == 127 || b[0] == 8:
+			keys = append(keys, selectorKey{kind: keyBackspace})
+			b = b[1:]
+		case b[0] == 21: // Ctrl-U
+			keys = append(keys, selectorKey{kind: keyClear})
+			b = b[1:]
+		case b[0] < 32:
+			keys = append(keys, selectorKey{kind: keyUnknown})
+			b = b[1:]
+		default:
+			r, size := utf8.DecodeRune(b)
+			keys = append(keys, selectorKey{kind: keyRune, r: r})
+			b = b[size:]
+		}
+	}
+
+	return keys
+}
+
+// キーを処理する。決定かキャンセルで終了する
+func (s *selector) handleKey(k selectorKey) (done bool, cancel bool) {
+	switch k.kind {
+	case keyRune:
+		if unicode.IsPrint(k.r) {
+			s.query = append(s.query, k.r)
+			s.filter()
+		}
+	case keyBackspace:
+		if len(s.query) != 0 {
+			s.query = s.query[:len(s.query)-1]
+			s.filter()
+		}
+	case keyClear:
+		s.query = s.query[:0]
+		s.filter()
+	case keyUp:
+		s.move(-1)
+	case keyDown:
+		s.move(1)
+	case keyTab, keyBackTab:
+		if s.multi && len(s.matches) != 0 {
+			i := s.matches[s.cursor]
+			s.selected[i] = !s.selected[i]
+		}
+
+		if k.kind == keyTab {
+			s.move(1)
+		} else {
+			s.move(-1)
+		}
+	case keyEnter:
+		if len(s.matches) != 0 || len(s.result()) != 0 {
+			return true, false
+		}
+	case keyCancel:
+		return true, true
+	}
+
+	return false, false
+}
+
+func (s *selector) move(n int) {
+	s.cursor += n
+
+	if s.cursor >= len(s.matches) {
+		s.cursor = len(s.matches) - 1
+	}
+
+	if s.cursor < 0 {
+		s.cursor = 0
+	}
+}
+
+// 選んだ行。--multi で Tab で選んだ行があれば、それらを元の順番で返す
+func (s *selector) result() []string {
+	var res []string
+
+	if s.multi {
+		var indexes []int
+		for i, ok := range s.selected {
+			if ok {
+				indexes = append(indexes, i)
+			}
+		}
+		sort.Ints(indexes)
+
+		for _, i := range indexes {
+			res = append(res, s.lines[i])
+		}
+
+		if len(res) != 0 {
+			return res
+		}
+	}
+
+	if len(s.matches) != 0 {
+		res = append(res, s.lines[s.matches[s.cursor]])
+	}
+
+	return res
+}
+
+// 画面を描く。1行目に入力、2行目に件数、ヘッダーがあれば3行目に表示し、その下に行を並べる
+func (s *selector) render(w io.Writer, width int, height int) {
+	b := new(bytes.Buffer)
+
+	b.WriteString("\x1b[H\x1b[2J")
+
+	b.WriteString(truncateText("> "+string(s.query), width))
+	b.WriteString("\r\n")
+
+	info := fmt.Sprintf("  %d/%d", len(s.matches), len(s.lines))
+	if s.multi {
+		n := 0
+		for _, ok := range s.selected {
+			if ok {
+				n++
+			}
+		}
+		info += fmt.Sprintf(" (%d)", n)
+	}
+	b.WriteString(truncateText(info, width))
+
+	top := 2
+	if s.header != "" {
+		b.WriteString("\r\n")
+		b.WriteString(truncateText("  "+s.header, width))
+		top++
+	}
+
+	rows := height - top
+	if rows < 1 {
+		rows = 1
+	}
+
+	if s.cursor < s.offset {
+		s.offset = s.cursor
+	}
+
+	if s.cursor >= s.offset+rows {
+		s.offset = s.cursor - rows + 1
+	}
+
+	for j := s.offset; j < len(s.matches) && j < s.offset+rows; j++ {
+		i := s.matches[j]
+
+		mark := " "
+		if s.selected[i] {
+			mark = "*"
+		}
+
+		b.WriteString("\r\n")
+
+		if j == s.cursor {
+			b.WriteString("\x1b[7m")
+			b.WriteString(truncateText(">"+mark+s.lines[i], width))
+			b.WriteString("\x1b[0m")
+		} else {
+			b.WriteString(truncateText(" "+mark+s.lines[i], width))
+		}
+	}
+
+	// カーソルを入力の末尾に置く
+	b.WriteString(fmt.Sprintf("\x1b[1;%dH", getTextWidth("> "+string(s.query))+1))
+
+	w.Write(b.Bytes())
+}
+
+// 表示幅が width を超えないように切り詰める
+func truncateText(s string, width int) string {
+	w := 0
+
+	for i, ch := range s {
+		cw := getTextWidth(string(ch))
+
+		if w+cw > width {
+			return s[:i]
+		}
+
+		w += cw
+	}
+
+	return s
+}
+
+// 組み込みの選択画面。キャンセルされたら true を返す
+func builtinSelect(src io.Reader, dst io.Writer, args []string) (bool, error) {
+	var lines []string
+
+	sc := bufio.NewScanner(src)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+
+	if err := sc.Err(); err != nil {
+		return false, err
+	}
+
+	header, multi := parseSelectorArgs(args)
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false, errors.New("端末を開けないので選択できない")
+	}
+	defer tty.Close()
+
+	fd := int(tty.Fd())
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return false, err
+	}
+	defer term.Restore(fd, state)
+
+	// 代替画面に切り替えて、終了時に元の画面に戻す
+	tty.WriteString("\x1b[?1049h")
+	defer tty.WriteString("\x1b[?1049l")
+
+	s := newSelector(lines, header, multi)
+
+	buf := make([]byte, 256)
+
+	for {
+		width, height, err := term.GetSize(fd)
+		if err != nil || width <= 0 || height <= 0 {
+			width, height = 80, 24
+		}
+
+		s.render(tty, width, height)
+
+		n, err := tty.Read(buf)
+		if err != nil {
+			return false, err
+		}
+
+		for _, k := range parseSelectorKeys(buf[:n]) {
+			done, cancel := s.handleKey(k)
+
+			if cancel {
+				return true, nil
+			}
+
+			if done {
+				for _, line := range s.result() {
+					io.WriteString(dst, line+"\n")
+				}
+
+				return false, nil
+			}
+		}
+	}
+}
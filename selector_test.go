@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMatchWords(t *testing.T) {
+	line := strings.ToLower("3 費用 食費 syokuhi Food")
+
+	for _, c := range []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"syoku", true},
+		{"skh", true},
+		{"food 食費", true},
+		{"FOOD", false}, // 行は小文字にしてから比べるので、入力も小文字にする
+		{"hiyou", false},
+		{"ihs", false},
+	} {
+		if got := matchWords(line, strings.Fields(c.query)); got != c.want {
+			t.Errorf("%q: got = %v", c.query, got)
+		}
+	}
+}
+
+func TestParseSelectorKeys(t *testing.T) {
+	keys := parseSelectorKeys([]byte("a食\x1b[A\x1b[B\t\x1b[Z\x7f\x15\r\x03"))
+
+	want := []selectorKey{
+		{kind: keyRune, r: 'a'}, {kind: keyRune, r: '食'}, {kind: keyUp}, {kind: keyDown},
+		{kind: keyTab}, {kind: keyBackTab}, {kind: keyBackspace}, {kind: keyClear},
+		{kind: keyEnter}, {kind: keyCancel},
+	}
+
+	if len(keys) != len(want) {
+		t.Fatalf("len(keys) = %d", len(keys))
+	}
+
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Errorf("%d: got = %v, want = %v", i, keys[i], want[i])
+		}
+	}
+
+	if keys := parseSelectorKeys([]byte{27}); len(keys) != 1 || keys[0].kind != keyCancel {
+		t.Errorf("Esc: got = %v", keys)
+	}
+}
+
+func runSelectorKeys(s *selector, input string) (bool, bool) {
+	for _, k := range parseSelectorKeys([]byte(input)) {
+		if done, cancel := s.handleKey(k); done {
+			return done, cancel
+		}
+	}
+
+	return false, false
+}
+
+func TestSelector(t *testing.T) {
+	lines := []string{
+		"0 資産 現金 genkin",
+		"1 資産 A銀行 aginkou",
+		"2 費用 食費 syokuhi",
+	}
+
+	s := newSelector(lines, "勘定科目", false)
+
+	done, cancel := runSelectorKeys(s, "gin\x1b[B\r")
+	if !done || cancel {
+		t.Fatal("決定されるはず")
+	}
+
+	if res := s.result(); len(res) != 1 || res[0] != lines[1] {
+		t.Errorf("got = %v", res)
+	}
+
+	// 一致する行がなければ決定できない
+	s = newSelector(lines, "", false)
+
+	if done, _ := runSelectorKeys(s, "xyz\r"); done {
+		t.Error("一致する行がないので決定されないはず")
+	}
+
+	if done, cancel := runSelectorKeys(s, "\x1b"); !done || !cancel {
+		t.Error("キャンセルされるはず")
+	}
+
+	// 複数選択
+	s = newSelector(lines, "", true)
+
+	runSelectorKeys(s, "\t\t\x1b[A\x1b[A\t")
+
+	if res := s.result(); len(res) != 1 || res[0] != lines[1] {
+		t.Errorf("multi got = %v", res)
+	}
+
+	s.query = nil
+	s.filter()
+	runSelectorKeys(s, "\x1b[B\x1b[B\t")
+
+	if res := s.result(); len(res) != 2 || res[0] != lines[1] || res[1] != lines[2] {
+		t.Errorf("multi got = %v", res)
+	}
+
+	b := new(bytes.Buffer)
+	s.render(b, 10, 4)
+
+	if !strings.Contains(b.String(), "3/3 (2)") {
+		t.Errorf("render: %q", b.String())
+	}
+}
+
+func TestParseSelectorArgs(t *testing.T) {
+	header, multi := parseSelectorArgs([]string{"--header=UNDO取引", "--multi"})
+
+	if header != "UNDO取引" || !multi {
+		t.Errorf("got = %s, %v", header, multi)
+	}
+}
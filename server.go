@@ -11,8 +11,12 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/rakyll/statik/fs"
 	"github.com/urfave/cli/v2"
+	"mime"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func cmdServer(context *cli.Context) error {
@@ -27,15 +31,23 @@ func cmdServer(context *cli.Context) error {
 	http.HandleFunc("/api/balances", apiBalancesHandler)
 	http.HandleFunc("/api/pl", apiPLHandler)
 	http.HandleFunc("/api/pl-years", apiPLYearsHandler)
+	http.HandleFunc("/api/budget", apiBudgetHandler)
+	http.HandleFunc("/api/transactions/", apiTransactionsHandler)
 
 	port := context.Int("port")
 	printf("Running on http://localhost:%d/ (Press CTRL+C to quit)\n", port)
 	return http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
 }
 
+/*
+Balance は外貨建ての勘定科目を月末のレートで評価した金額
+BookBalance は帳簿上の金額、FXGain は評価損益
+*/
 type apiAssets struct {
-	Month   int `json:"month"`
-	Balance int `json:"balance"`
+	Month       int `json:"month"`
+	Balance     int `json:"balance"`
+	BookBalance int `json:"book_balance"`
+	FXGain      int `json:"fx_gain"`
 }
 
 func apiAssetsHandler(w http.ResponseWriter, r *http.Request) {
@@ -146,7 +158,8 @@ func apiPLHandler(w http.ResponseWriter, r *http.Request) {
 
 	year, _ := getIntParam(r, "year")
 
-	values, err := getPLAmountMap(db, year, getBoolParam(r, "cash"), getBoolParam(r, "extraordinary"), keys)
+	values, err := getPLAmountMap(db, year, getBoolParam(r, "cash"), getBoolParam(r, "extraordinary"), keys,
+		r.URL.Query().Get("tag"))
 	if err != nil {
 		eprintln(err)
 		return
@@ -164,6 +177,163 @@ func apiPLHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type apiBudget struct {
+	Month  int              `json:"month"`
+	Values []apiBudgetValue `json:"values"`
+}
+
+type apiBudgetValue struct {
+	Name        string `json:"name"`
+	AccountType int    `json:"account_type"`
+	HasBudget   bool   `json:"has_budget"`
+	Budget      int    `json:"budget"`
+	Actual      int    `json:"actual"`
+}
+
+// 月の予算と実績を返す。月の指定がなければ今月
+func apiBudgetHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := connectDB()
+	if err != nil {
+		eprintln(err)
+		return
+	}
+	defer db.Close()
+
+	month, err := getIntParam(r, "month")
+	if err != nil {
+		month, _ = str2month("-0")
+	}
+
+	lines, err := getBudgetLines(db, getBoolParam(r, "cash"), month)
+	if err != nil {
+		eprintln(err)
+		return
+	}
+
+	data := apiBudget{
+		Month:  month,
+		Values: []apiBudgetValue{},
+	}
+
+	for _, d := range lines {
+		data.Values = append(data.Values, apiBudgetValue{
+			Name:        d.name,
+			AccountType: d.accountType,
+			HasBudget:   d.hasBudget,
+			Budget:      d.budget,
+			Actual:      d.actual,
+		})
+	}
+
+	w.Header().Set("Content-type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		eprintln(err)
+	}
+}
+
+type apiAttachment struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	AttachTime string `json:"attach_time"`
+	URL        string `json:"url"`
+}
+
+/*
+取引の添付ファイル
+
+/api/transactions/{取引ID}/attachments は添付ファイルの一覧を返し、
+/api/transactions/{取引ID}/attachments/{添付ファイルID} はファイルの中身を返す。
+*/
+func apiTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	arr := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/transactions/"), "/"), "/")
+
+	if len(arr) < 2 || len(arr) > 3 || arr[1] != "attachments" {
+		http.NotFound(w, r)
+		return
+	}
+
+	id, err := strconv.Atoi(arr[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		eprintln(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if len(arr) == 3 {
+		attachmentID, err := strconv.Atoi(arr[2])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		serveAttachment(w, r, db, id, attachmentID)
+		return
+	}
+
+	items, err := dbGetAttachments(db, id)
+	if err != nil {
+		eprintln(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	data := []apiAttachment{}
+
+	for _, d := range items {
+		data = append(data, apiAttachment{
+			ID:         d.id,
+			Name:       d.name,
+			Size:       d.size,
+			SHA256:     d.sha256,
+			AttachTime: d.attachTime.Local().Format(time.RFC3339),
+			URL:        fmt.Sprintf("/api/transactions/%d/attachments/%d", id, d.id),
+		})
+	}
+
+	w.Header().Set("Content-type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		eprintln(err)
+	}
+}
+
+func serveAttachment(w http.ResponseWriter, r *http.Request, db *sql.DB, id int, attachmentID int) {
+	d, err := dbGetAttachment(db, id, attachmentID)
+	if err != nil {
+		eprintln(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if d == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(attachmentPath(d.sha256))
+	if err != nil {
+		eprintln(err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": d.name}))
+
+	// Content-Type は拡張子か中身から決まる
+	http.ServeContent(w, r, d.name, d.attachTime, f)
+}
+
 type apiPLYears struct {
 	Years []int `json:"years"`
 }
@@ -215,10 +385,12 @@ func dbGetAssets(db *sql.DB) ([]apiAssets, error) {
 	for rows.Next() {
 		var d apiAssets
 
-		if err := rows.Scan(&d.Month, &d.Balance); err != nil {
+		if err := rows.Scan(&d.Month, &d.BookBalance); err != nil {
 			return nil, err
 		}
 
+		d.Balance = d.BookBalance
+
 		if isZeroStart == false || d.Balance != 0 {
 			isZeroStart = false
 			arr = append(arr, d)
@@ -226,6 +398,17 @@ func dbGetAssets(db *sql.DB) ([]apiAssets, error) {
 	}
 	rows.Close()
 
+	for i := range arr {
+		d := &arr[i]
+
+		d.FXGain, err = getFXGain(db, d.Month)
+		if err != nil {
+			return nil, err
+		}
+
+		d.Balance += d.FXGain
+	}
+
 	return arr, nil
 }
 
@@ -309,7 +492,9 @@ func getAccountTypeKeys(db *sql.DB, acType int) ([]string, error) {
 	return keys, nil
 }
 
-func getPLAmountMap(db *sql.DB, year int, isCash bool, showExtraordinary bool, keys []string) ([]map[string]int, error) {
+// tag が空でなければ、タグの付いた取引だけを集計する
+func getPLAmountMap(db *sql.DB, year int, isCash bool, showExtraordinary bool, keys []string,
+	tag string) ([]map[string]int, error) {
 	var arr []map[string]int
 
 	var month int
@@ -317,13 +502,21 @@ func getPLAmountMap(db *sql.DB, year int, isCash bool, showExtraordinary bool, k
 	if year == 0 {
 		month, _ = str2month("-11")
 	} else {
-		month = year*100 + 01
+		month, _ = fiscalYearRange(year)
 	}
 
 	for i := 0; i < 12; i++ {
 		item2amount := make(map[string]int)
 
-		items, err := dbGetGroupedPL(db, isCash, month)
+		var items []summary
+		var err error
+
+		if tag == "" {
+			items, err = dbGetGroupedPL(db, isCash, month, month)
+		} else {
+			items, err = dbGetTagGroupedPL(db, tag, isCash, month, month)
+		}
+
 		if err != nil {
 			return nil, err
 		}
@@ -371,15 +564,20 @@ func incrementMonth(ym int) int {
 	return year*100 + month
 }
 
+// 年度を列挙。年度の開始月を $1、現在月を $2 で渡す
 const sqlGetPLYears = `
-SELECT year
-FROM enum_pl_years_view
+SELECT CASE WHEN pl.month % 100 >= $1 THEN pl.month / 100 ELSE pl.month / 100 - 1 END AS year
+FROM pl_view AS pl
+WHERE pl.month <= $2
+GROUP BY 1
+HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0
+ORDER BY 1 DESC
 `
 
 func dbGetPLYears(db *sql.DB) ([]int, error) {
 	var years []int
 
-	rows, err := db.Query(sqlGetPLYears)
+	rows, err := db.Query(sqlGetPLYears, fiscalYearStartMonth(), time2month(time.Now()))
 
 	if err != nil {
 		return nil, err
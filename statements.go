@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+	"html"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+OFX(QFX) と QIF の明細
+
+ネットバンクや証券会社がダウンロードさせる明細ファイル。
+口座は OFX の口座番号(ACCTID)か QIF の口座名(!Account の N)で、
+設定ファイルの [statement_accounts] で勘定科目に対応づける。
+対応がなければ同じ名前の勘定科目を使う。
+OFX の取引番号(FITID)は外部IDとして重複の判定に使う。
+*/
+const (
+	statementFormatOFX = "ofx"
+	statementFormatQIF = "qif"
+)
+
+func isStatementFormat(format string) bool {
+	return format == statementFormatOFX || format == statementFormatQIF
+}
+
+// 明細ファイルの1つの口座
+type bankStatement struct {
+	accountID string // OFX の口座番号か QIF の口座名
+	currency  string // 通貨コード。わからなければ空
+	entries   []bankStatementEntry
+}
+
+// 明細ファイルの1件の取引
+type bankStatementEntry struct {
+	lineNo   int
+	date     time.Time
+	amount   string // 小数点付きの金額。入金が正
+	note     string
+	fitID    string
+	category string
+}
+
+/*
+OFX か QIF の明細を読み込んで取引を追加する
+
+account が空でなければ、全ての明細をその勘定科目の明細として扱う。
+相手の勘定科目の決め方は明細CSVと同じ。
+*/
+func readStatementTransactions(db *sql.DB, f io.Reader, format string, account string, suspense string,
+	isDryRun bool) error {
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	// 日本の銀行の明細は Shift_JIS のことがある
+	if !utf8.Valid(b) {
+		b, err = ioutil.ReadAll(transform.NewReader(bytes.NewReader(b), japanese.ShiftJIS.NewDecoder()))
+		if err != nil {
+			return err
+		}
+	}
+
+	var statements []bankStatement
+
+	if format == statementFormatOFX {
+		statements, err = parseOFX(bytes.NewReader(b))
+	} else {
+		statements, err = parseQIF(bytes.NewReader(b))
+	}
+	if err != nil {
+		return err
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	var items []importStatement
+
+	for _, st := range statements {
+		name := account
+		if name == "" {
+			name = statementAccountName(st.accountID)
+		}
+
+		target := findAccount(accounts, name)
+		if target == nil {
+			if name == "" {
+				return errors.New("明細に口座がないので --account で勘定科目を指定する")
+			}
+
+			return fmt.Errorf("口座'%s'に対応する勘定科目がない。[statement_accounts] か --account で指定する", name)
+		}
+
+		if target.accountType != acTypeAsset && target.accountType != acTypeLiability {
+			return fmt.Errorf("'%s'は資産か負債の勘定科目ではない", target.name)
+		}
+
+		rows, err := statement2rows(db, &st, target)
+		if err != nil {
+			return err
+		}
+
+		items = append(items, importStatement{*target, rows})
+	}
+
+	return importStatements(db, accounts, items, suspense, isDryRun)
+}
+
+// 明細の口座に対応する勘定科目の名前
+func statementAccountName(accountID string) string {
+	if name, ok := configData.StatementAccounts[accountID]; ok {
+		return name
+	}
+
+	return accountID
+}
+
+// 明細の取引を勘定科目 target の行にする。外貨建ての勘定科目なら為替レートで円に換算する
+func statement2rows(db *sql.DB, st *bankStatement, target *account) ([]*importRow, error) {
+	currency := target.currency
+	if currency == "" {
+		currency = ledgerYen
+	}
+
+	if st.currency != "" && st.currency != currency {
+		return nil, fmt.Errorf("口座'%s'の通貨 %s が勘定科目'%s'の通貨 %s と違う", st.accountID, st.currency,
+			target.name, currency)
+	}
+
+	var rows []*importRow
+
+	for _, d := range st.entries {
+		n, err := parseStatementAmount(d.amount, currency)
+		if err != nil {
+			return nil, fmt.Errorf("%d:%s", d.lineNo, err)
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		row := &importRow{lineNo: d.lineNo, date: d.date, note: d.note, amount: n, category: d.category}
+
+		if utf8.RuneCountInString(row.note) > 64 {
+			row.note = string([]rune(row.note)[:64])
+		}
+
+		if d.fitID != "" {
+			row.id = target.name + ":" + d.fitID
+		}
+
+		if target.currency != "" {
+			rate, err := dbGetRate(db, target.currency, d.date)
+			if err != nil {
+				return nil, err
+			}
+
+			if rate == 0 {
+				return nil, fmt.Errorf("%d:%sの%s以前の為替レートが見つからない", d.lineNo, target.currency,
+					d.date.Format("2006-01-02"))
+			}
+
+			row.currencyAmount = n
+			row.amount = currency2yen(n, target.currency, rate)
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// "-1,200.00" や "+500" のような金額を補助単位の数値に変換。小数点以下の余分な 0 は無視する
+func parseStatementAmount(s string, currency string) (int, error) {
+	s = strings.TrimPrefix(strings.ReplaceAll(strings.TrimSpace(s), ",", ""), "+")
+
+	if strings.Contains(s, ".") {
+		s = strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+	}
+
+	if s == "" || s == "-" {
+		return 0, fmt.Errorf("不正な金額'%s'", s)
+	}
+
+	return str2currency(s, currency)
+}
+
+// OFX の要素。SGML の OFX 1.x では値を持つ要素の終了タグが省略される
+type ofxElement struct {
+	name     string
+	value    string
+	lineNo   int
+	children []*ofxElement
+}
+
+// name の最初の子孫。なければ nil
+func (d *ofxElement) find(name string) *ofxElement {
+	for _, c := range d.children {
+		if c.name == name {
+			return c
+		}
+
+		if e := c.find(name); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// name の全ての子孫
+func (d *ofxElement) findAll(name string) []*ofxElement {
+	var items []*ofxElement
+
+	for _, c := range d.children {
+		if c.name == name {
+			items = append(items, c)
+		} else {
+			items = append(items, c.findAll(name)...)
+		}
+	}
+
+	return items
+}
+
+// name の最初の子孫の値。なければ空
+func (d *ofxElement) get(name string) string {
+	if e := d.find(name); e != nil {
+		return e.value
+	}
+
+	return ""
+}
+
+/*
+OFX 1.x (SGML) と OFX 2.x (XML) を要素の木にする
+
+ヘッダと <?...?>、<!...> は読み飛ばす。
+値のある要素は次のタグで閉じ、終了タグは対応する開始タグまでの要素を閉じる。
+*/
+func parseOFXElements(f io.Reader) (*ofxElement, error) {
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	s := string(b)
+
+	root := &ofxElement{}
+	stack := []*ofxElement{root}
+	lineNo := 1
+
+	for {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			break
+		}
+
+		text := strings.TrimSpace(s[:i])
+		top := stack[len(stack)-1]
+
+		if text != "" && top != root && len(top.children) == 0 {
+			top.value = html.UnescapeString(text)
+		}
+
+		lineNo += strings.Count(s[:i], "\n")
+		s = s[i:]
+
+		j := strings.IndexByte(s, '>')
+		if j < 0 {
+			return nil, fmt.Errorf("%d:タグが閉じてない", lineNo)
+		}
+
+		tag := s[1:j]
+		lineNo += strings.Count(tag, "\n")
+		s = s[j+1:]
+
+		if strings.HasPrefix(tag, "?") || strings.HasPrefix(tag, "!") {
+			continue
+		}
+
+		// 値のある要素は子を持たない
+		if top != root && top.value != "" {
+			stack = stack[:len(stack)-1]
+			top = stack[len(stack)-1]
+		}
+
+		if strings.HasPrefix(tag, "/") {
+			name := strings.ToUpper(strings.TrimSpace(tag[1:]))
+
+			for k := len(stack) - 1; k > 0; k-- {
+				if stack[k].name == name {
+					stack = stack[:k]
+					break
+				}
+			}
+
+			continue
+		}
+
+		isEmpty := strings.HasSuffix(tag, "/")
+		fields := strings.Fields(strings.TrimSuffix(tag, "/"))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%d:空のタグ", lineNo)
+		}
+
+		e := &ofxElement{name: strings.ToUpper(fields[0]), lineNo: lineNo}
+		top.children = append(top.children, e)
+
+		if !isEmpty {
+			stack = append(stack, e)
+		}
+	}
+
+	if root.find("OFX") == nil {
+		return nil, errors.New("OFXの明細ではない")
+	}
+
+	return root, nil
+}
+
+// OFX の銀行口座とクレジットカードの明細を読む。投資口座の明細には対応してない
+func parseOFX(f io.Reader) ([]bankStatement, error) {
+	root, err := parseOFXElements(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []bankStatement
+
+	for _, name := range []string{"STMTRS", "CCSTMTRS"} {
+		for _, e := range root.findAll(name) {
+			st := bankStatement{accountID: e.get("ACCTID"), currency: strings.ToUpper(e.get("CURDEF"))}
+
+			for _, tr := range e.findAll("STMTTRN") {
+				d, err := parseOFXTransaction(tr)
+				if err != nil {
+					return nil, fmt.Errorf("%d:%s", tr.lineNo, err)
+				}
+
+				st.entries = append(st.entries, *d)
+			}
+
+			statements = append(statements, st)
+		}
+	}
+
+	if len(statements) == 0 {
+		return nil, errors.New("銀行口座かクレジットカードの明細がない")
+	}
+
+	return statements, nil
+}
+
+func parseOFXTransaction(e *ofxElement) (*bankStatementEntry, error) {
+	d := bankStatementEntry{lineNo: e.lineNo, amount: e.get("TRNAMT"), fitID: e.get("FITID")}
+
+	if e.find("ORIGCURRENCY") != nil {
+		return nil, errors.New("ORIGCURRENCY には対応してない")
+	}
+
+	var err error
+
+	d.date, err = parseOFXDate(e.get("DTPOSTED"))
+	if err != nil {
+		return nil, err
+	}
+
+	d.note = e.get("NAME")
+	if d.note == "" {
+		d.note = e.get("MEMO")
+	}
+
+	if d.amount == "" {
+		return nil, errors.New("TRNAMT がない")
+	}
+
+	return &d, nil
+}
+
+// "20191225"、"20191225120000.000[+9:JST]" のような日時の日付
+func parseOFXDate(s string) (time.Time, error) {
+	if len(s) < 8 {
+		return time.Time{}, fmt.Errorf("不正な日付'%s'", s)
+	}
+
+	date, err := time.ParseInLocation("20060102", s[:8], time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("不正な日付'%s'", s)
+	}
+
+	return date, nil
+}
+
+// QIF の日付の書式。月と日の順番は米国式
+var qifDateFormats = []string{
+	"2006-01-02",
+	"2006/1/2",
+	"1/2/2006",
+	"1/2'06",
+	"1/2/06",
+	"1-2-2006",
+	"1-2-06",
+}
+
+func parseQIFDate(s string) (time.Time, error) {
+	s = strings.ReplaceAll(s, " ", "")
+
+	for _, layout := range qifDateFormats {
+		if date, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return date, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("不正な日付'%s'", s)
+}
+
+// QIF の取引を含む種類
+var qifTransactionTypes = map[string]bool{
+	"bank":  true,
+	"cash":  true,
+	"ccard": true,
+	"oth a": true,
+	"oth l": true,
+}
+
+/*
+QIF の明細を読む
+
+!Account の口座ごとに明細を分ける。銀行、現金、カード、その他の資産と負債の取引だけを読み、
+投資口座や分類の一覧は読み飛ばす。分割(S, $)は無視して合計の金額を使う。
+分類(L)は [口座名] の振替も含めて、同じ名前の勘定科目があれば相手の勘定科目にする。
+*/
+func parseQIF(f io.Reader) ([]bankStatement, error) {
+	scanner := bufio.NewScanner(f)
+
+	var statements []bankStatement
+	var current *bankStatement
+
+	accountName := ""
+	section := ""
+	var d bankStatementEntry
+	isEmpty := true
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" {
+			continue
+		}
+
+		if line[0] == '!' {
+			header := strings.ToLower(line)
+
+			switch {
+			case header == "!account":
+				section = "account"
+			case strings.HasPrefix(header, "!type:"):
+				section = strings.TrimSpace(header[len("!type:"):])
+
+				if qifTransactionTypes[section] {
+					statements = append(statements, bankStatement{accountID: accountName})
+					current = &statements[len(statements)-1]
+				}
+			default:
+				section = ""
+			}
+
+			isEmpty = true
+			continue
+		}
+
+		code, value := line[0], strings.TrimSpace(line[1:])
+
+		if section == "account" {
+			if code == 'N' {
+				accountName = value
+			}
+
+			continue
+		}
+
+		if !qifTransactionTypes[section] {
+			continue
+		}
+
+		if isEmpty {
+			d = bankStatementEntry{lineNo: lineNo}
+			isEmpty = false
+		}
+
+		switch code {
+		case 'D':
+			date, err := parseQIFDate(value)
+			if err != nil {
+				return nil, fmt.Errorf("%d:%s", lineNo, err)
+			}
+
+			d.date = date
+		case 'T', 'U':
+			if d.amount == "" {
+				d.amount = value
+			}
+		case 'P':
+			d.note = value
+		case 'M':
+			if d.note == "" {
+				d.note = value
+			}
+		case 'L':
+			d.category = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		case '^':
+			if d.date.IsZero() || d.amount == "" {
+				return nil, fmt.Errorf("%d:日付か金額がない", d.lineNo)
+			}
+
+			current.entries = append(current.entries, d)
+			isEmpty = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(statements) == 0 {
+		return nil, errors.New("銀行口座やクレジットカードの明細がない")
+	}
+
+	return statements, nil
+}
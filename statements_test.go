@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const testOFX1 = `OFXHEADER:100
+DATA:OFXSGML
+VERSION:102
+
+<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0<SEVERITY>INFO</STATUS><DTSERVER>20191231</SONRS></SIGNONMSGSRSV1>
+<BANKMSGSRSV1>
+<STMTTRNRS>
+<STMTRS>
+<CURDEF>JPY
+<BANKACCTFROM>
+<BANKID>0001
+<ACCTID>1234567
+</BANKACCTFROM>
+<BANKTRANLIST>
+<STMTTRN>
+<TRNTYPE>DEBIT
+<DTPOSTED>20191210120000.000[+9:JST]
+<TRNAMT>-1200.00
+<FITID>A001
+<NAME>イオン東店
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>CREDIT
+<DTPOSTED>20191225
+<TRNAMT>+200,000
+<FITID>A002
+<NAME>給与
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>DEBIT
+<DTPOSTED>20191226
+<TRNAMT>-3000
+<FITID>A003
+<MEMO>振込 &amp; 手数料
+</STMTTRN>
+</BANKTRANLIST>
+</STMTRS>
+</STMTTRNRS>
+</BANKMSGSRSV1>
+</OFX>
+`
+
+const testOFX2 = `<?xml version="1.0" encoding="UTF-8"?>
+<?OFX OFXHEADER="200" VERSION="220"?>
+<OFX>
+  <CREDITCARDMSGSRSV1><CCSTMTTRNRS><CCSTMTRS>
+    <CURDEF>USD</CURDEF>
+    <CCACCTFROM><ACCTID>9999</ACCTID></CCACCTFROM>
+    <BANKTRANLIST>
+      <STMTTRN><TRNTYPE>DEBIT</TRNTYPE><DTPOSTED>20191205</DTPOSTED><TRNAMT>-12.50</TRNAMT>
+        <FITID>X1</FITID><NAME>Book</NAME><MEMO></MEMO></STMTTRN>
+    </BANKTRANLIST>
+  </CCSTMTRS></CCSTMTTRNRS></CREDITCARDMSGSRSV1>
+</OFX>
+`
+
+func TestParseOFX(t *testing.T) {
+	statements, err := parseOFX(strings.NewReader(testOFX1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statements) != 1 || statements[0].accountID != "1234567" || statements[0].currency != "JPY" {
+		t.Fatalf("明細が違う: %+v", statements)
+	}
+
+	entries := statements[0].entries
+	if len(entries) != 3 {
+		t.Fatal("len(entries) != 3:", len(entries))
+	}
+
+	d := entries[0]
+	if d.date.Format("2006-01-02") != "2019-12-10" || d.amount != "-1200.00" || d.fitID != "A001" || d.note != "イオン東店" {
+		t.Errorf("SGML, got = %+v", d)
+	}
+
+	if entries[2].note != "振込 & 手数料" {
+		t.Errorf("MEMO, got = %+v", entries[2])
+	}
+
+	statements, err = parseOFX(strings.NewReader(testOFX2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statements) != 1 || statements[0].accountID != "9999" || statements[0].currency != "USD" ||
+		len(statements[0].entries) != 1 || statements[0].entries[0].note != "Book" {
+		t.Fatalf("XML, got = %+v", statements)
+	}
+
+	if _, err := parseOFX(strings.NewReader("日付,摘要\n")); err == nil {
+		t.Error("OFXではないのでエラーになるはず")
+	}
+}
+
+func TestParseQIF(t *testing.T) {
+	src := `!Option:AutoSwitch
+!Account
+NAカード
+TCCard
+^
+!Clear:AutoSwitch
+!Account
+NAカード
+TCCard
+^
+!Type:CCard
+D12/ 5'19
+T-1,500.00
+P書店
+LDiningOut
+^
+D2019/12/20
+U5,000
+T5,000
+M引落し
+L[A銀行]
+^
+!Type:Cat
+NDiningOut
+E
+^
+`
+
+	statements, err := parseQIF(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statements) != 1 || statements[0].accountID != "Aカード" || len(statements[0].entries) != 2 {
+		t.Fatalf("明細が違う: %+v", statements)
+	}
+
+	d := statements[0].entries[0]
+	if d.date.Format("2006-01-02") != "2019-12-05" || d.amount != "-1,500.00" || d.note != "書店" {
+		t.Errorf("got = %+v", d)
+	}
+
+	d = statements[0].entries[1]
+	if d.date.Format("2006-01-02") != "2019-12-20" || d.note != "引落し" || d.category != "A銀行" {
+		t.Errorf("got = %+v", d)
+	}
+
+	if _, err := parseQIF(strings.NewReader("!Type:Bank\nD13/45/2019\nT100\n^\n")); err == nil {
+		t.Error("日付が不正なのでエラーになるはず")
+	}
+}
+
+func TestParseStatementAmount(t *testing.T) {
+	tests := []struct {
+		s        string
+		currency string
+		res      int
+		isErr    bool
+	}{
+		{"-1200.00", "JPY", -1200, false},
+		{"+200,000", "JPY", 200000, false},
+		{"12.50", "USD", 1250, false},
+		{"12.345", "USD", 0, true},
+		{"1200.5", "JPY", 0, true},
+		{"", "JPY", 0, true},
+	}
+
+	for _, tt := range tests {
+		res, err := parseStatementAmount(tt.s, tt.currency)
+
+		if tt.isErr {
+			if err == nil {
+				t.Errorf("parseStatementAmount(%s) エラーになるはず", tt.s)
+			}
+		} else if err != nil || res != tt.res {
+			t.Errorf("parseStatementAmount(%s), got = %d, %v", tt.s, res, err)
+		}
+	}
+}
+
+func TestReadStatementTransactions(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	db, err := setupAccounts()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAddImportRule(db, []string{"^イオン", "食費"}); err != nil {
+		t.Fatal(err)
+	}
+
+	configData.StatementAccounts = map[string]string{"1234567": "A銀行"}
+	defer func() { configData.StatementAccounts = nil }()
+
+	// 明細は Shift_JIS
+	b, err := ioutil.ReadAll(transform.NewReader(strings.NewReader(testOFX1), japanese.ShiftJIS.NewEncoder()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readStatementTransactions(db, bytes.NewReader(b), statementFormatOFX, "", "雑費", false); err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err := getTransactions(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != 3 {
+		t.Fatal("len(transactions) != 3:", len(transactions))
+	}
+
+	for _, tr := range transactions {
+		switch tr.note {
+		case "イオン東店":
+			if tr.debit().name != "食費" || tr.credit().name != "A銀行" || tr.amount() != 1200 {
+				t.Errorf("イオン東店, got = %v", &tr)
+			}
+		case "給与":
+			if tr.debit().name != "A銀行" || tr.credit().name != "雑費" || tr.amount() != 200000 {
+				t.Errorf("給与, got = %v", &tr)
+			}
+		case "振込 & 手数料":
+			if tr.debit().name != "雑費" || tr.credit().name != "A銀行" || tr.amount() != 3000 {
+				t.Errorf("振込, got = %v", &tr)
+			}
+		default:
+			t.Errorf("got = %v", &tr)
+		}
+	}
+
+	// 摘要を変えても FITID が同じなら追加されない
+	buf := new(bytes.Buffer)
+	stdout = buf
+
+	src := strings.Replace(testOFX1, "イオン東店", "イオン", 1)
+
+	if err := readStatementTransactions(db, strings.NewReader(src), statementFormatOFX, "", "雑費", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "追加: 0, 重複: 3") {
+		t.Errorf("再インポート, got = %s", buf.String())
+	}
+
+	// FITID が長くても外部IDの列に入る
+	long := strings.Replace(testOFX1, "<TRNAMT>-1200.00\n<FITID>A001", "<TRNAMT>-1300\n<FITID>"+strings.Repeat("9", 255), 1)
+
+	for _, want := range []string{"追加: 1, 重複: 2", "追加: 0, 重複: 3"} {
+		buf.Reset()
+
+		if err := readStatementTransactions(db, strings.NewReader(long), statementFormatOFX, "", "雑費", false); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("長い FITID, got = %s", buf.String())
+		}
+	}
+
+	var maxLen int
+	if err := db.QueryRow("SELECT MAX(LENGTH(external_id)) FROM transactions_import").Scan(&maxLen); err != nil {
+		t.Fatal(err)
+	}
+
+	if maxLen > maxExternalIDLen {
+		t.Error("外部IDが長すぎる:", maxLen)
+	}
+
+	// 口座が対応づけられてない
+	configData.StatementAccounts = nil
+
+	if err := readStatementTransactions(db, strings.NewReader(testOFX1), statementFormatOFX, "", "雑費", true); err == nil {
+		t.Error("勘定科目がないのでエラーになるはず")
+	}
+
+	if err := readStatementTransactions(db, strings.NewReader(testOFX1), statementFormatOFX, "食費", "雑費", true); err == nil {
+		t.Error("資産か負債でないのでエラーになるはず")
+	}
+
+	// QIF は分類と同じ名前の勘定科目を相手にする
+	qif := "!Type:CCard\nD2019/12/20\nT5000\nP引落し\nL[A銀行]\n^\nD2019/12/21\nT-800\nP書店\n^\n"
+
+	if err := readStatementTransactions(db, strings.NewReader(qif), statementFormatQIF, "Aカード", "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "追加: 1, 重複: 0, 競合: 0, スキップ: 1") {
+		t.Errorf("QIF, got = %s", buf.String())
+	}
+
+	// 分類や規則が明細の勘定科目自身なら、相手にしないで仮勘定にする
+	if err := runAddImportRule(db, []string{"^年会費", "Aカード"}); err != nil {
+		t.Fatal(err)
+	}
+
+	qif = "!Type:CCard\nD2019/12/22\nT-700\nP年会費\nL[Aカード]\n^\nD2019/12/23\nT-900\nP年会費2\n^\n"
+
+	buf.Reset()
+
+	if err := readStatementTransactions(db, strings.NewReader(qif), statementFormatQIF, "Aカード", "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "追加: 0, 重複: 0, 競合: 0, スキップ: 2") {
+		t.Errorf("自分自身, got = %s", buf.String())
+	}
+
+	if err := readStatementTransactions(db, strings.NewReader(qif), statementFormatQIF, "Aカード", "雑費", false); err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err = findTransactions(db, []string{"年会費"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != 2 {
+		t.Fatal("len(transactions) != 2:", len(transactions))
+	}
+
+	for _, tr := range transactions {
+		if tr.debit().name != "雑費" || tr.credit().name != "Aカード" {
+			t.Errorf("自分自身, got = %v", &tr)
+		}
+	}
+}
+
+func TestStatementRepeatedFITID(t *testing.T) {
+	stdout = new(bytes.Buffer)
+	stderr = new(bytes.Buffer)
+
+	db, err := setupAccounts()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configData.StatementAccounts = map[string]string{"1234567": "A銀行"}
+	defer func() { configData.StatementAccounts = nil }()
+
+	// 期間が重なった明細をまとめたファイルでは、同じ FITID が繰り返される
+	repeated := strings.Replace(testOFX1, "</BANKTRANLIST>",
+		"<STMTTRN>\n<TRNTYPE>CREDIT\n<DTPOSTED>20191225\n<TRNAMT>+200,000\n<FITID>A002\n<NAME>給与\n</STMTTRN>\n</BANKTRANLIST>", 1)
+
+	buf := new(bytes.Buffer)
+	stdout = buf
+
+	if err := readStatementTransactions(db, strings.NewReader(repeated), statementFormatOFX, "", "雑費", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "追加: 3, 重複: 1") {
+		t.Errorf("繰り返した FITID, got = %s", buf.String())
+	}
+
+	countTransactions := func() int {
+		transactions, err := getTransactions(db, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(transactions)
+	}
+
+	if n := countTransactions(); n != 3 {
+		t.Fatal("len(transactions) != 3:", n)
+	}
+
+	// インポートを UNDO して REDO しても、再インポートで二重にならない
+	if _, err := dbRecordOperation(db, "import statement", operationNormal, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		sqlStr string
+		isUndo bool
+		want   int
+	}{
+		{sqlGetUndoTarget, true, 0},
+		{sqlGetRedoTarget, false, 3},
+	} {
+		op, err := dbGetOperation1(db, c.sqlStr)
+		if err != nil || op == nil {
+			t.Fatal("操作がない:", err)
+		}
+
+		if _, err := undoOperation(db, op, c.isUndo); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := countTransactions(); n != c.want {
+			t.Fatalf("isUndo = %v, len(transactions) = %d", c.isUndo, n)
+		}
+	}
+
+	// 摘要が変わっていても FITID で重複とわかる
+	buf.Reset()
+
+	src := strings.Replace(testOFX1, "イオン東店", "イオン", 1)
+
+	if err := readStatementTransactions(db, strings.NewReader(src), statementFormatOFX, "", "雑費", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "追加: 0, 重複: 3") {
+		t.Errorf("REDO のあとの再インポート, got = %s", buf.String())
+	}
+}
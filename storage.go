@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"os"
+	"runtime"
+)
+
+/*
+データベースの違いを吸収する
+
+設定ファイルの [database] の driver で PostgreSQL(postgres)か SQLite(sqlite)を選ぶ。
+環境変数 MITA_DB_DRIVER があれば、そちらを優先する。
+
+SQL はどちらのデータベースでも同じものを使う。
+集計テーブルの更新のように SQL だけでは同じにできない処理をこのインタフェースにまとめる。
+*/
+type storage interface {
+	// データベースへ接続する
+	open(name string) (*sql.DB, error)
+
+	// テーブル等を作成する SQL のファイル名(mita data で出力できる)
+	schemaFile() string
+
+	// テーブルが存在するか
+	hasTable(db *sql.DB, name string) (bool, error)
+
+	// ID を指定して行を追加したあとに、次に自動で振る ID を最大値の次にする
+	resetSerial(tx dbtx, table string, column string) error
+
+	// 現在月まで transactions_summary に全科目のデータを追加する
+	addCurrentSummary(db *sql.DB) error
+}
+
+var storages = map[string]storage{
+	"postgres": &pgStorage{},
+	"sqlite":   &sqliteStorage{},
+}
+
+func storageName() string {
+	if s := os.Getenv("MITA_DB_DRIVER"); s != "" {
+		return s
+	}
+
+	if configData.DB.Driver == "" {
+		return defaultDBDriver
+	}
+
+	return configData.DB.Driver
+}
+
+func getStorage() (storage, error) {
+	name := storageName()
+
+	st, ok := storages[name]
+	if !ok {
+		return nil, fmt.Errorf("未対応のデータベース'%s'。postgres か sqlite", name)
+	}
+
+	return st, nil
+}
+
+// PostgreSQL
+type pgStorage struct{}
+
+const pgDomain = "/var/run/postgresql/"
+
+func (st *pgStorage) open(name string) (*sql.DB, error) {
+	if runtime.GOOS != "windows" {
+		if _, err := os.Stat(pgDomain); err == nil {
+			/* peer認証で接続するために、hostを指定して
+			   UNIXドメインで接続してみる */
+			db, err := sql.Open("postgres",
+				fmt.Sprintf("host=%s dbname=%s sslmode=disable%s", pgDomain, name, pgSessionOptions()))
+			if err == nil {
+				return db, nil
+			}
+		}
+	}
+
+	var dataSrcName string
+
+	user := configData.DB.User
+	password := configData.DB.Password
+
+	if user != "" {
+		dataSrcName = fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", user, password, name)
+	} else {
+		dataSrcName = fmt.Sprintf("dbname=%s sslmode=disable", name)
+	}
+
+	return sql.Open("postgres", dataSrcName+pgSessionOptions())
+}
+
+// 履歴をトリガーでこのプロセスの操作に入れるために、接続ごとに mita.session を設定する
+func pgSessionOptions() string {
+	return fmt.Sprintf(" options='-c mita.session=%s'", operationSession)
+}
+
+func (st *pgStorage) schemaFile() string {
+	return "schema.sql"
+}
+
+func (st *pgStorage) hasTable(db *sql.DB, name string) (bool, error) {
+	var n int
+
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.tables
+WHERE table_schema = current_schema() AND table_name = $1`, name).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n != 0, nil
+}
+
+func (st *pgStorage) resetSerial(tx dbtx, table string, column string) error {
+	_, err := tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', '%s'), COALESCE((SELECT MAX(%s) FROM %s), 0) + 1, false)",
+		table, column, column, table))
+
+	return err
+}
+
+func (st *pgStorage) addCurrentSummary(db *sql.DB) error {
+	_, err := db.Exec("SELECT add_current_transactions_summary()")
+
+	return err
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+SQLite
+
+1つのファイルにすべてを保存するので、データベースサーバーがいらない。
+ファイルは設定ファイルの [database] の path で指定する(省略すると設定ディレクトリの<name>.db)。
+ファイルにテーブルがなければ schema_sqlite.sql で作成する。
+
+SQL は PostgreSQL と同じものを使うので、go-sqlite3 のドライバーを包んで以下のことを行う。
+
+・プレースホルダの $1 を ?1 に書き換え、FOR UPDATE を取り除く
+・取引の ID を、削除した取引の ID と重ならないように振る
+・日付を 'YYYY-MM-DD' の文字列として保存する
+・コミット時に、PostgreSQL ではトリガーで行っている貸借の確認、履歴の追加、月ごとの集計を行う
+・履歴は、このプロセスのまとめ途中の操作(operationSession)に入れる
+
+トランザクションの外で実行した INSERT, UPDATE, DELETE は、
+それだけのトランザクションとして実行してコミット時の処理を行う。
+*/
+type sqliteStorage struct{}
+
+const sqliteDriverName = "mita_sqlite3"
+
+func init() {
+	sql.Register(sqliteDriverName, &sqliteDriver{})
+}
+
+func (st *sqliteStorage) open(name string) (*sql.DB, error) {
+	path := configData.DB.Path
+	if path == "" {
+		path = filepath.Join(getConfigDir(), name+".db")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	return sql.Open(sqliteDriverName,
+		"file:"+path+"?_foreign_keys=1&_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL")
+}
+
+func (st *sqliteStorage) hasTable(db *sql.DB, name string) (bool, error) {
+	var n int
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1", name).Scan(&n); err != nil {
+		return false, err
+	}
+
+	return n != 0, nil
+}
+
+// INTEGER PRIMARY KEY は最大値の次が振られるので何もしない
+func (st *sqliteStorage) resetSerial(tx dbtx, table string, column string) error {
+	return nil
+}
+
+func (st *sqliteStorage) schemaFile() string {
+	return "schema_sqlite.sql"
+}
+
+// 集計データがある科目について、最後の月から現在月までのデータを追加する
+const sqlSQLiteAddCurrentSummary = `
+WITH RECURSIVE last AS (
+    SELECT account_id, MAX(month) AS month
+    FROM transactions_summary
+    GROUP BY account_id
+    HAVING MAX(month) < $1
+), months (account_id, month) AS (
+    SELECT account_id, month FROM last
+    UNION ALL
+    SELECT account_id, CASE WHEN month % 100 = 12 THEN month + 89 ELSE month + 1 END
+    FROM months
+    WHERE month < $1
+)
+INSERT INTO transactions_summary
+SELECT m.account_id, m.month, 0, 0, ts.accrual_accum_diff, 0, 0, ts.cash_accum_diff
+FROM months AS m
+JOIN last ON m.account_id = last.account_id
+JOIN transactions_summary AS ts ON last.account_id = ts.account_id AND last.month = ts.month
+WHERE m.month > last.month
+`
+
+func (st *sqliteStorage) addCurrentSummary(db *sql.DB) error {
+	_, err := db.Exec(sqlSQLiteAddCurrentSummary, time2month(time.Now()))
+
+	return err
+}
+
+type sqliteDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+func (d *sqliteDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteConn{SQLiteConn: conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type sqliteConn struct {
+	*sqlite3.SQLiteConn
+	inTx bool
+}
+
+var rePlaceholder = regexp.MustCompile(`\$(\d+)`)
+var reForUpdate = regexp.MustCompile(`(?i)\s+FOR\s+UPDATE\b`)
+
+/*
+取引を追加する SQL
+SQLite は最大の ID の行を削除すると同じ ID を振り直すので、履歴と重なってしまう。
+PostgreSQL のシーケンスと同じように、履歴に残っている ID より大きい ID を振る。
+*/
+const sqliteAddTransaction = `
+INSERT INTO transactions(transaction_id, date, description, start_month, end_month)
+VALUES(MAX(COALESCE((SELECT MAX(transaction_id) FROM transactions), 0),
+           COALESCE((SELECT MAX(transaction_id) FROM transactions_history), 0),
+           COALESCE((SELECT MAX(transaction_id) FROM transactions_dirty), 0)) + 1,
+       $1, $2, $3, $4)
+RETURNING transaction_id
+`
+
+// SQLite では別の SQL で実行するもの
+var sqliteQueries = map[string]string{
+	sqlAddTransaction: sqliteAddTransaction,
+}
+
+// PostgreSQL 用の SQL を SQLite で実行できるように書き換える
+func sqliteQuery(query string) string {
+	if s, ok := sqliteQueries[query]; ok {
+		query = s
+	}
+
+	query = rePlaceholder.ReplaceAllString(query, "?$1")
+
+	return reForUpdate.ReplaceAllString(query, "")
+}
+
+func isWriteQuery(query string) bool {
+	s := strings.ToUpper(strings.TrimSpace(query))
+
+	return strings.HasPrefix(s, "INSERT") || strings.HasPrefix(s, "UPDATE") || strings.HasPrefix(s, "DELETE")
+}
+
+func (c *sqliteConn) Prepare(query string) (driver.Stmt, error) {
+	return c.SQLiteConn.Prepare(sqliteQuery(query))
+}
+
+func (c *sqliteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.SQLiteConn.PrepareContext(ctx, sqliteQuery(query))
+}
+
+func (c *sqliteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.SQLiteConn.QueryContext(ctx, sqliteQuery(query), args)
+}
+
+func (c *sqliteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	query = sqliteQuery(query)
+
+	if c.inTx || !isWriteQuery(query) {
+		return c.SQLiteConn.ExecContext(ctx, query, args)
+	}
+
+	tx, err := c.BeginTx(ctx, driver.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (c *sqliteConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *sqliteConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.SQLiteConn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c.inTx = true
+
+	return &sqliteTx{c, tx}, nil
+}
+
+// 日付は 'YYYY-MM-DD'、時刻があれば 'YYYY-MM-DD HH:MM:SS.SSS' の文字列にする
+func (c *sqliteConn) CheckNamedValue(nv *driver.NamedValue) error {
+	v := nv.Value
+
+	if vr, ok := v.(driver.Valuer); ok {
+		var err error
+
+		if v, err = vr.Value(); err != nil {
+			return err
+		}
+	}
+
+	t, ok := v.(time.Time)
+	if !ok {
+		return driver.ErrSkip
+	}
+
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+		nv.Value = t.Format("2006-01-02")
+	} else {
+		nv.Value = t.Format("2006-01-02 15:04:05.000")
+	}
+
+	return nil
+}
+
+type sqliteTx struct {
+	c  *sqliteConn
+	tx driver.Tx
+}
+
+func (t *sqliteTx) Commit() error {
+	defer func() { t.c.inTx = false }()
+
+	if err := t.c.flush(); err != nil {
+		t.tx.Rollback()
+		return err
+	}
+
+	return t.tx.Commit()
+}
+
+func (t *sqliteTx) Rollback() error {
+	defer func() { t.c.inTx = false }()
+
+	return t.tx.Rollback()
+}
+
+func (c *sqliteConn) exec(query string, args ...interface{}) error {
+	_, err := c.SQLiteConn.ExecContext(context.Background(), query, namedValues(args))
+
+	return err
+}
+
+// すべての行を読む。整数は int64、文字列は string になる
+func (c *sqliteConn) query(query string, args ...interface{}) ([][]driver.Value, error) {
+	rows, err := c.SQLiteConn.QueryContext(context.Background(), query, namedValues(args))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res [][]driver.Value
+
+	for {
+		row := make([]driver.Value, len(rows.Columns()))
+
+		if err := rows.Next(row); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		res = append(res, row)
+	}
+
+	return res, nil
+}
+
+func namedValues(args []interface{}) []driver.NamedValue {
+	nv := make([]driver.NamedValue, len(args))
+
+	for i, v := range args {
+		nv[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+
+	return nv
+}
+
+func int64Value(v driver.Value) int64 {
+	n, _ := v.(int64)
+
+	return n
+}
+
+func textValue(v driver.Value) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	}
+
+	return ""
+}
+
+// コミット前に、変更された取引について PostgreSQL の遅延トリガーと同じ処理を行う
+func (c *sqliteConn) flush() error {
+	rows, err := c.query("SELECT transaction_id, operation FROM transactions_dirty ORDER BY transaction_id")
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if err := c.updateDirtyTransaction(int64Value(row[0]), textValue(row[1])); err != nil {
+			return err
+		}
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return c.exec("DELETE FROM transactions_dirty")
+}
+
+func (c *sqliteConn) updateDirtyTransaction(id int64, operation string) error {
+	rows, err := c.query("SELECT 1 FROM transactions WHERE transaction_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	exists := len(rows) != 0
+
+	if exists {
+		if err := c.checkBalance(id); err != nil {
+			return err
+		}
+	}
+
+	if operation == "" {
+		// 明細だけの変更
+		return nil
+	}
+
+	if exists && operation != "D" {
+		if err := c.addHistory(id, operation); err != nil {
+			return err
+		}
+	} else if !exists {
+		if err := c.setDeleteHistoryOperation(id); err != nil {
+			return err
+		}
+	}
+
+	if err := c.removeTransactionMonth(id); err != nil {
+		return err
+	}
+
+	if !exists {
+		return nil
+	}
+
+	return c.addTransactionMonth(id)
+}
+
+// 取引の借方金額の合計と貸方金額の合計が一致するか確認する
+func (c *sqliteConn) checkBalance(id int64) error {
+	rows, err := c.query(`
+SELECT COUNT(*), COALESCE(SUM(debit_amount - credit_amount), 0)
+FROM transactions_detail
+WHERE transaction_id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	if n := int64Value(rows[0][0]); n < 2 {
+		return fmt.Errorf("transaction %d must have at least 2 lines", id)
+	}
+
+	if diff := int64Value(rows[0][1]); diff != 0 {
+		return fmt.Errorf("transaction %d is not balanced: debit - credit = %d", id, diff)
+	}
+
+	return nil
+}
+
+// このプロセスのまとめ途中の操作のID。なければ追加する
+func (c *sqliteConn) currentOperationID() (int64, error) {
+	rows, err := c.query("SELECT operation_id FROM operations WHERE session = ?", operationSession)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(rows) != 0 {
+		return int64Value(rows[0][0]), nil
+	}
+
+	err = c.exec(`
+INSERT INTO operations (operate_time, command, kind, session)
+VALUES (strftime('%Y-%m-%d %H:%M:%f', 'now', 'localtime'), '', 'N', ?)`, operationSession)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err = c.query("SELECT last_insert_rowid()")
+	if err != nil {
+		return 0, err
+	}
+
+	return int64Value(rows[0][0]), nil
+}
+
+// 履歴テーブルへ取引と明細を追加する
+func (c *sqliteConn) addHistory(id int64, operation string) error {
+	operationID, err := c.currentOperationID()
+	if err != nil {
+		return err
+	}
+
+	err = c.exec(`
+INSERT INTO transactions_history (operation, operate_time, transaction_id, version, date, description, start_month, end_month,
+    operation_id, tags)
+SELECT ?2, strftime('%Y-%m-%d %H:%M:%f', 'now', 'localtime'), transaction_id, version, date, description, start_month, end_month,
+       ?3, COALESCE((SELECT tags FROM transaction_tags_view WHERE transaction_id = ?1), '')
+FROM transactions
+WHERE transaction_id = ?1`, id, operation, operationID)
+	if err != nil {
+		return err
+	}
+
+	return c.exec(`
+INSERT INTO transactions_detail_history (transaction_id, version, no, account_id,
+    debit_amount, credit_amount, currency_amount, rate)
+SELECT td.transaction_id, tr.version, td.no, td.account_id, td.debit_amount, td.credit_amount, td.currency_amount, td.rate
+FROM transactions_detail AS td
+JOIN transactions AS tr ON td.transaction_id = tr.transaction_id
+WHERE td.transaction_id = ?`, id)
+}
+
+// 削除の履歴はトリガーで追加されるので、このトランザクションで追加された最新の履歴に操作を設定する
+func (c *sqliteConn) setDeleteHistoryOperation(id int64) error {
+	operationID, err := c.currentOperationID()
+	if err != nil {
+		return err
+	}
+
+	return c.exec(`
+UPDATE transactions_history
+SET operation_id = ?2
+WHERE transaction_id = ?1 AND operation = 'D' AND operation_id IS NULL AND
+      version = (SELECT MAX(version) FROM transactions_history WHERE transaction_id = ?1)`, id, operationID)
+}
+
+/*
+取引を月ごとに分ける
+
+取引に開始月と終了月が指定されている場合は、
+発生主義の金額を計算するために、明細ごとに金額を期間内の各月に振り分ける。
+*/
+func (c *sqliteConn) addTransactionMonth(id int64) error {
+	rows, err := c.query(`
+SELECT CAST(strftime('%Y%m', date) AS integer), start_month, end_month
+FROM transactions
+WHERE transaction_id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	month := int(int64Value(rows[0][0]))
+	start := int(int64Value(rows[0][1]))
+	end := int(int64Value(rows[0][2]))
+
+	lines, err := c.query(`
+SELECT account_id, debit_amount, credit_amount
+FROM transactions_detail
+WHERE transaction_id = ?
+ORDER BY no`, id)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		accountID := int64Value(line[0])
+
+		amounts, err := splitLine(month, start, end, int(int64Value(line[1])), int(int64Value(line[2])))
+		if err != nil {
+			return err
+		}
+
+		for _, a := range amounts {
+			err := c.addMonth(id, accountID, int64(a.month), int64(a.accrualDebit), int64(a.accrualCredit),
+				int64(a.cashDebit), int64(a.cashCredit))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *sqliteConn) addMonth(id int64, accountID int64, month int64,
+	accrualDebit int64, accrualCredit int64, cashDebit int64, cashCredit int64) error {
+	if err := c.prepareSummary(accountID, month); err != nil {
+		return err
+	}
+
+	err := c.exec(`
+INSERT INTO transactions_month (transaction_id, account_id, month,
+    accrual_debit_amount, accrual_credit_amount, cash_debit_amount, cash_credit_amount)
+VALUES (?, ?, ?, ?, ?, ?, ?)`, id, accountID, month, accrualDebit, accrualCredit, cashDebit, cashCredit)
+	if err != nil {
+		return err
+	}
+
+	return c.updateSummary(accountID, month, accrualDebit, accrualCredit, cashDebit, cashCredit)
+}
+
+func (c *sqliteConn) removeTransactionMonth(id int64) error {
+	rows, err := c.query(`
+SELECT account_id, month, accrual_debit_amount, accrual_credit_amount, cash_debit_amount, cash_credit_amount
+FROM transactions_month
+WHERE transaction_id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		err := c.updateSummary(int64Value(row[0]), int64Value(row[1]),
+			-int64Value(row[2]), -int64Value(row[3]), -int64Value(row[4]), -int64Value(row[5]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.exec("DELETE FROM transactions_month WHERE transaction_id = ?", id)
+}
+
+// 集計するための行がなければ作る
+func (c *sqliteConn) prepareSummary(accountID int64, month int64) error {
+	rows, err := c.query("SELECT 1 FROM transactions_summary WHERE account_id = ? AND month = ?", accountID, month)
+	if err != nil || len(rows) != 0 {
+		return err
+	}
+
+	rows, err = c.query(`
+SELECT month, accrual_accum_diff, cash_accum_diff
+FROM transactions_summary
+WHERE account_id = ? AND month < ?
+ORDER BY month DESC
+LIMIT 1`, accountID, month)
+	if err != nil {
+		return err
+	}
+
+	if len(rows) != 0 {
+		// 過去の集計データがある場合
+		from := int64(nextMonth(int(int64Value(rows[0][0]))))
+
+		return c.insertSummary(accountID, from, month, int64Value(rows[0][1]), int64Value(rows[0][2]))
+	}
+
+	rows, err = c.query(`
+SELECT month
+FROM transactions_summary
+WHERE account_id = ? AND month > ?
+ORDER BY month
+LIMIT 1`, accountID, month)
+	if err != nil {
+		return err
+	}
+
+	if len(rows) != 0 {
+		// 未来の集計データがある場合
+		to := int64(subtractMonth(int(int64Value(rows[0][0])), 1))
+
+		return c.insertSummary(accountID, month, to, 0, 0)
+	}
+
+	// 過去にも未来にも指定した勘定科目の集計データがない場合
+	return c.insertSummary(accountID, month, month, 0, 0)
+}
+
+func (c *sqliteConn) insertSummary(accountID int64, from int64, to int64, accrualAccum int64, cashAccum int64) error {
+	for m := from; m <= to; m = int64(nextMonth(int(m))) {
+		err := c.exec("INSERT INTO transactions_summary VALUES (?, ?, 0, 0, ?, 0, 0, ?)",
+			accountID, m, accrualAccum, cashAccum)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 集計データに金額を加える。取り消す場合は負の金額を渡す
+func (c *sqliteConn) updateSummary(accountID int64, month int64,
+	accrualDebit int64, accrualCredit int64, cashDebit int64, cashCredit int64) error {
+	err := c.exec(`
+UPDATE transactions_summary
+SET accrual_debit_amount  = accrual_debit_amount  + ?3,
+    accrual_credit_amount = accrual_credit_amount + ?4,
+    cash_debit_amount     = cash_debit_amount     + ?5,
+    cash_credit_amount    = cash_credit_amount    + ?6
+WHERE account_id = ?1 AND month = ?2`, accountID, month, accrualDebit, accrualCredit, cashDebit, cashCredit)
+	if err != nil {
+		return err
+	}
+
+	return c.exec(`
+UPDATE transactions_summary
+SET accrual_accum_diff = accrual_accum_diff + ?3,
+    cash_accum_diff    = cash_accum_diff    + ?4
+WHERE account_id = ?1 AND month >= ?2`, accountID, month, accrualDebit-accrualCredit, cashDebit-cashCredit)
+}
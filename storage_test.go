@@ -0,0 +1,193 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSqliteQuery(t *testing.T) {
+	s := sqliteQuery("SELECT last_date FROM schedules WHERE schedule_id = $1 AND name = $12\nFOR UPDATE\n")
+	if s != "SELECT last_date FROM schedules WHERE schedule_id = ?1 AND name = ?12\n" {
+		t.Errorf("got = '%s'", s)
+	}
+}
+
+func TestGetStorage(t *testing.T) {
+	defer func(driver string) { configData.DB.Driver = driver }(configData.DB.Driver)
+
+	configData.DB.Driver = "mysql"
+
+	if storageName() == "mysql" {
+		if _, err := getStorage(); err == nil {
+			t.Error("未対応のデータベースなのでエラーになるはず")
+		}
+	}
+}
+
+// 貸借が一致しない取引はコミットできない
+func TestUnbalancedTransaction(t *testing.T) {
+	db, err := setupAccounts()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tr transaction
+	tr.date = ymd(2019, 12, 10)
+	tr.items = []transactionItem{
+		{account: accounts[0], debit: 1000},
+		{account: accounts[1], credit: 900},
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbAddTransaction(tx, &tr); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err == nil {
+		t.Fatal("貸借が一致しないのでエラーになるはず")
+	}
+
+	transactions, err := getTransactions(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != 0 {
+		t.Fatal("len(transactions) != 0:", len(transactions))
+	}
+}
+
+// 期間を指定した取引は各月に振り分けられる
+func TestTransactionMonths(t *testing.T) {
+	db, err := setupAccounts()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac := make(map[string]account)
+	for _, a := range accounts {
+		ac[a.name] = a
+	}
+
+	var tr transaction
+	tr.date = ymd(2019, 11, 25)
+	tr.start = 201912
+	tr.end = 202002
+	tr.items = []transactionItem{
+		{account: ac["自動車"], debit: 10000},
+		{account: ac["現金"], credit: 10000},
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbAddTransaction(tx, &tr); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []struct {
+		month   int
+		accrual int
+		cash    int
+	}{{201911, 0, -10000}, {201912, -3334, 0}, {202001, -3334, 0}, {202002, -3332, 0}} {
+		pl, err := dbGetPL(db, false, m.month, m.month)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cash, err := dbGetPL(db, true, m.month, m.month)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a := sumSummaries(pl); a != m.accrual {
+			t.Errorf("%d accrual, got = %d", m.month, a)
+		}
+
+		if c := sumSummaries(cash); c != m.cash {
+			t.Errorf("%d cash, got = %d", m.month, c)
+		}
+	}
+}
+
+func sumSummaries(p2d map[int][]summary) int {
+	sum := 0
+
+	for _, items := range p2d {
+		for _, d := range items {
+			sum += d.balance
+		}
+	}
+
+	return sum
+}
+
+// 最後の取引を削除しても、その ID は次の取引に振り直さない
+func TestTransactionIDNotReused(t *testing.T) {
+	db, err := setupAccounts()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAddTransaction(db, []string{"2019-12-10", "食費", "現金", "500", "削除する"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err := getTransactions(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != 1 {
+		t.Fatal("len(transactions) != 1:", len(transactions))
+	}
+
+	removedID := transactions[0].id
+
+	if err := dbRemoveTransaction(db, removedID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAddTransaction(db, []string{"2019-12-11", "食費", "現金", "700", "追加する"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err = getTransactions(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != 1 || transactions[0].id <= removedID {
+		t.Fatal("削除した取引の ID が振り直された:", transactions)
+	}
+}
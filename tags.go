@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+タグ
+
+勘定科目とは別の切り口で取引をまとめるために、取引にタグを付ける。
+例えば旅行の食費、交通費、宿泊費に同じタグを付けると、旅行の費用をまとめて集計できる。
+タグは空白を含まない名前で、TSV や表示では空白で区切って並べる。
+*/
+const maxTagLen = 32
+
+// 空白かカンマで区切ったタグを解析して、重複を除いて名前順に並べる
+func str2tags(s string) ([]string, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ','
+	})
+
+	return normalizeTags(fields)
+}
+
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var items []string
+
+	for _, tag := range tags {
+		tag = strings.TrimPrefix(tag, "#")
+
+		if tag == "" {
+			continue
+		}
+
+		if utf8.RuneCountInString(tag) > maxTagLen {
+			return nil, fmt.Errorf("タグ'%s'が%d文字より長い", tag, maxTagLen)
+		}
+
+		if strings.IndexFunc(tag, unicode.IsSpace) != -1 || strings.Contains(tag, ",") {
+			return nil, fmt.Errorf("タグ'%s'に空白かカンマが含まれている", tag)
+		}
+
+		if !seen[tag] {
+			seen[tag] = true
+			items = append(items, tag)
+		}
+	}
+
+	sort.Strings(items)
+
+	return items, nil
+}
+
+func tags2str(tags []string) string {
+	return strings.Join(tags, " ")
+}
+
+// 表示用のタグ。タグがなければ空文字
+func tags2label(tags []string) string {
+	label := ""
+
+	for _, tag := range tags {
+		label += " #" + tag
+	}
+
+	return label
+}
+
+func scanTags() []string {
+	for {
+		s := scanText("タグ(空白区切り)", 0, 256)
+
+		tags, err := str2tags(s)
+		if err == nil {
+			return tags
+		}
+
+		eprintln("エラー:", err)
+	}
+}
+
+const sqlRemoveTransactionTags = `
+DELETE FROM transactions_tags
+WHERE transaction_id = $1
+`
+
+const sqlAddTag = `
+INSERT INTO tags (name)
+VALUES ($1)
+ON CONFLICT (name) DO NOTHING
+`
+
+const sqlAddTransactionTag = `
+INSERT INTO transactions_tags (transaction_id, tag_id)
+SELECT $1, tag_id
+FROM tags
+WHERE name = $2
+`
+
+// 取引のタグを tags に置き換える。ないタグは追加する
+func dbSetTransactionTags(tx *sql.Tx, id interface{}, tags []string) error {
+	if _, err := tx.Exec(sqlRemoveTransactionTags, id); err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if _, err := tx.Exec(sqlAddTag, tag); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(sqlAddTransactionTag, id, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cmdReportTag(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tag := context.Args().First()
+	if tag == "" {
+		return errors.New("Usage: mita report tag [--cash] [--from month] [--to month] tag")
+	}
+
+	return runReportTag(db, tag, context.Bool("cash"), context.String("from"), context.String("to"))
+}
+
+/*
+タグの付いた取引だけのP/Lを表示する
+
+期間を省略すると、タグの付いた取引がある最初の月から最後の月まで
+*/
+func runReportTag(db *sql.DB, tag string, isCash bool, fromStr string, toStr string) error {
+	from, to, err := dbGetTagMonthRange(db, tag)
+	if err != nil {
+		return err
+	}
+
+	if from == 0 {
+		return fmt.Errorf("タグ'%s'の付いた取引がない", tag)
+	}
+
+	if fromStr != "" {
+		if from, err = str2month(fromStr); err != nil {
+			return fmt.Errorf("開始月:%s", err)
+		}
+	}
+
+	if toStr != "" {
+		if to, err = str2month(toStr); err != nil {
+			return fmt.Errorf("終了月:%s", err)
+		}
+	}
+
+	if from > to {
+		return fmt.Errorf("開始月が終了月より後ろ。開始月 = %s, 終了月 = %s", month2str(from), month2str(to))
+	}
+
+	items, err := dbGetTagGroupedPL(db, tag, isCash, from, to)
+	if err != nil {
+		return err
+	}
+
+	p2d, err := dbGetTagPL(db, tag, isCash, from, to)
+	if err != nil {
+		return err
+	}
+
+	if isRecordOutput() {
+		t := newPLRecordTable()
+		addPLItemRecords(t, from, to, items, p2d)
+
+		return printRecords(t)
+	}
+
+	println("タグ:", tag)
+	println(range2str(from, to))
+	println()
+
+	printPLItems(items, p2d)
+
+	return nil
+}
+
+const sqlGetTagMonthRange = `
+SELECT COALESCE(MIN(month), 0), COALESCE(MAX(month), 0)
+FROM tag_pl_view
+WHERE tag = $1
+`
+
+// タグの付いた取引の収入か費用がある最初の月と最後の月。なければ 0
+func dbGetTagMonthRange(db *sql.DB, tag string) (int, int, error) {
+	var from, to int
+
+	err := db.QueryRow(sqlGetTagMonthRange, tag).Scan(&from, &to)
+
+	return from, to, err
+}
+
+const sqlGetTagGroupedPLFrom = `
+FROM tag_grouped_pl_view AS pl
+JOIN accounts AS ac ON pl.account_id = ac.account_id
+WHERE pl.tag = $3 AND pl.month BETWEEN $1 AND $2
+GROUP BY pl.account_id, pl.account_type, pl.name, pl.is_extraordinary, ac.order_no
+HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0
+ORDER BY pl.account_type, ac.order_no, pl.account_id
+`
+
+const sqlGetTagGroupedPLAccrual = sqlGetGroupedPLSelect + "SUM(pl.accrual_balance)" + sqlGetTagGroupedPLFrom
+
+const sqlGetTagGroupedPLCash = sqlGetGroupedPLSelect + "SUM(pl.cash_balance)" + sqlGetTagGroupedPLFrom
+
+// from から to までの月を合計した、タグの付いた取引だけの親の勘定科目ごとのP/L
+func dbGetTagGroupedPL(db *sql.DB, tag string, isCash bool, from int, to int) ([]summary, error) {
+	var sqlStr string
+	if isCash {
+		sqlStr = sqlGetTagGroupedPLCash
+	} else {
+		sqlStr = sqlGetTagGroupedPLAccrual
+	}
+
+	rows, err := db.Query(sqlStr, from, to, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows2groupedPL(rows)
+}
+
+const sqlGetTagPLFrom = `
+FROM tag_pl_view AS pl
+JOIN accounts AS ac ON pl.account_id = ac.account_id
+WHERE pl.tag = $3 AND pl.month BETWEEN $1 AND $2
+GROUP BY pl.account_id, pl.account_type, pl.name, pl.parent, pl.is_extraordinary, ac.order_no
+HAVING SUM(pl.accrual_balance) <> 0 OR SUM(pl.cash_balance) <> 0
+ORDER BY pl.account_type, ac.order_no, pl.account_id, pl.is_extraordinary
+`
+
+const sqlGetTagPLAccrual = sqlGetPLSelect + "SUM(pl.accrual_balance)" + sqlGetTagPLFrom
+
+const sqlGetTagPLCash = sqlGetPLSelect + "SUM(pl.cash_balance)" + sqlGetTagPLFrom
+
+// from から to までの月を合計した、タグの付いた取引だけの親の勘定科目IDごとの子の勘定科目のP/L
+func dbGetTagPL(db *sql.DB, tag string, isCash bool, from int, to int) (map[int][]summary, error) {
+	var sqlStr string
+	if isCash {
+		sqlStr = sqlGetTagPLCash
+	} else {
+		sqlStr = sqlGetTagPLAccrual
+	}
+
+	rows, err := db.Query(sqlStr, from, to, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows2pl(db, rows)
+}
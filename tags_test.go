@@ -0,0 +1,190 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStr2Tags(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", nil},
+		{"旅行", []string{"旅行"}},
+		{"北海道 旅行,旅行  #出張", []string{"出張", "北海道", "旅行"}},
+	}
+
+	for _, tt := range tests {
+		got, err := str2tags(tt.s)
+		if err != nil {
+			t.Errorf("%q: %s", tt.s, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.s, got, tt.want)
+		}
+	}
+
+	if _, err := str2tags(strings.Repeat("あ", maxTagLen+1)); err == nil {
+		t.Error("長すぎるのでエラーになるはず")
+	}
+}
+
+func TestTags(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 旅行の食費と娯楽にタグを付ける
+	args := []string{"2019-12-20", "食費", "現金", "3000", "旅行の夕食"}
+	if err := runAddTransaction(db, args, []string{"旅行"}); err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name2id := make(map[string]int)
+	id2currency := make(map[int]string)
+
+	for _, d := range accounts {
+		name2id[d.name] = d.id
+		id2currency[d.id] = d.currency
+	}
+
+	d, err := arr2transaction(name2id, id2currency,
+		strings.Split("2020-01-05\t娯楽\t現金\t5000\t旅行の入場料\t0\t0\t\t旅行 北海道", "\t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbAddTransaction(tx, d); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := findTransactions(db, []string{"tag:旅行"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 2 {
+		t.Fatal("len(found) != 2:", len(found))
+	}
+
+	if !reflect.DeepEqual(found[1].tags, []string{"北海道", "旅行"}) {
+		t.Fatal("タグが違う:", found[1].tags)
+	}
+
+	// TSV に書き出して読み直すとタグも戻る
+	arr := transaction2tsv(&found[1])
+	if len(arr) != 9 || arr[8] != "北海道 旅行" {
+		t.Fatal("TSVにタグがない:", arr)
+	}
+
+	d, err = arr2transaction(name2id, id2currency, arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(d.tags, found[1].tags) {
+		t.Fatal("読み直したタグが違う:", d.tags)
+	}
+
+	// 説明の検索にタグも含む
+	found, err = findTransactions(db, []string{"北海道"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 1 {
+		t.Fatal("len(found) != 1:", len(found))
+	}
+
+	all, err := findTransactions(db, []string{"tag:none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) != 26 {
+		t.Fatal("len(all) != 26:", len(all))
+	}
+
+	// タグの付いた取引だけのP/L
+	from, to, err := dbGetTagMonthRange(db, "旅行")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if from != 201912 || to != 202001 {
+		t.Fatal("期間が違う:", from, to)
+	}
+
+	p2d, err := dbGetTagPL(db, "旅行", false, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := 0
+	for _, items := range p2d {
+		for _, d := range items {
+			sum += d.balance
+		}
+	}
+
+	if sum != -8000 {
+		t.Fatal("sum != -8000:", sum)
+	}
+
+	if err := runReportTag(db, "旅行", false, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runReportTag(db, "存在しない", false, "", ""); err == nil {
+		t.Fatal("タグの付いた取引がないのでエラーになるはず")
+	}
+
+	// タグを外すと履歴にも残る
+	tr := found[0]
+	tr.tags = nil
+
+	if err := dbEditTransactionTx(db, &tr); err != nil {
+		t.Fatal(err)
+	}
+
+	histories, err := dbGetHistory(db, tr.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(histories) != 2 || tags2str(histories[0].tr.tags) != "北海道 旅行" || len(histories[1].tr.tags) != 0 {
+		t.Fatal("履歴のタグが違う:", histories)
+	}
+
+	from, to, err = dbGetTagMonthRange(db, "北海道")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if from != 0 || to != 0 {
+		t.Fatal("タグを外したのに集計される:", from, to)
+	}
+}
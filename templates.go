@@ -56,6 +56,10 @@ func cmdListTemplates(context *cli.Context) error {
 		return err
 	}
 
+	if isRecordOutput() {
+		return printTemplateRecords(db, templates)
+	}
+
 	i := 0
 
 	for _, tmpl := range templates {
@@ -99,6 +103,26 @@ func cmdListTemplates(context *cli.Context) error {
 	return nil
 }
 
+// テンプレートの明細1行につき1レコード
+func printTemplateRecords(db *sql.DB, templates []template) error {
+	t := newRecordTable("template_id", "name", "no", "order_no", "debit_id", "debit", "credit_id", "credit",
+		"amount", "description")
+
+	for _, tmpl := range templates {
+		items, err := dbGetTemplateItems(db, tmpl.id)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range items {
+			t.add(tmpl.id, tmpl.name, d.no, d.orderNo, d.debit.id, d.debit.name, d.credit.id, d.credit.name,
+				d.amount, d.note)
+		}
+	}
+
+	return printRecords(t)
+}
+
 func cmdAddTemplate(context *cli.Context) error {
 	db, err := connectDB()
 	if err != nil {
@@ -326,13 +350,13 @@ func runRemoveTemplate(db *sql.DB) error {
 			return err
 		}
 
-		err = dbRemoveTemplateItems(db, tmpl.id)
+		err = dbRemoveTemplateItems(tx, tmpl.id)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
 
-		err = dbRemoveTemplate(db, tmpl.id)
+		err = dbRemoveTemplate(tx, tmpl.id)
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -373,16 +397,15 @@ func runUseTemplate(db *sql.DB) error {
 	trs := make([]transaction, len(tmpl.items))
 
 	for i, d := range tmpl.items {
-		trs[i].debit = d.debit
-		trs[i].credit = d.credit
-		trs[i].amount = d.amount
+		amount := d.amount
 		trs[i].note = d.note
 
 		if d.amount == 0 {
 			println(&d)
-			trs[i].amount = scanAmount()
+			amount = scanAmount()
 		}
 
+		trs[i].setSimple(d.debit, d.credit, amount)
 		trs[i].date = date
 	}
 
@@ -401,8 +424,11 @@ func runUseTemplate(db *sql.DB) error {
 	}
 
 	for _, tr := range trs {
-		if tr.amount != 0 {
-			_, err = dbAddTransaction(tx, &tr)
+		if tr.amount() != 0 {
+			err = fillCurrencyAmounts(db, accounts, &tr)
+			if err == nil {
+				_, err = dbAddTransaction(tx, &tr)
+			}
 		}
 
 		if err != nil {
@@ -755,7 +781,7 @@ DELETE FROM templates
 WHERE template_id = $1
 `
 
-func dbRemoveTemplate(db *sql.DB, id int) error {
+func dbRemoveTemplate(db dbtx, id int) error {
 	_, err := db.Exec(sqlRemoveTemplate, id)
 
 	return err
@@ -815,13 +841,13 @@ func dbEditTemplateItem(db *sql.DB, d *templateDetail) error {
 		return err
 	}
 
-	err = dbRemoveTemplateItem(db, d.templateID, d.no)
+	err = dbRemoveTemplateItem(tx, d.templateID, d.no)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	err = dbAddTemplateItem(db, d)
+	err = dbAddTemplateItem(tx, d)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -835,7 +861,7 @@ DELETE FROM templates_detail
 WHERE template_id = $1 AND no = $2
 `
 
-func dbRemoveTemplateItem(db *sql.DB, id int, no int) error {
+func dbRemoveTemplateItem(db dbtx, id int, no int) error {
 	_, err := db.Exec(sqlRemoveTemplateItem, id, no)
 
 	return err
@@ -846,7 +872,7 @@ DELETE FROM templates_detail
 WHERE template_id = $1
 `
 
-func dbRemoveTemplateItems(db *sql.DB, id int) error {
+func dbRemoveTemplateItems(db dbtx, id int) error {
 	_, err := db.Exec(sqlRemoveTemplateItems, id)
 
 	return err
@@ -20,14 +20,30 @@ type transaction struct {
 	id      int
 	version int
 	date    time.Time
-	debit   account
-	credit  account
-	amount  int
+	items   []transactionItem
 	note    string
 	start   int
 	end     int
+	tags    []string // 名前順
 }
 
+/*
+取引の明細
+
+debit と credit はどちらか一方だけが 0 以外
+外貨建ての勘定科目の場合、currencyAmount は外貨の金額(補助単位)、rate は取引時のレート
+*/
+type transactionItem struct {
+	account        account
+	debit          int
+	credit         int
+	currencyAmount int
+	rate           float64
+}
+
+// 複数の勘定科目をまとめて表すときの名前
+const multiAccountName = "諸口"
+
 func (d *transaction) String() string {
 	rng := ""
 
@@ -37,8 +53,149 @@ func (d *transaction) String() string {
 
 	date := d.date.Format("2006-01-02")
 
-	return fmt.Sprintf("%s %s / %s %s %s %s", date, d.debit.name, d.credit.name,
-		int2str(d.amount), d.note, rng)
+	if d.isSimple() {
+		return fmt.Sprintf("%s %s / %s %s %s %s%s", date, d.debit().name, d.credit().name,
+			int2str(d.amount()), d.note, rng, tags2label(d.tags))
+	}
+
+	return fmt.Sprintf("%s %s / %s %s %s%s", date, items2str(d.debits(), true),
+		items2str(d.credits(), false), d.note, rng, tags2label(d.tags))
+}
+
+func (d *transactionItem) String() string {
+	side, amount := "貸方", d.credit
+	if d.debit != 0 {
+		side, amount = "借方", d.debit
+	}
+
+	if d.account.currency != "" {
+		return fmt.Sprintf("%s %s %s (%s %s)", side, d.account.name, int2str(amount),
+			currency2str(d.currencyAmount, d.account.currency), d.account.currency)
+	}
+
+	return fmt.Sprintf("%s %s %s", side, d.account.name, int2str(amount))
+}
+
+// 借方と貸方が1行ずつの単純な取引か
+func (d *transaction) isSimple() bool {
+	return len(d.items) == 2 && d.items[0].debit != 0 && d.items[1].credit != 0 &&
+		d.items[0].debit == d.items[1].credit
+}
+
+// 借方1行、貸方1行の単純な取引として明細を設定する
+func (d *transaction) setSimple(debit account, credit account, amount int) {
+	d.items = []transactionItem{
+		{account: debit, debit: amount},
+		{account: credit, credit: amount},
+	}
+}
+
+func (d *transaction) debits() []transactionItem {
+	var items []transactionItem
+
+	for _, item := range d.items {
+		if item.debit != 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func (d *transaction) credits() []transactionItem {
+	var items []transactionItem
+
+	for _, item := range d.items {
+		if item.credit != 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// 借方の勘定科目。借方が複数行ある場合は諸口
+func (d *transaction) debit() account {
+	return itemsAccount(d.debits())
+}
+
+// 貸方の勘定科目。貸方が複数行ある場合は諸口
+func (d *transaction) credit() account {
+	return itemsAccount(d.credits())
+}
+
+func itemsAccount(items []transactionItem) account {
+	if len(items) == 1 {
+		return items[0].account
+	}
+
+	return account{name: multiAccountName}
+}
+
+// 借方金額の合計
+func (d *transaction) amount() int {
+	var sum int
+
+	for _, item := range d.items {
+		sum += item.debit
+	}
+
+	return sum
+}
+
+// 勘定科目 id の借方金額の合計と貸方金額の合計
+func (d *transaction) amountOf(id int) (int, int) {
+	var debit, credit int
+
+	for _, item := range d.items {
+		if item.account.id == id {
+			debit += item.debit
+			credit += item.credit
+		}
+	}
+
+	return debit, credit
+}
+
+func (d *transaction) validate() error {
+	if len(d.items) < 2 {
+		return errors.New("明細は2行以上必要")
+	}
+
+	var debit, credit int
+
+	for _, item := range d.items {
+		if (item.debit == 0) == (item.credit == 0) {
+			return fmt.Errorf("明細の借方金額と貸方金額はどちらか一方だけ設定する: %s", item.account.name)
+		}
+
+		debit += item.debit
+		credit += item.credit
+	}
+
+	if debit != credit {
+		return fmt.Errorf("借方合計(%s)と貸方合計(%s)が一致しない", int2str(debit), int2str(credit))
+	}
+
+	return nil
+}
+
+/*
+明細を "勘定科目 金額, 勘定科目 金額" 形式の文字列に変換
+*/
+func items2str(items []transactionItem, isDebit bool) string {
+	var arr []string
+
+	for _, item := range items {
+		amount := item.credit
+		if isDebit {
+			amount = item.debit
+		}
+
+		arr = append(arr, fmt.Sprintf("%s %s", item.account.name, int2str(amount)))
+	}
+
+	return strings.Join(arr, ", ")
 }
 
 func cmdListTransactions(context *cli.Context) error {
@@ -48,6 +205,29 @@ func cmdListTransactions(context *cli.Context) error {
 	}
 	defer db.Close()
 
+	terms, err := splitQuery(context.String("query"))
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range context.StringSlice("tag") {
+		terms = append(terms, "tag:"+tag)
+	}
+
+	if len(terms) != 0 {
+		// 月の指定は検索条件に足す
+		if !context.Bool("all") {
+			monthStr := context.Args().First()
+			if monthStr == "" {
+				monthStr = "-0" // 今月
+			}
+
+			terms = append(terms, "date:"+monthStr)
+		}
+
+		return runFindTransactions(db, terms)
+	}
+
 	return runListTransactions(db, context.Bool("all"), context.Args().First())
 }
 
@@ -79,12 +259,46 @@ func runListTransactions(db *sql.DB, isAll bool, monthStr string) error {
 		}
 	}
 
+	return printTransactions(transactions)
+}
+
+func printTransactions(transactions []transaction) error {
+	if isRecordOutput() {
+		return printRecords(transactions2records(transactions))
+	}
+
 	src := getTransactionsReader(transactions, false)
 	print(src)
 
 	return nil
 }
 
+var transactionColumns = []string{"transaction_id", "version", "date", "no", "account_id", "account",
+	"debit", "credit", "currency", "currency_amount", "rate", "description", "start_month", "end_month", "tags"}
+
+// 明細1行につき1レコード
+func transactions2records(transactions []transaction) *recordTable {
+	t := newRecordTable(transactionColumns...)
+
+	for _, tr := range transactions {
+		t.rows = append(t.rows, transaction2values(&tr)...)
+	}
+
+	return t
+}
+
+func transaction2values(tr *transaction) [][]interface{} {
+	var rows [][]interface{}
+
+	for i, item := range tr.items {
+		rows = append(rows, []interface{}{tr.id, tr.version, tr.date, i + 1, item.account.id, item.account.name,
+			item.debit, item.credit, item.account.currency, item.currencyAmount, item.rate,
+			tr.note, tr.start, tr.end, tags2str(tr.tags)})
+	}
+
+	return rows
+}
+
 func cmdSearchTransaction(context *cli.Context) error {
 	db, err := connectDB()
 	if err != nil {
@@ -119,10 +333,11 @@ func cmdAddTransaction(context *cli.Context) error {
 	}
 	defer db.Close()
 
-	return runAddTransaction(db, context.Args().Slice())
+	return runAddTransaction(db, context.Args().Slice(), context.StringSlice("tag"))
 }
 
-func runAddTransaction(db *sql.DB, args []string) error {
+// tags は引数の取引に足すタグ
+func runAddTransaction(db *sql.DB, args []string, tags []string) error {
 	accounts, err := dbGetAccounts(db)
 	if err != nil {
 		return err
@@ -140,6 +355,10 @@ func runAddTransaction(db *sql.DB, args []string) error {
 			return nil
 		}
 
+		if d.tags, err = normalizeTags(tags); err != nil {
+			return err
+		}
+
 		ok, err := confirmTransaction(accounts, d)
 		if err != nil {
 			return err
@@ -150,22 +369,40 @@ func runAddTransaction(db *sql.DB, args []string) error {
 		}
 	case 4, 5, 7:
 		name2id := make(map[string]int)
+		id2currency := make(map[int]string)
 
 		for _, d := range accounts {
 			name2id[d.name] = d.id
+			id2currency[d.id] = d.currency
 		}
 
-		d, err = arr2transaction(name2id, args)
+		d, err = arr2transaction(name2id, id2currency, args)
 		if err != nil {
 			return err
 		}
+
+		if d.tags, err = normalizeTags(append(d.tags, tags...)); err != nil {
+			return err
+		}
 	default:
-		return errors.New("Usage: mita transaction add date debit credit amount [description] [startMonth endMonth]")
+		return errors.New("Usage: mita transaction add [--tag tag] date debit credit amount [description] [startMonth endMonth]")
 	}
 
-	_, err = dbAddTransaction(db, d)
+	if err := fillCurrencyAmounts(db, accounts, d); err != nil {
+		return err
+	}
 
-	return err
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = dbAddTransaction(tx, d); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func cmdEditTransaction(context *cli.Context) error {
@@ -175,6 +412,10 @@ func cmdEditTransaction(context *cli.Context) error {
 	}
 	defer db.Close()
 
+	if context.Bool("editor") {
+		return runEditTransactionsWithEditor(db, context.Args().First())
+	}
+
 	return runEditTransaction(db)
 }
 
@@ -195,7 +436,11 @@ func runEditTransaction(db *sql.DB) error {
 	}
 
 	if ok {
-		if err := dbEditTransaction(db, tr); err != nil {
+		if err := fillCurrencyAmounts(db, accounts, tr); err != nil {
+			return err
+		}
+
+		if err := dbEditTransactionTx(db, tr); err != nil {
 			return err
 		}
 	}
@@ -226,71 +471,125 @@ func runRemoveTransaction(db *sql.DB) error {
 	return err
 }
 
-func cmdUndoTransaction(context *cli.Context) error {
-	db, err := connectDB()
+func runUndoTransaction(db *sql.DB) error {
+	d, err := selectUndoableHistory(db)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	if d == nil {
+		return nil
+	}
 
-	return runUndoTransaction(db)
-}
+	if !confirmYesNo("本当にUNDOする? ") {
+		return nil
+	}
 
-func runUndoTransaction(db *sql.DB) error {
-	d, err := selectUndoableHistory(db)
+	tr, err := undoHistory(db, d)
 	if err != nil {
 		return err
 	}
-	if d == nil {
-		return nil
+
+	if d.operation == "UPDATE" {
+		println(tr)
 	}
 
-	if confirmYesNo("本当にUNDOする? ") {
-		switch d.operation {
-		case "DELETE":
-			err = dbAddTransactionForUndo(db, d)
-		case "UPDATE":
-			prev, err := dbGetHistory1(db, d.tr.id, d.tr.version-1)
-			if err != nil {
-				return err
-			}
+	return nil
+}
 
-			err = dbEditTransaction(db, &prev.tr)
-			if err == nil {
-				println(&prev.tr)
-			}
-		case "INSERT":
-			err = dbRemoveTransaction(db, d.tr.id)
+/*
+履歴の操作を元に戻して、戻した後の取引を返す
+追加の操作を戻したときは取引が削除されるので nil を返す
+*/
+func undoHistory(db *sql.DB, d *history) (*transaction, error) {
+	switch d.operation {
+	case "DELETE":
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := dbAddTransactionForUndo(tx, d); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		return &d.tr, tx.Commit()
+	case "UPDATE":
+		prev, err := dbGetHistory1(db, d.tr.id, d.tr.version-1)
+		if err != nil {
+			return nil, err
 		}
+
+		if err := dbEditTransactionTx(db, &prev.tr); err != nil {
+			return nil, err
+		}
+
+		return &prev.tr, nil
+	case "INSERT":
+		return nil, dbRemoveTransaction(db, d.tr.id)
 	}
 
-	return err
+	return nil, fmt.Errorf("未対応の操作 '%s'", d.operation)
 }
 
 func cmdImportTransactions(context *cli.Context) error {
-	return importItems(context.Args().First(), readTransactions)
+	isDryRun := context.Bool("dry-run")
+
+	format := context.String("format")
+	if format == "" {
+		return importItems(context.Args().First(), func(db *sql.DB, f io.Reader) error {
+			return readTransactions(db, f, isDryRun)
+		})
+	}
+
+	if isLedgerFormat(format) {
+		return importItems(context.Args().First(), func(db *sql.DB, f io.Reader) error {
+			return readLedgerTransactions(db, f, format, isDryRun)
+		})
+	}
+
+	suspense := context.String("suspense")
+
+	if isStatementFormat(format) {
+		return importItems(context.Args().First(), func(db *sql.DB, f io.Reader) error {
+			return readStatementTransactions(db, f, format, context.String("account"), suspense, isDryRun)
+		})
+	}
+
+	profile, err := getImportProfile(format)
+	if err != nil {
+		return err
+	}
+
+	return importItems(context.Args().First(), func(db *sql.DB, f io.Reader) error {
+		return readCSVTransactions(db, f, profile, suspense, isDryRun)
+	})
 }
 
-func readTransactions(db *sql.DB, f io.Reader) error {
+/*
+TSVから取引を読み込んで追加する
+8列目があれば外部IDとして扱い、既に登録されている取引は追加しない
+9列目はタグを空白で区切ったもの
+*/
+func readTransactions(db *sql.DB, f io.Reader, isDryRun bool) error {
 	accounts, err := dbGetAccounts(db)
 	if err != nil {
 		return err
 	}
 
 	name2id := make(map[string]int)
+	id2currency := make(map[int]string)
 
 	for _, d := range accounts {
 		name2id[d.name] = d.id
+		id2currency[d.id] = d.currency
 	}
 
 	scanner := bufio.NewScanner(f)
 
 	lineNo := 0
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
+	var entries []importEntry
 
 	for scanner.Scan() {
 		lineNo++
@@ -303,31 +602,48 @@ func readTransactions(db *sql.DB, f io.Reader) error {
 
 		arr := strings.Split(line, "\t")
 
-		d, err := arr2transaction(name2id, arr)
+		d, err := arr2transaction(name2id, id2currency, arr)
 		if err != nil {
-			tx.Rollback()
 			return fmt.Errorf("%d:%s", lineNo, err)
 		}
 
-		_, err = dbAddTransaction(tx, d)
-		if err != nil {
-			tx.Rollback()
-			return err
+		if err := fillCurrencyAmounts(db, accounts, d); err != nil {
+			return fmt.Errorf("%d:%s", lineNo, err)
 		}
+
+		entry := importEntry{lineNo: lineNo, tr: d}
+
+		if len(arr) >= 8 {
+			entry.externalID = arr[7]
+		}
+
+		entries = append(entries, entry)
 	}
 
 	if err = scanner.Err(); err != nil {
-		tx.Rollback()
 		return err
 	}
 
-	return tx.Commit()
+	from, to := entriesDateRange(entries)
+
+	im, err := newImporter(db, from, to, isDryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := im.add(entry); err != nil {
+			return err
+		}
+	}
+
+	return im.commit()
 }
 
-func arr2transaction(name2id map[string]int, arr []string) (*transaction, error) {
+func arr2transaction(name2id map[string]int, id2currency map[int]string, arr []string) (*transaction, error) {
 	arrLen := len(arr)
-	if !(arrLen == 4 || arrLen == 5 || arrLen == 7) {
-		return nil, fmt.Errorf("項目数が4, 5, 7でない")
+	if !(arrLen == 4 || arrLen == 5 || arrLen == 7 || arrLen == 8 || arrLen == 9) {
+		return nil, fmt.Errorf("項目数が4, 5, 7, 8, 9でない")
 	}
 
 	var d transaction
@@ -338,21 +654,22 @@ func arr2transaction(name2id map[string]int, arr []string) (*transaction, error)
 	}
 	d.date = date
 
-	d.debit.id = name2id[arr[1]]
-	if d.debit.id == 0 {
-		return nil, fmt.Errorf("借方:存在しない勘定科目'%s'", arr[1])
+	amount, err := strconv.Atoi(arr[3])
+	if err != nil {
+		return nil, fmt.Errorf("金額:%s", err)
 	}
 
-	d.credit.id = name2id[arr[2]]
-	if d.credit.id == 0 {
-		return nil, fmt.Errorf("貸方:存在しない勘定科目'%s'", arr[2])
+	debits, err := str2items(name2id, id2currency, arr[1], amount, true)
+	if err != nil {
+		return nil, fmt.Errorf("借方:%s", err)
 	}
 
-	amount, err := strconv.Atoi(arr[3])
+	credits, err := str2items(name2id, id2currency, arr[2], amount, false)
 	if err != nil {
-		return nil, fmt.Errorf("金額:%s", err)
+		return nil, fmt.Errorf("貸方:%s", err)
 	}
-	d.amount = amount
+
+	d.items = append(debits, credits...)
 
 	if len(arr) >= 5 {
 		d.note = arr[4]
@@ -383,26 +700,217 @@ func arr2transaction(name2id map[string]int, arr []string) (*transaction, error)
 		}
 	}
 
+	if len(arr) >= 9 {
+		d.tags, err = str2tags(arr[8])
+		if err != nil {
+			return nil, fmt.Errorf("タグ:%s", err)
+		}
+	}
+
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+
 	return &d, nil
 }
 
+/*
+借方または貸方の列を解析して明細に変換
+
+"勘定科目" : 金額列の金額を持つ1行の明細
+"勘定科目:金額,勘定科目:金額" : 複数行の明細。金額の合計は金額列と一致しなければならない
+
+外貨建ての勘定科目は "勘定科目@外貨金額" のように外貨の金額を付けられる
+(例) "USD預金@100.50:15000"
+*/
+func str2items(name2id map[string]int, id2currency map[int]string, s string, amount int, isDebit bool) ([]transactionItem, error) {
+	var items []transactionItem
+
+	if !strings.Contains(s, ":") {
+		item, err := str2item(name2id, id2currency, s)
+		if err != nil {
+			return nil, err
+		}
+
+		if isDebit {
+			item.debit = amount
+		} else {
+			item.credit = amount
+		}
+
+		return append(items, item), nil
+	}
+
+	sum := 0
+
+	for _, part := range strings.Split(s, ",") {
+		arr := strings.Split(part, ":")
+		if len(arr) != 2 {
+			return nil, fmt.Errorf("'勘定科目:金額'の形式でない'%s'", part)
+		}
+
+		item, err := str2item(name2id, id2currency, arr[0])
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := strconv.Atoi(arr[1])
+		if err != nil {
+			return nil, fmt.Errorf("金額:%s", err)
+		}
+
+		if isDebit {
+			item.debit = v
+		} else {
+			item.credit = v
+		}
+
+		items = append(items, item)
+		sum += v
+	}
+
+	if sum != amount {
+		return nil, fmt.Errorf("明細の合計(%s)が金額(%s)と一致しない", int2str(sum), int2str(amount))
+	}
+
+	return items, nil
+}
+
+// "勘定科目" または "勘定科目@外貨金額" を金額のない明細に変換
+func str2item(name2id map[string]int, id2currency map[int]string, s string) (transactionItem, error) {
+	var item transactionItem
+
+	name, currencyStr := s, ""
+	if i := strings.Index(s, "@"); i != -1 {
+		name, currencyStr = s[:i], s[i+1:]
+	}
+
+	id := name2id[name]
+	if id == 0 {
+		return item, fmt.Errorf("存在しない勘定科目'%s'", name)
+	}
+
+	item.account = account{id: id, name: name, currency: id2currency[id]}
+
+	if currencyStr != "" {
+		if item.account.currency == "" {
+			return item, fmt.Errorf("外貨建てでない勘定科目'%s'に外貨金額は指定できない", name)
+		}
+
+		v, err := str2currency(currencyStr, item.account.currency)
+		if err != nil {
+			return item, fmt.Errorf("外貨金額:%s", err)
+		}
+
+		item.currencyAmount = v
+	}
+
+	return item, nil
+}
+
+/*
+明細を借方または貸方の列の文字列に変換
+str2items の逆変換
+*/
+func items2tsv(items []transactionItem, isDebit bool) string {
+	if len(items) == 1 {
+		return item2tsv(&items[0])
+	}
+
+	var arr []string
+
+	for _, item := range items {
+		amount := item.credit
+		if isDebit {
+			amount = item.debit
+		}
+
+		arr = append(arr, fmt.Sprintf("%s:%d", item2tsv(&item), amount))
+	}
+
+	return strings.Join(arr, ",")
+}
+
+func item2tsv(item *transactionItem) string {
+	if item.account.currency == "" {
+		return item.account.name
+	}
+
+	return fmt.Sprintf("%s@%s", item.account.name,
+		strings.ReplaceAll(currency2str(item.currencyAmount, item.account.currency), ",", ""))
+}
+
+/*
+取引をTSVの列に変換する。arr2transaction の逆変換
+タグがあれば、空の外部IDとタグの列を足す
+*/
+func transaction2tsv(d *transaction) []string {
+	arr := []string{
+		d.date.Format("2006-01-02"),
+		items2tsv(d.debits(), true),
+		items2tsv(d.credits(), false),
+		strconv.Itoa(d.amount()),
+		d.note,
+		strconv.Itoa(d.start),
+		strconv.Itoa(d.end),
+	}
+
+	if len(d.tags) != 0 {
+		arr = append(arr, "", tags2str(d.tags))
+	}
+
+	return arr
+}
+
 func cmdExportTransactions(context *cli.Context) error {
-	return exportItems(context.Args().First(), writeTransactions)
+	terms, err := splitQuery(context.String("query"))
+	if err != nil {
+		return err
+	}
+
+	format := context.String("format")
+	if format != "tsv" && !isLedgerFormat(format) {
+		return fmt.Errorf("未対応の形式 '%s'。tsv, ledger, beancount のどれか", format)
+	}
+
+	dir := context.String("attachments")
+
+	return exportItems(context.Args().First(), func(db *sql.DB, f io.Writer) error {
+		var err error
+
+		if isLedgerFormat(format) {
+			err = writeLedgerTransactions(db, f, terms, format)
+		} else {
+			err = writeFoundTransactions(db, f, terms)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if dir != "" {
+			return exportAttachments(db, dir, terms)
+		}
+
+		return nil
+	})
 }
 
 func writeTransactions(db *sql.DB, f io.Writer) error {
+	return writeFoundTransactions(db, f, nil)
+}
+
+// 検索条件に一致する取引をTSVで書き出す
+func writeFoundTransactions(db *sql.DB, f io.Writer, terms []string) error {
 	b := bufio.NewWriter(f)
 
-	transactions, err := getTransactions(db, false)
+	transactions, err := findTransactions(db, terms)
 	if err != nil {
 		return err
 	}
 
 	for _, d := range transactions {
-		date := d.date.Format("2006-01-02")
-
-		_, err := b.WriteString(fmt.Sprintf("%s\t%s\t%s\t%d\t%s\t%d\t%d\n",
-			date, d.debit.name, d.credit.name, d.amount, d.note, d.start, d.end))
+		_, err := b.WriteString(strings.Join(transaction2tsv(&d), "\t") + "\n")
 		if err != nil {
 			return err
 		}
@@ -418,7 +926,7 @@ func confirmTransaction(accounts []account, tr *transaction) (bool, error) {
 		println()
 		println(tr)
 
-		print("y(es), d(ate), l(eft), r(ight), a(mount), n(ote), s(tart-end), q(uit): ")
+		print("y(es), d(ate), l(eft), r(ight), a(mount), i(tems), n(ote), s(tart-end), t(ags), q(uit): ")
 		s, err := input()
 		if err != nil {
 			return false, err
@@ -429,50 +937,202 @@ func confirmTransaction(accounts []account, tr *transaction) (bool, error) {
 		case "q", "quit":
 			return false, nil
 		case "y", "yes":
+			if err := tr.validate(); err != nil {
+				eprintln("エラー:", err)
+				break
+			}
+
 			return true, nil
 		case "d", "date":
 			tr.date = scanDate()
 		case "l", "left":
+			i := findOnlyItem(tr.items, true)
+			if i == -1 {
+				eprintln("借方が複数行あるので、i(tems)で編集してください")
+				break
+			}
+
 			debit, err := selectAccount(accounts, "借方")
 			if err != nil {
 				return false, err
 			}
 			if debit != nil {
-				tr.debit = *debit
+				tr.items[i].account = *debit
 			}
 		case "r", "right":
+			i := findOnlyItem(tr.items, false)
+			if i == -1 {
+				eprintln("貸方が複数行あるので、i(tems)で編集してください")
+				break
+			}
+
 			credit, err := selectAccount(accounts, "貸方")
 			if err != nil {
 				return false, err
 			}
 			if credit != nil {
-				tr.credit = *credit
+				tr.items[i].account = *credit
 			}
 		case "a", "amount":
-			tr.amount = scanAmount()
+			if !tr.isSimple() {
+				eprintln("明細が複数行あるので、i(tems)で編集してください")
+				break
+			}
+
+			tr.setSimple(tr.items[0].account, tr.items[1].account, scanAmount())
+		case "i", "items":
+			if err := editTransactionItems(accounts, tr); err != nil {
+				return false, err
+			}
 		case "n", "note":
 			tr.note = scanNote()
 		case "s":
 			tr.start, tr.end = scanRange()
+		case "t", "tags":
+			tr.tags = scanTags()
+		}
+	}
+}
+
+/*
+借方または貸方が1行だけなら、その明細のインデックスを返す
+複数行ある場合は -1
+*/
+func findOnlyItem(items []transactionItem, isDebit bool) int {
+	idx := -1
+
+	for i, item := range items {
+		if (isDebit && item.debit != 0) || (!isDebit && item.credit != 0) {
+			if idx != -1 {
+				return -1
+			}
+
+			idx = i
+		}
+	}
+
+	return idx
+}
+
+// 取引の明細を編集する
+func editTransactionItems(accounts []account, tr *transaction) error {
+	for {
+		println()
+		for i, d := range tr.items {
+			println(i, &d)
+		}
+
+		debit, credit := tr.amount(), 0
+		for _, d := range tr.items {
+			credit += d.credit
+		}
+		printf("借方合計: %s, 貸方合計: %s\n", int2str(debit), int2str(credit))
+
+		q := "a(dd), q(uit): "
+		if len(tr.items) != 0 {
+			q = getRangeString(len(tr.items)) + ", a(dd), r(emove), q(uit): "
+		}
+
+		print(q)
+		s, err := input()
+		if err != nil {
+			return err
+		}
+		a := strings.ToLower(s)
+
+		switch a {
+		case "q", "quit":
+			return nil
+		case "a", "add":
+			side := scanInt("1: 借方, 2: 貸方", 1, 2)
+
+			ac, err := selectAccount(accounts, "勘定科目")
+			if err != nil {
+				return err
+			}
+			if ac == nil {
+				break
+			}
+
+			item := transactionItem{account: *ac}
+			if side == 1 {
+				item.debit = scanAmount()
+			} else {
+				item.credit = scanAmount()
+			}
+
+			if ac.currency != "" {
+				item.currencyAmount = scanCurrencyAmount(ac.currency)
+			}
+
+			tr.items = append(tr.items, item)
+		case "r", "remove":
+			if len(tr.items) == 0 {
+				break
+			}
+
+			no := scanInt("削除する行", 0, len(tr.items)-1)
+			tr.items = append(tr.items[:no], tr.items[no+1:]...)
+		default:
+			no, err := strconv.Atoi(a)
+			if err != nil || no < 0 || no >= len(tr.items) {
+				break
+			}
+
+			item := &tr.items[no]
+
+			ac, err := selectAccount(accounts, "勘定科目")
+			if err != nil {
+				return err
+			}
+			if ac != nil {
+				item.account = *ac
+			}
+
+			if item.debit != 0 {
+				item.debit = scanAmount()
+			} else {
+				item.credit = scanAmount()
+			}
+
+			item.currencyAmount = 0
+			if item.account.currency != "" {
+				item.currencyAmount = scanCurrencyAmount(item.account.currency)
+			}
 		}
 	}
 }
 
+/*
+取引ビューの行を取引に変換
+取引ビューは明細1行につき1行なので、同じ取引の明細が連続するように並べておくこと
+*/
 func rows2transactions(rows *sql.Rows) ([]transaction, error) {
 	var transactions []transaction
 
 	for rows.Next() {
 		var tr transaction
+		var no int
+		var item transactionItem
+
+		var tags string
 
-		err := rows.Scan(&tr.id, &tr.version, &tr.date,
-			&tr.debit.id, &tr.debit.name, &tr.debit.searchWords,
-			&tr.credit.id, &tr.credit.name, &tr.credit.searchWords,
-			&tr.amount, &tr.note, &tr.start, &tr.end)
+		err := rows.Scan(&tr.id, &tr.version, &tr.date, &tr.note, &tr.start, &tr.end,
+			&no, &item.account.id, &item.account.name, &item.account.searchWords,
+			&item.debit, &item.credit, &item.account.currency, &item.currencyAmount, &item.rate, &tags)
 		if err != nil {
 			return nil, err
 		}
 
-		transactions = append(transactions, tr)
+		last := len(transactions) - 1
+
+		if last >= 0 && transactions[last].id == tr.id {
+			transactions[last].items = append(transactions[last].items, item)
+		} else {
+			tr.items = []transactionItem{item}
+			tr.tags = strings.Fields(tags)
+			transactions = append(transactions, tr)
+		}
 	}
 	rows.Close()
 
@@ -480,14 +1140,16 @@ func rows2transactions(rows *sql.Rows) ([]transaction, error) {
 }
 
 const transactionRows = `
-transaction_id, version, date, debit_id, debit, debit_search_words, credit_id,
-credit, credit_search_words, amount, description, start_month, end_month
+transaction_id, version, date, description, start_month, end_month,
+no, account_id, account, search_words, debit_amount, credit_amount,
+currency, currency_amount, rate, tags
 `
 
 const sqlGetTransaction = `
 SELECT ` + transactionRows + `
 FROM transactions_view
 WHERE transaction_id = $1
+ORDER BY no
 `
 
 func dbGetTransaction(db *sql.DB, id int) (*transaction, error) {
@@ -517,9 +1179,9 @@ FROM transactions_view
 func getTransactions(db *sql.DB, reverse bool) ([]transaction, error) {
 	var sql string
 	if reverse {
-		sql = sqlGetTransactions + "ORDER BY date DESC, transaction_id DESC"
+		sql = sqlGetTransactions + "ORDER BY date DESC, transaction_id DESC, no"
 	} else {
-		sql = sqlGetTransactions + "ORDER BY date, transaction_id"
+		sql = sqlGetTransactions + "ORDER BY date, transaction_id, no"
 	}
 
 	rows, err := db.Query(sql)
@@ -533,13 +1195,15 @@ func getTransactions(db *sql.DB, reverse bool) ([]transaction, error) {
 const sqlGetTransactionsByMonth = `
 SELECT ` + transactionRows + `
 FROM transactions_view
-WHERE EXTRACT(year FROM "date") = $1
-      AND EXTRACT(month FROM "date") = $2
-ORDER BY date, transaction_id
+WHERE date BETWEEN $1 AND $2
+ORDER BY date, transaction_id, no
 `
 
 func getTransactionsByMonth(db *sql.DB, year int, month int) ([]transaction, error) {
-	rows, err := db.Query(sqlGetTransactionsByMonth, year, month)
+	from := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 1, -1)
+
+	rows, err := db.Query(sqlGetTransactionsByMonth, from.Format("2006-01-02"), to.Format("2006-01-02"))
 	if err != nil {
 		return nil, err
 	}
@@ -548,58 +1212,141 @@ func getTransactionsByMonth(db *sql.DB, year int, month int) ([]transaction, err
 }
 
 const sqlAddTransaction = `
-INSERT INTO transactions(date, debit_id, credit_id, amount, description, start_month, end_month)
-VALUES($1, $2, $3, $4, $5, $6, $7)
+INSERT INTO transactions(date, description, start_month, end_month)
+VALUES($1, $2, $3, $4)
 RETURNING transaction_id
 `
 
-func dbAddTransaction(db dbtx, tr *transaction) (string, error) {
+/*
+取引を追加する
+明細の追加と貸借の確認はコミット時に行われるので、トランザクション内で実行すること
+*/
+func dbAddTransaction(tx *sql.Tx, tr *transaction) (string, error) {
 	var id string
-	err := db.QueryRow(sqlAddTransaction, tr.date, tr.debit.id, tr.credit.id, tr.amount, tr.note, tr.start, tr.end).Scan(&id)
+	err := tx.QueryRow(sqlAddTransaction, tr.date, tr.note, tr.start, tr.end).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+
+	if err := dbAddTransactionItems(tx, id, tr.items); err != nil {
+		return "", err
+	}
+
+	if err := dbSetTransactionTags(tx, id, tr.tags); err != nil {
+		return "", err
+	}
 
 	return id, err
 }
 
+const sqlAddTransactionItem = `
+INSERT INTO transactions_detail(transaction_id, no, account_id, debit_amount, credit_amount,
+                                currency_amount, rate)
+VALUES($1, $2, $3, $4, $5, $6, $7)
+`
+
+func dbAddTransactionItems(tx *sql.Tx, id interface{}, items []transactionItem) error {
+	for i, item := range items {
+		_, err := tx.Exec(sqlAddTransactionItem, id, i+1, item.account.id, item.debit, item.credit,
+			item.currencyAmount, item.rate)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 const sqlAddTransactionForUndo = `
-INSERT INTO transactions(transaction_id, version, date, debit_id, credit_id, amount, description, start_month, end_month)
-VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+INSERT INTO transactions(transaction_id, version, date, description, start_month, end_month)
+VALUES($1, $2, $3, $4, $5, $6)
 `
 
-func dbAddTransactionForUndo(db dbtx, d *history) error {
+func dbAddTransactionForUndo(tx *sql.Tx, d *history) error {
 	if d.operation != "DELETE" {
 		return errors.New("dbAddTransactionForUndoの引数はDELETEの履歴のみ")
 	}
 
-	_, err := db.Exec(sqlAddTransactionForUndo, d.tr.id, d.tr.version+1,
-		d.tr.date, d.tr.debit.id, d.tr.credit.id, d.tr.amount, d.tr.note, d.tr.start, d.tr.end)
+	_, err := tx.Exec(sqlAddTransactionForUndo, d.tr.id, d.tr.version+1,
+		d.tr.date, d.tr.note, d.tr.start, d.tr.end)
+	if err != nil {
+		return err
+	}
 
-	return err
+	if err := dbAddTransactionItems(tx, d.tr.id, d.tr.items); err != nil {
+		return err
+	}
+
+	if err := dbSetTransactionTags(tx, d.tr.id, d.tr.tags); err != nil {
+		return err
+	}
+
+	if err := dbRestoreAttachments(tx, d.tr.id); err != nil {
+		return err
+	}
+
+	return dbRestoreImportedTransactionIDs(tx, d.tr.id)
 }
 
+const sqlRemoveTransactionItems = `
+DELETE FROM transactions_detail
+WHERE transaction_id = $1
+`
+
+// 明細だけの変更でも履歴が残るように、バージョンを明示的に増やす
 const sqlEditTransaction = `
 UPDATE transactions SET
+version = version + 1,
 date = $2,
-debit_id = $3,
-credit_id = $4,
-amount = $5,
-description = $6,
-start_month = $7,
-end_month = $8
+description = $3,
+start_month = $4,
+end_month = $5
 WHERE transaction_id = $1
 `
 
-func dbEditTransaction(db *sql.DB, tr *transaction) error {
-	_, err := db.Exec(sqlEditTransaction, tr.id, tr.date, tr.debit.id, tr.credit.id, tr.amount, tr.note, tr.start, tr.end)
+/*
+取引を更新する
+明細を書き換えるので、トランザクション内で実行すること
+*/
+func dbEditTransaction(tx *sql.Tx, tr *transaction) error {
+	if _, err := tx.Exec(sqlRemoveTransactionItems, tr.id); err != nil {
+		return err
+	}
+
+	if err := dbAddTransactionItems(tx, tr.id, tr.items); err != nil {
+		return err
+	}
+
+	if err := dbSetTransactionTags(tx, tr.id, tr.tags); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(sqlEditTransaction, tr.id, tr.date, tr.note, tr.start, tr.end)
 
 	return err
 }
 
+// 1件の取引を更新するトランザクションを実行する
+func dbEditTransactionTx(db *sql.DB, tr *transaction) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := dbEditTransaction(tx, tr); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
 const sqlRemoveTransaction = `
 DELETE FROM transactions
 WHERE transaction_id = $1
 `
 
-func dbRemoveTransaction(db *sql.DB, id int) error {
+func dbRemoveTransaction(db dbtx, id int) error {
 	_, err := db.Exec(sqlRemoveTransaction, id)
 
 	return err
@@ -607,14 +1354,16 @@ func dbRemoveTransaction(db *sql.DB, id int) error {
 
 func tr2alignedString(d *transaction) string {
 	date := d.date.Format("2006-01-02")
+	debit := d.debit()
+	credit := d.credit()
 
-	debitWidth := getTextWidth(d.debit.name)
+	debitWidth := getTextWidth(debit.name)
 	dw := 16 - debitWidth
 	if dw < 0 {
 		dw = 0
 	}
 
-	creditWidth := getTextWidth(d.credit.name)
+	creditWidth := getTextWidth(credit.name)
 	cw := 16 - creditWidth
 	if cw < 0 {
 		cw = 0
@@ -625,6 +1374,12 @@ func tr2alignedString(d *transaction) string {
 		note = " " + d.note
 	}
 
+	if !d.isSimple() {
+		note += fmt.Sprintf(" (%s / %s)", items2str(d.debits(), true), items2str(d.credits(), false))
+	}
+
+	note += tags2label(d.tags)
+
 	rng := ""
 
 	if d.start != 0 {
@@ -634,8 +1389,8 @@ func tr2alignedString(d *transaction) string {
 	}
 
 	return fmt.Sprintf("%s %s%*s %s%*s %9s%s%s", date,
-		d.debit.name, dw, "", d.credit.name, cw, "",
-		int2str(d.amount), rng, note)
+		debit.name, dw, "", credit.name, cw, "",
+		int2str(d.amount()), rng, note)
 }
 
 func getTransactionsReader(transactions []transaction, showSearchWords bool) io.Reader {
@@ -650,7 +1405,11 @@ func getTransactionsReader(transactions []transaction, showSearchWords bool) io.
 		src.WriteString(tr2alignedString(&d))
 
 		if showSearchWords {
-			src.WriteString(fmt.Sprintf("    %s %s", d.debit.searchWords, d.credit.searchWords))
+			src.WriteString("   ")
+
+			for _, item := range d.items {
+				src.WriteString(" " + item.account.searchWords)
+			}
 		}
 
 		src.WriteString("\n")
@@ -708,7 +1467,6 @@ func scanTransaction(accounts []account) (*transaction, error) {
 	if debit == nil {
 		return nil, nil
 	}
-	tr.debit = *debit
 
 	credit, err := selectAccount(accounts, "貸方")
 	if err != nil {
@@ -717,9 +1475,15 @@ func scanTransaction(accounts []account) (*transaction, error) {
 	if credit == nil {
 		return nil, nil
 	}
-	tr.credit = *credit
 
-	tr.amount = scanAmount()
+	tr.setSimple(*debit, *credit, scanAmount())
+
+	for i := range tr.items {
+		if currency := tr.items[i].account.currency; currency != "" {
+			tr.items[i].currencyAmount = scanCurrencyAmount(currency)
+		}
+	}
+
 	tr.note = scanNote()
 	// 期間はあまり設定しないのでコメントアウト
 	// tr.start, tr.end = scanRange()
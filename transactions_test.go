@@ -27,7 +27,7 @@ func TestTransactionCommands(t *testing.T) {
 		stdin = bytes.NewBufferString("2019-11-03\n11\n0\n3000\nもやし、鶏卵等\ny\n")
 		scanner = bufio.NewScanner(stdin)
 
-		if err := runAddTransaction(db, nil); err != nil {
+		if err := runAddTransaction(db, nil, nil); err != nil {
 			t.Fatal(err)
 		}
 
@@ -54,7 +54,7 @@ func TestTransactionCommands(t *testing.T) {
 
 		args := []string{"2019-12-20", "年金保険料", "A銀行", "379640", "2年前納", "2019-12", "2021-11"}
 
-		if err := runAddTransaction(db, args); err != nil {
+		if err := runAddTransaction(db, args, nil); err != nil {
 			t.Fatal(err)
 		}
 
@@ -70,6 +70,48 @@ func TestTransactionCommands(t *testing.T) {
 		testTransaction(t, transactions[0], "2019-12-20", "年金保険料", "A銀行", 379640, "2年前納", 201912, 202111)
 	})
 
+	t.Run("TestRunAddCompoundTransactionArgs", func(t *testing.T) {
+		db, err := setupAccounts()
+		if db != nil {
+			defer db.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args := []string{"2019-12-21", "食費:800,娯楽:600", "Aカード", "1400", "スーパー"}
+
+		if err := runAddTransaction(db, args, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		transactions, err := getTransactions(db, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(transactions) != 1 {
+			t.Fatal("len(transactions) != 1:", len(transactions))
+		}
+
+		testTransaction(t, transactions[0], "2019-12-21", multiAccountName, "Aカード", 1400, "スーパー", 0, 0)
+
+		d := transactions[0]
+		if len(d.items) != 3 {
+			t.Fatal("len(d.items) != 3:", len(d.items))
+		}
+
+		if d.items[1].account.name != "娯楽" || d.items[1].debit != 600 {
+			t.Fatal("wrong d.items[1]:", &d.items[1])
+		}
+
+		args = []string{"2019-12-21", "食費:800,娯楽:500", "Aカード", "1400"}
+
+		if err := runAddTransaction(db, args, nil); err == nil {
+			t.Fatal("エラーになるはず")
+		}
+	})
+
 	t.Run("TestRunListTransaction", func(t *testing.T) {
 		db, err := setupAccounts()
 		if db != nil {
@@ -81,13 +123,13 @@ func TestTransactionCommands(t *testing.T) {
 
 		args := []string{"2019-10-10", "娯楽", "現金", "2000"}
 
-		if err := runAddTransaction(db, args); err != nil {
+		if err := runAddTransaction(db, args, nil); err != nil {
 			t.Fatal(err)
 		}
 
 		args = []string{"2019-11-09", "食費", "現金", "3000"}
 
-		if err := runAddTransaction(db, args); err != nil {
+		if err := runAddTransaction(db, args, nil); err != nil {
 			t.Fatal(err)
 		}
 
@@ -143,7 +185,7 @@ func TestTransactionCommands(t *testing.T) {
 
 		args := []string{"2019-10-10", "娯楽", "現金", "2000"}
 
-		if err := runAddTransaction(db, args); err != nil {
+		if err := runAddTransaction(db, args, nil); err != nil {
 			t.Fatal(err)
 		}
 
@@ -177,7 +219,7 @@ func TestTransactionCommands(t *testing.T) {
 
 		args := []string{"2019-10-10", "娯楽", "現金", "2000"}
 
-		if err := runAddTransaction(db, args); err != nil {
+		if err := runAddTransaction(db, args, nil); err != nil {
 			t.Fatal(err)
 		}
 
@@ -209,7 +251,7 @@ func TestTransactionCommands(t *testing.T) {
 
 		args := []string{"2019-10-10", "娯楽", "現金", "2000"}
 
-		if err := runAddTransaction(db, args); err != nil {
+		if err := runAddTransaction(db, args, nil); err != nil {
 			t.Fatal(err)
 		}
 
@@ -235,8 +277,8 @@ func TestTransactionCommands(t *testing.T) {
 		}
 
 		d := transactions[0]
-		if d.amount != 2000 {
-			t.Fatal("d.amount != 2000:", d.amount)
+		if d.amount() != 2000 {
+			t.Fatal("d.amount() != 2000:", d.amount())
 		}
 
 		// 取引の削除
@@ -299,7 +341,7 @@ func TestReadTransactions(t *testing.T) {
 	}
 	defer f.Close()
 
-	if err := readTransactions(db, f); err != nil {
+	if err := readTransactions(db, f, false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -338,54 +380,142 @@ func TestArr2transaction(t *testing.T) {
 
 	arr := []string{"2019-11-23", "なし", "現金"}
 
-	_, err = arr2transaction(name2id, arr)
+	_, err = arr2transaction(name2id, nil, arr)
 	if err == nil {
 		t.Fatal("エラーになるはず")
 	}
 
 	arr = []string{"2019-11-23", "なし", "現金", "3000"}
 
-	_, err = arr2transaction(name2id, arr)
+	_, err = arr2transaction(name2id, nil, arr)
 	if err == nil {
 		t.Fatal("エラーになるはず")
 	}
 
 	arr = []string{"2019-11-23", "食費", "なし", "3000"}
 
-	_, err = arr2transaction(name2id, arr)
+	_, err = arr2transaction(name2id, nil, arr)
 	if err == nil {
 		t.Fatal("エラーになるはず")
 	}
 
 	arr = []string{"2019-11-23", "食費", "現金", "1円"}
 
-	_, err = arr2transaction(name2id, arr)
+	_, err = arr2transaction(name2id, nil, arr)
 	if err == nil {
 		t.Fatal("エラーになるはず")
 	}
 
 	arr = []string{"2019-11-23", "食費", "現金", "3000", "", ""}
 
-	_, err = arr2transaction(name2id, arr)
+	_, err = arr2transaction(name2id, nil, arr)
 	if err == nil {
 		t.Fatal("エラーになるはず")
 	}
 
 	arr = []string{"2019-11-23", "食費", "現金", "3000", "", "", "2019-12"}
 
-	_, err = arr2transaction(name2id, arr)
+	_, err = arr2transaction(name2id, nil, arr)
 	if err == nil {
 		t.Fatal("エラーになるはず")
 	}
 
 	arr = []string{"2019-11-23", "食費", "現金", "3000", "", "2019-11", ""}
 
-	_, err = arr2transaction(name2id, arr)
+	_, err = arr2transaction(name2id, nil, arr)
 	if err == nil {
 		t.Fatal("エラーになるはず")
 	}
 }
 
+func TestStr2items(t *testing.T) {
+	name2id := map[string]int{"食費": 1, "娯楽": 2, "現金": 3}
+
+	items, err := str2items(name2id, nil, "食費", 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 1 || items[0].account.id != 1 || items[0].debit != 1000 || items[0].credit != 0 {
+		t.Fatalf("str2items, got = %v", items)
+	}
+
+	items, err = str2items(name2id, nil, "食費:800,娯楽:200", 1000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 || items[1].account.id != 2 || items[1].credit != 200 {
+		t.Fatalf("str2items, got = %v", items)
+	}
+
+	if s := items2tsv(items, false); s != "食費:800,娯楽:200" {
+		t.Fatalf("items2tsv, got = %s", s)
+	}
+
+	errTests := []string{"なし", "食費:800", "食費:800,娯楽", "食費:800,なし:200", "食費:8百,娯楽:200"}
+
+	for _, test := range errTests {
+		if _, err := str2items(name2id, nil, test, 1000, true); err == nil {
+			t.Errorf("str2items(%q) should be error", test)
+		}
+	}
+}
+
+func TestTransactionValidate(t *testing.T) {
+	var d transaction
+
+	food := account{id: 1, name: "食費"}
+	fun := account{id: 2, name: "娯楽"}
+	cash := account{id: 3, name: "現金"}
+
+	d.setSimple(food, cash, 1000)
+
+	if err := d.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !d.isSimple() || d.debit().name != "食費" || d.credit().name != "現金" || d.amount() != 1000 {
+		t.Fatal("wrong simple transaction:", &d)
+	}
+
+	d.items = []transactionItem{
+		{account: food, debit: 800},
+		{account: fun, debit: 200},
+		{account: cash, credit: 1000},
+	}
+
+	if err := d.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.isSimple() || d.debit().name != multiAccountName || d.credit().name != "現金" {
+		t.Fatal("wrong compound transaction:", &d)
+	}
+
+	if debit, credit := d.amountOf(cash.id); debit != 0 || credit != 1000 {
+		t.Fatalf("amountOf, got = %d, %d", debit, credit)
+	}
+
+	d.items[1].debit = 300
+
+	if err := d.validate(); err == nil {
+		t.Fatal("貸借が一致しないのでエラーになるはず")
+	}
+
+	d.items[1].credit = 300
+
+	if err := d.validate(); err == nil {
+		t.Fatal("借方と貸方の両方に金額があるのでエラーになるはず")
+	}
+
+	d.items = d.items[:1]
+
+	if err := d.validate(); err == nil {
+		t.Fatal("明細が1行なのでエラーになるはず")
+	}
+}
+
 func TestWriteTransactions(t *testing.T) {
 	db, err := setupAcAndTr()
 	if db != nil {
@@ -0,0 +1,815 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+全画面で取引を閲覧・編集する
+
+左に月の取引、右に月末の資産・負債の勘定科目ツリーと月のP/Lを表示する。
+
+キー操作
+
+	←, h / →, l     前の月 / 次の月
+	t               今月
+	↑, k / ↓, j     取引を選ぶ
+	J / K           右側をスクロール
+	/               絞り込み
+	a               取引を追加
+	e               選んだ取引を編集
+	d               選んだ取引を削除
+	u               最後の操作をUNDO
+	r               再読み込み
+	q, Esc          終了(絞り込み中の Esc は絞り込みの解除)
+
+追加と編集は import と同じTSVの列を1行で入力する。Tab で次の列に進む。
+*/
+const (
+	tuiNormal = iota
+	tuiFilter
+	tuiAdd
+	tuiEdit
+	tuiRemove
+	tuiUndo
+	tuiRedo
+)
+
+type tui struct {
+	db           *sql.DB
+	month        int
+	transactions []transaction
+	lines        []string // transactions の表示
+	lower        []string // 絞り込み用に検索語を足して小文字にした行
+	filter       []rune
+	matches      []int    // 絞り込んだ取引の番号
+	cursor       int      // matches の中の位置
+	offset       int      // 表示している最初の matches の位置
+	side         []string // 右側に表示する勘定科目ツリーとP/L
+	sideOffset   int
+	mode         int
+	input        []rune     // 追加・編集で入力中の行
+	target       int        // 編集する取引のID
+	undo         *operation // UNDO・REDOする操作
+	message      string
+}
+
+func newTUI(db *sql.DB, month int) (*tui, error) {
+	t := &tui{
+		db:    db,
+		month: month,
+	}
+
+	// 起動前に追加した履歴(スケジュールの自動実行など)を、TUI での操作と混ぜないように先に記録する
+	if _, err := dbRecordOperation(db, "", operationNormal, 0); err != nil {
+		return nil, err
+	}
+
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func cmdTUI(context *cli.Context) error {
+	monthStr := context.Args().First()
+	if monthStr == "" {
+		monthStr = "-0" // 今月
+	}
+
+	month, err := str2month(monthStr)
+	if err != nil {
+		return err
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runTUI(db, month)
+}
+
+func runTUI(db *sql.DB, month int) error {
+	t, err := newTUI(db, month)
+	if err != nil {
+		return err
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return errors.New("端末を開けない")
+	}
+	defer tty.Close()
+
+	fd := int(tty.Fd())
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	// 代替画面に切り替えて、終了時に元の画面とカーソルに戻す
+	tty.WriteString("\x1b[?1049h")
+	defer tty.WriteString("\x1b[?25h\x1b[?1049l")
+
+	buf := make([]byte, 256)
+
+	for {
+		width, height, err := term.GetSize(fd)
+		if err != nil || width <= 0 || height <= 0 {
+			width, height = 80, 24
+		}
+
+		t.render(tty, width, height)
+
+		n, err := tty.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range parseSelectorKeys(buf[:n]) {
+			if t.handleKey(k) {
+				return nil
+			}
+		}
+	}
+}
+
+// 月の取引と右側の表示を読み直す
+func (t *tui) reload() error {
+	if err := updateTransactionsSummary(t.db); err != nil {
+		return err
+	}
+
+	transactions, err := getTransactionsByMonth(t.db, t.month/100, t.month%100)
+	if err != nil {
+		return err
+	}
+
+	t.transactions = transactions
+	t.lines = nil
+	t.lower = nil
+
+	for _, d := range transactions {
+		line := tr2alignedString(&d)
+		t.lines = append(t.lines, line)
+
+		// fzf で選ぶときと同じように、勘定科目の検索語でも絞り込めるようにする
+		for _, item := range d.items {
+			line += " " + item.account.searchWords
+		}
+		t.lower = append(t.lower, strings.ToLower(line))
+	}
+
+	t.applyFilter()
+
+	accountLines, err := tuiAccountLines(t.db, t.month)
+	if err != nil {
+		return err
+	}
+
+	plLines, err := captureLines(func() error {
+		_, err := printPL(t.db, false, t.month, t.month)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	t.side = append(accountLines, "")
+	t.side = append(t.side, "P/L:")
+	t.side = append(t.side, plLines...)
+
+	t.scrollSide(0)
+
+	return nil
+}
+
+// 絞り込みの文字列で取引を絞り込む。選んでいる位置はできるだけ保つ
+func (t *tui) applyFilter() {
+	words := strings.Fields(strings.ToLower(string(t.filter)))
+
+	t.matches = t.matches[:0]
+
+	for i, line := range t.lower {
+		if matchWords(line, words) {
+			t.matches = append(t.matches, i)
+		}
+	}
+
+	t.move(0)
+}
+
+func (t *tui) move(n int) {
+	t.cursor += n
+
+	if t.cursor >= len(t.matches) {
+		t.cursor = len(t.matches) - 1
+	}
+
+	if t.cursor < 0 {
+		t.cursor = 0
+	}
+}
+
+func (t *tui) scrollSide(n int) {
+	t.sideOffset += n
+
+	if t.sideOffset >= len(t.side) {
+		t.sideOffset = len(t.side) - 1
+	}
+
+	if t.sideOffset < 0 {
+		t.sideOffset = 0
+	}
+}
+
+// 選んでいる取引。取引がなければ nil
+func (t *tui) current() *transaction {
+	if len(t.matches) == 0 {
+		return nil
+	}
+
+	return &t.transactions[t.matches[t.cursor]]
+}
+
+// ID の取引を選ぶ。絞り込みで見えなければ何もしない
+func (t *tui) selectTransaction(id int) {
+	for i, j := range t.matches {
+		if t.transactions[j].id == id {
+			t.cursor = i
+			return
+		}
+	}
+}
+
+func (t *tui) setMonth(month int) {
+	t.month = month
+	t.cursor = 0
+	t.offset = 0
+	t.sideOffset = 0
+
+	if err := t.reload(); err != nil {
+		t.message = "エラー: " + err.Error()
+	}
+}
+
+// キーを処理する。終了するときは true を返す
+func (t *tui) handleKey(k selectorKey) bool {
+	switch t.mode {
+	case tuiNormal:
+		return t.handleNormalKey(k)
+	case tuiFilter:
+		t.handleFilterKey(k)
+	case tuiAdd, tuiEdit:
+		t.handleFormKey(k)
+	case tuiRemove, tuiUndo, tuiRedo:
+		t.handleConfirmKey(k)
+	}
+
+	return false
+}
+
+func (t *tui) handleNormalKey(k selectorKey) bool {
+	t.message = ""
+
+	switch k.kind {
+	case keyUp:
+		t.move(-1)
+	case keyDown:
+		t.move(1)
+	case keyLeft:
+		t.setMonth(subtractMonth(t.month, 1))
+	case keyRight:
+		t.setMonth(nextMonth(t.month))
+	case keyCancel:
+		if len(t.filter) == 0 {
+			return true
+		}
+
+		t.filter = t.filter[:0]
+		t.applyFilter()
+	case keyRune:
+		switch k.r {
+		case 'q':
+			return true
+		case 'k':
+			t.move(-1)
+		case 'j':
+			t.move(1)
+		case 'h':
+			t.setMonth(subtractMonth(t.month, 1))
+		case 'l':
+			t.setMonth(nextMonth(t.month))
+		case 't':
+			t.setMonth(time2month(time.Now()))
+		case 'K':
+			t.scrollSide(-1)
+		case 'J':
+			t.scrollSide(1)
+		case '/':
+			t.mode = tuiFilter
+		case 'a':
+			t.startAdd()
+		case 'e':
+			t.startEdit()
+		case 'd':
+			t.startRemove()
+		case 'u':
+			t.startUndo(true)
+		case 'R':
+			t.startUndo(false)
+		case 'r':
+			if err := t.reload(); err != nil {
+				t.message = "エラー: " + err.Error()
+			}
+		}
+	}
+
+	return false
+}
+
+func (t *tui) handleFilterKey(k selectorKey) {
+	switch k.kind {
+	case keyRune:
+		if unicode.IsPrint(k.r) {
+			t.filter = append(t.filter, k.r)
+			t.cursor = 0
+			t.applyFilter()
+		}
+	case keyBackspace:
+		if len(t.filter) != 0 {
+			t.filter = t.filter[:len(t.filter)-1]
+			t.cursor = 0
+			t.applyFilter()
+		}
+	case keyClear:
+		t.filter = t.filter[:0]
+		t.cursor = 0
+		t.applyFilter()
+	case keyUp:
+		t.move(-1)
+	case keyDown:
+		t.move(1)
+	case keyEnter:
+		t.mode = tuiNormal
+	case keyCancel:
+		t.filter = t.filter[:0]
+		t.applyFilter()
+		t.mode = tuiNormal
+	}
+}
+
+func (t *tui) handleFormKey(k selectorKey) {
+	switch k.kind {
+	case keyRune:
+		if unicode.IsPrint(k.r) {
+			t.input = append(t.input, k.r)
+		}
+	case keyTab:
+		t.input = append(t.input, '\t')
+	case keyBackspace:
+		if len(t.input) != 0 {
+			t.input = t.input[:len(t.input)-1]
+		}
+	case keyClear:
+		t.input = t.input[:0]
+	case keyEnter:
+		id, err := t.save()
+		if err != nil {
+			t.message = "エラー: " + err.Error()
+			return
+		}
+
+		if t.mode == tuiAdd {
+			t.message = "追加した"
+		} else {
+			t.message = "更新した"
+		}
+
+		t.mode = tuiNormal
+		t.selectTransaction(id)
+	case keyCancel:
+		t.mode = tuiNormal
+		t.message = "取り消した"
+	}
+}
+
+func (t *tui) handleConfirmKey(k selectorKey) {
+	mode := t.mode
+	t.mode = tuiNormal
+
+	if k.kind != keyRune || (k.r != 'y' && k.r != 'Y') {
+		t.message = "取り消した"
+		return
+	}
+
+	var err error
+
+	if mode == tuiRemove {
+		err = t.remove()
+	} else {
+		err = t.undoLast(mode == tuiUndo)
+	}
+
+	if err != nil {
+		t.message = "エラー: " + err.Error()
+	}
+}
+
+// 取引の追加を始める。日付は今月なら今日、それ以外は月の1日
+func (t *tui) startAdd() {
+	date := time.Date(t.month/100, time.Month(t.month%100), 1, 0, 0, 0, 0, time.Local)
+	if now := time.Now(); time2month(now) == t.month {
+		date = now
+	}
+
+	t.mode = tuiAdd
+	t.input = []rune(date.Format("2006-01-02") + "\t")
+}
+
+func (t *tui) startEdit() {
+	d := t.current()
+	if d == nil {
+		return
+	}
+
+	arr := transaction2tsv(d)
+	if d.start == 0 {
+		arr = arr[:5]
+	}
+
+	t.mode = tuiEdit
+	t.target = d.id
+	t.input = []rune(strings.Join(arr, "\t"))
+}
+
+func (t *tui) startRemove() {
+	d := t.current()
+	if d == nil {
+		return
+	}
+
+	t.mode = tuiRemove
+	t.target = d.id
+	t.message = fmt.Sprintf("削除する? %v (y/n)", d)
+}
+
+// 最新の操作の UNDO か、最後に UNDO した操作の REDO を始める
+func (t *tui) startUndo(isUndo bool) {
+	sqlStr, mode, name := sqlGetUndoTarget, tuiUndo, "UNDO"
+	if !isUndo {
+		sqlStr, mode, name = sqlGetRedoTarget, tuiRedo, "REDO"
+	}
+
+	op, err := dbGetOperation1(t.db, sqlStr)
+	if err != nil {
+		t.message = "エラー: " + err.Error()
+		return
+	}
+
+	if op == nil {
+		t.message = name + "できる操作がない"
+		return
+	}
+
+	t.mode = mode
+	t.undo = op
+	t.message = fmt.Sprintf("%sする? %v (y/n)", name, op)
+}
+
+// 入力した行を解析して、取引を追加または更新する。保存した取引のIDを返す
+func (t *tui) save() (int, error) {
+	accounts, err := dbGetAccounts(t.db)
+	if err != nil {
+		return 0, err
+	}
+
+	name2id := make(map[string]int)
+	id2currency := make(map[int]string)
+
+	for _, d := range accounts {
+		name2id[d.name] = d.id
+		id2currency[d.id] = d.currency
+	}
+
+	d, err := arr2transaction(name2id, id2currency, strings.Split(string(t.input), "\t"))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := fillCurrencyAmounts(t.db, accounts, d); err != nil {
+		return 0, err
+	}
+
+	if t.mode == tuiEdit {
+		d.id = t.target
+
+		if err := dbEditTransactionTx(t.db, d); err != nil {
+			return 0, err
+		}
+	} else {
+		tx, err := t.db.Begin()
+		if err != nil {
+			return 0, err
+		}
+
+		idStr, err := dbAddTransaction(tx, d)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+
+		d.id, err = strconv.Atoi(idStr)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	command := "tui add"
+	if t.mode == tuiEdit {
+		command = "tui edit"
+	}
+
+	if _, err := dbRecordOperation(t.db, command, operationNormal, 0); err != nil {
+		return 0, err
+	}
+
+	// 保存した取引の月を表示する
+	t.month = time2month(d.date)
+
+	return d.id, t.reload()
+}
+
+func (t *tui) remove() error {
+	if err := dbRemoveTransaction(t.db, t.target); err != nil {
+		return err
+	}
+
+	if _, err := dbRecordOperation(t.db, "tui remove", operationNormal, 0); err != nil {
+		return err
+	}
+
+	t.message = "削除した"
+
+	return t.reload()
+}
+
+func (t *tui) undoLast(isUndo bool) error {
+	items, err := undoOperation(t.db, t.undo, isUndo)
+	if err != nil {
+		return err
+	}
+
+	// 変更後に残っている最初の取引を選ぶ
+	var tr *transaction
+	for _, d := range items {
+		if d != nil {
+			tr = d
+			break
+		}
+	}
+
+	if isUndo {
+		t.message = "UNDOした"
+	} else {
+		t.message = "REDOした"
+	}
+
+	if tr != nil {
+		t.month = time2month(tr.date)
+	}
+
+	if err := t.reload(); err != nil {
+		return err
+	}
+
+	if tr != nil {
+		t.selectTransaction(tr.id)
+	}
+
+	return nil
+}
+
+// 月末の資産と負債を、親の勘定科目の下に子を字下げして並べる
+func tuiAccountLines(db *sql.DB, month int) ([]string, error) {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	balances, err := dbGetBalances(db, month)
+	if err != nil {
+		return nil, err
+	}
+
+	fxItems, err := getFXValuations(db, month)
+	if err != nil {
+		return nil, err
+	}
+
+	// 外貨建ての勘定科目は月末のレートで評価する
+	id2fx := make(map[int]int)
+	for _, fx := range fxItems {
+		id2fx[fx.account.id] = fx.value
+	}
+
+	for i := range balances {
+		if v, ok := id2fx[balances[i].id]; ok {
+			balances[i].balance = v
+		}
+	}
+
+	roots, p2d := rollUpSummaries(accounts, balances)
+
+	var lines []string
+	var assetSum, liabilitySum int
+
+	var addChildren func(id int, indent int)
+	addChildren = func(id int, indent int) {
+		for _, c := range p2d[id] {
+			if c.id == id || c.balance == 0 {
+				continue
+			}
+
+			lines = append(lines, plRow(c.name, indent, []int{c.balance}))
+			addChildren(c.id, indent+2)
+		}
+	}
+
+	for _, accountType := range []int{acTypeAsset, acTypeLiability} {
+		if accountType == acTypeAsset {
+			lines = append(lines, "資産:")
+		} else {
+			lines = append(lines, "", "負債:")
+		}
+
+		for _, p := range roots {
+			if p.accountType != accountType || p.balance == 0 {
+				continue
+			}
+
+			lines = append(lines, plRow(p.name, 2, []int{p.balance}))
+			addChildren(p.id, 4)
+
+			if accountType == acTypeAsset {
+				assetSum += p.balance
+			} else {
+				liabilitySum += p.balance
+			}
+		}
+	}
+
+	lines = append(lines, "",
+		plRow("総資産:", 0, []int{assetSum}),
+		plRow("総負債:", 0, []int{liabilitySum}),
+		plRow("純資産:", 0, []int{assetSum + liabilitySum}))
+
+	return lines, nil
+}
+
+// f が stdout に出力した内容を行に分けて返す
+func captureLines(f func() error) ([]string, error) {
+	b := new(bytes.Buffer)
+
+	w := stdout
+	stdout = b
+	err := f()
+	stdout = w
+
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(strings.TrimRight(b.String(), "\n"), "\n"), nil
+}
+
+/*
+画面を描く
+
+1行目に月と件数、最後の2行に入力またはメッセージとキーの説明を表示する。
+その間の左に取引、右に勘定科目ツリーとP/Lを並べる
+*/
+func (t *tui) render(w io.Writer, width int, height int) {
+	b := new(bytes.Buffer)
+
+	b.WriteString("\x1b[?25l\x1b[H\x1b[2J")
+
+	title := fmt.Sprintf(" %s  %d/%d件", month2str(t.month), len(t.matches), len(t.transactions))
+	if len(t.filter) != 0 {
+		title += "  絞り込み: " + string(t.filter)
+	}
+	b.WriteString("\x1b[7m")
+	b.WriteString(padText(title, width))
+	b.WriteString("\x1b[0m")
+
+	rows := height - 3
+	if rows < 1 {
+		rows = 1
+	}
+
+	leftWidth := width * 3 / 5
+	rightWidth := width - leftWidth - 1
+
+	if t.cursor < t.offset {
+		t.offset = t.cursor
+	}
+
+	if t.cursor >= t.offset+rows {
+		t.offset = t.cursor - rows + 1
+	}
+
+	for i := 0; i < rows; i++ {
+		b.WriteString("\r\n")
+
+		left := ""
+		if j := t.offset + i; j < len(t.matches) {
+			left = t.lines[t.matches[j]]
+
+			if j == t.cursor {
+				left = "\x1b[7m" + padText(left, leftWidth) + "\x1b[0m"
+			} else {
+				left = padText(left, leftWidth)
+			}
+		} else {
+			left = padText(left, leftWidth)
+		}
+		b.WriteString(left)
+
+		b.WriteString("|")
+
+		if j := t.sideOffset + i; j < len(t.side) {
+			b.WriteString(truncateText(t.side[j], rightWidth))
+		}
+	}
+
+	b.WriteString("\r\n")
+
+	var line, help string
+
+	switch t.mode {
+	case tuiNormal:
+		line = t.message
+		help = "←→ 月  ↑↓ 選択  / 絞り込み  a 追加  e 編集  d 削除  u UNDO  R REDO  J/K 右をスクロール  q 終了"
+	case tuiFilter:
+		line = "/" + string(t.filter)
+		help = "Enter 決定  Esc 解除"
+	case tuiAdd, tuiEdit:
+		prompt := "追加: "
+		if t.mode == tuiEdit {
+			prompt = "編集: "
+		}
+
+		line = prompt + strings.ReplaceAll(string(t.input), "\t", " | ")
+		help = "日付 | 借方 | 貸方 | 金額 | 摘要 | 開始月 | 終了月  Tab 次の列  Enter 保存  Esc 取消"
+
+		if t.message != "" {
+			help = t.message
+		}
+	case tuiRemove, tuiUndo, tuiRedo:
+		line = t.message
+		help = "y 実行  それ以外 取消"
+	}
+
+	b.WriteString(truncateText(line, width))
+	b.WriteString("\r\n")
+	b.WriteString(truncateText(help, width))
+
+	// 入力中はカーソルを入力の末尾に置く
+	if t.mode == tuiFilter || t.mode == tuiAdd || t.mode == tuiEdit {
+		col := getTextWidth(line) + 1
+		if col > width {
+			col = width
+		}
+
+		b.WriteString(fmt.Sprintf("\x1b[%d;%dH\x1b[?25h", height-1, col))
+	}
+
+	w.Write(b.Bytes())
+}
+
+// 表示幅が width になるように切り詰めるか空白を足す
+func padText(s string, width int) string {
+	s = truncateText(s, width)
+
+	return s + strings.Repeat(" ", width-getTextWidth(s))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// 端末から入力したように、文字列をキーとして処理する
+func sendTUIKeys(d *tui, s string) bool {
+	for _, k := range parseSelectorKeys([]byte(s)) {
+		if d.handleKey(k) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestTUI(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newTUI(db, 201911)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := len(d.transactions)
+	if n == 0 {
+		t.Fatal("2019-11の取引がない")
+	}
+
+	if !strings.Contains(strings.Join(d.side, "\n"), "純資産") {
+		t.Error("勘定科目ツリーがない:", d.side)
+	}
+
+	if !strings.Contains(strings.Join(d.side, "\n"), "総収入") {
+		t.Error("P/Lがない:", d.side)
+	}
+
+	// 絞り込み
+	sendTUIKeys(d, "/yatin\r")
+
+	if d.mode != tuiNormal || len(d.matches) != 1 || d.current().debit().name != "家賃" {
+		t.Fatal("絞り込みが違う:", d.matches)
+	}
+
+	sendTUIKeys(d, "\x1b")
+
+	if len(d.matches) != n {
+		t.Fatal("絞り込みが解除されてない:", len(d.matches))
+	}
+
+	// 月の移動
+	sendTUIKeys(d, "\x1b[C")
+	if d.month != 201912 {
+		t.Error("d.month != 201912:", d.month)
+	}
+
+	sendTUIKeys(d, "h")
+	if d.month != 201911 {
+		t.Error("d.month != 201911:", d.month)
+	}
+
+	// 追加。日付は月の1日が入っている
+	sendTUIKeys(d, "a")
+	if string(d.input) != "2019-11-01\t" {
+		t.Fatalf("input = %q", string(d.input))
+	}
+
+	sendTUIKeys(d, "\x15")
+	sendTUIKeys(d, "2019-11-30\t娯楽\t現金\t1234\tTUI\r")
+
+	if d.mode != tuiNormal {
+		t.Fatal("追加できてない:", d.message)
+	}
+
+	if len(d.transactions) != n+1 || d.current().amount() != 1234 {
+		t.Fatal("追加した取引を選んでない:", d.current())
+	}
+
+	// 編集
+	sendTUIKeys(d, "e")
+	if string(d.input) != "2019-11-30\t娯楽\t現金\t1234\tTUI" {
+		t.Fatalf("input = %q", string(d.input))
+	}
+
+	sendTUIKeys(d, "\x7f\x7f\x7f\x7f\x7f\x7f\x7f\x7f5678\tTUI\r")
+
+	if d.mode != tuiNormal || d.current().amount() != 5678 {
+		t.Fatal("更新できてない:", d.message)
+	}
+
+	// 不正な入力はエラーを表示して入力を続ける
+	sendTUIKeys(d, "e\x15x\r")
+	if d.mode != tuiEdit || !strings.HasPrefix(d.message, "エラー") {
+		t.Fatal("エラーにならない:", d.message)
+	}
+
+	sendTUIKeys(d, "\x1b")
+
+	// 編集をUNDO
+	sendTUIKeys(d, "uy")
+	if d.current().amount() != 1234 {
+		t.Fatal("UNDOできてない:", d.message)
+	}
+
+	// 削除。y 以外は取り消し
+	sendTUIKeys(d, "dn")
+	if len(d.transactions) != n+1 {
+		t.Fatal("取り消したのに削除された")
+	}
+
+	sendTUIKeys(d, "dy")
+	if len(d.transactions) != n {
+		t.Fatal("削除できてない:", d.message)
+	}
+
+	b := new(bytes.Buffer)
+	d.render(b, 120, 30)
+
+	if !strings.Contains(b.String(), "2019-11") {
+		t.Error("月が表示されてない")
+	}
+
+	if !sendTUIKeys(d, "q") {
+		t.Error("q で終了しない")
+	}
+}
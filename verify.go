@@ -0,0 +1,535 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"sort"
+	"time"
+)
+
+/*
+集計テーブルの確認と作り直し
+
+transactions_month と transactions_summary はトリガー等で少しずつ更新しているので、
+何かの拍子に取引とずれてしまうと気づけない。
+ここでは取引から Go で集計し直して、集計テーブルと比べたり、集計テーブルを作り直したりする。
+*/
+
+// 1つの取引で振り分けられる月数の上限
+const maxTransactionMonths = 2048
+
+// transactions_month の1行分の金額
+type monthAmount struct {
+	month         int
+	accrualDebit  int
+	accrualCredit int
+	cashDebit     int
+	cashCredit    int
+}
+
+/*
+明細の金額を月ごとに振り分ける
+
+期間(start, end)が指定されてなければ、取引日の月(month)に振り分ける。
+期間が指定されている場合は、現金主義の金額は取引日の月に、
+発生主義の金額は期間内の各月に切り上げで均等に振り分け、端数は最後の月で調整する。
+*/
+func splitLine(month int, start int, end int, debit int, credit int) ([]monthAmount, error) {
+	if start == 0 && end == 0 {
+		return []monthAmount{{month, debit, credit, debit, credit}}, nil
+	}
+
+	var months []int
+
+	for m := start; m <= end; m = nextMonth(m) {
+		months = append(months, m)
+
+		if len(months) > maxTransactionMonths {
+			return nil, errors.New("exceed the month limit")
+		}
+	}
+
+	amounts := []monthAmount{{month, 0, 0, debit, credit}}
+
+	n := len(months)
+	remainDebit := debit // まだ振り分けてない金額
+	remainCredit := credit
+	monthDebit := (debit + n - 1) / n // 各月に振り分ける金額
+	monthCredit := (credit + n - 1) / n
+
+	for _, m := range months {
+		if monthDebit > remainDebit {
+			monthDebit = remainDebit
+		}
+
+		if monthCredit > remainCredit {
+			monthCredit = remainCredit
+		}
+
+		amounts = append(amounts, monthAmount{m, monthDebit, monthCredit, 0, 0})
+
+		remainDebit -= monthDebit
+		remainCredit -= monthCredit
+	}
+
+	return amounts, nil
+}
+
+// transactions_month に追加する行
+type transactionMonth struct {
+	transactionID int
+	accountID     int
+	monthAmount
+}
+
+const sqlGetTransactionLines = `
+SELECT tr.transaction_id, tr.date, tr.start_month, tr.end_month,
+       td.account_id, td.debit_amount, td.credit_amount
+FROM transactions AS tr
+JOIN transactions_detail AS td ON tr.transaction_id = td.transaction_id
+ORDER BY tr.transaction_id, td.no
+`
+
+// 取引から transactions_month の行を計算する
+func dbCalcTransactionsMonth(db dbQuerier) ([]transactionMonth, error) {
+	rows, err := db.Query(sqlGetTransactionLines)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []transactionMonth
+
+	for rows.Next() {
+		var id, start, end, accountID, debit, credit int
+		var date time.Time
+
+		if err := rows.Scan(&id, &date, &start, &end, &accountID, &debit, &credit); err != nil {
+			return nil, err
+		}
+
+		amounts, err := splitLine(time2month(date), start, end, debit, credit)
+		if err != nil {
+			return nil, fmt.Errorf("取引 %d: %s", id, err)
+		}
+
+		for _, a := range amounts {
+			items = append(items, transactionMonth{id, accountID, a})
+		}
+	}
+
+	return items, rows.Err()
+}
+
+// 勘定科目と月
+type accountMonth struct {
+	accountID int
+	month     int
+}
+
+// transactions_summary の1行分の金額
+type summaryAmount struct {
+	monthAmount
+	accrualAccum int
+	cashAccum    int
+}
+
+// 勘定科目,月ごとに合計する
+func sumTransactionsMonth(items []transactionMonth) map[accountMonth]monthAmount {
+	sums := make(map[accountMonth]monthAmount)
+
+	for _, d := range items {
+		key := accountMonth{d.accountID, d.month}
+
+		s := sums[key]
+		s.month = d.month
+		s.accrualDebit += d.accrualDebit
+		s.accrualCredit += d.accrualCredit
+		s.cashDebit += d.cashDebit
+		s.cashCredit += d.cashCredit
+		sums[key] = s
+	}
+
+	return sums
+}
+
+/*
+勘定科目ごとに、集計する月の範囲を求める
+
+最初の月から最後の月(current より前なら current)まで途切れなく集計データを作る。
+*/
+func summaryRanges(sums map[accountMonth]monthAmount, current int) map[int][2]int {
+	ranges := make(map[int][2]int)
+
+	for key := range sums {
+		r, ok := ranges[key.accountID]
+		if !ok {
+			r = [2]int{key.month, key.month}
+		}
+
+		if key.month < r[0] {
+			r[0] = key.month
+		}
+
+		if key.month > r[1] {
+			r[1] = key.month
+		}
+
+		ranges[key.accountID] = r
+	}
+
+	for id, r := range ranges {
+		if r[1] < current {
+			r[1] = current
+			ranges[id] = r
+		}
+	}
+
+	return ranges
+}
+
+// 月ごとの合計から、範囲内の各月の集計データを計算する
+func calcSummary(sums map[accountMonth]monthAmount, accountID int, from int, to int) map[int]summaryAmount {
+	summaries := make(map[int]summaryAmount)
+
+	var accrualAccum, cashAccum int
+
+	for m := from; m <= to; m = nextMonth(m) {
+		s := sums[accountMonth{accountID, m}]
+		s.month = m
+
+		accrualAccum += s.accrualDebit - s.accrualCredit
+		cashAccum += s.cashDebit - s.cashCredit
+
+		summaries[m] = summaryAmount{s, accrualAccum, cashAccum}
+	}
+
+	return summaries
+}
+
+type dbQuerier interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}
+
+func cmdDBVerify(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	diffs, err := runDBVerify(db)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range diffs {
+		println(d)
+	}
+
+	if len(diffs) != 0 {
+		return fmt.Errorf("集計テーブルが取引と一致しない(%d件)。mita db rebuild で作り直せる", len(diffs))
+	}
+
+	println("集計テーブルは取引と一致している")
+
+	return nil
+}
+
+const sqlGetMonthSums = `
+SELECT account_id, month,
+       SUM(accrual_debit_amount), SUM(accrual_credit_amount),
+       SUM(cash_debit_amount), SUM(cash_credit_amount)
+FROM transactions_month
+GROUP BY account_id, month
+`
+
+const sqlGetSummaryAmounts = `
+SELECT account_id, month,
+       accrual_debit_amount, accrual_credit_amount, cash_debit_amount, cash_credit_amount,
+       accrual_accum_diff, cash_accum_diff
+FROM transactions_summary
+`
+
+// 取引から集計し直して、集計テーブルとの違いを返す
+func runDBVerify(db *sql.DB) ([]string, error) {
+	accounts, err := dbGetAccounts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	id2name := make(map[int]string)
+	for _, ac := range accounts {
+		id2name[ac.id] = ac.name
+	}
+
+	items, err := dbCalcTransactionsMonth(db)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := sumTransactionsMonth(items)
+
+	// transactions_month
+
+	actualMonth := make(map[accountMonth]monthAmount)
+
+	rows, err := db.Query(sqlGetMonthSums)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var key accountMonth
+		var s monthAmount
+
+		if err := rows.Scan(&key.accountID, &key.month,
+			&s.accrualDebit, &s.accrualCredit, &s.cashDebit, &s.cashCredit); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		s.month = key.month
+		actualMonth[key] = s
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+
+	for _, key := range sortedAccountMonths(expected, actualMonth) {
+		e := expected[key]
+		a, ok := actualMonth[key]
+
+		name := id2name[key.accountID]
+
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("transactions_month %s %s: 行がない", name, month2str(key.month)))
+			continue
+		}
+
+		diffs = append(diffs, compareAmounts("transactions_month", name, key.month, e, a)...)
+	}
+
+	// transactions_summary
+
+	actualSummary := make(map[accountMonth]summaryAmount)
+	ranges := make(map[int][2]int)
+
+	rows, err = db.Query(sqlGetSummaryAmounts)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var key accountMonth
+		var s summaryAmount
+
+		if err := rows.Scan(&key.accountID, &key.month,
+			&s.accrualDebit, &s.accrualCredit, &s.cashDebit, &s.cashCredit,
+			&s.accrualAccum, &s.cashAccum); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		s.month = key.month
+		actualSummary[key] = s
+
+		r, ok := ranges[key.accountID]
+		if !ok || key.month < r[0] {
+			r[0] = key.month
+		}
+		if !ok || key.month > r[1] {
+			r[1] = key.month
+		}
+		ranges[key.accountID] = r
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// 集計データは途切れずに並んでいるはずなので、両方の範囲を合わせた各月を比べる
+	for id, r := range summaryRanges(expected, 0) {
+		if a, ok := ranges[id]; ok {
+			if a[0] < r[0] {
+				r[0] = a[0]
+			}
+			if a[1] > r[1] {
+				r[1] = a[1]
+			}
+		}
+
+		ranges[id] = r
+	}
+
+	ids := make([]int, 0, len(ranges))
+	for id := range ranges {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		r := ranges[id]
+		summaries := calcSummary(expected, id, r[0], r[1])
+		name := id2name[id]
+
+		for m := r[0]; m <= r[1]; m = nextMonth(m) {
+			e := summaries[m]
+			a, ok := actualSummary[accountMonth{id, m}]
+
+			if !ok {
+				diffs = append(diffs, fmt.Sprintf("transactions_summary %s %s: 行がない", name, month2str(m)))
+				continue
+			}
+
+			diffs = append(diffs, compareAmounts("transactions_summary", name, m, e.monthAmount, a.monthAmount)...)
+
+			if e.accrualAccum != a.accrualAccum {
+				diffs = append(diffs, fmt.Sprintf("transactions_summary %s %s accrual_accum_diff: 正しい値 %d, 実際の値 %d",
+					name, month2str(m), e.accrualAccum, a.accrualAccum))
+			}
+
+			if e.cashAccum != a.cashAccum {
+				diffs = append(diffs, fmt.Sprintf("transactions_summary %s %s cash_accum_diff: 正しい値 %d, 実際の値 %d",
+					name, month2str(m), e.cashAccum, a.cashAccum))
+			}
+		}
+	}
+
+	return diffs, nil
+}
+
+func sortedAccountMonths(a map[accountMonth]monthAmount, b map[accountMonth]monthAmount) []accountMonth {
+	keys := make([]accountMonth, 0, len(a))
+
+	for key := range a {
+		keys = append(keys, key)
+	}
+
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].accountID != keys[j].accountID {
+			return keys[i].accountID < keys[j].accountID
+		}
+
+		return keys[i].month < keys[j].month
+	})
+
+	return keys
+}
+
+func compareAmounts(table string, name string, month int, e monthAmount, a monthAmount) []string {
+	var diffs []string
+
+	for _, c := range []struct {
+		column   string
+		expected int
+		actual   int
+	}{
+		{"accrual_debit_amount", e.accrualDebit, a.accrualDebit},
+		{"accrual_credit_amount", e.accrualCredit, a.accrualCredit},
+		{"cash_debit_amount", e.cashDebit, a.cashDebit},
+		{"cash_credit_amount", e.cashCredit, a.cashCredit},
+	} {
+		if c.expected != c.actual {
+			diffs = append(diffs, fmt.Sprintf("%s %s %s %s: 正しい値 %d, 実際の値 %d",
+				table, name, month2str(month), c.column, c.expected, c.actual))
+		}
+	}
+
+	return diffs
+}
+
+func cmdDBRebuild(context *cli.Context) error {
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := runDBRebuild(db); err != nil {
+		return err
+	}
+
+	println("集計テーブルを作り直した")
+
+	return nil
+}
+
+/*
+集計テーブルを取引から作り直す
+
+PostgreSQL では transactions_month への追加でトリガーが transactions_summary を更新するので、
+transactions_month を追加したあとに transactions_summary を空にしてから、計算した集計データを追加する。
+*/
+func runDBRebuild(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := dbRebuildSummary(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func dbRebuildSummary(tx *sql.Tx) error {
+	items, err := dbCalcTransactionsMonth(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, q := range []string{"DELETE FROM transactions_month", "DELETE FROM transactions_summary"} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range items {
+		_, err := tx.Exec(`
+INSERT INTO transactions_month (transaction_id, account_id, month,
+    accrual_debit_amount, accrual_credit_amount, cash_debit_amount, cash_credit_amount)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`, d.transactionID, d.accountID, d.month,
+			d.accrualDebit, d.accrualCredit, d.cashDebit, d.cashCredit)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM transactions_summary"); err != nil {
+		return err
+	}
+
+	sums := sumTransactionsMonth(items)
+
+	for id, r := range summaryRanges(sums, time2month(time.Now())) {
+		summaries := calcSummary(sums, id, r[0], r[1])
+
+		for m := r[0]; m <= r[1]; m = nextMonth(m) {
+			s := summaries[m]
+
+			_, err := tx.Exec("INSERT INTO transactions_summary VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+				id, m, s.accrualDebit, s.accrualCredit, s.accrualAccum, s.cashDebit, s.cashCredit, s.cashAccum)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	amounts, err := splitLine(201911, 201912, 202002, 10000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []monthAmount{
+		{201911, 0, 0, 10000, 0},
+		{201912, 3334, 0, 0, 0},
+		{202001, 3334, 0, 0, 0},
+		{202002, 3332, 0, 0, 0},
+	}
+
+	if len(amounts) != len(want) {
+		t.Fatalf("len(amounts) = %d", len(amounts))
+	}
+
+	for i := range want {
+		if amounts[i] != want[i] {
+			t.Errorf("%d: got = %v, want = %v", i, amounts[i], want[i])
+		}
+	}
+
+	amounts, err = splitLine(201911, 0, 0, 0, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(amounts) != 1 || amounts[0] != (monthAmount{201911, 0, 500, 0, 500}) {
+		t.Errorf("got = %v", amounts)
+	}
+
+	if _, err := splitLine(201911, 100001, 999912, 100, 0); err == nil {
+		t.Error("月数が多すぎるのでエラーになるはず")
+	}
+}
+
+func TestVerifyAndRebuild(t *testing.T) {
+	db, err := setupAcAndTr()
+	if db != nil {
+		defer db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := updateTransactionsSummary(db); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := runDBVerify(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diffs) != 0 {
+		t.Fatal("集計テーブルは一致しているはず:", diffs)
+	}
+
+	pl, err := dbGetPL(db, false, 201901, 203012)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 集計テーブルを壊す
+	for _, q := range []string{
+		"DELETE FROM transactions_month WHERE tm_id = (SELECT MIN(tm_id) FROM transactions_month)",
+		"UPDATE transactions_summary SET cash_accum_diff = cash_accum_diff + 1",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diffs, err = runDBVerify(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diffs) == 0 {
+		t.Fatal("集計テーブルが一致しないはず")
+	}
+
+	if err := runDBRebuild(db); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err = runDBVerify(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diffs) != 0 {
+		t.Fatal("作り直したので一致するはず:", diffs)
+	}
+
+	rebuilt, err := dbGetPL(db, false, 201901, 203012)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a, b := sumSummaries(pl), sumSummaries(rebuilt); a != b {
+		t.Errorf("P/L が変わった: %d, %d", a, b)
+	}
+}